@@ -0,0 +1,122 @@
+// Package archive runs the archival job: it moves the invoices past the archival
+// horizon to the archive tables, which the database package reads transparently, and
+// expires what is no longer needed: the cached PDFs of archived invoices and of
+// superseded invoice versions, and used or expired one-time codes.
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/pdfstore"
+	"log"
+	"time"
+)
+
+// archiveBatch is how many invoices an archival run moves in one transaction.
+const archiveBatch = 500
+
+// archivalActor is the actor of the archivals the job makes.
+var archivalActor = dto.SystemActor("archival")
+
+// Service archives old invoices.
+type Service struct {
+	DB   *sql.DB
+	PDFs pdfstore.Store
+	// AfterMonths is the archival horizon: invoices dated more than AfterMonths months
+	// ago are archived. Archived invoices are read-only, so it should be longer than
+	// the period in which invoices are still rectified or voided.
+	AfterMonths int
+}
+
+// Run runs the archival job once, for every tenant, and reports what it did. With
+// dryRun set nothing is changed, and the report counts what a run would do.
+func (s *Service) Run(dryRun bool) (dto.ArchivalRunDTO, error) {
+	now := time.Now().UTC()
+	run := dto.ArchivalRunDTO{DryRun: dryRun, Cutoff: now.AddDate(0, -s.AfterMonths, 0), StartedAt: now}
+
+	tenants, err := database.TenantIDs(s.DB)
+	if err != nil {
+		return run, err
+	}
+	for _, tenantID := range tenants {
+		if dryRun {
+			invoices, lines, kept, err := database.CountArchivableInvoices(s.DB, tenantID, run.Cutoff)
+			if err != nil {
+				return run, err
+			}
+			run.InvoicesArchived += invoices
+			run.LinesArchived += lines
+			run.InvoicesKept += kept
+		} else {
+			if err := s.archive(tenantID, &run); err != nil {
+				return run, err
+			}
+		}
+	}
+	if run.PDFsPruned, err = s.PDFs.Prune(dryRun); err != nil {
+		return run, err
+	}
+	if run.FiscalProfileCodesExpired, err = database.ExpireFiscalProfileCodes(s.DB, dryRun); err != nil {
+		return run, err
+	}
+	run.FinishedAt = time.Now().UTC()
+	return run, nil
+}
+
+// archive archives the invoices of a tenant past the horizon, batch by batch, and
+// purges their stored PDFs.
+func (s *Service) archive(tenantID int, run *dto.ArchivalRunDTO) error {
+	for {
+		ids, lines, err := database.ArchiveInvoices(s.DB, tenantID, run.Cutoff, archiveBatch, archivalActor)
+		if err != nil {
+			return err
+		}
+		run.InvoicesArchived += len(ids)
+		run.LinesArchived += lines
+		for _, id := range ids {
+			// The database store lost them with the invoice; a failure is only logged,
+			// the files are unreachable either way.
+			if err := s.PDFs.Purge(tenantID, pdfstore.KindInvoice, id); err != nil {
+				log.Printf("ERROR: Stored PDFs of archived invoice %d of tenant %d were not purged: %v", id, tenantID, err)
+			}
+		}
+		if len(ids) < archiveBatch {
+			break
+		}
+	}
+	_, _, kept, err := database.CountArchivableInvoices(s.DB, tenantID, run.Cutoff)
+	run.InvoicesKept += kept
+	return err
+}
+
+// Worker runs the archival job.
+type Worker struct {
+	Service  *Service
+	Interval time.Duration // Time between runs
+	DryRun   bool          // Only report what each run would do
+}
+
+// Run runs the archival job every Interval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if run, err := w.Service.Run(w.DryRun); err != nil {
+			log.Printf("Error running archival job: %v", err)
+		} else {
+			prefix := "Archival job"
+			if run.DryRun {
+				prefix = "Archival job (dry run, nothing changed)"
+			}
+			log.Printf("%s: %d invoices and %d lines archived, %d kept, %d superseded PDFs pruned, %d fiscal profile codes expired.",
+				prefix, run.InvoicesArchived, run.LinesArchived, run.InvoicesKept, run.PDFsPruned, run.FiscalProfileCodesExpired)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
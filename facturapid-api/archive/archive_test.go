@@ -0,0 +1,162 @@
+package archive
+
+import (
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"facturapid-api/pdfstore"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The archival tests run against the PostgreSQL database in FACTURAPID_TEST_DATABASE_URL,
+// and are skipped without one. The job archives every tenant, so the invoices they
+// archive are dated decades back, where no other test puts any.
+
+// afterMonths is the archival horizon of the tests.
+const afterMonths = 20 * 12
+
+// testService connects to the test database, creates the schema and a tenant, and
+// returns a Service storing PDFs in a temporary directory and the tenant, or skips the
+// test.
+func testService(t *testing.T) (*Service, int) {
+	t.Helper()
+	url := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	db, err := database.InitDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := database.CreateTenant(db, dto.TenantDTO{Code: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdfs, err := pdfstore.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Service{DB: db, PDFs: pdfs, AfterMonths: afterMonths}, tenant.ID
+}
+
+// createInvoice stores a ticket of a tenant dated fecha with one line of 10.00 at 21%.
+func createInvoice(t *testing.T, s *Service, tenantID, codigo int, fecha time.Time) {
+	t.Helper()
+	b, rate := money.MustParse("10.00"), money.MustParse("21")
+	quota := money.VATQuota(b, rate)
+	day, hora := fecha.Format("2006-01-02"), "12:00:00"
+	inv := dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: codigo, Serie: "A", Tarifa: "1", Fecha: &day, Hora: &hora,
+			Base1: &b, Iva1: &rate, CuotaIva1: &quota, CuotaIVA: &quota, Total: b.Add(quota),
+		},
+		Lines: []dto.InvoiceLineDTO{{CodigoFactura: codigo, Linea: 1, Producto: "Menú del día", Unidades: money.One, Subtotal: b, IvaAplicado: &rate}},
+	}
+	if _, err := database.CreateFullInvoice(s.DB, tenantID, inv, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pdfKey(tenantID, codigo, version int) pdfstore.Key {
+	return pdfstore.Key{TenantID: tenantID, Kind: pdfstore.KindInvoice, InvoiceID: codigo, Version: version, Variant: "a4"}
+}
+
+// stored tells whether the PDF of key is in the store.
+func stored(t *testing.T, s *Service, key pdfstore.Key) bool {
+	t.Helper()
+	_, err := s.PDFs.Get(key)
+	if errors.Is(err, pdfstore.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+// archived tells whether invoice codigo of a tenant has been archived.
+func archived(t *testing.T, s *Service, tenantID, codigo int) bool {
+	t.Helper()
+	inv, err := database.GetFullInvoiceByID(s.DB, tenantID, codigo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv.Header.ArchivedAt != nil
+}
+
+// TestRunDryRun runs the job dry and then for real: the dry run changes nothing and
+// counts what the real run does, and the invoices within the archival horizon, with
+// their current PDFs, are left alone.
+func TestRunDryRun(t *testing.T) {
+	s, tenantID := testService(t)
+	now := time.Now().UTC()
+	createInvoice(t, s, tenantID, 1, now.AddDate(-30, 0, 0))
+	createInvoice(t, s, tenantID, 2, now.AddDate(-30, 0, 0)) // Rectified, so kept
+	createInvoice(t, s, tenantID, 3, now.AddDate(0, -afterMonths, 1))
+	createInvoice(t, s, tenantID, 4, now.AddDate(0, -1, 0))
+	fecha, hora := now.Format("2006-01-02"), "13:00:00"
+	rectifying := dto.RectifyingInvoiceDTO{
+		Header: dto.RectifyingInvoiceHeaderDTO{
+			Serie: "R", Tarifa: "1", Fecha: &fecha, Hora: &hora, Total: money.MustParse("-12.10"),
+			FacturaRectificada: 2, TipoRectificativa: dto.RectificationR5, TipoRectificacion: dto.RectificationByDifferences,
+		},
+	}
+	if _, err := database.CreateRectifyingInvoice(s.DB, tenantID, rectifying, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	// Invoice 4 has a superseded version
+	pdfs := []pdfstore.Key{pdfKey(tenantID, 1, 1), pdfKey(tenantID, 3, 1), pdfKey(tenantID, 4, 1), pdfKey(tenantID, 4, 2)}
+	for _, key := range pdfs {
+		if _, err := s.PDFs.Put(key, []byte("%PDF-1.4")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dry, err := s.Run(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dry.DryRun || dry.InvoicesArchived < 1 || dry.LinesArchived < 1 || dry.InvoicesKept < 1 || dry.PDFsPruned != 1 {
+		t.Errorf("dry run %+v, want invoice 1 and its line archived, invoice 2 kept and a PDF pruned", dry)
+	}
+	for codigo := 1; codigo <= 4; codigo++ {
+		if archived(t, s, tenantID, codigo) {
+			t.Errorf("invoice %d archived by a dry run", codigo)
+		}
+	}
+	for _, key := range pdfs {
+		if !stored(t, s, key) {
+			t.Errorf("PDF %+v deleted by a dry run", key)
+		}
+	}
+
+	run, err := s.Run(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.DryRun || run.InvoicesArchived != dry.InvoicesArchived || run.LinesArchived != dry.LinesArchived ||
+		run.InvoicesKept != dry.InvoicesKept || run.PDFsPruned != dry.PDFsPruned {
+		t.Errorf("run %+v does not do what the dry run %+v counted", run, dry)
+	}
+	if !archived(t, s, tenantID, 1) {
+		t.Error("invoice 1 was not archived")
+	}
+	for codigo := 2; codigo <= 4; codigo++ {
+		if archived(t, s, tenantID, codigo) {
+			t.Errorf("invoice %d archived, want it kept", codigo)
+		}
+	}
+	for key, want := range map[pdfstore.Key]bool{pdfs[0]: false, pdfs[1]: true, pdfs[2]: false, pdfs[3]: true} {
+		if got := stored(t, s, key); got != want {
+			t.Errorf("PDF %+v stored %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"time"
+)
+
+const createAccountMappingsTableSQL = `
+CREATE TABLE IF NOT EXISTS account_mappings (
+    tenant_id INTEGER PRIMARY KEY REFERENCES tenants(id),
+    mapping TEXT NOT NULL, -- JSON of dto.AccountMappingDTO
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+`
+
+// GetAccountMapping returns the account mapping of a tenant, or the default one when
+// the tenant has not saved any.
+func GetAccountMapping(db *sql.DB, tenantID int) (dto.AccountMappingDTO, error) {
+	var mapping string
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT mapping, updated_at FROM account_mappings WHERE tenant_id = $1;`, tenantID).Scan(&mapping, &updatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return dto.DefaultAccountMapping(), nil
+	}
+	if err != nil {
+		return dto.AccountMappingDTO{}, fmt.Errorf("error querying account mapping: %w", err)
+	}
+	var m dto.AccountMappingDTO
+	if err := json.Unmarshal([]byte(mapping), &m); err != nil {
+		return dto.AccountMappingDTO{}, fmt.Errorf("error decoding account mapping: %w", err)
+	}
+	m.UpdatedAt = &updatedAt
+	return m, nil
+}
+
+// SaveAccountMapping replaces the account mapping of a tenant and returns it as saved.
+func SaveAccountMapping(db *sql.DB, tenantID int, m dto.AccountMappingDTO) (dto.AccountMappingDTO, error) {
+	m.UpdatedAt = nil
+	mapping, err := json.Marshal(m)
+	if err != nil {
+		return dto.AccountMappingDTO{}, fmt.Errorf("error encoding account mapping: %w", err)
+	}
+	var updatedAt time.Time
+	err = db.QueryRow(`
+INSERT INTO account_mappings (tenant_id, mapping) VALUES ($1, $2)
+ON CONFLICT (tenant_id) DO UPDATE SET mapping = EXCLUDED.mapping, updated_at = NOW()
+RETURNING updated_at;`, tenantID, string(mapping)).Scan(&updatedAt)
+	if err != nil {
+		return dto.AccountMappingDTO{}, fmt.Errorf("error saving account mapping: %w", err)
+	}
+	m.UpdatedAt = &updatedAt
+	return m, nil
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Invoices past the archival horizon are moved to invoices_archive and their lines to
+// invoice_lines_archive, which keep the working tables small. The archive tables are
+// copies of the working ones (see syncArchiveColumns) and are read through the same
+// functions: GetFullInvoiceByID falls back to them. Archived invoices are read-only.
+// They are not partitioned: codigo is their key, as it is unique.
+const createArchiveTablesSQL = `
+CREATE TABLE IF NOT EXISTS invoices_archive (LIKE invoices INCLUDING DEFAULTS);
+ALTER TABLE invoices_archive ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+CREATE INDEX IF NOT EXISTS idx_invoices_archive_fecha ON invoices_archive (fecha);
+CREATE TABLE IF NOT EXISTS invoice_lines_archive (LIKE invoice_lines INCLUDING DEFAULTS);
+CREATE INDEX IF NOT EXISTS idx_invoice_lines_archive_codigo_factura ON invoice_lines_archive (codigo_factura);
+`
+
+// archiveTables maps each archived table to its archive table.
+var archiveTables = []struct{ table, archive string }{
+	{"invoices", "invoices_archive"},
+	{"invoice_lines", "invoice_lines_archive"},
+}
+
+// ErrInvoiceArchived is returned when changing an invoice the archival job has archived.
+var ErrInvoiceArchived = errors.New("invoice is archived")
+
+// syncArchiveColumns adds to the archive tables the columns added to the working
+// tables since the archive tables were created, so rows can be copied column by column.
+func syncArchiveColumns(db *sql.DB) error {
+	for _, t := range archiveTables {
+		var stmt sql.NullString
+		err := db.QueryRow(`
+SELECT string_agg(format('ALTER TABLE %I ADD COLUMN IF NOT EXISTS %I %s', $2::text, a.attname, format_type(a.atttypid, a.atttypmod)), '; ')
+FROM pg_attribute a
+WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+    AND NOT EXISTS (
+        SELECT 1 FROM pg_attribute b
+        WHERE b.attrelid = $2::regclass AND b.attname = a.attname AND b.attnum > 0 AND NOT b.attisdropped
+    );`, t.table, t.archive).Scan(&stmt)
+		if err != nil {
+			return fmt.Errorf("error comparing columns of %s and %s: %w", t.table, t.archive, err)
+		}
+		if !stmt.Valid {
+			continue
+		}
+		if _, err := db.Exec(stmt.String); err != nil {
+			return fmt.Errorf("error adding columns to %s: %w", t.archive, err)
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the quoted, comma-separated column names of a table.
+func tableColumns(q queryRower, table string) (string, error) {
+	var columns string
+	err := q.QueryRow(`
+SELECT string_agg(quote_ident(attname), ', ' ORDER BY attnum)
+FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped;`, table).Scan(&columns)
+	if err != nil {
+		return "", fmt.Errorf("error querying columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// missingInvoice returns the error for an invoice of a tenant that is not in the
+// invoices table: ErrInvoiceArchived if it was archived, and ErrInvoiceNotFound
+// otherwise.
+func missingInvoice(q queryRower, tenantID, invoiceID int) error {
+	var archived bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM invoices_archive WHERE tenant_id = $1 AND codigo = $2);`, tenantID, invoiceID).Scan(&archived)
+	if err != nil {
+		return fmt.Errorf("error querying archive for invoice id %d: %w", invoiceID, err)
+	}
+	if archived {
+		return ErrInvoiceArchived
+	}
+	return ErrInvoiceNotFound
+}
+
+// archivableSQL selects, from the invoices i of the tenant $1, those dated before $2
+// that can be archived. An invoice a rectifying invoice refers to stays, as
+// rectifying_invoices references it, and so does one with an email delivery pending,
+// which the mailer still has to send.
+const archivableSQL = `
+i.tenant_id = $1 AND i.fecha < $2
+    AND NOT EXISTS (SELECT 1 FROM rectifying_invoices r WHERE r.tenant_id = i.tenant_id AND r.factura_rectificada = i.codigo)
+    AND NOT EXISTS (SELECT 1 FROM email_deliveries d WHERE d.tenant_id = i.tenant_id AND d.invoice_codigo = i.codigo AND d.status = 'pending')`
+
+// CountArchivableInvoices returns how many invoices of a tenant dated before cutoff
+// would be archived, with how many lines, and how many more are dated before it but
+// are kept.
+func CountArchivableInvoices(db *sql.DB, tenantID int, cutoff time.Time) (invoices, lines, kept int, err error) {
+	err = db.QueryRow(`
+SELECT
+    COUNT(*) FILTER (WHERE archivable),
+    COALESCE(SUM(lines) FILTER (WHERE archivable), 0),
+    COUNT(*) FILTER (WHERE NOT archivable)
+FROM (
+    SELECT `+archivableSQL+` AS archivable,
+        (SELECT COUNT(*) FROM invoice_lines l WHERE l.tenant_id = i.tenant_id AND l.codigo_factura = i.codigo) AS lines
+    FROM invoices i WHERE i.tenant_id = $1 AND i.fecha < $2
+) candidates;`, tenantID, cutoff).Scan(&invoices, &lines, &kept)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error counting archivable invoices: %w", err)
+	}
+	return invoices, lines, kept, nil
+}
+
+// ArchiveInvoices moves up to limit invoices of a tenant dated before cutoff, with
+// their lines, to the archive tables, in one transaction, and returns their codes and
+// the number of lines moved. Their cached PDFs, delivered emails and one-time codes are
+// deleted with them; the caller must purge their PDFs from stores outside the database.
+// The audit trail and the fiscal records are kept as they are.
+func ArchiveInvoices(db *sql.DB, tenantID int, cutoff time.Time, limit int, actor dto.ActorDTO) ([]int, int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+SELECT i.codigo FROM invoices i WHERE `+archivableSQL+`
+ORDER BY i.codigo LIMIT $3
+FOR UPDATE SKIP LOCKED;`, tenantID, cutoff, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error querying archivable invoices: %w", err)
+	}
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, 0, fmt.Errorf("error scanning archivable invoice: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading archivable invoices: %w", err)
+	}
+	if len(ids) == 0 {
+		return ids, 0, nil
+	}
+
+	moved := map[string]int64{}
+	for _, t := range archiveTables {
+		columns, err := tableColumns(tx, t.table)
+		if err != nil {
+			return nil, 0, err
+		}
+		key := "codigo"
+		if t.table == "invoice_lines" {
+			key = "codigo_factura"
+		}
+		result, err := tx.Exec(`
+INSERT INTO `+t.archive+` (`+columns+`)
+SELECT `+columns+` FROM `+t.table+` WHERE tenant_id = $1 AND `+key+` = ANY($2);`, tenantID, pq.Array(ids))
+		if err != nil {
+			return nil, 0, fmt.Errorf("error archiving %s: %w", t.table, err)
+		}
+		if moved[t.table], err = result.RowsAffected(); err != nil {
+			return nil, 0, fmt.Errorf("error fetching rows affected for %s: %w", t.table, err)
+		}
+	}
+	// Cascades to the lines, the cached PDFs, the email deliveries and the one-time codes
+	if _, err := tx.Exec(`DELETE FROM invoices WHERE tenant_id = $1 AND codigo = ANY($2);`, tenantID, pq.Array(ids)); err != nil {
+		return nil, 0, fmt.Errorf("error deleting archived invoices: %w", err)
+	}
+	for _, id := range ids {
+		err := insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{
+			InvoiceID: id, EventType: dto.InvoiceEventArchived, Actor: actor,
+			Details: map[string]interface{}{"cutoff": cutoff.Format("2006-01-02")},
+		})
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, fmt.Errorf("error committing archival: %w", err)
+	}
+	log.Printf("Archived %d invoices and %d lines of tenant %d dated before %s.", moved["invoices"], moved["invoice_lines"], tenantID, cutoff.Format("2006-01-02"))
+	return ids, int(moved["invoice_lines"]), nil
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// location tells whether invoice codigo of a tenant is in the invoices table, in
+// invoices_archive, or in both.
+func location(t *testing.T, db *sql.DB, tenantID, codigo int) (working, archived bool) {
+	t.Helper()
+	err := db.QueryRow(`
+SELECT EXISTS (SELECT 1 FROM invoices WHERE tenant_id = $1 AND codigo = $2),
+    EXISTS (SELECT 1 FROM invoices_archive WHERE tenant_id = $1 AND codigo = $2);`, tenantID, codigo).Scan(&working, &archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return working, archived
+}
+
+// archivedEvents counts the archived events of an invoice.
+func archivedEvents(t *testing.T, db *sql.DB, tenantID, codigo int) int {
+	t.Helper()
+	events, err := ListInvoiceEvents(db, tenantID, codigo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range events {
+		if e.EventType == dto.InvoiceEventArchived {
+			n++
+		}
+	}
+	return n
+}
+
+// TestArchiveInvoices seeds invoices on both sides of the cutoff, and some before it
+// that must stay, and archives them in batches of one: the counts of the dry run are
+// what the archival moves, and nothing dated on or after the cutoff is touched.
+func TestArchiveInvoices(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+	now := time.Now().UTC()
+	cutoff := now.AddDate(-1, 0, 0)
+	old, recent := now.AddDate(-2, 0, 0).Format("2006-01-02"), now.AddDate(0, -1, 0).Format("2006-01-02")
+
+	inv2 := testInvoice(2, old, "10.00")
+	inv2.Lines = append(inv2.Lines, dto.InvoiceLineDTO{CodigoFactura: 2, Linea: 2, Producto: "Agua", Unidades: money.One, Subtotal: money.Zero, IvaAplicado: decPtr("21")})
+	createInvoices(t, db, tenantID,
+		testInvoice(1, old, "10.00"),
+		inv2,
+		testInvoice(3, old, "10.00"), // Rectified: rectifying_invoices refers to it
+		testInvoice(4, old, "10.00"), // Its email is still to be sent
+		testInvoice(5, recent, "10.00"),
+		testInvoice(6, cutoff.AddDate(0, 0, 1).Format("2006-01-02"), "10.00"),
+	)
+	rectifying := dto.RectifyingInvoiceDTO{
+		Header: dto.RectifyingInvoiceHeaderDTO{
+			Codigo: 1, Serie: "R", Tarifa: "1", Fecha: strPtr(recent), Hora: strPtr("13:00:00"),
+			Total: money.MustParse("-12.10"), Base1: decPtr("-10"), Iva1: decPtr("21"), CuotaIva1: decPtr("-2.10"), CuotaIVA: decPtr("-2.10"),
+			FacturaRectificada: 3, TipoRectificativa: dto.RectificationR5, TipoRectificacion: dto.RectificationByDifferences,
+		},
+	}
+	if _, err := CreateRectifyingInvoice(db, tenantID, rectifying, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := EnqueueEmailDelivery(db, tenantID, 4, "ana@example.com", "es"); err != nil {
+		t.Fatal(err)
+	}
+	kept := map[int]dto.InvoiceHeaderDTO{}
+	for _, codigo := range []int{3, 4, 5, 6} {
+		inv, err := GetFullInvoiceByID(db, tenantID, codigo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept[codigo] = inv.Header
+	}
+
+	invoices, lines, stay, err := CountArchivableInvoices(db, tenantID, cutoff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoices != 2 || lines != 3 || stay != 2 {
+		t.Errorf("dry run: %d invoices, %d lines, %d kept, want 2, 3 and 2", invoices, lines, stay)
+	}
+
+	ids, moved := []int{}, 0
+	for {
+		batch, n, err := ArchiveInvoices(db, tenantID, cutoff, 1, dto.SystemActor("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, moved = append(ids, batch...), moved+n
+		if len(batch) < 1 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("archived %v, want [1 2]", ids)
+	}
+	if len(ids) != invoices || moved != lines {
+		t.Errorf("archived %d invoices and %d lines, the dry run counted %d and %d", len(ids), moved, invoices, lines)
+	}
+	if invoices, lines, stay, err := CountArchivableInvoices(db, tenantID, cutoff); err != nil || invoices != 0 || lines != 0 || stay != 2 {
+		t.Errorf("dry run after archiving: %d invoices, %d lines, %d kept (%v), want 0, 0 and 2", invoices, lines, stay, err)
+	}
+
+	// The archived invoices are read from the archive, lines included
+	for _, codigo := range ids {
+		if working, archived := location(t, db, tenantID, codigo); working || !archived {
+			t.Errorf("invoice %d: in invoices %v, in the archive %v, want only archived", codigo, working, archived)
+		}
+		inv, err := GetFullInvoiceByID(db, tenantID, codigo)
+		if err != nil {
+			t.Fatalf("GetFullInvoiceByID(%d) after archiving: %v", codigo, err)
+		}
+		if want := codigo; len(inv.Lines) != want {
+			t.Errorf("archived invoice %d has %d lines, want %d", codigo, len(inv.Lines), want)
+		}
+		if n := archivedEvents(t, db, tenantID, codigo); n != 1 {
+			t.Errorf("invoice %d has %d archived events, want 1", codigo, n)
+		}
+	}
+	if _, err := UpdateInvoiceFiscalData(db, tenantID, 1, dto.FiscalDataDTO{ClienteNombre: strPtr("Ana")}, 1, dto.SystemActor("test")); !errors.Is(err, ErrInvoiceArchived) {
+		t.Errorf("UpdateInvoiceFiscalData of an archived invoice: %v, want ErrInvoiceArchived", err)
+	}
+
+	// The rest is left as it was
+	for codigo, before := range kept {
+		if working, archived := location(t, db, tenantID, codigo); !working || archived {
+			t.Errorf("invoice %d: in invoices %v, in the archive %v, want it kept", codigo, working, archived)
+		}
+		inv, err := GetFullInvoiceByID(db, tenantID, codigo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(inv.Header, before) {
+			t.Errorf("invoice %d changed:\nbefore %+v\nafter  %+v", codigo, before, inv.Header)
+		}
+		if n := archivedEvents(t, db, tenantID, codigo); n != 0 {
+			t.Errorf("invoice %d has %d archived events, want none", codigo, n)
+		}
+	}
+	deliveries, err := ListEmailDeliveries(db, tenantID, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != dto.EmailStatusPending {
+		t.Errorf("email deliveries of invoice 4: %+v, want one pending", deliveries)
+	}
+}
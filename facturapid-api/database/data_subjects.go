@@ -0,0 +1,531 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Invoices keep their customer data for the retention period tax law sets, and are
+	// then pseudonymised in place: the amounts and the numbering stay, the customer
+	// fields are replaced by pseudonyms. data_subject_requests audits every export and
+	// every pseudonymisation, by a pseudonym of the subject.
+	createDataSubjectTablesSQL = `
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS pseudonymised_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE rectifying_invoices ADD COLUMN IF NOT EXISTS pseudonymised_at TIMESTAMP WITH TIME ZONE;
+CREATE TABLE IF NOT EXISTS data_subject_requests (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    kind VARCHAR(10) NOT NULL, -- export, erasure, retention
+    subject_ref VARCHAR(20),   -- Pseudonym of the subject's NIF and email; NULL for retention runs
+    requested_by VARCHAR(100),
+    reason VARCHAR(500),
+    actor_type VARCHAR(20) NOT NULL,
+    actor_id VARCHAR(100) NOT NULL,
+    invoices INTEGER[] NOT NULL DEFAULT '{}',
+    rectifying_invoices INTEGER[] NOT NULL DEFAULT '{}',
+    retained_invoices INTEGER[] NOT NULL DEFAULT '{}',
+    retained_rectifying_invoices INTEGER[] NOT NULL DEFAULT '{}',
+    fiscal_profiles_deleted INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+`
+
+	dataSubjectRequestColumns = `
+    id, kind, subject_ref, requested_by, reason, actor_type, actor_id, invoices, rectifying_invoices,
+    retained_invoices, retained_rectifying_invoices, fiscal_profiles_deleted, created_at`
+
+	// subjectMatchSQL matches the rows of invoices or rectifying_invoices of the subject
+	// in $1 (normalized NIF) and $2 (lower-case email).
+	subjectMatchSQL = `
+    ($1 <> '' AND regexp_replace(UPPER(cliente3), '[ .-]', '', 'g') = $1)
+    OR ($2 <> '' AND LOWER(cliente4) = $2)`
+)
+
+// personalEventFields are the audit trail fields, in changes and details, that hold
+// customer data.
+var personalEventFields = map[string]bool{
+	"cliente1": true, "cliente2": true, "cliente3": true, "cliente4": true,
+	"cliente_nombre": true, "cliente_direccion": true, "cliente_nif": true, "cliente_email": true,
+	"recipient": true,
+}
+
+// pseudonym returns the pseudonym of a personal data value: "P-" and the first 16 hex
+// digits of its HMAC-SHA256 under key. Equal values get equal pseudonyms, so repeat
+// customers can still be counted, but the value cannot be recovered without the key.
+func pseudonym(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "P-" + hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func subjectRef(key []byte, s dto.DataSubjectDTO) string {
+	return pseudonym(key, "nif:"+s.NIF+"|email:"+s.Email)
+}
+
+func scanDataSubjectRequest(row scanner) (dto.DataSubjectRequestDTO, error) {
+	var r dto.DataSubjectRequestDTO
+	var subjectRef, requestedBy, reason sql.NullString
+	var invoices, rectifying, retained, retainedRectifying pq.Int64Array
+	err := row.Scan(
+		&r.ID, &r.Kind, &subjectRef, &requestedBy, &reason, &r.Actor.Type, &r.Actor.ID, &invoices, &rectifying,
+		&retained, &retainedRectifying, &r.FiscalProfilesDeleted, &r.CreatedAt,
+	)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	if subjectRef.Valid { r.SubjectRef = &subjectRef.String }
+	if requestedBy.Valid { r.RequestedBy = &requestedBy.String }
+	if reason.Valid { r.Reason = &reason.String }
+	r.Invoices, r.RectifyingInvoices = intsOf(invoices), intsOf(rectifying)
+	r.RetainedInvoices, r.RetainedRectifyingInvoices = intsOf(retained), intsOf(retainedRectifying)
+	return r, nil
+}
+
+func intsOf(a pq.Int64Array) []int {
+	ints := make([]int, len(a))
+	for i, v := range a {
+		ints[i] = int(v)
+	}
+	return ints
+}
+
+// insertDataSubjectRequest records r in a tenant and returns it as stored.
+func insertDataSubjectRequest(q queryRower, tenantID int, r dto.DataSubjectRequestDTO) (dto.DataSubjectRequestDTO, error) {
+	stored, err := scanDataSubjectRequest(q.QueryRow(`
+INSERT INTO data_subject_requests (
+    kind, subject_ref, requested_by, reason, actor_type, actor_id, invoices, rectifying_invoices,
+    retained_invoices, retained_rectifying_invoices, fiscal_profiles_deleted, tenant_id
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+RETURNING`+dataSubjectRequestColumns+`;`,
+		r.Kind, NullableString(r.SubjectRef), NullableString(r.RequestedBy), NullableString(r.Reason), r.Actor.Type, r.Actor.ID,
+		pq.Array(r.Invoices), pq.Array(r.RectifyingInvoices), pq.Array(r.RetainedInvoices), pq.Array(r.RetainedRectifyingInvoices),
+		r.FiscalProfilesDeleted, tenantID,
+	))
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error recording %s data subject request: %w", r.Kind, err)
+	}
+	return stored, nil
+}
+
+// ListDataSubjectRequests returns the audit records of the data subject requests and
+// retention runs of a tenant, newest first.
+func ListDataSubjectRequests(db *sql.DB, tenantID, limit int) ([]dto.DataSubjectRequestDTO, error) {
+	rows, err := db.Query(`SELECT`+dataSubjectRequestColumns+`
+FROM data_subject_requests WHERE tenant_id = $2 ORDER BY id DESC LIMIT $1;`, limit, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying data subject requests: %w", err)
+	}
+	defer rows.Close()
+	requests := []dto.DataSubjectRequestDTO{}
+	for rows.Next() {
+		r, err := scanDataSubjectRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning data subject request: %w", err)
+		}
+		requests = append(requests, r)
+	}
+	return requests, rows.Err()
+}
+
+// subjectDocument is an invoice or rectifying invoice of a data subject.
+type subjectDocument struct {
+	codigo int
+	// erasable is set when the document may be pseudonymised now: its retention period
+	// is over, or it is an invoice that was never issued.
+	erasable bool
+}
+
+func querySubjectDocuments(db *sql.DB, query string, args ...interface{}) ([]subjectDocument, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := []subjectDocument{}
+	for rows.Next() {
+		var d subjectDocument
+		if err := rows.Scan(&d.codigo, &d.erasable); err != nil {
+			return nil, err
+		}
+		docs = append(docs, d)
+	}
+	return docs, rows.Err()
+}
+
+// findSubjectDocuments returns the invoices, archived or not, and rectifying invoices of
+// a normalized subject in a tenant that have not been pseudonymised yet. Documents
+// without a date never leave the retention period.
+func findSubjectDocuments(db *sql.DB, tenantID int, s dto.DataSubjectDTO, retentionYears int) (invoices, rectifying []subjectDocument, err error) {
+	invoices, err = querySubjectDocuments(db, `
+SELECT codigo, COALESCE(fecha < NOW() - make_interval(years => $3), FALSE) OR estado IN ($4, $5)
+FROM invoices
+WHERE tenant_id = $6 AND pseudonymised_at IS NULL AND (`+subjectMatchSQL+`
+    OR ($2 <> '' AND codigo IN (SELECT invoice_codigo FROM email_deliveries WHERE tenant_id = $6 AND LOWER(recipient) = $2)))
+UNION ALL
+SELECT codigo, COALESCE(fecha < NOW() - make_interval(years => $3), FALSE) OR estado IN ($4, $5)
+FROM invoices_archive
+WHERE tenant_id = $6 AND pseudonymised_at IS NULL AND (`+subjectMatchSQL+`)
+ORDER BY codigo;`, s.NIF, s.Email, retentionYears, dto.InvoiceStatusReceived, dto.InvoiceStatusFiscalDataPending, tenantID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying invoices of data subject: %w", err)
+	}
+	rectifying, err = querySubjectDocuments(db, `
+SELECT codigo, COALESCE(fecha < NOW() - make_interval(years => $3), FALSE)
+FROM rectifying_invoices
+WHERE tenant_id = $4 AND pseudonymised_at IS NULL AND (`+subjectMatchSQL+`)
+ORDER BY codigo;`, s.NIF, s.Email, retentionYears, tenantID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying rectifying invoices of data subject: %w", err)
+	}
+	return invoices, rectifying, nil
+}
+
+// ExportDataSubject returns everything a tenant stores about a data subject, and records
+// the export.
+func ExportDataSubject(db *sql.DB, tenantID int, key []byte, subject dto.DataSubjectDTO, actor dto.ActorDTO) (dto.DataSubjectExportDTO, error) {
+	s := subject.Normalized()
+	export := dto.DataSubjectExportDTO{
+		Subject:            s,
+		GeneratedAt:        time.Now().UTC(),
+		FiscalProfiles:     []dto.FiscalProfileDTO{},
+		Invoices:           []dto.FullInvoiceDTO{},
+		RectifyingInvoices: []dto.RectifyingInvoiceDTO{},
+		EmailDeliveries:    []dto.EmailDeliveryDTO{},
+		InvoiceEvents:      []dto.InvoiceEventDTO{},
+	}
+
+	rows, err := db.Query(`SELECT`+fiscalProfileColumns+`
+FROM fiscal_profiles WHERE tenant_id = $3 AND (($1 <> '' AND nif = $1) OR ($2 <> '' AND LOWER(email) = $2)) ORDER BY nif;`, s.NIF, s.Email, tenantID)
+	if err != nil {
+		return dto.DataSubjectExportDTO{}, fmt.Errorf("error querying fiscal profiles of data subject: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanFiscalProfile(rows)
+		if err != nil {
+			return dto.DataSubjectExportDTO{}, fmt.Errorf("error scanning fiscal profile: %w", err)
+		}
+		export.FiscalProfiles = append(export.FiscalProfiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		return dto.DataSubjectExportDTO{}, fmt.Errorf("error reading fiscal profiles of data subject: %w", err)
+	}
+
+	invoices, rectifying, err := findSubjectDocuments(db, tenantID, s, 0)
+	if err != nil {
+		return dto.DataSubjectExportDTO{}, err
+	}
+	record := dto.DataSubjectRequestDTO{Kind: dto.DataSubjectExport, Actor: actor, Invoices: []int{}, RectifyingInvoices: []int{}}
+	for _, d := range invoices {
+		inv, err := GetFullInvoiceByID(db, tenantID, d.codigo)
+		if err != nil {
+			return dto.DataSubjectExportDTO{}, err
+		}
+		deliveries, err := ListEmailDeliveries(db, tenantID, d.codigo)
+		if err != nil {
+			return dto.DataSubjectExportDTO{}, err
+		}
+		events, err := ListInvoiceEvents(db, tenantID, d.codigo)
+		if err != nil {
+			return dto.DataSubjectExportDTO{}, err
+		}
+		export.Invoices = append(export.Invoices, inv)
+		export.EmailDeliveries = append(export.EmailDeliveries, deliveries...)
+		export.InvoiceEvents = append(export.InvoiceEvents, events...)
+		record.Invoices = append(record.Invoices, d.codigo)
+	}
+	for _, d := range rectifying {
+		r, err := GetRectifyingInvoiceByID(db, tenantID, d.codigo)
+		if err != nil {
+			return dto.DataSubjectExportDTO{}, err
+		}
+		export.RectifyingInvoices = append(export.RectifyingInvoices, r)
+		record.RectifyingInvoices = append(record.RectifyingInvoices, d.codigo)
+	}
+
+	ref := subjectRef(key, s)
+	record.SubjectRef = &ref
+	if _, err := insertDataSubjectRequest(db, tenantID, record); err != nil {
+		return dto.DataSubjectExportDTO{}, err
+	}
+	return export, nil
+}
+
+// EraseDataSubject handles an erasure request in a tenant: it deletes the subject's
+// fiscal profiles, and pseudonymises their invoices and rectifying invoices whose
+// retention period is over, and the invoices that were never issued. Issued documents
+// within the retention period are kept intact, as tax law requires, and reported as
+// retained; the retention job pseudonymises them once the period ends. The caller must
+// purge the stored PDFs of the pseudonymised documents.
+func EraseDataSubject(db *sql.DB, tenantID int, key []byte, retentionYears int, req dto.EraseDataSubjectDTO, actor dto.ActorDTO) (dto.DataSubjectRequestDTO, error) {
+	s := req.DataSubjectDTO.Normalized()
+	invoices, rectifying, err := findSubjectDocuments(db, tenantID, s, retentionYears)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	ref := subjectRef(key, s)
+	record := dto.DataSubjectRequestDTO{
+		Kind: dto.DataSubjectErasure, SubjectRef: &ref, RequestedBy: &req.RequestedBy, Reason: &req.Reason, Actor: actor,
+		Invoices: []int{}, RectifyingInvoices: []int{}, RetainedInvoices: []int{}, RetainedRectifyingInvoices: []int{},
+	}
+	for _, d := range invoices {
+		if d.erasable {
+			record.Invoices = append(record.Invoices, d.codigo)
+		} else {
+			record.RetainedInvoices = append(record.RetainedInvoices, d.codigo)
+		}
+	}
+	for _, d := range rectifying {
+		if d.erasable {
+			record.RectifyingInvoices = append(record.RectifyingInvoices, d.codigo)
+		} else {
+			record.RetainedRectifyingInvoices = append(record.RetainedRectifyingInvoices, d.codigo)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := pseudonymiseDocuments(tx, tenantID, key, record.Invoices, record.RectifyingInvoices, dto.DataSubjectErasure, actor); err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	if _, err := tx.Exec(`DELETE FROM fiscal_profile_codes WHERE tenant_id = $2 AND $1 <> '' AND nif = $1;`, s.NIF, tenantID); err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error deleting fiscal profile codes: %w", err)
+	}
+	result, err := tx.Exec(`
+DELETE FROM fiscal_profiles WHERE tenant_id = $3 AND (($1 <> '' AND nif = $1) OR ($2 <> '' AND LOWER(email) = $2));`, s.NIF, s.Email, tenantID)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error deleting fiscal profiles: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error fetching rows affected for fiscal profiles: %w", err)
+	}
+	record.FiscalProfilesDeleted = int(deleted)
+
+	stored, err := insertDataSubjectRequest(tx, tenantID, record)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error committing erasure: %w", err)
+	}
+	log.Printf("Erasure request %d: pseudonymised %d invoices and %d rectifying invoices, retained %d and %d, deleted %d fiscal profiles.",
+		stored.ID, len(stored.Invoices), len(stored.RectifyingInvoices), len(stored.RetainedInvoices), len(stored.RetainedRectifyingInvoices), stored.FiscalProfilesDeleted)
+	return stored, nil
+}
+
+// PseudonymiseExpired pseudonymises up to limit invoices of a tenant, archived or not,
+// and limit rectifying invoices whose retention period is over, and records the run.
+// It returns a record with no documents, not stored, when there was nothing to do. The
+// caller must purge the stored PDFs of the pseudonymised documents.
+func PseudonymiseExpired(db *sql.DB, tenantID int, key []byte, retentionYears, limit int, actor dto.ActorDTO) (dto.DataSubjectRequestDTO, error) {
+	record := dto.DataSubjectRequestDTO{Kind: dto.DataSubjectRetention, Actor: actor}
+	var err error
+	record.Invoices, err = queryInts(db, `
+SELECT codigo FROM invoices
+WHERE tenant_id = $3 AND pseudonymised_at IS NULL AND fecha < NOW() - make_interval(years => $1)
+UNION ALL
+SELECT codigo FROM invoices_archive
+WHERE tenant_id = $3 AND pseudonymised_at IS NULL AND fecha < NOW() - make_interval(years => $1)
+ORDER BY codigo LIMIT $2;`, retentionYears, limit, tenantID)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error querying expired invoices: %w", err)
+	}
+	record.RectifyingInvoices, err = queryInts(db, `
+SELECT codigo FROM rectifying_invoices
+WHERE tenant_id = $3 AND pseudonymised_at IS NULL AND fecha < NOW() - make_interval(years => $1)
+ORDER BY codigo LIMIT $2;`, retentionYears, limit, tenantID)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error querying expired rectifying invoices: %w", err)
+	}
+	if len(record.Invoices) == 0 && len(record.RectifyingInvoices) == 0 {
+		return record, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := pseudonymiseDocuments(tx, tenantID, key, record.Invoices, record.RectifyingInvoices, dto.DataSubjectRetention, actor); err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	stored, err := insertDataSubjectRequest(tx, tenantID, record)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return dto.DataSubjectRequestDTO{}, fmt.Errorf("error committing retention run: %w", err)
+	}
+	log.Printf("Retention run %d of tenant %d: pseudonymised %d invoices and %d rectifying invoices.", stored.ID, tenantID, len(stored.Invoices), len(stored.RectifyingInvoices))
+	return stored, nil
+}
+
+func queryInts(db *sql.DB, query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ints := []int{}
+	for rows.Next() {
+		var v int
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		ints = append(ints, v)
+	}
+	return ints, rows.Err()
+}
+
+// pseudonymiseDocuments replaces the customer data of invoices and rectifying invoices
+// of a tenant by pseudonyms, wherever it is kept: the documents, their email
+// deliveries, their audit trail and their webhook deliveries (which are deleted). The
+// invoices' version is bumped, so PDFs are generated anew from the pseudonymised data.
+// Amounts, numbering and the fiscal record chain are left as they are.
+func pseudonymiseDocuments(tx *sql.Tx, tenantID int, key []byte, invoices, rectifying []int, kind string, actor dto.ActorDTO) error {
+	if len(invoices) == 0 && len(rectifying) == 0 {
+		return nil
+	}
+	// Lets the audit trail trigger accept the rewrite of personal data (see
+	// createInvoiceEventsTableSQL), until the transaction ends.
+	if _, err := tx.Exec(`SET LOCAL facturapid.erasure = 'on';`); err != nil {
+		return fmt.Errorf("error enabling erasure: %w", err)
+	}
+	for _, table := range []struct {
+		name    string
+		archive string // Where the document is when it is not in name
+		ids     []int
+		extra   string
+	}{
+		{"invoices", "invoices_archive", invoices, ", version = version + 1"},
+		{"rectifying_invoices", "", rectifying, ""},
+	} {
+		for _, id := range table.ids {
+			name := table.name
+			var c [3]sql.NullString
+			err := tx.QueryRow(`SELECT cliente1, cliente2, cliente3 FROM `+name+` WHERE tenant_id = $2 AND codigo = $1 FOR UPDATE;`, id, tenantID).Scan(&c[0], &c[1], &c[2])
+			if err == sql.ErrNoRows && table.archive != "" {
+				name = table.archive
+				err = tx.QueryRow(`SELECT cliente1, cliente2, cliente3 FROM `+name+` WHERE tenant_id = $2 AND codigo = $1 FOR UPDATE;`, id, tenantID).Scan(&c[0], &c[1], &c[2])
+			}
+			if err != nil {
+				return fmt.Errorf("error querying %s %d: %w", name, id, err)
+			}
+			var p [3]interface{}
+			for i := range c {
+				if c[i].Valid && c[i].String != "" { p[i] = pseudonym(key, c[i].String) }
+			}
+			_, err = tx.Exec(`
+UPDATE `+name+` SET cliente1 = $2, cliente2 = $3, cliente3 = $4, cliente4 = NULL, pseudonymised_at = NOW()`+table.extra+`
+WHERE tenant_id = $5 AND codigo = $1;`, id, p[0], p[1], p[2], tenantID)
+			if err != nil {
+				return fmt.Errorf("error pseudonymising %s %d: %w", name, id, err)
+			}
+		}
+	}
+	if len(invoices) == 0 {
+		return nil
+	}
+
+	ids := pq.Array(invoices)
+	deliveries, err := tx.Query(`SELECT id, recipient FROM email_deliveries WHERE tenant_id = $2 AND invoice_codigo = ANY($1);`, ids, tenantID)
+	if err != nil {
+		return fmt.Errorf("error querying email deliveries: %w", err)
+	}
+	recipients := map[int]string{}
+	for deliveries.Next() {
+		var id int
+		var recipient string
+		if err := deliveries.Scan(&id, &recipient); err != nil {
+			deliveries.Close()
+			return fmt.Errorf("error scanning email delivery: %w", err)
+		}
+		recipients[id] = recipient
+	}
+	deliveries.Close()
+	if err := deliveries.Err(); err != nil {
+		return fmt.Errorf("error reading email deliveries: %w", err)
+	}
+	for id, recipient := range recipients {
+		// SMTP errors usually quote the address: last_error goes too
+		_, err := tx.Exec(`UPDATE email_deliveries SET recipient = $2, last_error = NULL WHERE id = $1;`, id, pseudonym(key, recipient))
+		if err != nil {
+			return fmt.Errorf("error pseudonymising email delivery %d: %w", id, err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE tenant_id = $2 AND invoice_codigo = ANY($1);`, ids, tenantID); err != nil {
+		return fmt.Errorf("error deleting webhook deliveries: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT`+invoiceEventColumns+` FROM invoice_events WHERE tenant_id = $2 AND invoice_codigo = ANY($1);`, ids, tenantID)
+	if err != nil {
+		return fmt.Errorf("error querying invoice events: %w", err)
+	}
+	var events []dto.InvoiceEventDTO
+	for rows.Next() {
+		e, err := scanInvoiceEvent(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning invoice event: %w", err)
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading invoice events: %w", err)
+	}
+	for _, e := range events {
+		for field, change := range e.Changes {
+			if personalEventFields[field] {
+				e.Changes[field] = dto.FieldChangeDTO{Before: pseudonymValue(key, change.Before), After: pseudonymValue(key, change.After)}
+			}
+		}
+		for field, v := range e.Details {
+			if personalEventFields[field] { e.Details[field] = pseudonymValue(key, v) }
+		}
+		changes, err := nullableJSON(e.Changes, len(e.Changes) == 0)
+		if err != nil {
+			return fmt.Errorf("error encoding changes of invoice event %d: %w", e.ID, err)
+		}
+		details, err := nullableJSON(e.Details, len(e.Details) == 0)
+		if err != nil {
+			return fmt.Errorf("error encoding details of invoice event %d: %w", e.ID, err)
+		}
+		if _, err := tx.Exec(`UPDATE invoice_events SET changes = $2, details = $3, client_ip = NULL WHERE id = $1;`, e.ID, changes, details); err != nil {
+			return fmt.Errorf("error pseudonymising invoice event %d: %w", e.ID, err)
+		}
+	}
+	for _, id := range invoices {
+		err := insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{
+			InvoiceID: id, EventType: dto.InvoiceEventPseudonymised, Actor: actor,
+			Details: map[string]interface{}{"cause": kind},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pseudonymValue returns the pseudonym of v if it is a non-empty string, and v
+// otherwise (null, or a number that is not personal data).
+func pseudonymValue(key []byte, v interface{}) interface{} {
+	if s, ok := v.(string); ok && s != "" {
+		return pseudonym(key, s)
+	}
+	return v
+}
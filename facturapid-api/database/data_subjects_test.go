@@ -0,0 +1,157 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"facturapid-api/dto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("test pseudonym key")
+
+// ana is the customer data of the data subject of the erasure tests.
+var ana = dto.FiscalDataDTO{
+	ClienteNombre: strPtr("Ana Núñez"), ClienteDireccion: strPtr("Calle Mayor 1"),
+	ClienteNIF: strPtr("12345678Z"), ClienteEmail: strPtr("ana@example.com"),
+}
+
+// customerInvoice stores invoice codigo, dated fecha, with the fiscal data of ana, and
+// issues it when issued is set.
+func customerInvoice(t *testing.T, db *sql.DB, tenantID, codigo int, fecha time.Time, issued bool) {
+	t.Helper()
+	createInvoices(t, db, tenantID, testInvoice(codigo, fecha.Format("2006-01-02"), "10.00"))
+	version, err := GetInvoiceVersion(db, tenantID, codigo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UpdateInvoiceFiscalData(db, tenantID, codigo, ana, version, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	if issued {
+		if _, err := IssueInvoice(db, tenantID, codigo, dto.SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEraseDataSubject(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+	now := time.Now().UTC()
+	customerInvoice(t, db, tenantID, 1, now.AddDate(0, -1, 0), true)  // Issued, within the retention period
+	customerInvoice(t, db, tenantID, 2, now.AddDate(0, -1, 0), false) // Never issued
+	customerInvoice(t, db, tenantID, 3, now.AddDate(-7, 0, 0), true)  // Issued, retention period over
+	if _, err := EnqueueEmailDelivery(db, tenantID, 2, "ana@example.com", "es"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateFiscalProfileCode(db, tenantID, "12345678Z", 2, "123456", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	before := map[int]dto.InvoiceHeaderDTO{}
+	for _, codigo := range []int{1, 2, 3} {
+		inv, err := GetFullInvoiceByID(db, tenantID, codigo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[codigo] = inv.Header
+	}
+
+	req := dto.EraseDataSubjectDTO{DataSubjectDTO: dto.DataSubjectDTO{NIF: "12.345.678-z"}, RequestedBy: "DPO", Reason: "Art. 17 RGPD"}
+	record, err := EraseDataSubject(db, tenantID, testKey, 6, req, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(record.Invoices, []int{2, 3}) || !reflect.DeepEqual(record.RetainedInvoices, []int{1}) {
+		t.Errorf("pseudonymised %v, retained %v, want [2 3] and [1]", record.Invoices, record.RetainedInvoices)
+	}
+	if record.FiscalProfilesDeleted != 1 {
+		t.Errorf("%d fiscal profiles deleted, want 1", record.FiscalProfilesDeleted)
+	}
+
+	// The issued invoice within the retention period keeps its fiscal data as it was
+	retained, err := GetFullInvoiceByID(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(retained.Header, before[1]) {
+		t.Errorf("retained invoice changed:\nbefore %+v\nafter  %+v", before[1], retained.Header)
+	}
+
+	// The others keep their amounts and numbering, with pseudonyms for the customer
+	for _, codigo := range []int{2, 3} {
+		inv, err := GetFullInvoiceByID(db, tenantID, codigo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := inv.Header
+		for name, v := range map[string]*string{"cliente1": h.Cliente1, "cliente2": h.Cliente2, "cliente3": h.Cliente3} {
+			if v == nil || !strings.HasPrefix(*v, "P-") {
+				t.Errorf("invoice %d: %s = %v, want a pseudonym", codigo, name, v)
+			}
+		}
+		if h.Cliente4 != nil {
+			t.Errorf("invoice %d: cliente4 = %q, want NULL", codigo, *h.Cliente4)
+		}
+		if h.Total.Cmp(before[codigo].Total) != 0 || h.Serie != before[codigo].Serie || h.Version != before[codigo].Version+1 {
+			t.Errorf("invoice %d: total %s, serie %s, version %d, want %s, %s, %d",
+				codigo, h.Total, h.Serie, h.Version, before[codigo].Total, before[codigo].Serie, before[codigo].Version+1)
+		}
+	}
+
+	// Nor does anything else kept about the unissued invoice hold the subject's data
+	deliveries, err := ListEmailDeliveries(db, tenantID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := ListInvoiceEvents(db, tenantID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := json.Marshal(map[string]interface{}{"deliveries": deliveries, "events": events})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, personal := range []string{"Ana", "Calle Mayor", "12345678Z", "ana@example.com"} {
+		if strings.Contains(string(stored), personal) {
+			t.Errorf("email deliveries or events of invoice 2 still hold %q: %s", personal, stored)
+		}
+	}
+	if _, err := GetFiscalProfile(db, tenantID, "12345678Z"); !errors.Is(err, ErrFiscalProfileNotFound) {
+		t.Errorf("GetFiscalProfile after erasure: %v, want ErrFiscalProfileNotFound", err)
+	}
+	if _, err := VerifyFiscalProfileCode(db, tenantID, "12345678Z", 2, "123456"); err == nil {
+		t.Error("fiscal profile code still verifies after erasure")
+	}
+
+	// A second request finds nothing more to erase but the retained invoice
+	record, err = EraseDataSubject(db, tenantID, testKey, 6, req, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Invoices) != 0 || !reflect.DeepEqual(record.RetainedInvoices, []int{1}) {
+		t.Errorf("second erasure: pseudonymised %v, retained %v, want none and [1]", record.Invoices, record.RetainedInvoices)
+	}
+}
+
+func TestEraseDataSubjectByEmail(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+	customerInvoice(t, db, tenantID, 1, time.Now().UTC().AddDate(0, -1, 0), false)
+	createInvoices(t, db, tenantID, testInvoice(2, time.Now().UTC().AddDate(0, -1, 0).Format("2006-01-02"), "10.00"))
+
+	req := dto.EraseDataSubjectDTO{DataSubjectDTO: dto.DataSubjectDTO{Email: "ANA@example.com"}, RequestedBy: "DPO", Reason: "Art. 17 RGPD"}
+	record, err := EraseDataSubject(db, tenantID, testKey, 6, req, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(record.Invoices, []int{1}) {
+		t.Errorf("pseudonymised %v, want [1]: invoice 2 has no customer", record.Invoices)
+	}
+	if inv, err := GetFullInvoiceByID(db, tenantID, 2); err != nil || inv.Header.Version != 1 {
+		t.Errorf("invoice of no one touched: version %d (%v)", inv.Header.Version, err)
+	}
+}
@@ -2,7 +2,10 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"facturapid-api/dto" // Import DTO package
+	"facturapid-api/money"
 	"fmt"
 	"log"
 	"time" // For parsing string dates to time.Time if necessary
@@ -13,12 +16,20 @@ import (
 // Custom error for not found, to be specific from db layer
 var ErrInvoiceNotFound = sql.ErrNoRows // Reuse sql.ErrNoRows for semantic clarity or define a new one
 
+// ErrInvoiceVoided is returned when an operation needs an invoice that has not been voided.
+var ErrInvoiceVoided = errors.New("invoice has been voided")
+
+// ErrVersionMismatch is returned by conditional updates when the invoice has changed
+// since the version the client read.
+var ErrVersionMismatch = errors.New("invoice version mismatch")
+
 const (
 	createInvoicesTableSQL = `
 CREATE TABLE IF NOT EXISTS invoices (
-    codigo INTEGER PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    codigo INTEGER NOT NULL, -- Unique within the tenant
     cuenta VARCHAR(20),
-    fecha TIMESTAMP WITHOUT TIME ZONE,
+    fecha TIMESTAMP WITHOUT TIME ZONE NOT NULL, -- Partition key (see partitions.go)
     hora TIMESTAMP WITHOUT TIME ZONE,
     total NUMERIC(12,4), 
     tipo_cobro VARCHAR(50),
@@ -61,12 +72,61 @@ CREATE TABLE IF NOT EXISTS invoices (
     iva6 NUMERIC(5,2),
     cuota_iva4 NUMERIC(12,4),
     cuota_iva5 NUMERIC(12,4),
-    cuota_iva6 NUMERIC(12,4)
-);`
+    cuota_iva6 NUMERIC(12,4),
+    validation_status VARCHAR(10), -- valid, warnings or invalid (see package validation)
+    validation_report JSONB,       -- The validation.Report behind validation_status
+    recargo1 NUMERIC(5,2), -- Recargo de equivalencia percentage for base1
+    recargo2 NUMERIC(5,2),
+    recargo3 NUMERIC(5,2),
+    recargo4 NUMERIC(5,2),
+    recargo5 NUMERIC(5,2),
+    recargo6 NUMERIC(5,2),
+    cuota_recargo1 NUMERIC(12,4),
+    cuota_recargo2 NUMERIC(12,4),
+    cuota_recargo3 NUMERIC(12,4),
+    cuota_recargo4 NUMERIC(12,4),
+    cuota_recargo5 NUMERIC(12,4),
+    cuota_recargo6 NUMERIC(12,4),
+    causa_exencion VARCHAR(2), -- AEAT exemption code (E1..E6) for bases taxed at 0%
+    -- The keys of a partitioned table include the partition key; CreateFullInvoice
+    -- keeps codigo unique within the tenant on its own.
+    PRIMARY KEY (tenant_id, codigo, fecha)
+) PARTITION BY RANGE (fecha);`
+
+	// alterInvoicesTableSQL adds the columns introduced after the first release,
+	// so databases created with an older version of createInvoicesTableSQL catch up.
+	alterInvoicesTableSQL = `
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS validation_status VARCHAR(10);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS validation_report JSONB;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo1 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo2 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo3 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo4 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo5 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS recargo6 NUMERIC(5,2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo1 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo2 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo3 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo4 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo5 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS cuota_recargo6 NUMERIC(12,4);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS causa_exencion VARCHAR(2);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS voided_by VARCHAR(100);
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS void_reason TEXT;
+ALTER TABLE invoices ADD COLUMN IF NOT EXISTS estado VARCHAR(20) NOT NULL DEFAULT 'received';
+`
+
+	// backfillVoidedStatusSQL sets the status of the invoices voided before they had
+	// one. It runs once, when alterInvoicesTableSQL adds the estado column.
+	backfillVoidedStatusSQL = `UPDATE invoices SET estado = 'voided' WHERE voided_at IS NOT NULL;`
 
 	createInvoiceLinesTableSQL = `
 CREATE TABLE IF NOT EXISTS invoice_lines (
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
     codigo_factura INTEGER NOT NULL,
+    fecha_factura TIMESTAMP WITHOUT TIME ZONE NOT NULL, -- The invoice's fecha: lines are partitioned with their invoice
     unidades_old SMALLINT,
     subtotal NUMERIC(12,4),
     codigo_producto VARCHAR(15),
@@ -77,9 +137,9 @@ CREATE TABLE IF NOT EXISTS invoice_lines (
     combinado_con VARCHAR(15) NOT NULL, 
     liga_siguiente VARCHAR(1),
     serie VARCHAR(1),
-    PRIMARY KEY (codigo_factura, producto, linea),
-    FOREIGN KEY (codigo_factura) REFERENCES invoices(codigo) ON DELETE CASCADE
-);`
+    PRIMARY KEY (tenant_id, codigo_factura, fecha_factura, producto, linea),
+    FOREIGN KEY (tenant_id, codigo_factura, fecha_factura) REFERENCES invoices(tenant_id, codigo, fecha) ON DELETE CASCADE
+) PARTITION BY RANGE (fecha_factura);`
 
 	createInvoicesIndexesSQL = `
 CREATE INDEX IF NOT EXISTS idx_invoices_cliente1 ON invoices (cliente1);
@@ -112,14 +172,43 @@ func InitDB(connStr string) (*sql.DB, error) {
 // CreateSchema creates the necessary database tables if they don't already exist.
 func CreateSchema(db *sql.DB) error {
 	log.Println("Attempting to create database schema...")
+	if _, err := db.Exec(createTenantsTablesSQL); err != nil {
+		return fmt.Errorf("error creating tenant tables: %w", err)
+	}
+	log.Println("Tables 'tenants' and 'api_keys' checked/created successfully.")
 	if _, err := db.Exec(createInvoicesTableSQL); err != nil {
 		return fmt.Errorf("error creating invoices table: %w", err)
 	}
 	log.Println("Table 'invoices' checked/created successfully.")
+	if err := partitionInvoices(db); err != nil {
+		return err
+	}
+	var hasStatus bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_attribute WHERE attrelid = 'invoices'::regclass AND attname = 'estado' AND NOT attisdropped);`).Scan(&hasStatus)
+	if err != nil {
+		return fmt.Errorf("error querying invoices columns: %w", err)
+	}
+	if _, err := db.Exec(alterInvoicesTableSQL); err != nil {
+		return fmt.Errorf("error altering invoices table: %w", err)
+	}
+	log.Println("Columns for 'invoices' table checked/added successfully.")
+	if !hasStatus {
+		if _, err := db.Exec(backfillVoidedStatusSQL); err != nil {
+			return fmt.Errorf("error setting status of voided invoices: %w", err)
+		}
+		log.Println("Status of voided invoices set successfully.")
+	}
+	if err := migrateTenancy(db); err != nil {
+		return err
+	}
 	if _, err := db.Exec(createInvoiceLinesTableSQL); err != nil {
 		return fmt.Errorf("error creating invoice_lines table: %w", err)
 	}
 	log.Println("Table 'invoice_lines' checked/created successfully.")
+	if err := EnsureInvoicePartitions(db); err != nil {
+		return err
+	}
+	log.Println("Partitions of 'invoices' and 'invoice_lines' checked/created successfully.")
 	if _, err := db.Exec(createInvoicesIndexesSQL); err != nil {
 		return fmt.Errorf("error creating indexes for invoices table: %w", err)
 	}
@@ -128,6 +217,62 @@ func CreateSchema(db *sql.DB) error {
 		return fmt.Errorf("error creating indexes for invoice_lines table: %w", err)
 	}
 	log.Println("Indexes for 'invoice_lines' table checked/created successfully.")
+	if _, err := db.Exec(createIssuerProfilesTableSQL); err != nil {
+		return fmt.Errorf("error creating issuer_profiles table: %w", err)
+	}
+	log.Println("Table 'issuer_profiles' checked/created successfully.")
+	if _, err := db.Exec(createRectifyingInvoicesTablesSQL); err != nil {
+		return fmt.Errorf("error creating rectifying invoice tables: %w", err)
+	}
+	log.Println("Tables 'rectifying_invoices' and 'rectifying_invoice_lines' checked/created successfully.")
+	if _, err := db.Exec(createInvoicePDFsTableSQL); err != nil {
+		return fmt.Errorf("error creating invoice_pdfs table: %w", err)
+	}
+	log.Println("Tables 'invoice_pdfs' and 'rectifying_invoice_pdfs' checked/created successfully.")
+	if _, err := db.Exec(createEmailDeliveriesTableSQL); err != nil {
+		return fmt.Errorf("error creating email_deliveries table: %w", err)
+	}
+	log.Println("Table 'email_deliveries' checked/created successfully.")
+	if _, err := db.Exec(createWebhooksTablesSQL); err != nil {
+		return fmt.Errorf("error creating webhook tables: %w", err)
+	}
+	log.Println("Webhook tables checked/created successfully.")
+	if _, err := db.Exec(createFiscalRecordsTableSQL); err != nil {
+		return fmt.Errorf("error creating fiscal_records table: %w", err)
+	}
+	log.Println("Table 'fiscal_records' checked/created successfully.")
+	if _, err := db.Exec(createInvoiceEventsTableSQL); err != nil {
+		return fmt.Errorf("error creating invoice_events table: %w", err)
+	}
+	log.Println("Table 'invoice_events' checked/created successfully.")
+	if _, err := db.Exec(createFiscalProfilesTablesSQL); err != nil {
+		return fmt.Errorf("error creating fiscal profile tables: %w", err)
+	}
+	log.Println("Tables 'fiscal_profiles' and 'fiscal_profile_codes' checked/created successfully.")
+	if _, err := db.Exec(createDataSubjectTablesSQL); err != nil {
+		return fmt.Errorf("error creating data_subject_requests table: %w", err)
+	}
+	log.Println("Table 'data_subject_requests' checked/created successfully.")
+	if _, err := db.Exec(createSIITablesSQL); err != nil {
+		return fmt.Errorf("error creating SII tables: %w", err)
+	}
+	log.Println("Tables 'sii_batches' and 'sii_submissions' checked/created successfully.")
+	if _, err := db.Exec(createAccountMappingsTableSQL); err != nil {
+		return fmt.Errorf("error creating account_mappings table: %w", err)
+	}
+	log.Println("Table 'account_mappings' checked/created successfully.")
+	// Last: the archive tables copy the columns of the working ones
+	if _, err := db.Exec(createArchiveTablesSQL); err != nil {
+		return fmt.Errorf("error creating archive tables: %w", err)
+	}
+	if _, err := db.Exec(createTenantIndexesSQL); err != nil {
+		return fmt.Errorf("error creating tenant indexes: %w", err)
+	}
+	log.Println("Tenant columns and indexes checked/created successfully.")
+	if err := syncArchiveColumns(db); err != nil {
+		return err
+	}
+	log.Println("Tables 'invoices_archive' and 'invoice_lines_archive' checked/created successfully.")
 	log.Println("Database schema creation process completed.")
 	return nil
 }
@@ -168,7 +313,9 @@ func parseDateTime(dateStrP *string, timeStrP *string) (sql.NullTime, error) {
 	return sql.NullTime{Time: parsedTime, Valid: true}, nil
 }
 
-func insertInvoiceHeader(tx *sql.Tx, header dto.InvoiceHeaderDTO) error {
+// insertInvoiceHeader inserts an invoice header of a tenant and reports whether it was
+// new: an invoice sent again by the synchronizer is left as it is.
+func insertInvoiceHeader(tx *sql.Tx, tenantID int, header dto.InvoiceHeaderDTO) (bool, error) {
 	fecha, _ := parseDateTime(header.Fecha, header.Hora)
 	fechaDeFactura, _ := parseDateTime(header.FechaDeFactura, header.HoraDeFactura)
 	stmt := `
@@ -178,37 +325,50 @@ INSERT INTO invoices (
     serie, cliente1, cliente2, cliente3, cliente4, revisable, impresa, cobro_mixto, efectivo_mixto,
     tipo_cobro_mixto, tipo_cobro_mixto2, comensales, codigo_de_factura, fecha_de_factura,
     hora_de_factura, cobro_mixto2, base4, base5, base6, iva4, iva5, iva6,
-    cuota_iva4, cuota_iva5, cuota_iva6
+    cuota_iva4, cuota_iva5, cuota_iva6, validation_status,
+    recargo1, recargo2, recargo3, recargo4, recargo5, recargo6,
+    cuota_recargo1, cuota_recargo2, cuota_recargo3, cuota_recargo4, cuota_recargo5, cuota_recargo6,
+    causa_exencion, tenant_id, validation_report
 ) VALUES (
     $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20,
     $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40,
-    $41, $42, $43, $44, $45, $46
-) ON CONFLICT (codigo) DO NOTHING;`
-	_, err := tx.Exec(stmt,
+    $41, $42, $43, $44, $45, $46, $47, $48, $49, $50, $51, $52, $53, $54, $55, $56, $57, $58, $59, $60,
+    $61, $62, $63
+) ON CONFLICT (tenant_id, codigo, fecha) DO NOTHING;`
+	result, err := tx.Exec(stmt,
 		header.Codigo, header.Cuenta, fecha, fecha, header.Total, header.TipoCobro, header.Vendedor, header.CuotaIVA, header.Abonado, header.Terminal,
 		header.Traspasada, header.Tarifa, header.Base1, header.Base2, header.Base3, header.Iva1, header.Iva2, header.Iva3, header.CuotaIva1, header.CuotaIva2, header.CuotaIva3,
 		header.Serie, header.Cliente1, header.Cliente2, header.Cliente3, header.Cliente4, header.Revisable, header.Impresa, header.CobroMixto, header.EfectivoMixto,
 		header.TipoCobroMixto, header.TipoCobroMixto2, header.Comensales, header.CodigoDeFactura, fechaDeFactura,
 		fechaDeFactura, header.CobroMixto2, header.Base4, header.Base5, header.Base6, header.Iva4, header.Iva5, header.Iva6,
-		header.CuotaIva4, header.CuotaIva5, header.CuotaIva6,
+		header.CuotaIva4, header.CuotaIva5, header.CuotaIva6, header.ValidationStatus,
+		header.Recargo1, header.Recargo2, header.Recargo3, header.Recargo4, header.Recargo5, header.Recargo6,
+		header.CuotaRecargo1, header.CuotaRecargo2, header.CuotaRecargo3, header.CuotaRecargo4, header.CuotaRecargo5, header.CuotaRecargo6,
+		header.CausaExencion, tenantID, nullableRawJSON(header.ValidationReport),
 	)
 	if err != nil {
-		return fmt.Errorf("error inserting invoice header (codigo %d): %w", header.Codigo, err)
+		return false, fmt.Errorf("error inserting invoice header (codigo %d): %w", header.Codigo, err)
 	}
-	return nil
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error fetching rows affected for invoice header (codigo %d): %w", header.Codigo, err)
+	}
+	return inserted > 0, nil
 }
 
-func insertInvoiceLine(tx *sql.Tx, line dto.InvoiceLineDTO, headerCodigo int) error {
+// insertInvoiceLine inserts a line of the invoice headerCodigo of a tenant, whose fecha
+// is headerFecha.
+func insertInvoiceLine(tx *sql.Tx, tenantID int, line dto.InvoiceLineDTO, headerCodigo int, headerFecha time.Time) error {
 	stmt := `
 INSERT INTO invoice_lines (
     codigo_factura, unidades_old, subtotal, codigo_producto, producto, iva_aplicado,
-    linea, unidades, combinado_con, liga_siguiente, serie
+    linea, unidades, combinado_con, liga_siguiente, serie, fecha_factura, tenant_id
 ) VALUES (
-    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
-) ON CONFLICT (codigo_factura, producto, linea) DO NOTHING;`
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
+) ON CONFLICT (tenant_id, codigo_factura, fecha_factura, producto, linea) DO NOTHING;`
 	_, err := tx.Exec(stmt,
 		headerCodigo, line.UnidadesOld, line.Subtotal, line.CodigoProducto, line.Producto, line.IvaAplicado,
-		line.Linea, line.Unidades, line.CombinadoCon, line.LigaSiguiente, line.Serie,
+		line.Linea, line.Unidades, line.CombinadoCon, line.LigaSiguiente, line.Serie, headerFecha, tenantID,
 	)
 	if err != nil {
 		return fmt.Errorf("error inserting invoice line (header_codigo %d, producto %s, linea %d): %w", headerCodigo, line.Producto, line.Linea, err)
@@ -216,10 +376,19 @@ INSERT INTO invoice_lines (
 	return nil
 }
 
-func CreateFullInvoice(db *sql.DB, fullInvoice dto.FullInvoiceDTO) error {
+// CreateFullInvoice stores an invoice of a tenant received from the synchronizer with its
+// lines, and reports whether it was new: an invoice sent again is left as it is. It
+// returns ErrInvoiceDateMissing when the invoice has no valid fecha.
+func CreateFullInvoice(db *sql.DB, tenantID int, fullInvoice dto.FullInvoiceDTO, actor dto.ActorDTO) (inserted bool, err error) {
+	fecha, _ := parseDateTime(fullInvoice.Header.Fecha, fullInvoice.Header.Hora)
+	if !fecha.Valid {
+		return false, ErrInvoiceDateMissing
+	}
+	ensureInvoicePartition(db, fecha.Time)
+
 	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("error starting database transaction: %w", err)
+		return false, fmt.Errorf("error starting database transaction: %w", err)
 	}
 	defer func() {
 		if p := recover(); p != nil {
@@ -232,20 +401,61 @@ func CreateFullInvoice(db *sql.DB, fullInvoice dto.FullInvoiceDTO) error {
 			err = tx.Commit()
 			if err != nil {
 				log.Printf("Error committing transaction: %v", err)
+				inserted = false
 			} else {
 				log.Printf("Transaction committed successfully for invoice %d.", fullInvoice.Header.Codigo)
 			}
 		}
 	}()
-	if err = insertInvoiceHeader(tx, fullInvoice.Header); err != nil {
-		return err
+	// Codigo is unique within the tenant on its own, which the keys of the partitioned
+	// table cannot enforce: stores of the same codigo are serialized, and the first one
+	// wins. An invoice sent again is left as it is, whether it is still in the working
+	// tables or archived already; only its missing lines are added.
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock($1, $2);`, tenantID, fullInvoice.Header.Codigo); err != nil {
+		err = fmt.Errorf("error locking invoice codigo %d: %w", fullInvoice.Header.Codigo, err)
+		return false, err
+	}
+	stored, err := invoiceFecha(tx, tenantID, fullInvoice.Header.Codigo)
+	switch err {
+	case nil:
+		fecha.Time = stored
+	case ErrInvoiceArchived:
+		err = nil
+		return false, nil
+	case ErrInvoiceNotFound:
+		if inserted, err = insertInvoiceHeader(tx, tenantID, fullInvoice.Header); err != nil {
+			return false, err
+		}
+	default:
+		return false, err
 	}
 	for _, line := range fullInvoice.Lines {
-		if err = insertInvoiceLine(tx, line, fullInvoice.Header.Codigo); err != nil {
-			return err
+		if err = insertInvoiceLine(tx, tenantID, line, fullInvoice.Header.Codigo, fecha.Time); err != nil {
+			return false, err
 		}
 	}
-	return nil
+	if !inserted {
+		return false, nil
+	}
+	created := fullInvoice.Header
+	created.Version, created.Estado = 1, dto.InvoiceStatusReceived // The column defaults
+	changes, err := dto.Diff(nil, created)
+	if err != nil {
+		return false, err
+	}
+	err = insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{
+		InvoiceID: fullInvoice.Header.Codigo, EventType: dto.InvoiceEventCreated, Actor: actor,
+		Changes: changes, Details: map[string]interface{}{"lines": len(fullInvoice.Lines)},
+	})
+	return err == nil, err
+}
+
+// nullableRawJSON writes a JSON document to a JSONB column, or NULL when it is empty.
+func nullableRawJSON(raw json.RawMessage) sql.NullString {
+	if len(raw) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(raw), Valid: true}
 }
 
 func NullableString(s *string) sql.NullString {
@@ -282,13 +492,30 @@ func timeToNullTime(t time.Time) sql.NullTime {
     return sql.NullTime{Time: t, Valid: true}
 }
 
-func GetFullInvoiceByID(db *sql.DB, invoiceID int) (dto.FullInvoiceDTO, error) {
+// GetFullInvoiceByID returns an invoice of a tenant with its lines, looking in the
+// archive tables when it is not in the working ones.
+func GetFullInvoiceByID(db *sql.DB, tenantID, invoiceID int) (dto.FullInvoiceDTO, error) {
+	fullInvoice, err := getFullInvoice(db, tenantID, invoiceID, false)
+	if err == ErrInvoiceNotFound {
+		return getFullInvoice(db, tenantID, invoiceID, true)
+	}
+	return fullInvoice, err
+}
+
+func getFullInvoice(db querier, tenantID, invoiceID int, archived bool) (dto.FullInvoiceDTO, error) {
+	invoicesTable, linesTable, archivedAt := "invoices", "invoice_lines", "NULL::timestamptz"
+	if archived {
+		invoicesTable, linesTable, archivedAt = "invoices_archive", "invoice_lines_archive", "archived_at"
+	}
 	var fullInvoice dto.FullInvoiceDTO
 	var header dto.InvoiceHeaderDTO
-	var cuenta, tipoCobro, vendedor, terminal, traspasada, cliente1, cliente2, cliente3, cliente4, revisable, impresa, tipoCobroMixto, tipoCobroMixto2 sql.NullString
-	var fecha, hora, fechaDeFactura, horaDeFactura sql.NullTime
-	var cuotaIVA, abonado, base1, base2, base3, iva1, iva2, iva3, cuotaIva1, cuotaIva2, cuotaIva3, cobroMixto, efectivoMixto, cobroMixto2, base4, base5, base6, iva4, iva5, iva6, cuotaIva4, cuotaIva5, cuotaIva6 sql.NullFloat64
+	var establecimiento string
+	var cuenta, tipoCobro, vendedor, terminal, traspasada, cliente1, cliente2, cliente3, cliente4, revisable, impresa, tipoCobroMixto, tipoCobroMixto2, validationStatus, causaExencion, voidedBy, voidReason sql.NullString
+	var fecha, hora, fechaDeFactura, horaDeFactura, voidedAt, archivedAtTime sql.NullTime
+	var cuotaIVA, abonado, base1, base2, base3, iva1, iva2, iva3, cuotaIva1, cuotaIva2, cuotaIva3, cobroMixto, efectivoMixto, cobroMixto2, base4, base5, base6, iva4, iva5, iva6, cuotaIva4, cuotaIva5, cuotaIva6 money.NullDecimal
+	var recargo1, recargo2, recargo3, recargo4, recargo5, recargo6, cuotaRecargo1, cuotaRecargo2, cuotaRecargo3, cuotaRecargo4, cuotaRecargo5, cuotaRecargo6 money.NullDecimal
 	var comensales, codigoDeFactura sql.NullInt64
+	var validationReport []byte
 	queryHeader := `
 SELECT 
     codigo, cuenta, fecha, hora, total, tipo_cobro, vendedor, cuota_iva, abonado, terminal,
@@ -296,16 +523,24 @@ SELECT
     serie, cliente1, cliente2, cliente3, cliente4, revisable, impresa, cobro_mixto, efectivo_mixto,
     tipo_cobro_mixto, tipo_cobro_mixto2, comensales, codigo_de_factura, fecha_de_factura,
     hora_de_factura, cobro_mixto2, base4, base5, base6, iva4, iva5, iva6,
-    cuota_iva4, cuota_iva5, cuota_iva6
-FROM invoices WHERE codigo = $1;`
-	row := db.QueryRow(queryHeader, invoiceID)
+    cuota_iva4, cuota_iva5, cuota_iva6, validation_status,
+    recargo1, recargo2, recargo3, recargo4, recargo5, recargo6,
+    cuota_recargo1, cuota_recargo2, cuota_recargo3, cuota_recargo4, cuota_recargo5, cuota_recargo6,
+    causa_exencion, version, voided_at, voided_by, void_reason, estado, `+archivedAt+`, validation_report,
+    (SELECT code FROM tenants t WHERE t.id = tenant_id)
+FROM `+invoicesTable+` WHERE tenant_id = $1 AND codigo = $2;`
+	row := db.QueryRow(queryHeader, tenantID, invoiceID)
 	err := row.Scan(
 		&header.Codigo, &cuenta, &fecha, &hora, &header.Total, &tipoCobro, &vendedor, &cuotaIVA, &abonado, &terminal,
 		&traspasada, &header.Tarifa, &base1, &base2, &base3, &iva1, &iva2, &iva3, &cuotaIva1, &cuotaIva2, &cuotaIva3,
 		&header.Serie, &cliente1, &cliente2, &cliente3, &cliente4, &revisable, &impresa, &cobroMixto, &efectivoMixto,
 		&tipoCobroMixto, &tipoCobroMixto2, &comensales, &codigoDeFactura, &fechaDeFactura,
 		&horaDeFactura, &cobroMixto2, &base4, &base5, &base6, &iva4, &iva5, &iva6,
-		&cuotaIva4, &cuotaIva5, &cuotaIva6,
+		&cuotaIva4, &cuotaIva5, &cuotaIva6, &validationStatus,
+		&recargo1, &recargo2, &recargo3, &recargo4, &recargo5, &recargo6,
+		&cuotaRecargo1, &cuotaRecargo2, &cuotaRecargo3, &cuotaRecargo4, &cuotaRecargo5, &cuotaRecargo6,
+		&causaExencion, &header.Version, &voidedAt, &voidedBy, &voidReason, &header.Estado, &archivedAtTime, &validationReport,
+		&establecimiento,
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -318,50 +553,68 @@ FROM invoices WHERE codigo = $1;`
 	if hora.Valid { t := hora.Time.Format("15:04:05"); header.Hora = &t } 
 	if tipoCobro.Valid { header.TipoCobro = &tipoCobro.String }
 	if vendedor.Valid { header.Vendedor = &vendedor.String }
-	if cuotaIVA.Valid { header.CuotaIVA = &cuotaIVA.Float64 }
-	if abonado.Valid { header.Abonado = &abonado.Float64 }
+	if cuotaIVA.Valid { header.CuotaIVA = &cuotaIVA.Decimal }
+	if abonado.Valid { header.Abonado = &abonado.Decimal }
 	if terminal.Valid { header.Terminal = &terminal.String }
 	if traspasada.Valid { header.Traspasada = &traspasada.String }
-	if base1.Valid { header.Base1 = &base1.Float64 }
-	if base2.Valid { header.Base2 = &base2.Float64 }
-	if base3.Valid { header.Base3 = &base3.Float64 }
-	if iva1.Valid { header.Iva1 = &iva1.Float64 }
-	if iva2.Valid { header.Iva2 = &iva2.Float64 }
-	if iva3.Valid { header.Iva3 = &iva3.Float64 }
-	if cuotaIva1.Valid { header.CuotaIva1 = &cuotaIva1.Float64 }
-	if cuotaIva2.Valid { header.CuotaIva2 = &cuotaIva2.Float64 }
-	if cuotaIva3.Valid { header.CuotaIva3 = &cuotaIva3.Float64 }
+	if base1.Valid { header.Base1 = &base1.Decimal }
+	if base2.Valid { header.Base2 = &base2.Decimal }
+	if base3.Valid { header.Base3 = &base3.Decimal }
+	if iva1.Valid { header.Iva1 = &iva1.Decimal }
+	if iva2.Valid { header.Iva2 = &iva2.Decimal }
+	if iva3.Valid { header.Iva3 = &iva3.Decimal }
+	if cuotaIva1.Valid { header.CuotaIva1 = &cuotaIva1.Decimal }
+	if cuotaIva2.Valid { header.CuotaIva2 = &cuotaIva2.Decimal }
+	if cuotaIva3.Valid { header.CuotaIva3 = &cuotaIva3.Decimal }
 	if cliente1.Valid { header.Cliente1 = &cliente1.String }
 	if cliente2.Valid { header.Cliente2 = &cliente2.String }
 	if cliente3.Valid { header.Cliente3 = &cliente3.String }
 	if cliente4.Valid { header.Cliente4 = &cliente4.String }
 	if revisable.Valid { header.Revisable = &revisable.String }
 	if impresa.Valid { header.Impresa = &impresa.String }
-	if cobroMixto.Valid { header.CobroMixto = &cobroMixto.Float64 }
-	if efectivoMixto.Valid { header.EfectivoMixto = &efectivoMixto.Float64 }
+	if cobroMixto.Valid { header.CobroMixto = &cobroMixto.Decimal }
+	if efectivoMixto.Valid { header.EfectivoMixto = &efectivoMixto.Decimal }
 	if tipoCobroMixto.Valid { header.TipoCobroMixto = &tipoCobroMixto.String }
     if tipoCobroMixto2.Valid { header.TipoCobroMixto2 = &tipoCobroMixto2.String }
 	if comensales.Valid { v := int(comensales.Int64); header.Comensales = &v }
 	if codigoDeFactura.Valid { v := int(codigoDeFactura.Int64); header.CodigoDeFactura = &v }
 	if fechaDeFactura.Valid { t := fechaDeFactura.Time.Format("2006-01-02"); header.FechaDeFactura = &t }
 	if horaDeFactura.Valid { t := horaDeFactura.Time.Format("15:04:05"); header.HoraDeFactura = &t }
-	if cobroMixto2.Valid { header.CobroMixto2 = &cobroMixto2.Float64 }
-	if base4.Valid { header.Base4 = &base4.Float64 }
-	if base5.Valid { header.Base5 = &base5.Float64 }
-	if base6.Valid { header.Base6 = &base6.Float64 }
-	if iva4.Valid { header.Iva4 = &iva4.Float64 }
-	if iva5.Valid { header.Iva5 = &iva5.Float64 }
-	if iva6.Valid { header.Iva6 = &iva6.Float64 }
-	if cuotaIva4.Valid { header.CuotaIva4 = &cuotaIva4.Float64 }
-	if cuotaIva5.Valid { header.CuotaIva5 = &cuotaIva5.Float64 }
-	if cuotaIva6.Valid { header.CuotaIva6 = &cuotaIva6.Float64 }
+	if cobroMixto2.Valid { header.CobroMixto2 = &cobroMixto2.Decimal }
+	if base4.Valid { header.Base4 = &base4.Decimal }
+	if base5.Valid { header.Base5 = &base5.Decimal }
+	if base6.Valid { header.Base6 = &base6.Decimal }
+	if iva4.Valid { header.Iva4 = &iva4.Decimal }
+	if iva5.Valid { header.Iva5 = &iva5.Decimal }
+	if iva6.Valid { header.Iva6 = &iva6.Decimal }
+	if cuotaIva4.Valid { header.CuotaIva4 = &cuotaIva4.Decimal }
+	if cuotaIva5.Valid { header.CuotaIva5 = &cuotaIva5.Decimal }
+	if cuotaIva6.Valid { header.CuotaIva6 = &cuotaIva6.Decimal }
+	if validationStatus.Valid { header.ValidationStatus = &validationStatus.String }
+	if validationReport != nil { header.ValidationReport = validationReport }
+	if recargo1.Valid { header.Recargo1 = &recargo1.Decimal }
+	if recargo2.Valid { header.Recargo2 = &recargo2.Decimal }
+	if recargo3.Valid { header.Recargo3 = &recargo3.Decimal }
+	if recargo4.Valid { header.Recargo4 = &recargo4.Decimal }
+	if recargo5.Valid { header.Recargo5 = &recargo5.Decimal }
+	if recargo6.Valid { header.Recargo6 = &recargo6.Decimal }
+	if cuotaRecargo1.Valid { header.CuotaRecargo1 = &cuotaRecargo1.Decimal }
+	if cuotaRecargo2.Valid { header.CuotaRecargo2 = &cuotaRecargo2.Decimal }
+	if cuotaRecargo3.Valid { header.CuotaRecargo3 = &cuotaRecargo3.Decimal }
+	if cuotaRecargo4.Valid { header.CuotaRecargo4 = &cuotaRecargo4.Decimal }
+	if cuotaRecargo5.Valid { header.CuotaRecargo5 = &cuotaRecargo5.Decimal }
+	if cuotaRecargo6.Valid { header.CuotaRecargo6 = &cuotaRecargo6.Decimal }
+	if causaExencion.Valid { header.CausaExencion = &causaExencion.String }
+	if voidedAt.Valid { header.Void = &dto.VoidDTO{VoidedAt: voidedAt.Time, VoidedBy: voidedBy.String, Reason: voidReason.String} }
+	if archivedAtTime.Valid { header.ArchivedAt = &archivedAtTime.Time }
+	header.Establecimiento = &establecimiento
 	fullInvoice.Header = header
 	queryLines := `
 SELECT 
     codigo_factura, unidades_old, subtotal, codigo_producto, producto, iva_aplicado,
     linea, unidades, combinado_con, liga_siguiente, serie
-FROM invoice_lines WHERE codigo_factura = $1 ORDER BY linea ASC;`
-	rowsLines, err := db.Query(queryLines, invoiceID)
+FROM `+linesTable+` WHERE tenant_id = $1 AND codigo_factura = $2 ORDER BY linea ASC;`
+	rowsLines, err := db.Query(queryLines, tenantID, invoiceID)
 	if err != nil {
 		return dto.FullInvoiceDTO{}, fmt.Errorf("error querying invoice lines for id %d: %w", invoiceID, err)
 	}
@@ -370,7 +623,7 @@ FROM invoice_lines WHERE codigo_factura = $1 ORDER BY linea ASC;`
 	for rowsLines.Next() {
 		var line dto.InvoiceLineDTO
 		var unidadesOld sql.NullInt16
-		var subtotal, ivaAplicado, unidades sql.NullFloat64
+		var subtotal, ivaAplicado, unidades money.NullDecimal
 		var codigoProducto, combinadoCon, ligaSiguiente, serie sql.NullString
 		err := rowsLines.Scan(
 			&line.CodigoFactura, &unidadesOld, &subtotal, &codigoProducto, &line.Producto, &ivaAplicado,
@@ -380,10 +633,10 @@ FROM invoice_lines WHERE codigo_factura = $1 ORDER BY linea ASC;`
 			return dto.FullInvoiceDTO{}, fmt.Errorf("error scanning invoice line for id %d: %w", invoiceID, err)
 		}
 		if unidadesOld.Valid { v:= int16(unidadesOld.Int16); line.UnidadesOld = &v}
-		if subtotal.Valid { line.Subtotal = subtotal.Float64 } 
+		if subtotal.Valid { line.Subtotal = subtotal.Decimal } 
 		if codigoProducto.Valid { line.CodigoProducto = &codigoProducto.String }
-		if ivaAplicado.Valid { line.IvaAplicado = &ivaAplicado.Float64 }
-		if unidades.Valid { line.Unidades = unidades.Float64 } 
+		if ivaAplicado.Valid { line.IvaAplicado = &ivaAplicado.Decimal }
+		if unidades.Valid { line.Unidades = unidades.Decimal } 
 		if combinadoCon.Valid { line.CombinadoCon = combinadoCon.String } 
 		if ligaSiguiente.Valid { line.LigaSiguiente = &ligaSiguiente.String }
 		if serie.Valid { line.Serie = &serie.String }
@@ -396,39 +649,185 @@ FROM invoice_lines WHERE codigo_factura = $1 ORDER BY linea ASC;`
 	return fullInvoice, nil
 }
 
-// UpdateInvoiceFiscalData updates the fiscal information for a specific invoice.
-// It maps FiscalDataDTO fields to cliente1, cliente2, cliente3, and cliente4.
-func UpdateInvoiceFiscalData(db *sql.DB, invoiceID int, fiscalData dto.FiscalDataDTO) error {
+// UpdateInvoiceFiscalData replaces the fiscal information of an invoice, and returns
+// its new data version. It maps FiscalDataDTO fields to cliente1, cliente2, cliente3,
+// and cliente4, records the change, with its previous values, in the invoice's audit
+// trail, and keeps the data as the customer's fiscal profile (see saveFiscalProfile).
+// Unless ifVersion is 0, it returns ErrVersionMismatch when the invoice is no longer at
+// that version. Archived invoices cannot change: ErrInvoiceArchived is returned for them.
+func UpdateInvoiceFiscalData(db *sql.DB, tenantID, invoiceID int, fiscalData dto.FiscalDataDTO, ifVersion int, actor dto.ActorDTO) (int, error) {
+	return updateFiscalData(db, tenantID, invoiceID, ifVersion, actor, func(dto.FiscalDataDTO) dto.FiscalDataDTO { return fiscalData })
+}
+
+// PatchInvoiceFiscalData applies a merge patch to the fiscal information of an invoice,
+// under the same rules as UpdateInvoiceFiscalData.
+func PatchInvoiceFiscalData(db *sql.DB, tenantID, invoiceID int, patch dto.FiscalDataPatchDTO, ifVersion int, actor dto.ActorDTO) (int, error) {
+	return updateFiscalData(db, tenantID, invoiceID, ifVersion, actor, patch.Apply)
+}
+
+// updateFiscalData writes the fiscal data that change returns for the current data,
+// which is read with the invoice row locked.
+func updateFiscalData(db *sql.DB, tenantID, invoiceID, ifVersion int, actor dto.ActorDTO, change func(dto.FiscalDataDTO) dto.FiscalDataDTO) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var before dto.FiscalDataDTO
+	var cliente1, cliente2, cliente3, cliente4 sql.NullString
+	var status string
+	var version int
+	err = tx.QueryRow(`
+SELECT cliente1, cliente2, cliente3, cliente4, estado, version FROM invoices WHERE tenant_id = $1 AND codigo = $2 FOR UPDATE;`,
+		tenantID, invoiceID,
+	).Scan(&cliente1, &cliente2, &cliente3, &cliente4, &status, &version)
+	if err == sql.ErrNoRows {
+		return 0, missingInvoice(tx, tenantID, invoiceID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying invoice id %d: %w", invoiceID, err)
+	}
+	// Once issued, the data is final: a change needs a rectifying invoice
+	if err := checkTransition(invoiceID, status, dto.InvoiceStatusFiscalDataPending); err != nil {
+		return 0, err
+	}
+	if ifVersion != 0 && ifVersion != version {
+		return 0, fmt.Errorf("%w: invoice %d is at version %d, not %d", ErrVersionMismatch, invoiceID, version, ifVersion)
+	}
+	if cliente1.Valid { before.ClienteNombre = &cliente1.String }
+	if cliente2.Valid { before.ClienteDireccion = &cliente2.String }
+	if cliente3.Valid { before.ClienteNIF = &cliente3.String }
+	if cliente4.Valid { before.ClienteEmail = &cliente4.String }
+	fiscalData := change(before)
+
 	stmt := `
 UPDATE invoices 
 SET 
     cliente1 = $1, 
     cliente2 = $2, 
     cliente3 = $3, 
-    cliente4 = $4
-WHERE codigo = $5;`
+    cliente4 = $4,
+    version = version + 1,
+    estado = $6
+WHERE tenant_id = $7 AND codigo = $5
+RETURNING version;`
 
-	result, err := db.Exec(stmt,
+	err = tx.QueryRow(stmt,
 		NullableString(fiscalData.ClienteNombre),
 		NullableString(fiscalData.ClienteDireccion),
 		NullableString(fiscalData.ClienteNIF),
 		NullableString(fiscalData.ClienteEmail),
 		invoiceID,
-	)
+		dto.InvoiceStatusFiscalDataPending,
+		tenantID,
+	).Scan(&version)
 	if err != nil {
-		return fmt.Errorf("error executing update for invoice id %d: %w", invoiceID, err)
+		return 0, fmt.Errorf("error executing update for invoice id %d: %w", invoiceID, err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	changes, err := dto.Diff(before, fiscalData)
 	if err != nil {
-		// This error is less common for UPDATE unless there's a driver issue or connection problem
-		return fmt.Errorf("error fetching rows affected for invoice id %d: %w", invoiceID, err)
+		return 0, fmt.Errorf("error computing changes for invoice id %d: %w", invoiceID, err)
+	}
+	changes = addStatusChange(changes, status, dto.InvoiceStatusFiscalDataPending)
+	if err := saveFiscalProfile(tx, tenantID, fiscalData); err != nil {
+		return 0, err
 	}
+	err = insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{InvoiceID: invoiceID, EventType: dto.InvoiceEventFiscalDataUpdated, Actor: actor, Changes: changes})
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing update of invoice id %d: %w", invoiceID, err)
+	}
+
+	log.Printf("Successfully updated fiscal data for invoice ID %d (version %d).", invoiceID, version)
+	return version, nil
+}
 
-	if rowsAffected == 0 {
-		return ErrInvoiceNotFound // No rows updated means invoice with that ID was not found
+// GetInvoiceVersion returns the data version of an invoice of a tenant, archived or not,
+// without loading it. A voided invoice has no current version: ErrInvoiceVoided is
+// returned for it.
+func GetInvoiceVersion(db *sql.DB, tenantID, invoiceID int) (int, error) {
+	var version int
+	var voided bool
+	err := db.QueryRow(`
+SELECT version, estado = 'voided' FROM invoices WHERE tenant_id = $1 AND codigo = $2
+UNION ALL
+SELECT version, estado = 'voided' FROM invoices_archive WHERE tenant_id = $1 AND codigo = $2;`, tenantID, invoiceID).Scan(&version, &voided)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvoiceNotFound
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying version of invoice id %d: %w", invoiceID, err)
 	}
+	if voided {
+		return 0, ErrInvoiceVoided
+	}
+	return version, nil
+}
 
-	log.Printf("Successfully updated fiscal data for invoice ID %d. Rows affected: %d", invoiceID, rowsAffected)
-	return nil
+// VoidInvoice marks an invoice as voided by actor and chains its cancellation record, in
+// a single transaction. Invoices never issued have no issue record to cancel, and get
+// no cancellation record either. It returns ErrInvoiceNotFound, ErrInvoiceArchived, or
+// ErrInvoiceVoided when the invoice was voided already.
+func VoidInvoice(db *sql.DB, tenantID, invoiceID int, reason string, actor dto.ActorDTO) (dto.VoidDTO, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return dto.VoidDTO{}, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The fields the cancellation record and the issuer lookup need
+	header := dto.InvoiceHeaderDTO{Codigo: invoiceID}
+	var fecha sql.NullTime
+	var terminal sql.NullString
+	var status string
+	err = tx.QueryRow(`
+SELECT serie, fecha, terminal, estado FROM invoices WHERE tenant_id = $1 AND codigo = $2 FOR UPDATE;`,
+		tenantID, invoiceID,
+	).Scan(&header.Serie, &fecha, &terminal, &status)
+	if err == sql.ErrNoRows {
+		return dto.VoidDTO{}, missingInvoice(tx, tenantID, invoiceID)
+	}
+	if err != nil {
+		return dto.VoidDTO{}, fmt.Errorf("error querying invoice id %d: %w", invoiceID, err)
+	}
+	if err := checkTransition(invoiceID, status, dto.InvoiceStatusVoided); err != nil {
+		return dto.VoidDTO{}, err
+	}
+	if fecha.Valid { t := fecha.Time.Format("2006-01-02"); header.Fecha = &t }
+	if terminal.Valid { header.Terminal = &terminal.String }
+
+	v := dto.VoidDTO{VoidedBy: actor.String(), Reason: reason}
+	err = tx.QueryRow(`
+UPDATE invoices SET voided_at = NOW(), voided_by = $2, void_reason = $3, estado = $4 WHERE tenant_id = $5 AND codigo = $1
+RETURNING voided_at;`, invoiceID, v.VoidedBy, reason, dto.InvoiceStatusVoided, tenantID).Scan(&v.VoidedAt)
+	if err != nil {
+		return dto.VoidDTO{}, fmt.Errorf("error voiding invoice id %d: %w", invoiceID, err)
+	}
+	chained, err := hasIssueRecord(tx, tenantID, invoiceID)
+	if err != nil {
+		return dto.VoidDTO{}, err
+	}
+	if chained {
+		if err := appendInvoiceFiscalRecord(tx, tenantID, header, dto.NewCancellationRecord); err != nil {
+			return dto.VoidDTO{}, err
+		}
+	}
+	changes, err := dto.Diff(map[string]interface{}{"void": nil}, map[string]interface{}{"void": v})
+	if err != nil {
+		return dto.VoidDTO{}, err
+	}
+	changes = addStatusChange(changes, status, dto.InvoiceStatusVoided)
+	err = insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{InvoiceID: invoiceID, EventType: dto.InvoiceEventVoided, Actor: actor, Changes: changes})
+	if err != nil {
+		return dto.VoidDTO{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return dto.VoidDTO{}, fmt.Errorf("error committing void of invoice id %d: %w", invoiceID, err)
+	}
+	log.Printf("Invoice %d voided by %s.", invoiceID, v.VoidedBy)
+	return v, nil
 }
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"database/sql"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The tests of this package run against the PostgreSQL database in
+// FACTURAPID_TEST_DATABASE_URL, and are skipped without one. Each test works in a
+// tenant of its own, so they neither see nor clean up each other's rows.
+
+// testDB connects to the test database and creates the schema, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	db, err := InitDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testTenant creates a tenant for one test.
+func testTenant(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	tenant, err := CreateTenant(db, dto.TenantDTO{Code: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tenant.ID
+}
+
+func strPtr(s string) *string { return &s }
+
+func decPtr(s string) *money.Decimal {
+	d := money.MustParse(s)
+	return &d
+}
+
+// testInvoice returns a ticket of serie A dated fecha (YYYY-MM-DD) with one line of
+// base at 21%.
+func testInvoice(codigo int, fecha, base string) dto.FullInvoiceDTO {
+	b := money.MustParse(base)
+	quota := money.VATQuota(b, money.MustParse("21"))
+	return dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: codigo, Serie: "A", Tarifa: "1", Fecha: strPtr(fecha), Hora: strPtr("12:00:00"),
+			Base1: &b, Iva1: decPtr("21"), CuotaIva1: &quota, CuotaIVA: &quota, Total: b.Add(quota),
+			TipoCobro: strPtr("EFECTIVO"),
+		},
+		Lines: []dto.InvoiceLineDTO{{CodigoFactura: codigo, Linea: 1, Producto: "Menú del día", Unidades: money.One, Subtotal: b, IvaAplicado: decPtr("21")}},
+	}
+}
+
+// createInvoices stores invoices of a tenant as the synchronizer would.
+func createInvoices(t *testing.T, db *sql.DB, tenantID int, invoices ...dto.FullInvoiceDTO) {
+	t.Helper()
+	for _, inv := range invoices {
+		if _, err := CreateFullInvoice(db, tenantID, inv, dto.SystemActor("test")); err != nil {
+			t.Fatalf("CreateFullInvoice(%d): %v", inv.Header.Codigo, err)
+		}
+	}
+}
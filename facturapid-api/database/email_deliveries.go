@@ -0,0 +1,163 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	createEmailDeliveriesTableSQL = `
+CREATE TABLE IF NOT EXISTS email_deliveries (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    invoice_codigo INTEGER NOT NULL,
+    invoice_fecha TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    recipient VARCHAR(254) NOT NULL,
+    language VARCHAR(2) NOT NULL,
+    status VARCHAR(10) NOT NULL DEFAULT 'pending', -- pending, sent, failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_error TEXT,
+    pdf_sha256 CHAR(64),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    sent_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (tenant_id, invoice_codigo, invoice_fecha) REFERENCES invoices(tenant_id, codigo, fecha) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_email_deliveries_invoice ON email_deliveries (invoice_codigo);
+CREATE INDEX IF NOT EXISTS idx_email_deliveries_due ON email_deliveries (next_attempt_at) WHERE status = 'pending';
+`
+
+	emailDeliveryColumns = `
+    id, tenant_id, invoice_codigo, recipient, language, status, attempts, next_attempt_at,
+    last_error, pdf_sha256, created_at, sent_at`
+)
+
+func scanEmailDelivery(row scanner) (dto.EmailDeliveryDTO, error) {
+	var d dto.EmailDeliveryDTO
+	var nextAttemptAt time.Time
+	var lastError, pdfSHA256 sql.NullString
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&d.ID, &d.TenantID, &d.InvoiceID, &d.Recipient, &d.Language, &d.Status, &d.Attempts, &nextAttemptAt,
+		&lastError, &pdfSHA256, &d.CreatedAt, &sentAt,
+	)
+	if err != nil {
+		return dto.EmailDeliveryDTO{}, err
+	}
+	if d.Status == dto.EmailStatusPending { d.NextAttemptAt = &nextAttemptAt }
+	if lastError.Valid { d.LastError = &lastError.String }
+	if pdfSHA256.Valid { d.PDFSHA256 = &pdfSHA256.String }
+	if sentAt.Valid { d.SentAt = &sentAt.Time }
+	return d, nil
+}
+
+// EnqueueEmailDelivery queues the PDF of an invoice of a tenant to be emailed to
+// recipient.
+func EnqueueEmailDelivery(db *sql.DB, tenantID, invoiceID int, recipient, language string) (dto.EmailDeliveryDTO, error) {
+	fecha, err := invoiceFecha(db, tenantID, invoiceID)
+	if err != nil {
+		return dto.EmailDeliveryDTO{}, err
+	}
+	d, err := scanEmailDelivery(db.QueryRow(`
+INSERT INTO email_deliveries (tenant_id, invoice_codigo, invoice_fecha, recipient, language)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING`+emailDeliveryColumns+`;`,
+		tenantID, invoiceID, fecha, recipient, language,
+	))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return dto.EmailDeliveryDTO{}, missingInvoice(db, tenantID, invoiceID)
+		}
+		return dto.EmailDeliveryDTO{}, fmt.Errorf("error queueing email for invoice id %d: %w", invoiceID, err)
+	}
+	return d, nil
+}
+
+// ClaimDueEmailDeliveries returns up to limit pending deliveries whose next attempt is
+// due, counting the attempt. Claimed deliveries are pushed lease into the future, so
+// other workers skip them while they are being sent; a worker that dies mid-send
+// leaves them to be retried once the lease expires.
+func ClaimDueEmailDeliveries(db *sql.DB, limit int, lease time.Duration) ([]dto.EmailDeliveryDTO, error) {
+	rows, err := db.Query(`
+UPDATE email_deliveries
+SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+WHERE id IN (
+    SELECT id FROM email_deliveries
+    WHERE status = 'pending' AND next_attempt_at <= NOW()
+    ORDER BY next_attempt_at
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING`+emailDeliveryColumns+`;`,
+		limit, lease.Seconds(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error claiming due emails: %w", err)
+	}
+	defer rows.Close()
+	var deliveries []dto.EmailDeliveryDTO
+	for rows.Next() {
+		d, err := scanEmailDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning email delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating email deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// MarkEmailDeliverySent records a successful delivery and the digest of the PDF sent.
+func MarkEmailDeliverySent(db *sql.DB, id int, pdfSHA256 string) error {
+	_, err := db.Exec(`
+UPDATE email_deliveries SET status = 'sent', sent_at = NOW(), last_error = NULL, pdf_sha256 = $2
+WHERE id = $1;`, id, pdfSHA256)
+	if err != nil {
+		return fmt.Errorf("error marking email delivery %d as sent: %w", id, err)
+	}
+	return nil
+}
+
+// MarkEmailDeliveryFailed records a failed attempt. The delivery is retried at retryAt,
+// or marked as failed for good when retryAt is nil.
+func MarkEmailDeliveryFailed(db *sql.DB, id int, cause string, retryAt *time.Time) error {
+	var err error
+	if retryAt != nil {
+		_, err = db.Exec(`UPDATE email_deliveries SET last_error = $2, next_attempt_at = $3 WHERE id = $1;`, id, cause, *retryAt)
+	} else {
+		_, err = db.Exec(`UPDATE email_deliveries SET status = 'failed', last_error = $2 WHERE id = $1;`, id, cause)
+	}
+	if err != nil {
+		return fmt.Errorf("error recording failure of email delivery %d: %w", id, err)
+	}
+	return nil
+}
+
+// ListEmailDeliveries returns the deliveries of an invoice of a tenant, newest first.
+func ListEmailDeliveries(db *sql.DB, tenantID, invoiceID int) ([]dto.EmailDeliveryDTO, error) {
+	rows, err := db.Query(`SELECT`+emailDeliveryColumns+` FROM email_deliveries WHERE tenant_id = $1 AND invoice_codigo = $2 ORDER BY id DESC;`, tenantID, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing email deliveries for invoice id %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+	deliveries := []dto.EmailDeliveryDTO{}
+	for rows.Next() {
+		d, err := scanEmailDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning email delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating email deliveries: %w", err)
+	}
+	return deliveries, nil
+}
@@ -0,0 +1,232 @@
+package database
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrFiscalProfileNotFound is returned when no fiscal profile exists for a NIF.
+var ErrFiscalProfileNotFound = errors.New("fiscal profile not found")
+
+// ErrFiscalProfileCodeInvalid is returned when a one-time code is wrong, expired,
+// already used or out of attempts. The cases are not told apart.
+var ErrFiscalProfileCodeInvalid = errors.New("invalid or expired fiscal profile code")
+
+// ErrTooManyFiscalProfileCodes is returned when too many codes were requested for a
+// NIF recently.
+var ErrTooManyFiscalProfileCodes = errors.New("too many fiscal profile codes requested")
+
+const (
+	// fiscalProfileCodeAttempts is how many wrong guesses a code survives.
+	fiscalProfileCodeAttempts = 5
+	// fiscalProfileCodesPerHour limits the codes requested for a NIF, so a profile's
+	// owner cannot be flooded with emails.
+	fiscalProfileCodesPerHour = 5
+)
+
+const (
+	// Codes are stored as hashes, and stored even for NIFs without a profile so that
+	// requests look the same whether or not a profile exists.
+	createFiscalProfilesTablesSQL = `
+CREATE TABLE IF NOT EXISTS fiscal_profiles (
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    nif VARCHAR(30) NOT NULL, -- Normalized: upper case, no separators
+    nombre VARCHAR(30),
+    direccion VARCHAR(30),
+    email VARCHAR(30) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, nif)
+);
+CREATE TABLE IF NOT EXISTS fiscal_profile_codes (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL,
+    nif VARCHAR(30) NOT NULL,
+    invoice_codigo INTEGER NOT NULL,
+    invoice_fecha TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    code_hash CHAR(64) NOT NULL, -- SHA-256 of NIF:code
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    FOREIGN KEY (tenant_id, invoice_codigo, invoice_fecha) REFERENCES invoices(tenant_id, codigo, fecha) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_fiscal_profile_codes_nif ON fiscal_profile_codes (nif, created_at);
+`
+
+	fiscalProfileColumns = `
+    nif, nombre, direccion, email, created_at, updated_at`
+)
+
+func scanFiscalProfile(row scanner) (dto.FiscalProfileDTO, error) {
+	var p dto.FiscalProfileDTO
+	var nombre, direccion sql.NullString
+	err := row.Scan(&p.NIF, &nombre, &direccion, &p.Email, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return dto.FiscalProfileDTO{}, err
+	}
+	if nombre.Valid { p.Nombre = &nombre.String }
+	if direccion.Valid { p.Direccion = &direccion.String }
+	return p, nil
+}
+
+// saveFiscalProfile keeps the fiscal data of an invoice as the profile of its NIF in the
+// tenant, when it has both a NIF and an email address. A new profile is created; an
+// existing one is only updated when the email address matches, so whoever types
+// someone else's NIF cannot take over their profile.
+func saveFiscalProfile(ex execer, tenantID int, data dto.FiscalDataDTO) error {
+	if data.ClienteNIF == nil || data.ClienteEmail == nil || *data.ClienteEmail == "" {
+		return nil
+	}
+	nif := dto.NormalizeNIF(*data.ClienteNIF)
+	if nif == "" {
+		return nil
+	}
+	_, err := ex.Exec(`
+INSERT INTO fiscal_profiles (tenant_id, nif, nombre, direccion, email) VALUES ($5, $1, $2, $3, $4)
+ON CONFLICT (tenant_id, nif) DO UPDATE SET nombre = EXCLUDED.nombre, direccion = EXCLUDED.direccion, updated_at = NOW()
+WHERE LOWER(fiscal_profiles.email) = LOWER(EXCLUDED.email);`,
+		nif, NullableString(data.ClienteNombre), NullableString(data.ClienteDireccion), *data.ClienteEmail, tenantID,
+	)
+	if err != nil {
+		return fmt.Errorf("error saving fiscal profile: %w", err)
+	}
+	return nil
+}
+
+// GetFiscalProfile returns the fiscal profile of a NIF, in any format, in a tenant.
+func GetFiscalProfile(db *sql.DB, tenantID int, nif string) (dto.FiscalProfileDTO, error) {
+	p, err := scanFiscalProfile(db.QueryRow(`SELECT`+fiscalProfileColumns+` FROM fiscal_profiles WHERE tenant_id = $1 AND nif = $2;`, tenantID, dto.NormalizeNIF(nif)))
+	if err == sql.ErrNoRows {
+		return dto.FiscalProfileDTO{}, ErrFiscalProfileNotFound
+	}
+	if err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error querying fiscal profile: %w", err)
+	}
+	return p, nil
+}
+
+func fiscalProfileCodeHash(nif, code string) string {
+	sum := sha256.Sum256([]byte(nif + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateFiscalProfileCode stores a one-time code for prefilling the fiscal data of an
+// invoice of a tenant from the profile of nif, valid for ttl. It returns
+// ErrInvoiceNotFound, ErrInvoiceArchived and ErrTooManyFiscalProfileCodes.
+func CreateFiscalProfileCode(db *sql.DB, tenantID int, nif string, invoiceID int, code string, ttl time.Duration) error {
+	nif = dto.NormalizeNIF(nif)
+	fecha, err := invoiceFecha(db, tenantID, invoiceID)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec(`
+INSERT INTO fiscal_profile_codes (tenant_id, nif, invoice_codigo, invoice_fecha, code_hash, expires_at)
+SELECT $7, $1, $2, $6, $3, NOW() + $4 * INTERVAL '1 second'
+WHERE (SELECT COUNT(*) FROM fiscal_profile_codes WHERE tenant_id = $7 AND nif = $1 AND created_at > NOW() - INTERVAL '1 hour') < $5;`,
+		nif, invoiceID, fiscalProfileCodeHash(nif, code), int64(ttl/time.Second), fiscalProfileCodesPerHour, fecha, tenantID,
+	)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return missingInvoice(db, tenantID, invoiceID)
+		}
+		return fmt.Errorf("error storing fiscal profile code: %w", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error fetching rows affected for fiscal profile code: %w", err)
+	} else if n == 0 {
+		return ErrTooManyFiscalProfileCodes
+	}
+	return nil
+}
+
+// VerifyFiscalProfileCode checks the latest code sent for nif and invoiceID in a tenant
+// and, if it is right, uses it up and returns the profile. A wrong guess counts against
+// the code's attempts. It returns ErrFiscalProfileCodeInvalid.
+func VerifyFiscalProfileCode(db *sql.DB, tenantID int, nif string, invoiceID int, code string) (dto.FiscalProfileDTO, error) {
+	nif = dto.NormalizeNIF(nif)
+	tx, err := db.Begin()
+	if err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var codeHash string
+	var attempts int
+	err = tx.QueryRow(`
+SELECT id, code_hash, attempts FROM fiscal_profile_codes
+WHERE tenant_id = $3 AND nif = $1 AND invoice_codigo = $2 AND used_at IS NULL AND expires_at > NOW()
+ORDER BY id DESC LIMIT 1 FOR UPDATE;`, nif, invoiceID, tenantID,
+	).Scan(&id, &codeHash, &attempts)
+	if err == sql.ErrNoRows {
+		return dto.FiscalProfileDTO{}, ErrFiscalProfileCodeInvalid
+	}
+	if err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error querying fiscal profile code: %w", err)
+	}
+	if attempts >= fiscalProfileCodeAttempts {
+		return dto.FiscalProfileDTO{}, ErrFiscalProfileCodeInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(codeHash)), []byte(fiscalProfileCodeHash(nif, code))) != 1 {
+		if _, err := tx.Exec(`UPDATE fiscal_profile_codes SET attempts = attempts + 1 WHERE id = $1;`, id); err != nil {
+			return dto.FiscalProfileDTO{}, fmt.Errorf("error counting fiscal profile code attempt: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return dto.FiscalProfileDTO{}, fmt.Errorf("error committing fiscal profile code attempt: %w", err)
+		}
+		return dto.FiscalProfileDTO{}, ErrFiscalProfileCodeInvalid
+	}
+
+	if _, err := tx.Exec(`UPDATE fiscal_profile_codes SET used_at = NOW() WHERE id = $1;`, id); err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error using fiscal profile code: %w", err)
+	}
+	p, err := scanFiscalProfile(tx.QueryRow(`SELECT`+fiscalProfileColumns+` FROM fiscal_profiles WHERE tenant_id = $1 AND nif = $2;`, tenantID, nif))
+	if err == sql.ErrNoRows {
+		return dto.FiscalProfileDTO{}, ErrFiscalProfileCodeInvalid // No email was sent: the code cannot be right
+	}
+	if err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error querying fiscal profile: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return dto.FiscalProfileDTO{}, fmt.Errorf("error committing fiscal profile code: %w", err)
+	}
+	log.Printf("Fiscal profile code verified for invoice %d.", invoiceID)
+	return p, nil
+}
+
+// ExpireFiscalProfileCodes deletes the one-time codes that were used or have expired,
+// or only counts them when dryRun is set. Codes of the last hour are kept whatever
+// their state: they count towards the NIF's hourly limit.
+func ExpireFiscalProfileCodes(db *sql.DB, dryRun bool) (int, error) {
+	const expired = `
+FROM fiscal_profile_codes
+WHERE created_at < NOW() - INTERVAL '1 hour' AND (used_at IS NOT NULL OR expires_at < NOW())`
+	if dryRun {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*)` + expired + `;`).Scan(&n); err != nil {
+			return 0, fmt.Errorf("error counting expired fiscal profile codes: %w", err)
+		}
+		return n, nil
+	}
+	result, err := db.Exec(`DELETE` + expired + `;`)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting expired fiscal profile codes: %w", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error fetching rows affected for fiscal profile codes: %w", err)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,141 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	createFiscalRecordsTableSQL = `
+CREATE TABLE IF NOT EXISTS fiscal_records (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id), -- Each tenant has its own chain
+    record_type VARCHAR(10) NOT NULL, -- alta, anulacion
+    invoice_codigo INTEGER NOT NULL,  -- Not a foreign key: the chain outlives the invoice
+    issuer_nif VARCHAR(20) NOT NULL,
+    number VARCHAR(20) NOT NULL,
+    issue_date DATE,
+    invoice_type VARCHAR(2),
+    total_quota NUMERIC(12,2),
+    total_amount NUMERIC(12,2),
+    previous_hash VARCHAR(64) NOT NULL, -- Empty for the first record
+    hash VARCHAR(64) NOT NULL UNIQUE,
+    generated_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_fiscal_records_invoice ON fiscal_records (invoice_codigo);
+`
+
+	fiscalRecordColumns = `
+    id, record_type, invoice_codigo, issuer_nif, number, issue_date, invoice_type,
+    total_quota, total_amount, previous_hash, hash, generated_at`
+)
+
+func scanFiscalRecord(row scanner) (dto.FiscalRecordDTO, error) {
+	var r dto.FiscalRecordDTO
+	var issueDate sql.NullTime
+	var invoiceType sql.NullString
+	var totalQuota, totalAmount money.NullDecimal
+	err := row.Scan(
+		&r.ID, &r.RecordType, &r.InvoiceID, &r.IssuerNIF, &r.Number, &issueDate, &invoiceType,
+		&totalQuota, &totalAmount, &r.PreviousHash, &r.Hash, &r.GeneratedAt,
+	)
+	if err != nil {
+		return dto.FiscalRecordDTO{}, err
+	}
+	if issueDate.Valid { r.IssueDate = issueDate.Time.Format("2006-01-02") }
+	if invoiceType.Valid { r.InvoiceType = invoiceType.String }
+	if totalQuota.Valid { r.TotalQuota = &totalQuota.Decimal }
+	if totalAmount.Valid { r.TotalAmount = &totalAmount.Decimal }
+	return r, nil
+}
+
+// appendFiscalRecord chains r after the last record of the tenant's chain and inserts
+// it, filling in its ID, previous hash, generation time and hash. The tenant's chain is
+// locked until tx ends so concurrent transactions cannot chain two records to the same
+// predecessor; other tenants' chains are not held up. The lock is a transaction-level
+// advisory lock on the tenant ID alone, whose key space does not overlap the
+// (tenant, codigo) pairs CreateFullInvoice locks.
+func appendFiscalRecord(tx *sql.Tx, tenantID int, r *dto.FiscalRecordDTO) error {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1::BIGINT);`, tenantID); err != nil {
+		return fmt.Errorf("error locking fiscal record chain: %w", err)
+	}
+	err := tx.QueryRow(`SELECT hash FROM fiscal_records WHERE tenant_id = $1 ORDER BY id DESC LIMIT 1;`, tenantID).Scan(&r.PreviousHash)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error reading last fiscal record: %w", err)
+	}
+	// Whole seconds: the generation time is hashed as text, and must read back the same
+	r.GeneratedAt = time.Now().Truncate(time.Second)
+	r.Hash = r.Fingerprint()
+
+	var issueDate sql.NullTime
+	if t, err := time.Parse("2006-01-02", r.IssueDate); err == nil {
+		issueDate = sql.NullTime{Time: t, Valid: true}
+	}
+	err = tx.QueryRow(`
+INSERT INTO fiscal_records (
+    record_type, invoice_codigo, issuer_nif, number, issue_date, invoice_type,
+    total_quota, total_amount, previous_hash, hash, generated_at, tenant_id
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+RETURNING id;`,
+		r.RecordType, r.InvoiceID, r.IssuerNIF, r.Number, issueDate, NullableString(&r.InvoiceType),
+		r.TotalQuota, r.TotalAmount, r.PreviousHash, r.Hash, r.GeneratedAt, tenantID,
+	).Scan(&r.ID)
+	if err != nil {
+		return fmt.Errorf("error inserting fiscal record for invoice %d: %w", r.InvoiceID, err)
+	}
+	return nil
+}
+
+// appendInvoiceFiscalRecord appends the record newRecord builds for an invoice under
+// the NIF of its issuer profile. Without an issuer profile there is no NIF to record:
+// the record is skipped with a warning rather than failing the operation, as the TPV
+// has issued the invoice anyway.
+func appendInvoiceFiscalRecord(tx *sql.Tx, tenantID int, header dto.InvoiceHeaderDTO, newRecord func(dto.InvoiceHeaderDTO, string) dto.FiscalRecordDTO) error {
+	issuer, err := issuerProfileForInvoice(tx, tenantID, header)
+	if errors.Is(err, ErrIssuerProfileNotFound) {
+		log.Printf("WARNING: No issuer profile for invoice %d; no fiscal record was chained for it.", header.Codigo)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r := newRecord(header, issuer.NIF)
+	return appendFiscalRecord(tx, tenantID, &r)
+}
+
+// hasIssueRecord reports whether an invoice of a tenant has its issue record chained.
+func hasIssueRecord(tx *sql.Tx, tenantID, invoiceID int) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(`
+SELECT EXISTS (SELECT 1 FROM fiscal_records WHERE tenant_id = $1 AND invoice_codigo = $2 AND record_type = $3);`,
+		tenantID, invoiceID, dto.FiscalRecordIssue,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("error querying fiscal records of invoice %d: %w", invoiceID, err)
+	}
+	return exists, nil
+}
+
+// ListFiscalRecords returns the fiscal records of an invoice of a tenant, oldest first.
+func ListFiscalRecords(db *sql.DB, tenantID, invoiceID int) ([]dto.FiscalRecordDTO, error) {
+	rows, err := db.Query(`SELECT`+fiscalRecordColumns+`
+FROM fiscal_records WHERE tenant_id = $1 AND invoice_codigo = $2 ORDER BY id;`, tenantID, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying fiscal records of invoice %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+	records := []dto.FiscalRecordDTO{}
+	for rows.Next() {
+		r, err := scanFiscalRecord(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning fiscal record: %w", err)
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
@@ -0,0 +1,66 @@
+package database
+
+import (
+	"facturapid-api/dto"
+	"testing"
+	"time"
+)
+
+func TestFiscalRecordsChainOnIssue(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+	if _, err := CreateIssuerProfile(db, tenantID, dto.IssuerProfileDTO{
+		LegalName: "Cafetería Peñalara S.L.", NIF: "B12345678", Address: "Calle Mayor 1, Madrid", IsDefault: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().Format("2006-01-02")
+	createInvoices(t, db, tenantID, testInvoice(1, today, "10"), testInvoice(2, today, "20"))
+	actor := dto.ActorDTO{Type: dto.ActorAdmin, ID: "key:0badc0de"}
+
+	records := func(invoiceID int) []dto.FiscalRecordDTO {
+		t.Helper()
+		r, err := ListFiscalRecords(db, tenantID, invoiceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if r := records(1); len(r) != 0 {
+		t.Fatalf("received invoice has %d fiscal records, want none until it is issued", len(r))
+	}
+
+	// The customer's NIF, filled in before the PDF is issued, makes it an F1
+	if _, err := UpdateInvoiceFiscalData(db, tenantID, 1, dto.FiscalDataDTO{ClienteNombre: strPtr("Jesús Muñoz"), ClienteNIF: strPtr("12345678Z")}, 0, actor); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // Issuing again chains nothing
+		if _, err := IssueInvoice(db, tenantID, 1, actor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	issued := records(1)
+	if len(issued) != 1 || issued[0].RecordType != dto.FiscalRecordIssue || issued[0].InvoiceType != dto.InvoiceTypeComplete {
+		t.Fatalf("issued invoice records = %+v, want a single F1 issue record", issued)
+	}
+
+	v, err := VoidInvoice(db, tenantID, 1, "Enviada por error", actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.VoidedBy != "admin:key:0badc0de" {
+		t.Errorf("VoidedBy = %q, want the actor", v.VoidedBy)
+	}
+	voided := records(1)
+	if len(voided) != 2 || voided[1].RecordType != dto.FiscalRecordCancellation || voided[1].PreviousHash != voided[0].Hash {
+		t.Errorf("voided invoice records = %+v, want the issue record and its cancellation chained to it", voided)
+	}
+
+	// Never issued: no issue record, so nothing to cancel
+	if _, err := VoidInvoice(db, tenantID, 2, "Enviada por error", actor); err != nil {
+		t.Fatal(err)
+	}
+	if r := records(2); len(r) != 0 {
+		t.Errorf("invoice voided before being issued has records %+v, want none", r)
+	}
+}
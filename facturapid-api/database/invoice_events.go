@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"facturapid-api/dto"
+	"fmt"
+)
+
+const (
+	// createInvoiceEventsTableSQL creates the audit trail. A trigger rejects updates
+	// and deletes, so entries can only be appended. The one exception is erasure, which
+	// rewrites the personal data of entries in place after setting facturapid.erasure
+	// (see pseudonymiseDocuments); what happened, when and by whom stays as it was.
+	createInvoiceEventsTableSQL = `
+CREATE TABLE IF NOT EXISTS invoice_events (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    invoice_codigo INTEGER NOT NULL, -- Not a foreign key: the trail outlives the invoice
+    event_type VARCHAR(30) NOT NULL,
+    actor_type VARCHAR(20) NOT NULL, -- api_key, admin, system
+    actor_id VARCHAR(100) NOT NULL,
+    client_ip VARCHAR(45),
+    changes TEXT, -- JSON: {"field": {"before": ..., "after": ...}}
+    details TEXT, -- JSON
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_invoice_events_invoice ON invoice_events (invoice_codigo, id);
+CREATE OR REPLACE FUNCTION invoice_events_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND current_setting('facturapid.erasure', true) = 'on'
+        AND NEW.id = OLD.id AND NEW.tenant_id = OLD.tenant_id AND NEW.invoice_codigo = OLD.invoice_codigo AND NEW.event_type = OLD.event_type
+        AND NEW.actor_type = OLD.actor_type AND NEW.actor_id = OLD.actor_id AND NEW.created_at = OLD.created_at THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'invoice_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS invoice_events_append_only ON invoice_events;
+CREATE TRIGGER invoice_events_append_only BEFORE UPDATE OR DELETE ON invoice_events
+    FOR EACH ROW EXECUTE FUNCTION invoice_events_append_only();
+`
+
+	invoiceEventColumns = `
+    id, invoice_codigo, event_type, actor_type, actor_id, client_ip, changes, details, created_at`
+)
+
+// execer is implemented by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func scanInvoiceEvent(row scanner) (dto.InvoiceEventDTO, error) {
+	var e dto.InvoiceEventDTO
+	var clientIP, changes, details sql.NullString
+	err := row.Scan(
+		&e.ID, &e.InvoiceID, &e.EventType, &e.Actor.Type, &e.Actor.ID, &clientIP, &changes, &details, &e.CreatedAt,
+	)
+	if err != nil {
+		return dto.InvoiceEventDTO{}, err
+	}
+	if clientIP.Valid { e.Actor.ClientIP = &clientIP.String }
+	if changes.Valid {
+		if err := json.Unmarshal([]byte(changes.String), &e.Changes); err != nil {
+			return dto.InvoiceEventDTO{}, fmt.Errorf("error decoding changes of invoice event %d: %w", e.ID, err)
+		}
+	}
+	if details.Valid {
+		if err := json.Unmarshal([]byte(details.String), &e.Details); err != nil {
+			return dto.InvoiceEventDTO{}, fmt.Errorf("error decoding details of invoice event %d: %w", e.ID, err)
+		}
+	}
+	return e, nil
+}
+
+// nullableJSON encodes v as JSON, or NULL when it is empty.
+func nullableJSON(v interface{}, empty bool) (sql.NullString, error) {
+	if empty {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+// insertInvoiceEvent appends an event to the audit trail of an invoice of a tenant.
+// Called with the transaction of the change it records, the change and its record
+// commit together.
+func insertInvoiceEvent(ex execer, tenantID int, e dto.InvoiceEventDTO) error {
+	changes, err := nullableJSON(e.Changes, len(e.Changes) == 0)
+	if err != nil {
+		return fmt.Errorf("error encoding changes of invoice event: %w", err)
+	}
+	details, err := nullableJSON(e.Details, len(e.Details) == 0)
+	if err != nil {
+		return fmt.Errorf("error encoding details of invoice event: %w", err)
+	}
+	_, err = ex.Exec(`
+INSERT INTO invoice_events (tenant_id, invoice_codigo, event_type, actor_type, actor_id, client_ip, changes, details)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`,
+		tenantID, e.InvoiceID, e.EventType, e.Actor.Type, e.Actor.ID, NullableString(e.Actor.ClientIP), changes, details,
+	)
+	if err != nil {
+		return fmt.Errorf("error recording %s event of invoice %d: %w", e.EventType, e.InvoiceID, err)
+	}
+	return nil
+}
+
+// RecordInvoiceEvent appends an event to an invoice's audit trail. It is for events
+// that change no invoice data (PDFs, emails); data changes record theirs themselves.
+func RecordInvoiceEvent(db *sql.DB, tenantID, invoiceID int, eventType string, actor dto.ActorDTO, details map[string]interface{}) error {
+	return insertInvoiceEvent(db, tenantID, dto.InvoiceEventDTO{InvoiceID: invoiceID, EventType: eventType, Actor: actor, Details: details})
+}
+
+// ListInvoiceEvents returns the audit trail of an invoice of a tenant, oldest first.
+func ListInvoiceEvents(db *sql.DB, tenantID, invoiceID int) ([]dto.InvoiceEventDTO, error) {
+	rows, err := db.Query(`SELECT`+invoiceEventColumns+`
+FROM invoice_events WHERE tenant_id = $1 AND invoice_codigo = $2 ORDER BY id;`, tenantID, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying events of invoice %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+	events := []dto.InvoiceEventDTO{}
+	for rows.Next() {
+		e, err := scanInvoiceEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning invoice event: %w", err)
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"facturapid-api/dto"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoiceListQuery returns the query listing the invoices of a tenant q asks for,
+// newest first, one more than the page size so the caller knows whether there is a
+// next page. The fecha bounds are compared with the column as it is, so only the
+// partitions of the months asked for are read.
+func invoiceListQuery(tenantID int, q dto.InvoiceListQueryDTO) (string, []interface{}, error) {
+	table := "invoices"
+	if q.Archived {
+		table = "invoices_archive"
+	}
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+	where := []string{"tenant_id = " + arg(tenantID)}
+	if q.From != "" {
+		from, err := time.Parse("2006-01-02", q.From)
+		if err != nil {
+			return "", nil, err
+		}
+		where = append(where, "fecha >= "+arg(from))
+	}
+	if q.To != "" {
+		to, err := time.Parse("2006-01-02", q.To)
+		if err != nil {
+			return "", nil, err
+		}
+		where = append(where, "fecha < "+arg(to.AddDate(0, 0, 1)))
+	}
+	if q.Serie != "" {
+		where = append(where, "serie = "+arg(q.Serie))
+	}
+	if q.Estado != "" {
+		where = append(where, "estado = "+arg(q.Estado))
+	}
+	if q.Cursor != "" {
+		fecha, codigo, err := dto.DecodeInvoiceCursor(q.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		where = append(where, "(fecha, codigo) < ("+arg(fecha)+", "+arg(codigo)+")")
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = dto.DefaultInvoiceListLimit
+	}
+
+	query := `
+SELECT codigo, serie, fecha, hora, terminal, total, cliente1, cliente3, estado, validation_status, version
+FROM ` + table + `
+WHERE ` + strings.Join(where, " AND ") + `
+ORDER BY fecha DESC, codigo DESC
+LIMIT ` + arg(limit+1) + `;`
+	return query, args, nil
+}
+
+// ListInvoices returns a page of the invoices of a tenant q asks for, newest first. It
+// returns dto.ErrInvalidCursor for a cursor it did not make.
+func ListInvoices(db *sql.DB, tenantID int, q dto.InvoiceListQueryDTO) (dto.InvoiceListDTO, error) {
+	query, args, err := invoiceListQuery(tenantID, q)
+	if err != nil {
+		return dto.InvoiceListDTO{}, err
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return dto.InvoiceListDTO{}, fmt.Errorf("error listing invoices: %w", err)
+	}
+	defer rows.Close()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = dto.DefaultInvoiceListLimit
+	}
+	list := dto.InvoiceListDTO{Invoices: []dto.InvoiceSummaryDTO{}}
+	var last time.Time
+	for rows.Next() {
+		if len(list.Invoices) == limit {
+			cursor := dto.EncodeInvoiceCursor(last, list.Invoices[limit-1].Codigo)
+			list.NextCursor = &cursor
+			break
+		}
+		var s dto.InvoiceSummaryDTO
+		var terminal, cliente1, cliente3, validationStatus sql.NullString
+		var hora sql.NullTime
+		err := rows.Scan(&s.Codigo, &s.Serie, &last, &hora, &terminal, &s.Total, &cliente1, &cliente3, &s.Estado, &validationStatus, &s.Version)
+		if err != nil {
+			return dto.InvoiceListDTO{}, fmt.Errorf("error scanning invoice: %w", err)
+		}
+		s.Fecha = last.Format("2006-01-02")
+		if hora.Valid { t := hora.Time.Format("15:04:05"); s.Hora = &t }
+		if terminal.Valid { s.Terminal = &terminal.String }
+		if cliente1.Valid { s.Cliente1 = &cliente1.String }
+		if cliente3.Valid { s.Cliente3 = &cliente3.String }
+		if validationStatus.Valid { s.ValidationStatus = &validationStatus.String }
+		list.Invoices = append(list.Invoices, s)
+	}
+	if err := rows.Err(); err != nil {
+		return dto.InvoiceListDTO{}, fmt.Errorf("error reading invoices: %w", err)
+	}
+	return list, nil
+}
@@ -0,0 +1,80 @@
+package database
+
+import (
+	"encoding/json"
+	"facturapid-api/dto"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// planRelations returns the tables the plan of the listing for q reads.
+func planRelations(t *testing.T, db queryRower, tenantID int, q dto.InvoiceListQueryDTO) []string {
+	t.Helper()
+	query, args, err := invoiceListQuery(tenantID, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plan []byte
+	if err := db.QueryRow(`EXPLAIN (FORMAT JSON) `+query, args...).Scan(&plan); err != nil {
+		t.Fatal(err)
+	}
+	var nodes []map[string]interface{}
+	if err := json.Unmarshal(plan, &nodes); err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	var walk func(node map[string]interface{})
+	walk = func(node map[string]interface{}) {
+		if rel, ok := node["Relation Name"].(string); ok {
+			seen[rel] = true
+		}
+		children, _ := node["Plans"].([]interface{})
+		for _, child := range children {
+			walk(child.(map[string]interface{}))
+		}
+	}
+	for _, n := range nodes {
+		walk(n["Plan"].(map[string]interface{}))
+	}
+	var relations []string
+	for rel := range seen {
+		relations = append(relations, rel)
+	}
+	sort.Strings(relations)
+	return relations
+}
+
+// TestListInvoicesPrunesPartitions checks that a listing bounded by fecha only reads
+// the partitions of the months asked for.
+func TestListInvoicesPrunesPartitions(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+	createInvoices(t, db, tenantID,
+		testInvoice(1, "2025-01-31", "10"), testInvoice(2, "2025-02-01", "20"),
+		testInvoice(3, "2025-02-28", "30"), testInvoice(4, "2025-03-01", "40"))
+
+	q := dto.InvoiceListQueryDTO{From: "2025-02-01", To: "2025-02-28"}
+	if got, want := planRelations(t, db, tenantID, q), []string{"invoices_p2025_02"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listing of February reads %v, want %v", got, want)
+	}
+	q = dto.InvoiceListQueryDTO{From: "2025-02-15", To: "2025-03-10"}
+	if got, want := planRelations(t, db, tenantID, q), []string{"invoices_p2025_02", "invoices_p2025_03"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listing of 15 February to 10 March reads %v, want %v", got, want)
+	}
+	if got := planRelations(t, db, tenantID, dto.InvoiceListQueryDTO{}); len(got) < 4 {
+		t.Errorf("unbounded listing reads %v, want every partition", got)
+	}
+
+	list, err := ListInvoices(db, tenantID, dto.InvoiceListQueryDTO{From: "2025-02-01", To: "2025-02-28"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codigos []int
+	for _, s := range list.Invoices {
+		codigos = append(codigos, s.Codigo)
+	}
+	if want := []int{3, 2}; !reflect.DeepEqual(codigos, want) {
+		t.Errorf("listing of February = %v, want %v", codigos, want)
+	}
+}
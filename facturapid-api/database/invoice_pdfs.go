@@ -0,0 +1,133 @@
+package database
+
+import (
+	"database/sql"
+	"facturapid-api/pdfstore"
+	"fmt"
+)
+
+const createInvoicePDFsTableSQL = `
+CREATE TABLE IF NOT EXISTS invoice_pdfs (
+    tenant_id INTEGER NOT NULL,
+    invoice_codigo INTEGER NOT NULL,
+    invoice_fecha TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+    version INTEGER NOT NULL,   -- invoices.version the PDF was generated from
+    variant VARCHAR(40) NOT NULL, -- Layout, plus "+signed" for signed PDFs
+    content BYTEA NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, invoice_codigo, version, variant),
+    FOREIGN KEY (tenant_id, invoice_codigo, invoice_fecha) REFERENCES invoices(tenant_id, codigo, fecha) ON DELETE CASCADE
+);
+CREATE TABLE IF NOT EXISTS rectifying_invoice_pdfs (
+    tenant_id INTEGER NOT NULL,
+    invoice_codigo INTEGER NOT NULL,
+    version INTEGER NOT NULL,
+    variant VARCHAR(40) NOT NULL,
+    content BYTEA NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, invoice_codigo, version, variant),
+    FOREIGN KEY (tenant_id, invoice_codigo) REFERENCES rectifying_invoices(tenant_id, codigo) ON DELETE CASCADE
+);`
+
+// pdfTable returns the table holding the PDFs of the key's kind of document.
+func pdfTable(key pdfstore.Key) string {
+	if key.Kind == pdfstore.KindRectifying {
+		return "rectifying_invoice_pdfs"
+	}
+	return "invoice_pdfs"
+}
+
+// PDFStore keeps invoice PDFs in the invoice_pdfs table, and those of rectifying
+// invoices in rectifying_invoice_pdfs.
+type PDFStore struct {
+	db *sql.DB
+}
+
+// NewPDFStore returns a pdfstore.Store backed by the database.
+func NewPDFStore(db *sql.DB) *PDFStore {
+	return &PDFStore{db: db}
+}
+
+// Get reads the PDF stored under key.
+func (s *PDFStore) Get(key pdfstore.Key) (*pdfstore.Artifact, error) {
+	a := &pdfstore.Artifact{Key: key}
+	err := s.db.QueryRow(`
+SELECT content, sha256, created_at FROM `+pdfTable(key)+`
+WHERE tenant_id = $4 AND invoice_codigo = $1 AND version = $2 AND variant = $3;`,
+		key.InvoiceID, key.Version, key.Variant, key.TenantID,
+	).Scan(&a.Data, &a.SHA256, &a.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, pdfstore.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error querying stored PDF for invoice id %d: %w", key.InvoiceID, err)
+	}
+	return a, nil
+}
+
+// Put stores data under key unless a PDF is already stored there, and returns the
+// stored PDF.
+func (s *PDFStore) Put(key pdfstore.Key, data []byte) (*pdfstore.Artifact, error) {
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	var err error
+	if key.Kind == pdfstore.KindRectifying {
+		_, err = s.db.Exec(`
+INSERT INTO rectifying_invoice_pdfs (tenant_id, invoice_codigo, version, variant, content, sha256)
+VALUES ($6, $1, $2, $3, $4, $5)
+ON CONFLICT (tenant_id, invoice_codigo, version, variant) DO NOTHING;`,
+			key.InvoiceID, key.Version, key.Variant, data, pdfstore.Digest(data), key.TenantID,
+		)
+	} else {
+		// Invoice PDFs reference their invoice by codigo and fecha
+		_, err = s.db.Exec(`
+INSERT INTO invoice_pdfs (tenant_id, invoice_codigo, invoice_fecha, version, variant, content, sha256)
+SELECT tenant_id, codigo, fecha, $2, $3, $4, $5 FROM invoices WHERE tenant_id = $6 AND codigo = $1
+ON CONFLICT (tenant_id, invoice_codigo, version, variant) DO NOTHING;`,
+			key.InvoiceID, key.Version, key.Variant, data, pdfstore.Digest(data), key.TenantID,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error storing PDF for invoice id %d: %w", key.InvoiceID, err)
+	}
+	return s.Get(key)
+}
+
+// Purge deletes every stored PDF of a document.
+func (s *PDFStore) Purge(tenantID int, kind string, invoiceID int) error {
+	_, err := s.db.Exec(`DELETE FROM `+pdfTable(pdfstore.Key{Kind: kind})+` WHERE tenant_id = $1 AND invoice_codigo = $2;`, tenantID, invoiceID)
+	if err != nil {
+		return fmt.Errorf("error purging stored PDFs for invoice id %d: %w", invoiceID, err)
+	}
+	return nil
+}
+
+// Prune deletes the PDFs of superseded versions, or only counts them when dryRun is
+// set.
+func (s *PDFStore) Prune(dryRun bool) (int, error) {
+	pruned := 0
+	for _, table := range []string{"invoice_pdfs", "rectifying_invoice_pdfs"} {
+		superseded := `
+FROM ` + table + ` p
+WHERE p.version < (SELECT MAX(n.version) FROM ` + table + ` n WHERE n.tenant_id = p.tenant_id AND n.invoice_codigo = p.invoice_codigo)`
+		var n int64
+		if dryRun {
+			if err := s.db.QueryRow(`SELECT COUNT(*)` + superseded + `;`).Scan(&n); err != nil {
+				return pruned, fmt.Errorf("error counting superseded PDFs: %w", err)
+			}
+		} else {
+			result, err := s.db.Exec(`DELETE` + superseded + `;`)
+			if err != nil {
+				return pruned, fmt.Errorf("error pruning superseded PDFs: %w", err)
+			}
+			if n, err = result.RowsAffected(); err != nil {
+				return pruned, fmt.Errorf("error fetching rows affected for superseded PDFs: %w", err)
+			}
+		}
+		pruned += int(n)
+	}
+	return pruned, nil
+}
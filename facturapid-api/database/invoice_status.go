@@ -0,0 +1,111 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+)
+
+// ErrInvalidStatusTransition is returned when an invoice's status does not allow an
+// operation, e.g. updating the fiscal data of an issued invoice. Voided invoices
+// return ErrInvoiceVoided instead.
+var ErrInvalidStatusTransition = errors.New("invalid invoice status transition")
+
+// lockInvoiceStatus returns the status of an invoice of a tenant, locking its row until
+// tx ends so the status cannot change under the caller.
+func lockInvoiceStatus(tx *sql.Tx, tenantID, invoiceID int) (string, error) {
+	var status string
+	err := tx.QueryRow(`SELECT estado FROM invoices WHERE tenant_id = $1 AND codigo = $2 FOR UPDATE;`, tenantID, invoiceID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", missingInvoice(tx, tenantID, invoiceID)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error querying status of invoice id %d: %w", invoiceID, err)
+	}
+	return status, nil
+}
+
+// checkTransition returns the error for moving an invoice from status from to status to,
+// or nil if the move is allowed.
+func checkTransition(invoiceID int, from, to string) error {
+	if from == dto.InvoiceStatusVoided {
+		return ErrInvoiceVoided
+	}
+	if !dto.CanTransition(from, to) {
+		return fmt.Errorf("%w: invoice %d is %s and cannot become %s", ErrInvalidStatusTransition, invoiceID, from, to)
+	}
+	return nil
+}
+
+// addStatusChange adds a status change to the changes of an invoice event.
+func addStatusChange(changes map[string]dto.FieldChangeDTO, from, to string) map[string]dto.FieldChangeDTO {
+	if from == to {
+		return changes
+	}
+	if changes == nil {
+		changes = map[string]dto.FieldChangeDTO{}
+	}
+	changes["estado"] = dto.FieldChangeDTO{Before: from, After: to}
+	return changes
+}
+
+// IssueInvoice marks an invoice of a tenant as issued, if it was not already, chains
+// its issue record and returns its data version. It is called before a PDF of the
+// invoice is generated: from then on the fiscal data is final, so the record has the
+// customer's NIF if it was filled in after the invoice was received. It returns
+// ErrInvoiceNotFound, ErrInvoiceArchived for archived invoices, which are issued
+// already or never will be, or ErrInvoiceVoided for voided invoices, which cannot be
+// issued.
+func IssueInvoice(db *sql.DB, tenantID, invoiceID int, actor dto.ActorDTO) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var version int
+	var status string
+	err = tx.QueryRow(`SELECT version, estado FROM invoices WHERE tenant_id = $1 AND codigo = $2 FOR UPDATE;`, tenantID, invoiceID).Scan(&version, &status)
+	if err == sql.ErrNoRows {
+		return 0, missingInvoice(tx, tenantID, invoiceID)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error querying invoice id %d: %w", invoiceID, err)
+	}
+	if status == dto.InvoiceStatusVoided {
+		return 0, ErrInvoiceVoided
+	}
+	if !dto.CanTransition(status, dto.InvoiceStatusIssued) {
+		return version, nil // Issued already
+	}
+
+	if _, err := tx.Exec(`UPDATE invoices SET estado = $3 WHERE tenant_id = $1 AND codigo = $2;`, tenantID, invoiceID, dto.InvoiceStatusIssued); err != nil {
+		return 0, fmt.Errorf("error issuing invoice id %d: %w", invoiceID, err)
+	}
+	err = insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{
+		InvoiceID: invoiceID, EventType: dto.InvoiceEventIssued, Actor: actor,
+		Changes: addStatusChange(nil, status, dto.InvoiceStatusIssued),
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Invoices received before issue records were chained here have one already
+	chained, err := hasIssueRecord(tx, tenantID, invoiceID)
+	if err != nil {
+		return 0, err
+	}
+	if !chained {
+		invoice, err := getFullInvoice(tx, tenantID, invoiceID, false)
+		if err != nil {
+			return 0, err
+		}
+		if err := appendInvoiceFiscalRecord(tx, tenantID, invoice.Header, dto.NewIssueRecord); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing issue of invoice id %d: %w", invoiceID, err)
+	}
+	return version, nil
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// ErrIssuerProfileNotFound is returned when no issuer profile matches an ID or an invoice.
+var ErrIssuerProfileNotFound = errors.New("issuer profile not found")
+
+const (
+	createIssuerProfilesTableSQL = `
+CREATE TABLE IF NOT EXISTS issuer_profiles (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    legal_name VARCHAR(200) NOT NULL,
+    trade_name VARCHAR(200),
+    nif VARCHAR(20) NOT NULL,
+    address VARCHAR(300) NOT NULL,
+    registry_data VARCHAR(300),
+    logo BYTEA,
+    logo_type VARCHAR(4),
+    footer_text VARCHAR(500),
+    primary_color VARCHAR(7),
+    accent_color VARCHAR(7),
+    series TEXT[] NOT NULL DEFAULT '{}',    -- Invoice series issued under this profile
+    terminals TEXT[] NOT NULL DEFAULT '{}', -- TPV terminals issuing under this profile
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+`
+
+	issuerProfileColumns = `
+    id, legal_name, trade_name, nif, address, registry_data, logo, logo_type, footer_text,
+    primary_color, accent_color, series, terminals, is_default`
+)
+
+// scanner is implemented by both *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// queryRower is implemented by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	queryRower
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func scanIssuerProfile(row scanner) (dto.IssuerProfileDTO, error) {
+	var p dto.IssuerProfileDTO
+	var tradeName, registryData, logoType, footerText, primaryColor, accentColor sql.NullString
+	err := row.Scan(
+		&p.ID, &p.LegalName, &tradeName, &p.NIF, &p.Address, &registryData, &p.Logo, &logoType, &footerText,
+		&primaryColor, &accentColor, pq.Array(&p.Series), pq.Array(&p.Terminals), &p.IsDefault,
+	)
+	if err != nil {
+		return dto.IssuerProfileDTO{}, err
+	}
+	if tradeName.Valid { p.TradeName = &tradeName.String }
+	if registryData.Valid { p.RegistryData = &registryData.String }
+	if logoType.Valid { p.LogoType = &logoType.String }
+	if footerText.Valid { p.FooterText = &footerText.String }
+	if primaryColor.Valid { p.PrimaryColor = &primaryColor.String }
+	if accentColor.Valid { p.AccentColor = &accentColor.String }
+	return p, nil
+}
+
+// nonNilStrings keeps TEXT[] NOT NULL columns from receiving NULL.
+func nonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// clearDefaultIssuerProfile unsets the current default of a tenant so another profile
+// can take it.
+func clearDefaultIssuerProfile(tx *sql.Tx, tenantID, exceptID int) error {
+	_, err := tx.Exec(`UPDATE issuer_profiles SET is_default = FALSE WHERE tenant_id = $1 AND is_default AND id <> $2;`, tenantID, exceptID)
+	if err != nil {
+		return fmt.Errorf("error clearing default issuer profile: %w", err)
+	}
+	return nil
+}
+
+// CreateIssuerProfile inserts a new issuer profile of a tenant and returns its ID.
+func CreateIssuerProfile(db *sql.DB, tenantID int, p dto.IssuerProfileDTO) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if p.IsDefault {
+		if err := clearDefaultIssuerProfile(tx, tenantID, 0); err != nil {
+			return 0, err
+		}
+	}
+	var id int
+	err = tx.QueryRow(`
+INSERT INTO issuer_profiles (
+    legal_name, trade_name, nif, address, registry_data, logo, logo_type, footer_text,
+    primary_color, accent_color, series, terminals, is_default, tenant_id
+) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+RETURNING id;`,
+		p.LegalName, NullableString(p.TradeName), p.NIF, p.Address, NullableString(p.RegistryData), p.Logo, NullableString(p.LogoType), NullableString(p.FooterText),
+		NullableString(p.PrimaryColor), NullableString(p.AccentColor), pq.Array(nonNilStrings(p.Series)), pq.Array(nonNilStrings(p.Terminals)), p.IsDefault,
+		tenantID,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("error inserting issuer profile: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing issuer profile: %w", err)
+	}
+	log.Printf("Created issuer profile %d (%s) of tenant %d.", id, p.LegalName, tenantID)
+	return id, nil
+}
+
+// UpdateIssuerProfile replaces every field of an existing issuer profile of a tenant.
+// A nil Logo removes the stored logo.
+func UpdateIssuerProfile(db *sql.DB, tenantID, id int, p dto.IssuerProfileDTO) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if p.IsDefault {
+		if err := clearDefaultIssuerProfile(tx, tenantID, id); err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec(`
+UPDATE issuer_profiles
+SET
+    legal_name = $1, trade_name = $2, nif = $3, address = $4, registry_data = $5,
+    logo = $6, logo_type = $7, footer_text = $8, primary_color = $9, accent_color = $10,
+    series = $11, terminals = $12, is_default = $13, updated_at = NOW()
+WHERE id = $14 AND tenant_id = $15;`,
+		p.LegalName, NullableString(p.TradeName), p.NIF, p.Address, NullableString(p.RegistryData),
+		p.Logo, NullableString(p.LogoType), NullableString(p.FooterText), NullableString(p.PrimaryColor), NullableString(p.AccentColor),
+		pq.Array(nonNilStrings(p.Series)), pq.Array(nonNilStrings(p.Terminals)), p.IsDefault,
+		id, tenantID,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating issuer profile %d: %w", id, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error fetching rows affected for issuer profile %d: %w", id, err)
+	}
+	if rowsAffected == 0 {
+		return ErrIssuerProfileNotFound
+	}
+	return tx.Commit()
+}
+
+// DeleteIssuerProfile removes an issuer profile of a tenant.
+func DeleteIssuerProfile(db *sql.DB, tenantID, id int) error {
+	result, err := db.Exec(`DELETE FROM issuer_profiles WHERE id = $1 AND tenant_id = $2;`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("error deleting issuer profile %d: %w", id, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error fetching rows affected for issuer profile %d: %w", id, err)
+	}
+	if rowsAffected == 0 {
+		return ErrIssuerProfileNotFound
+	}
+	return nil
+}
+
+// GetIssuerProfileByID returns a single issuer profile of a tenant.
+func GetIssuerProfileByID(db *sql.DB, tenantID, id int) (dto.IssuerProfileDTO, error) {
+	p, err := scanIssuerProfile(db.QueryRow(`SELECT`+issuerProfileColumns+` FROM issuer_profiles WHERE id = $1 AND tenant_id = $2;`, id, tenantID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.IssuerProfileDTO{}, ErrIssuerProfileNotFound
+		}
+		return dto.IssuerProfileDTO{}, fmt.Errorf("error querying issuer profile %d: %w", id, err)
+	}
+	return p, nil
+}
+
+// ListIssuerProfiles returns every issuer profile of a tenant, ordered by ID.
+func ListIssuerProfiles(db *sql.DB, tenantID int) ([]dto.IssuerProfileDTO, error) {
+	rows, err := db.Query(`SELECT`+issuerProfileColumns+` FROM issuer_profiles WHERE tenant_id = $1 ORDER BY id;`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying issuer profiles: %w", err)
+	}
+	defer rows.Close()
+	profiles := []dto.IssuerProfileDTO{}
+	for rows.Next() {
+		p, err := scanIssuerProfile(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning issuer profile: %w", err)
+		}
+		profiles = append(profiles, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating issuer profiles: %w", err)
+	}
+	return profiles, nil
+}
+
+// GetIssuerProfileForInvoice returns the profile an invoice of a tenant is issued under.
+// A profile listing the invoice's terminal wins over one listing its series,
+// which in turn wins over the default profile of the tenant.
+func GetIssuerProfileForInvoice(db *sql.DB, tenantID int, header dto.InvoiceHeaderDTO) (dto.IssuerProfileDTO, error) {
+	return issuerProfileForInvoice(db, tenantID, header)
+}
+
+func issuerProfileForInvoice(q queryRower, tenantID int, header dto.InvoiceHeaderDTO) (dto.IssuerProfileDTO, error) {
+	terminal := ""
+	if header.Terminal != nil {
+		terminal = *header.Terminal
+	}
+	query := `SELECT` + issuerProfileColumns + `
+FROM issuer_profiles
+WHERE tenant_id = $3 AND ($1 = ANY(terminals) OR $2 = ANY(series) OR is_default)
+ORDER BY ($1 = ANY(terminals)) DESC, ($2 = ANY(series)) DESC, id
+LIMIT 1;`
+	p, err := scanIssuerProfile(q.QueryRow(query, terminal, header.Serie, tenantID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.IssuerProfileDTO{}, ErrIssuerProfileNotFound
+		}
+		return dto.IssuerProfileDTO{}, fmt.Errorf("error querying issuer profile for invoice %d: %w", header.Codigo, err)
+	}
+	return p, nil
+}
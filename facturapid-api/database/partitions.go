@@ -0,0 +1,289 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// invoices and invoice_lines are partitioned by month of the invoice's fecha, one
+// partition per month (invoices_p2024_01, invoice_lines_p2024_01...) and a default
+// partition for rows outside them. Queries filtered by fecha only read the partitions
+// of the months asked for. Partitions are created ahead of time by
+// EnsureInvoicePartitions, at startup and then by PartitionWorker, and for the month
+// of every invoice received.
+
+// ErrInvoiceDateMissing is returned when an invoice to store has no valid fecha, the
+// partition key.
+var ErrInvoiceDateMissing = errors.New("invoice has no valid fecha")
+
+// invoicePartitionsAhead is how many months ahead of the current one have their
+// partitions created in advance.
+const invoicePartitionsAhead = 3
+
+// partitionedTables are the tables partitioned by the invoice fecha.
+var partitionedTables = []string{"invoices", "invoice_lines"}
+
+// invoiceReferences are the tables that reference invoices, by codigo and fecha.
+var invoiceReferences = []struct {
+	table, codigo, fecha string
+	cascade              bool
+}{
+	{"email_deliveries", "invoice_codigo", "invoice_fecha", true},
+	{"invoice_pdfs", "invoice_codigo", "invoice_fecha", true},
+	{"fiscal_profile_codes", "invoice_codigo", "invoice_fecha", true},
+	{"rectifying_invoices", "factura_rectificada", "fecha_factura_rectificada", false},
+}
+
+// knownPartitions holds the months, as "2006_01", whose partitions this process has
+// made sure exist for the invoices it stores.
+var knownPartitions sync.Map
+
+func monthStart(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// ensureDefaultPartitions creates the default partitions of the partitioned tables.
+func ensureDefaultPartitions(ex execer) error {
+	for _, table := range partitionedTables {
+		_, err := ex.Exec(`CREATE TABLE IF NOT EXISTS ` + pq.QuoteIdentifier(table+"_default") + ` PARTITION OF ` + table + ` DEFAULT;`)
+		if err != nil {
+			return fmt.Errorf("error creating default partition of %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// ensureMonthPartitions creates the partitions of the partitioned tables for the month
+// of m.
+func ensureMonthPartitions(ex execer, m time.Time) error {
+	m = monthStart(m)
+	month := m.Format("2006_01")
+	for _, table := range partitionedTables {
+		_, err := ex.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s');`,
+			pq.QuoteIdentifier(table+"_p"+month), table, m.Format("2006-01-02"), m.AddDate(0, 1, 0).Format("2006-01-02")))
+		if err != nil {
+			return fmt.Errorf("error creating partition %s of %s: %w", month, table, err)
+		}
+	}
+	return nil
+}
+
+// ensurePartitions creates the monthly partitions of the partitioned tables for the
+// months from from to to, both included, and the default partitions.
+func ensurePartitions(ex execer, from, to time.Time) error {
+	if err := ensureDefaultPartitions(ex); err != nil {
+		return err
+	}
+	for m := monthStart(from); !m.After(to); m = m.AddDate(0, 1, 0) {
+		if err := ensureMonthPartitions(ex, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureInvoicePartitions creates the partitions of the current month and of the
+// months ahead, when missing. A month some rows went to the default partition for
+// already cannot have its partitions created; that is only logged, and its rows stay
+// in the default partition, where they are read as any other.
+func EnsureInvoicePartitions(db *sql.DB) error {
+	if err := ensureDefaultPartitions(db); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for m := monthStart(now); !m.After(now.AddDate(0, invoicePartitionsAhead, 0)); m = m.AddDate(0, 1, 0) {
+		if err := ensureMonthPartitions(db, m); err != nil {
+			log.Printf("Warning: invoices of %s stay in the default partition: %v", m.Format("2006_01"), err)
+		}
+	}
+	return nil
+}
+
+// PartitionWorker creates the invoice partitions of the months ahead.
+type PartitionWorker struct {
+	DB       *sql.DB
+	Interval time.Duration // Time between runs
+}
+
+// Run calls EnsureInvoicePartitions every Interval until ctx is cancelled, so the
+// partitions of a month are ready before its first invoice arrives however long the
+// API runs.
+func (w *PartitionWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if err := EnsureInvoicePartitions(w.DB); err != nil {
+			log.Printf("Error creating invoice partitions: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ensureInvoicePartition creates the partitions of the month of fecha, when missing,
+// before an invoice of that month is stored: invoices sent late or of past years get a
+// partition of their own too. A failure is only logged, the invoice then goes to the
+// default partition.
+func ensureInvoicePartition(db *sql.DB, fecha time.Time) {
+	month := fecha.Format("2006_01")
+	if _, ok := knownPartitions.Load(month); ok {
+		return
+	}
+	if err := ensurePartitions(db, fecha, fecha); err != nil {
+		log.Printf("Warning: invoices of %s go to the default partition: %v", month, err)
+	}
+	knownPartitions.Store(month, true)
+}
+
+// invoiceFecha returns the fecha of an invoice of a tenant in the invoices table, which
+// rows referencing it store with its codigo. It returns ErrInvoiceNotFound or
+// ErrInvoiceArchived when it is not there.
+func invoiceFecha(q queryRower, tenantID, invoiceID int) (time.Time, error) {
+	var fecha time.Time
+	err := q.QueryRow(`SELECT fecha FROM invoices WHERE tenant_id = $1 AND codigo = $2;`, tenantID, invoiceID).Scan(&fecha)
+	if err == sql.ErrNoRows {
+		return time.Time{}, missingInvoice(q, tenantID, invoiceID)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error querying fecha of invoice id %d: %w", invoiceID, err)
+	}
+	return fecha, nil
+}
+
+// partitionInvoices turns the invoices and invoice_lines tables of a database created
+// before they were partitioned into partitioned tables, in one transaction: the rows
+// are copied into new partitioned tables, and the tables referencing invoices get the
+// fecha of the invoice they reference. Invoices without fecha take their
+// fecha_de_factura; if some have neither it fails, and those must be dated by hand.
+func partitionInvoices(db *sql.DB) error {
+	var kind sql.NullString
+	if err := db.QueryRow(`SELECT relkind::text FROM pg_class WHERE oid = to_regclass('invoices');`).Scan(&kind); err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("error querying invoices table: %w", err)
+	}
+	if kind.String != "r" {
+		return nil // Partitioned already, or a new database
+	}
+	log.Println("Partitioning tables 'invoices' and 'invoice_lines' by fecha...")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE invoices SET fecha = fecha_de_factura WHERE fecha IS NULL;`); err != nil {
+		return fmt.Errorf("error dating invoices without fecha: %w", err)
+	}
+	var undated int
+	var first sql.NullTime
+	if err := tx.QueryRow(`SELECT COUNT(*) FILTER (WHERE fecha IS NULL), MIN(fecha) FROM invoices;`).Scan(&undated, &first); err != nil {
+		return fmt.Errorf("error querying invoice dates: %w", err)
+	}
+	if undated > 0 {
+		return fmt.Errorf("%d invoices have no fecha nor fecha_de_factura: set one before upgrading", undated)
+	}
+
+	steps := []string{
+		`ALTER TABLE invoices RENAME TO invoices_unpartitioned;`,
+		`ALTER TABLE invoices_unpartitioned RENAME CONSTRAINT invoices_pkey TO invoices_unpartitioned_pkey;`,
+		`ALTER TABLE invoice_lines RENAME TO invoice_lines_unpartitioned;`,
+		`ALTER TABLE invoice_lines_unpartitioned RENAME CONSTRAINT invoice_lines_pkey TO invoice_lines_unpartitioned_pkey;`,
+		`CREATE TABLE invoices (LIKE invoices_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (fecha);`,
+		`ALTER TABLE invoices ALTER COLUMN fecha SET NOT NULL, ADD PRIMARY KEY (codigo, fecha);`,
+		`CREATE TABLE invoice_lines (
+    LIKE invoice_lines_unpartitioned INCLUDING DEFAULTS,
+    fecha_factura TIMESTAMP WITHOUT TIME ZONE NOT NULL
+) PARTITION BY RANGE (fecha_factura);`,
+		`ALTER TABLE invoice_lines ADD PRIMARY KEY (codigo_factura, fecha_factura, producto, linea),
+    ADD FOREIGN KEY (codigo_factura, fecha_factura) REFERENCES invoices(codigo, fecha) ON DELETE CASCADE;`,
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step); err != nil {
+			return fmt.Errorf("error partitioning invoices (%s): %w", step, err)
+		}
+	}
+
+	from := time.Now().UTC()
+	if first.Valid && first.Time.Before(from) {
+		from = first.Time
+	}
+	if err := ensurePartitions(tx, from, time.Now().UTC().AddDate(0, invoicePartitionsAhead, 0)); err != nil {
+		return err
+	}
+	lineColumns, err := tableColumns(tx, "invoice_lines_unpartitioned")
+	if err != nil {
+		return err
+	}
+	steps = []string{
+		`INSERT INTO invoices SELECT * FROM invoices_unpartitioned;`,
+		`INSERT INTO invoice_lines (` + lineColumns + `, fecha_factura)
+SELECT l.*, i.fecha FROM invoice_lines_unpartitioned l JOIN invoices_unpartitioned i ON i.codigo = l.codigo_factura;`,
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step); err != nil {
+			return fmt.Errorf("error copying invoices into partitions: %w", err)
+		}
+	}
+
+	var referencing []string
+	for _, ref := range invoiceReferences {
+		exists, err := tableExists(tx, ref.table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue // Created later, referencing the partitioned table
+		}
+		referencing = append(referencing, ref.table)
+		_, err = tx.Exec(fmt.Sprintf(`
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS %[3]s TIMESTAMP WITHOUT TIME ZONE;
+UPDATE %[1]s t SET %[3]s = i.fecha FROM invoices_unpartitioned i WHERE i.codigo = t.%[2]s;
+ALTER TABLE %[1]s ALTER COLUMN %[3]s SET NOT NULL;`, ref.table, ref.codigo, ref.fecha))
+		if err != nil {
+			return fmt.Errorf("error adding %s to %s: %w", ref.fecha, ref.table, err)
+		}
+	}
+	// Drops the foreign keys to the old table too
+	if _, err := tx.Exec(`DROP TABLE invoice_lines_unpartitioned, invoices_unpartitioned CASCADE;`); err != nil {
+		return fmt.Errorf("error dropping unpartitioned invoice tables: %w", err)
+	}
+	for _, ref := range invoiceReferences {
+		if !contains(referencing, ref.table) {
+			continue
+		}
+		onDelete := ""
+		if ref.cascade {
+			onDelete = " ON DELETE CASCADE"
+		}
+		_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD FOREIGN KEY (%s, %s) REFERENCES invoices(codigo, fecha)%s;`,
+			ref.table, ref.codigo, ref.fecha, onDelete))
+		if err != nil {
+			return fmt.Errorf("error adding foreign key of %s to invoices: %w", ref.table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing partitioning of invoices: %w", err)
+	}
+	log.Println("Tables 'invoices' and 'invoice_lines' partitioned by fecha.")
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
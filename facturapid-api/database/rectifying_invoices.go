@@ -0,0 +1,326 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// ErrRectifyingInvoiceNotFound is returned when no rectifying invoice matches an ID.
+var ErrRectifyingInvoiceNotFound = errors.New("rectifying invoice not found")
+
+// ErrRectifyingInvoiceExists is returned by CreateRectifyingInvoice when the Codigo is
+// already taken.
+var ErrRectifyingInvoiceExists = errors.New("rectifying invoice already exists")
+
+const (
+	// Rectifying invoices mirror the TPV's FacturasR/FacturasRLin tables. They have their
+	// own numbering, so they are kept apart from invoices rather than in the same table.
+	createRectifyingInvoicesTablesSQL = `
+CREATE TABLE IF NOT EXISTS rectifying_invoices (
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    codigo INTEGER NOT NULL,
+    cuenta VARCHAR(20),
+    fecha TIMESTAMP WITHOUT TIME ZONE,
+    hora TIMESTAMP WITHOUT TIME ZONE,
+    total NUMERIC(12,4),
+    tipo_cobro VARCHAR(50),
+    vendedor VARCHAR(50),
+    cuota_iva NUMERIC(12,4),
+    abonado NUMERIC(12,4),
+    terminal VARCHAR(15),
+    traspasada VARCHAR(1),
+    revisable VARCHAR(1),
+    impresa VARCHAR(1),
+    tarifa VARCHAR(10) NOT NULL,
+    base1 NUMERIC(12,4),
+    base2 NUMERIC(12,4),
+    base3 NUMERIC(12,4),
+    iva1 NUMERIC(5,2),
+    iva2 NUMERIC(5,2),
+    iva3 NUMERIC(5,2),
+    cuota_iva1 NUMERIC(12,4),
+    cuota_iva2 NUMERIC(12,4),
+    cuota_iva3 NUMERIC(12,4),
+    serie VARCHAR(1) NOT NULL,
+    cliente1 VARCHAR(30),
+    cliente2 VARCHAR(30),
+    cliente3 VARCHAR(30),
+    cliente4 VARCHAR(30),
+    cobro_mixto NUMERIC(12,4),
+    efectivo_mixto NUMERIC(12,4),
+    tipo_cobro_mixto VARCHAR(50),
+    tipo_cobro_mixto2 VARCHAR(50),
+    comensales INTEGER,
+    codigo_de_factura INTEGER,
+    fecha_de_factura TIMESTAMP WITHOUT TIME ZONE,
+    hora_de_factura TIMESTAMP WITHOUT TIME ZONE,
+    cobro_mixto2 NUMERIC(12,4),
+    factura_rectificada INTEGER NOT NULL,
+    fecha_factura_rectificada TIMESTAMP WITHOUT TIME ZONE NOT NULL, -- The rectified invoice's fecha
+    tipo_rectificativa VARCHAR(2) NOT NULL, -- R1..R5
+    tipo_rectificacion VARCHAR(1) NOT NULL, -- S (substitution) or I (differences)
+    motivo VARCHAR(500),
+    base_rectificada NUMERIC(12,4),  -- Substitution only: the rectified invoice's base
+    cuota_rectificada NUMERIC(12,4), -- and VAT quota
+    validation_status VARCHAR(10),
+    validation_report JSONB, -- As in invoices
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (tenant_id, codigo),
+    -- Not cascaded: a rectified invoice cannot be deleted
+    FOREIGN KEY (tenant_id, factura_rectificada, fecha_factura_rectificada) REFERENCES invoices(tenant_id, codigo, fecha)
+);
+ALTER TABLE rectifying_invoices ADD COLUMN IF NOT EXISTS validation_report JSONB;
+CREATE INDEX IF NOT EXISTS idx_rectifying_invoices_factura_rectificada ON rectifying_invoices (factura_rectificada);
+-- Codigos of the rectifying invoices the API issues itself (POST /invoices/:id/rectify),
+-- far above the TPV's FacturasR numbering
+CREATE SEQUENCE IF NOT EXISTS api_rectifying_codigo_seq START 900000001;
+CREATE TABLE IF NOT EXISTS rectifying_invoice_lines (
+    tenant_id INTEGER NOT NULL,
+    codigo_factura INTEGER NOT NULL,
+    codigo_producto VARCHAR(15),
+    subtotal NUMERIC(12,4),
+    producto VARCHAR(200) NOT NULL,
+    iva_aplicado NUMERIC(5,2),
+    linea INTEGER NOT NULL,
+    unidades NUMERIC(10,4),
+    unidades_old NUMERIC(10,4),
+    combinado_con VARCHAR(15) NOT NULL,
+    liga_siguiente VARCHAR(1),
+    serie VARCHAR(1),
+    PRIMARY KEY (tenant_id, codigo_factura, producto, linea),
+    FOREIGN KEY (tenant_id, codigo_factura) REFERENCES rectifying_invoices(tenant_id, codigo) ON DELETE CASCADE
+);`
+
+	rectifyingInvoiceColumns = `
+    codigo, cuenta, fecha, hora, total, tipo_cobro, vendedor, cuota_iva, abonado, terminal,
+    traspasada, revisable, impresa, tarifa, base1, base2, base3, iva1, iva2, iva3,
+    cuota_iva1, cuota_iva2, cuota_iva3, serie, cliente1, cliente2, cliente3, cliente4,
+    cobro_mixto, efectivo_mixto, tipo_cobro_mixto, tipo_cobro_mixto2, comensales,
+    codigo_de_factura, fecha_de_factura, hora_de_factura, cobro_mixto2,
+    factura_rectificada, tipo_rectificativa, tipo_rectificacion, motivo,
+    base_rectificada, cuota_rectificada, validation_status, validation_report`
+)
+
+func scanRectifyingInvoiceHeader(row scanner) (dto.RectifyingInvoiceHeaderDTO, error) {
+	var h dto.RectifyingInvoiceHeaderDTO
+	var cuenta, tipoCobro, vendedor, terminal, traspasada, revisable, impresa, cliente1, cliente2, cliente3, cliente4, tipoCobroMixto, tipoCobroMixto2, motivo, validationStatus sql.NullString
+	var fecha, hora, fechaDeFactura, horaDeFactura sql.NullTime
+	var cuotaIVA, abonado, base1, base2, base3, iva1, iva2, iva3, cuotaIva1, cuotaIva2, cuotaIva3, cobroMixto, efectivoMixto, cobroMixto2, baseRectificada, cuotaRectificada money.NullDecimal
+	var comensales, codigoDeFactura sql.NullInt64
+	var validationReport []byte
+	err := row.Scan(
+		&h.Codigo, &cuenta, &fecha, &hora, &h.Total, &tipoCobro, &vendedor, &cuotaIVA, &abonado, &terminal,
+		&traspasada, &revisable, &impresa, &h.Tarifa, &base1, &base2, &base3, &iva1, &iva2, &iva3,
+		&cuotaIva1, &cuotaIva2, &cuotaIva3, &h.Serie, &cliente1, &cliente2, &cliente3, &cliente4,
+		&cobroMixto, &efectivoMixto, &tipoCobroMixto, &tipoCobroMixto2, &comensales,
+		&codigoDeFactura, &fechaDeFactura, &horaDeFactura, &cobroMixto2,
+		&h.FacturaRectificada, &h.TipoRectificativa, &h.TipoRectificacion, &motivo,
+		&baseRectificada, &cuotaRectificada, &validationStatus, &validationReport,
+	)
+	if err != nil {
+		return dto.RectifyingInvoiceHeaderDTO{}, err
+	}
+	if cuenta.Valid { h.Cuenta = &cuenta.String }
+	if fecha.Valid { t := fecha.Time.Format("2006-01-02"); h.Fecha = &t }
+	if hora.Valid { t := hora.Time.Format("15:04:05"); h.Hora = &t }
+	if tipoCobro.Valid { h.TipoCobro = &tipoCobro.String }
+	if vendedor.Valid { h.Vendedor = &vendedor.String }
+	if cuotaIVA.Valid { h.CuotaIVA = &cuotaIVA.Decimal }
+	if abonado.Valid { h.Abonado = &abonado.Decimal }
+	if terminal.Valid { h.Terminal = &terminal.String }
+	if traspasada.Valid { h.Traspasada = &traspasada.String }
+	if revisable.Valid { h.Revisable = &revisable.String }
+	if impresa.Valid { h.Impresa = &impresa.String }
+	if base1.Valid { h.Base1 = &base1.Decimal }
+	if base2.Valid { h.Base2 = &base2.Decimal }
+	if base3.Valid { h.Base3 = &base3.Decimal }
+	if iva1.Valid { h.Iva1 = &iva1.Decimal }
+	if iva2.Valid { h.Iva2 = &iva2.Decimal }
+	if iva3.Valid { h.Iva3 = &iva3.Decimal }
+	if cuotaIva1.Valid { h.CuotaIva1 = &cuotaIva1.Decimal }
+	if cuotaIva2.Valid { h.CuotaIva2 = &cuotaIva2.Decimal }
+	if cuotaIva3.Valid { h.CuotaIva3 = &cuotaIva3.Decimal }
+	if cliente1.Valid { h.Cliente1 = &cliente1.String }
+	if cliente2.Valid { h.Cliente2 = &cliente2.String }
+	if cliente3.Valid { h.Cliente3 = &cliente3.String }
+	if cliente4.Valid { h.Cliente4 = &cliente4.String }
+	if cobroMixto.Valid { h.CobroMixto = &cobroMixto.Decimal }
+	if efectivoMixto.Valid { h.EfectivoMixto = &efectivoMixto.Decimal }
+	if tipoCobroMixto.Valid { h.TipoCobroMixto = &tipoCobroMixto.String }
+	if tipoCobroMixto2.Valid { h.TipoCobroMixto2 = &tipoCobroMixto2.String }
+	if comensales.Valid { v := int(comensales.Int64); h.Comensales = &v }
+	if codigoDeFactura.Valid { v := int(codigoDeFactura.Int64); h.CodigoDeFactura = &v }
+	if fechaDeFactura.Valid { t := fechaDeFactura.Time.Format("2006-01-02"); h.FechaDeFactura = &t }
+	if horaDeFactura.Valid { t := horaDeFactura.Time.Format("15:04:05"); h.HoraDeFactura = &t }
+	if cobroMixto2.Valid { h.CobroMixto2 = &cobroMixto2.Decimal }
+	if motivo.Valid { h.Motivo = &motivo.String }
+	if baseRectificada.Valid { h.BaseRectificada = &baseRectificada.Decimal }
+	if cuotaRectificada.Valid { h.CuotaRectificada = &cuotaRectificada.Decimal }
+	if validationStatus.Valid { h.ValidationStatus = &validationStatus.String }
+	if validationReport != nil { h.ValidationReport = validationReport }
+	return h, nil
+}
+
+// CreateRectifyingInvoice stores a rectifying invoice of a tenant and its lines, and
+// marks the rectified invoice as rectified, in one transaction. A Codigo of 0 takes the
+// next API-issued number. It returns the Codigo, ErrRectifyingInvoiceExists when it is
+// taken, ErrInvoiceNotFound when the rectified invoice does not exist, ErrInvoiceVoided
+// when it has been voided, ErrInvoiceArchived when it has been archived, and
+// ErrInvalidStatusTransition when it cannot be rectified.
+func CreateRectifyingInvoice(db *sql.DB, tenantID int, r dto.RectifyingInvoiceDTO, actor dto.ActorDTO) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	h := r.Header
+	status, err := lockInvoiceStatus(tx, tenantID, h.FacturaRectificada)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkTransition(h.FacturaRectificada, status, dto.InvoiceStatusRectified); err != nil {
+		return 0, err
+	}
+	fechaRectificada, err := invoiceFecha(tx, tenantID, h.FacturaRectificada)
+	if err != nil {
+		return 0, err
+	}
+
+	fecha, _ := parseDateTime(h.Fecha, h.Hora)
+	fechaDeFactura, _ := parseDateTime(h.FechaDeFactura, h.HoraDeFactura)
+	var codigo int
+	err = tx.QueryRow(`
+INSERT INTO rectifying_invoices (`+rectifyingInvoiceColumns+`, fecha_factura_rectificada, tenant_id
+) VALUES (
+    COALESCE(NULLIF($1, 0), nextval('api_rectifying_codigo_seq')), $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20,
+    $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40,
+    $41, $42, $43, $44, $45, $46, $47
+) ON CONFLICT (tenant_id, codigo) DO NOTHING
+RETURNING codigo;`,
+		h.Codigo, h.Cuenta, fecha, fecha, h.Total, h.TipoCobro, h.Vendedor, h.CuotaIVA, h.Abonado, h.Terminal,
+		h.Traspasada, h.Revisable, h.Impresa, h.Tarifa, h.Base1, h.Base2, h.Base3, h.Iva1, h.Iva2, h.Iva3,
+		h.CuotaIva1, h.CuotaIva2, h.CuotaIva3, h.Serie, h.Cliente1, h.Cliente2, h.Cliente3, h.Cliente4,
+		h.CobroMixto, h.EfectivoMixto, h.TipoCobroMixto, h.TipoCobroMixto2, h.Comensales,
+		h.CodigoDeFactura, fechaDeFactura, fechaDeFactura, h.CobroMixto2,
+		h.FacturaRectificada, h.TipoRectificativa, h.TipoRectificacion, h.Motivo,
+		h.BaseRectificada, h.CuotaRectificada, h.ValidationStatus, nullableRawJSON(h.ValidationReport), fechaRectificada, tenantID,
+	).Scan(&codigo)
+	if err == sql.ErrNoRows {
+		return 0, ErrRectifyingInvoiceExists
+	}
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return 0, ErrInvoiceNotFound
+		}
+		return 0, fmt.Errorf("error inserting rectifying invoice (codigo %d): %w", h.Codigo, err)
+	}
+
+	for _, line := range r.Lines {
+		_, err := tx.Exec(`
+INSERT INTO rectifying_invoice_lines (
+    codigo_factura, codigo_producto, subtotal, producto, iva_aplicado,
+    linea, unidades, unidades_old, combinado_con, liga_siguiente, serie, tenant_id
+) VALUES (
+    $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12
+) ON CONFLICT (tenant_id, codigo_factura, producto, linea) DO NOTHING;`,
+			codigo, line.CodigoProducto, line.Subtotal, line.Producto, line.IvaAplicado,
+			line.Linea, line.Unidades, line.UnidadesOld, line.CombinadoCon, line.LigaSiguiente, line.Serie, tenantID,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("error inserting rectifying invoice line (codigo %d, producto %s, linea %d): %w", codigo, line.Producto, line.Linea, err)
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE invoices SET estado = $2 WHERE tenant_id = $3 AND codigo = $1;`, h.FacturaRectificada, dto.InvoiceStatusRectified, tenantID); err != nil {
+		return 0, fmt.Errorf("error marking invoice %d as rectified: %w", h.FacturaRectificada, err)
+	}
+	err = insertInvoiceEvent(tx, tenantID, dto.InvoiceEventDTO{
+		InvoiceID: h.FacturaRectificada, EventType: dto.InvoiceEventRectified, Actor: actor,
+		Changes: addStatusChange(nil, status, dto.InvoiceStatusRectified),
+		Details: map[string]interface{}{"rectifying_invoice": codigo, "tipo_rectificativa": h.TipoRectificativa, "tipo_rectificacion": h.TipoRectificacion},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error committing rectifying invoice %d: %w", codigo, err)
+	}
+	log.Printf("Stored rectifying invoice %d (%s, rectifies invoice %d).", codigo, h.TipoRectificativa, h.FacturaRectificada)
+	return codigo, nil
+}
+
+// GetRectifyingInvoiceByID returns a rectifying invoice of a tenant and its lines.
+func GetRectifyingInvoiceByID(db *sql.DB, tenantID, id int) (dto.RectifyingInvoiceDTO, error) {
+	h, err := scanRectifyingInvoiceHeader(db.QueryRow(`SELECT`+rectifyingInvoiceColumns+` FROM rectifying_invoices WHERE tenant_id = $1 AND codigo = $2;`, tenantID, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.RectifyingInvoiceDTO{}, ErrRectifyingInvoiceNotFound
+		}
+		return dto.RectifyingInvoiceDTO{}, fmt.Errorf("error querying rectifying invoice %d: %w", id, err)
+	}
+
+	rows, err := db.Query(`
+SELECT
+    codigo_factura, codigo_producto, subtotal, producto, iva_aplicado,
+    linea, unidades, unidades_old, combinado_con, liga_siguiente, serie
+FROM rectifying_invoice_lines WHERE tenant_id = $1 AND codigo_factura = $2 ORDER BY linea ASC;`, tenantID, id)
+	if err != nil {
+		return dto.RectifyingInvoiceDTO{}, fmt.Errorf("error querying lines of rectifying invoice %d: %w", id, err)
+	}
+	defer rows.Close()
+	r := dto.RectifyingInvoiceDTO{Header: h, Lines: []dto.RectifyingInvoiceLineDTO{}}
+	for rows.Next() {
+		var line dto.RectifyingInvoiceLineDTO
+		var codigoProducto, ligaSiguiente, serie sql.NullString
+		var subtotal, ivaAplicado, unidades, unidadesOld money.NullDecimal
+		err := rows.Scan(
+			&line.CodigoFactura, &codigoProducto, &subtotal, &line.Producto, &ivaAplicado,
+			&line.Linea, &unidades, &unidadesOld, &line.CombinadoCon, &ligaSiguiente, &serie,
+		)
+		if err != nil {
+			return dto.RectifyingInvoiceDTO{}, fmt.Errorf("error scanning line of rectifying invoice %d: %w", id, err)
+		}
+		if codigoProducto.Valid { line.CodigoProducto = &codigoProducto.String }
+		if subtotal.Valid { line.Subtotal = subtotal.Decimal }
+		if ivaAplicado.Valid { line.IvaAplicado = &ivaAplicado.Decimal }
+		if unidades.Valid { line.Unidades = unidades.Decimal }
+		if unidadesOld.Valid { line.UnidadesOld = &unidadesOld.Decimal }
+		if ligaSiguiente.Valid { line.LigaSiguiente = &ligaSiguiente.String }
+		if serie.Valid { line.Serie = &serie.String }
+		r.Lines = append(r.Lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		return dto.RectifyingInvoiceDTO{}, fmt.Errorf("error iterating lines of rectifying invoice %d: %w", id, err)
+	}
+	return r, nil
+}
+
+// ListRectifyingInvoicesFor returns the headers of the rectifying invoices of an
+// invoice of a tenant, oldest first.
+func ListRectifyingInvoicesFor(db *sql.DB, tenantID, invoiceID int) ([]dto.RectifyingInvoiceHeaderDTO, error) {
+	rows, err := db.Query(`SELECT`+rectifyingInvoiceColumns+` FROM rectifying_invoices WHERE tenant_id = $1 AND factura_rectificada = $2 ORDER BY codigo;`, tenantID, invoiceID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing rectifying invoices of invoice id %d: %w", invoiceID, err)
+	}
+	defer rows.Close()
+	headers := []dto.RectifyingInvoiceHeaderDTO{}
+	for rows.Next() {
+		h, err := scanRectifyingInvoiceHeader(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning rectifying invoice: %w", err)
+		}
+		headers = append(headers, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rectifying invoices: %w", err)
+	}
+	return headers, nil
+}
@@ -0,0 +1,448 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// salesCTE selects the invoices of a tenant that count as sales between two fechas
+// ($2 included, $3 excluded), archived or not: every invoice but the voided ones.
+const salesCTE = `
+WITH sales AS (
+    SELECT fecha, total, tipo_cobro, vendedor, comensales, cobro_mixto, efectivo_mixto,
+        iva1, base1, cuota_iva1, iva2, base2, cuota_iva2, iva3, base3, cuota_iva3,
+        iva4, base4, cuota_iva4, iva5, base5, cuota_iva5, iva6, base6, cuota_iva6
+    FROM invoices
+    WHERE tenant_id = $1 AND fecha >= $2 AND fecha < $3 AND estado <> 'voided'
+    UNION ALL
+    SELECT fecha, total, tipo_cobro, vendedor, comensales, cobro_mixto, efectivo_mixto,
+        iva1, base1, cuota_iva1, iva2, base2, cuota_iva2, iva3, base3, cuota_iva3,
+        iva4, base4, cuota_iva4, iva5, base5, cuota_iva5, iva6, base6, cuota_iva6
+    FROM invoices_archive
+    WHERE tenant_id = $1 AND fecha >= $2 AND fecha < $3 AND estado <> 'voided'
+)`
+
+const (
+	dailySalesSQL = salesCTE + `
+SELECT fecha::date, COUNT(*), COALESCE(SUM(total), 0),
+    COALESCE(SUM(comensales) FILTER (WHERE comensales > 0), 0),
+    COALESCE(SUM(total) FILTER (WHERE comensales > 0), 0),
+    COALESCE(SUM(cobro_mixto), 0), COALESCE(SUM(efectivo_mixto), 0)
+FROM sales
+GROUP BY 1
+ORDER BY 1;`
+
+	// The six base/rate/quota groups of each invoice are unpivoted, so a rate adds up
+	// whichever group it was in.
+	dailyVATRatesSQL = salesCTE + `
+SELECT s.fecha::date, COALESCE(v.rate, 0), COALESCE(SUM(v.base), 0), COALESCE(SUM(v.cuota), 0)
+FROM sales s
+CROSS JOIN LATERAL (VALUES
+    (s.iva1, s.base1, s.cuota_iva1), (s.iva2, s.base2, s.cuota_iva2), (s.iva3, s.base3, s.cuota_iva3),
+    (s.iva4, s.base4, s.cuota_iva4), (s.iva5, s.base5, s.cuota_iva5), (s.iva6, s.base6, s.cuota_iva6)
+) AS v(rate, base, cuota)
+WHERE COALESCE(v.base, 0) <> 0 OR COALESCE(v.cuota, 0) <> 0
+GROUP BY 1, 2
+ORDER BY 1, 2;`
+
+	dailyPaymentsSQL = salesCTE + `
+SELECT fecha::date, tipo_cobro, COUNT(*), COALESCE(SUM(total), 0),
+    COALESCE(SUM(cobro_mixto), 0), COALESCE(SUM(efectivo_mixto), 0)
+FROM sales
+GROUP BY 1, 2
+ORDER BY 1, 2 NULLS LAST;`
+
+	dailyVendedoresSQL = salesCTE + `
+SELECT fecha::date, vendedor, COUNT(*), COALESCE(SUM(total), 0),
+    COALESCE(SUM(comensales) FILTER (WHERE comensales > 0), 0)
+FROM sales
+GROUP BY 1, 2
+ORDER BY 1, 2 NULLS LAST;`
+)
+
+// GetDailyReport returns the daily sales and VAT summary of a tenant from one day to
+// another, both included. The aggregates are read in one snapshot, so they add up to
+// each other.
+func GetDailyReport(db *sql.DB, tenantID int, from, to time.Time) (dto.DailyReportDTO, error) {
+	report := dto.DailyReportDTO{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Days: []dto.DailySalesDTO{}}
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return report, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+	args := []interface{}{tenantID, from, to.AddDate(0, 0, 1)}
+
+	days := map[string]*dto.DailySalesDTO{}
+	err = queryReportRows(tx, dailySalesSQL, args, func(rows *sql.Rows) error {
+		var fecha time.Time
+		var s dto.DailySalesDTO
+		if err := rows.Scan(&fecha, &s.Invoices, &s.Total, &s.Comensales, &s.TotalWithComensales, &s.CobroMixto, &s.EfectivoMixto); err != nil {
+			return err
+		}
+		s.Fecha = fecha.Format("2006-01-02")
+		s.VATRates, s.PaymentMethods, s.Vendedores = []dto.VATRateSalesDTO{}, []dto.PaymentSalesDTO{}, []dto.VendedorSalesDTO{}
+		report.Days = append(report.Days, s)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error querying daily sales: %w", err)
+	}
+	for i := range report.Days {
+		days[report.Days[i].Fecha] = &report.Days[i]
+	}
+	day := func(fecha time.Time) (*dto.DailySalesDTO, error) {
+		if d, ok := days[fecha.Format("2006-01-02")]; ok {
+			return d, nil
+		}
+		return nil, fmt.Errorf("no sales on %s", fecha.Format("2006-01-02"))
+	}
+
+	err = queryReportRows(tx, dailyVATRatesSQL, args, func(rows *sql.Rows) error {
+		var fecha time.Time
+		var r dto.VATRateSalesDTO
+		if err := rows.Scan(&fecha, &r.Rate, &r.Base, &r.CuotaIVA); err != nil {
+			return err
+		}
+		d, err := day(fecha)
+		if err != nil {
+			return err
+		}
+		d.VATRates = append(d.VATRates, r)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error querying daily VAT rates: %w", err)
+	}
+
+	err = queryReportRows(tx, dailyPaymentsSQL, args, func(rows *sql.Rows) error {
+		var fecha time.Time
+		var tipoCobro sql.NullString
+		var p dto.PaymentSalesDTO
+		if err := rows.Scan(&fecha, &tipoCobro, &p.Invoices, &p.Total, &p.CobroMixto, &p.EfectivoMixto); err != nil {
+			return err
+		}
+		if tipoCobro.Valid { p.TipoCobro = &tipoCobro.String }
+		d, err := day(fecha)
+		if err != nil {
+			return err
+		}
+		d.PaymentMethods = append(d.PaymentMethods, p)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error querying daily payment methods: %w", err)
+	}
+
+	err = queryReportRows(tx, dailyVendedoresSQL, args, func(rows *sql.Rows) error {
+		var fecha time.Time
+		var vendedor sql.NullString
+		var v dto.VendedorSalesDTO
+		if err := rows.Scan(&fecha, &vendedor, &v.Invoices, &v.Total, &v.Comensales); err != nil {
+			return err
+		}
+		if vendedor.Valid { v.Vendedor = &vendedor.String }
+		d, err := day(fecha)
+		if err != nil {
+			return err
+		}
+		d.Vendedores = append(d.Vendedores, v)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error querying daily vendedores: %w", err)
+	}
+
+	for i := range report.Days {
+		report.Days[i].SetAverageTicket()
+	}
+	report.Totals = sumDailySales(report.Days)
+	return report, nil
+}
+
+// queryReportRows runs a report query and calls scan for each row.
+func queryReportRows(tx *sql.Tx, query string, args []interface{}, scan func(*sql.Rows) error) error {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sumDailySales adds up the days of a report into its totals.
+func sumDailySales(days []dto.DailySalesDTO) dto.DailySalesDTO {
+	totals := dto.DailySalesDTO{}
+	rates := money.SumByRate{}
+	quotas := money.SumByRate{}
+	payments := map[string]*dto.PaymentSalesDTO{}
+	vendedores := map[string]*dto.VendedorSalesDTO{}
+	var paymentKeys, vendedorKeys []string
+	for _, d := range days {
+		totals.Invoices += d.Invoices
+		totals.Total = totals.Total.Add(d.Total)
+		totals.Comensales += d.Comensales
+		totals.TotalWithComensales = totals.TotalWithComensales.Add(d.TotalWithComensales)
+		totals.CobroMixto = totals.CobroMixto.Add(d.CobroMixto)
+		totals.EfectivoMixto = totals.EfectivoMixto.Add(d.EfectivoMixto)
+		for _, r := range d.VATRates {
+			rates.Add(r.Rate, r.Base)
+			quotas.Add(r.Rate, r.CuotaIVA)
+		}
+		for _, p := range d.PaymentMethods {
+			key := reportKey(p.TipoCobro)
+			t, ok := payments[key]
+			if !ok {
+				t = &dto.PaymentSalesDTO{TipoCobro: p.TipoCobro}
+				payments[key] = t
+				paymentKeys = append(paymentKeys, key)
+			}
+			t.Invoices += p.Invoices
+			t.Total = t.Total.Add(p.Total)
+			t.CobroMixto = t.CobroMixto.Add(p.CobroMixto)
+			t.EfectivoMixto = t.EfectivoMixto.Add(p.EfectivoMixto)
+		}
+		for _, v := range d.Vendedores {
+			key := reportKey(v.Vendedor)
+			t, ok := vendedores[key]
+			if !ok {
+				t = &dto.VendedorSalesDTO{Vendedor: v.Vendedor}
+				vendedores[key] = t
+				vendedorKeys = append(vendedorKeys, key)
+			}
+			t.Invoices += v.Invoices
+			t.Total = t.Total.Add(v.Total)
+			t.Comensales += v.Comensales
+		}
+	}
+
+	totals.VATRates = []dto.VATRateSalesDTO{}
+	for _, r := range rates.Sorted() {
+		totals.VATRates = append(totals.VATRates, dto.VATRateSalesDTO{Rate: r.Rate, Base: r.Amount, CuotaIVA: quotas[r.Rate]})
+	}
+	totals.PaymentMethods = []dto.PaymentSalesDTO{}
+	sort.Strings(paymentKeys)
+	for _, key := range paymentKeys {
+		totals.PaymentMethods = append(totals.PaymentMethods, *payments[key])
+	}
+	totals.Vendedores = []dto.VendedorSalesDTO{}
+	sort.Strings(vendedorKeys)
+	for _, key := range vendedorKeys {
+		totals.Vendedores = append(totals.Vendedores, *vendedores[key])
+	}
+	totals.SetAverageTicket()
+	return totals
+}
+
+// reportKey returns the key a nullable grouping column is added up under; NULL sorts
+// last, as in the queries.
+func reportKey(s *string) string {
+	if s == nil {
+		return "\xff"
+	}
+	return *s
+}
+
+// vatGroupColumns are the base/rate/quota columns of the six VAT groups of invoices,
+// in the order scanVATGroups reads them.
+const vatGroupColumns = `
+    iva1, base1, cuota_iva1, recargo1, cuota_recargo1, iva2, base2, cuota_iva2, recargo2, cuota_recargo2,
+    iva3, base3, cuota_iva3, recargo3, cuota_recargo3, iva4, base4, cuota_iva4, recargo4, cuota_recargo4,
+    iva5, base5, cuota_iva5, recargo5, cuota_recargo5, iva6, base6, cuota_iva6, recargo6, cuota_recargo6`
+
+// vatGroupFields returns the fields of h the VAT group columns are scanned into, in
+// the order of vatGroupColumns; rectifying invoices only have the first three groups,
+// without surcharges.
+func vatGroupFields(h *dto.InvoiceHeaderDTO, groups int, surcharges bool) []**money.Decimal {
+	all := [][5]**money.Decimal{
+		{&h.Iva1, &h.Base1, &h.CuotaIva1, &h.Recargo1, &h.CuotaRecargo1},
+		{&h.Iva2, &h.Base2, &h.CuotaIva2, &h.Recargo2, &h.CuotaRecargo2},
+		{&h.Iva3, &h.Base3, &h.CuotaIva3, &h.Recargo3, &h.CuotaRecargo3},
+		{&h.Iva4, &h.Base4, &h.CuotaIva4, &h.Recargo4, &h.CuotaRecargo4},
+		{&h.Iva5, &h.Base5, &h.CuotaIva5, &h.Recargo5, &h.CuotaRecargo5},
+		{&h.Iva6, &h.Base6, &h.CuotaIva6, &h.Recargo6, &h.CuotaRecargo6},
+	}
+	var fields []**money.Decimal
+	for _, g := range all[:groups] {
+		if surcharges {
+			fields = append(fields, g[:]...)
+		} else {
+			fields = append(fields, g[:3]...)
+		}
+	}
+	return fields
+}
+
+// scanDocument scans a row of ListIssuedDocuments' queries: the columns of the
+// document (cols), then those of the VAT groups into groups.
+func scanDocument(rows *sql.Rows, groups []**money.Decimal, cols ...interface{}) error {
+	decimals := make([]money.NullDecimal, len(groups))
+	for i := range decimals {
+		cols = append(cols, &decimals[i])
+	}
+	if err := rows.Scan(cols...); err != nil {
+		return err
+	}
+	for i, d := range decimals {
+		if d.Valid { v := d.Decimal; *groups[i] = &v }
+	}
+	return nil
+}
+
+// paymentColumns are the payment columns of invoices and rectifying invoices, in the
+// order scanPayment reads them.
+const paymentColumns = `tipo_cobro, cobro_mixto, tipo_cobro_mixto, cobro_mixto2, tipo_cobro_mixto2, efectivo_mixto`
+
+// qualifiedColumns prefixes each of the comma separated columns with table.
+func qualifiedColumns(table, columns string) string {
+	names := strings.Split(columns, ",")
+	for i, n := range names {
+		names[i] = table + "." + strings.TrimSpace(n)
+	}
+	return " " + strings.Join(names, ", ")
+}
+
+// paymentFields returns the fields the payment columns are scanned into, and a function
+// setting d's payment from them once scanned.
+func paymentFields(d *dto.IssuedDocumentDTO) ([]interface{}, func()) {
+	var tipoCobro, tipoCobroMixto, tipoCobroMixto2 sql.NullString
+	var cobroMixto, cobroMixto2, efectivoMixto money.NullDecimal
+	fields := []interface{}{&tipoCobro, &cobroMixto, &tipoCobroMixto, &cobroMixto2, &tipoCobroMixto2, &efectivoMixto}
+	return fields, func() {
+		p := &d.Payment
+		if tipoCobro.Valid { p.TipoCobro = &tipoCobro.String }
+		if cobroMixto.Valid { p.CobroMixto = cobroMixto.Decimal }
+		if tipoCobroMixto.Valid { p.TipoCobroMixto = &tipoCobroMixto.String }
+		if cobroMixto2.Valid { p.CobroMixto2 = cobroMixto2.Decimal }
+		if tipoCobroMixto2.Valid { p.TipoCobroMixto2 = &tipoCobroMixto2.String }
+		if efectivoMixto.Valid { p.EfectivoMixto = efectivoMixto.Decimal }
+	}
+}
+
+// ListIssuedDocuments returns the invoices, archived or not, and the rectifying
+// invoices a tenant issued from one day to another, both included, in the order of
+// the VAT books: by fecha, then number. Voided invoices are left out.
+func ListIssuedDocuments(db *sql.DB, tenantID int, from, to time.Time) ([]dto.IssuedDocumentDTO, error) {
+	args := []interface{}{tenantID, from, to.AddDate(0, 0, 1)}
+	docs := []dto.IssuedDocumentDTO{}
+
+	invoiceColumns := `serie, codigo, fecha, total, terminal, cliente1, cliente3, causa_exencion, ` + paymentColumns + `,` + vatGroupColumns
+	rows, err := db.Query(`
+SELECT`+invoiceColumns+` FROM invoices
+WHERE tenant_id = $1 AND fecha >= $2 AND fecha < $3 AND estado <> 'voided'
+UNION ALL
+SELECT`+invoiceColumns+` FROM invoices_archive
+WHERE tenant_id = $1 AND fecha >= $2 AND fecha < $3 AND estado <> 'voided';`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying issued invoices: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d dto.IssuedDocumentDTO
+		var h dto.InvoiceHeaderDTO
+		var fecha time.Time
+		var terminal, cliente1, cliente3, causaExencion sql.NullString
+		payment, setPayment := paymentFields(&d)
+		cols := append([]interface{}{&d.Serie, &d.Codigo, &fecha, &d.Total, &terminal, &cliente1, &cliente3, &causaExencion}, payment...)
+		err := scanDocument(rows, vatGroupFields(&h, 6, true), cols...)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning issued invoice: %w", err)
+		}
+		d.Fecha = fecha.Format("2006-01-02")
+		if terminal.Valid { d.Terminal = &terminal.String }
+		if cliente1.Valid { d.Nombre = &cliente1.String }
+		if cliente3.Valid { d.NIF = &cliente3.String }
+		if causaExencion.Valid { d.CausaExencion = &causaExencion.String }
+		setPayment()
+		d.VATGroups = h.VATGroups()
+		docs = append(docs, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating issued invoices: %w", err)
+	}
+
+	// The exemption cause of 0% bases is the rectified invoice's, as in
+	// RectifyingInvoiceDTO.Invoice. The rectified invoice's total and VAT groups are
+	// read too, for the journal to book what a substitution changes.
+	originalColumns := ` tenant_id, codigo, serie, causa_exencion, total,` + vatGroupColumns
+	rrows, err := db.Query(`
+SELECT r.serie, r.codigo, r.fecha, r.total, r.terminal, r.cliente1, r.cliente3, o.causa_exencion,`+qualifiedColumns("r", paymentColumns)+`,
+    r.tipo_rectificativa, r.tipo_rectificacion, r.motivo, r.base_rectificada, r.cuota_rectificada,
+    o.serie, r.factura_rectificada, r.fecha_factura_rectificada, o.total,
+    r.iva1, r.base1, r.cuota_iva1, r.iva2, r.base2, r.cuota_iva2, r.iva3, r.base3, r.cuota_iva3,`+
+		qualifiedColumns("o", vatGroupColumns)+`
+FROM rectifying_invoices r
+LEFT JOIN (
+    SELECT`+originalColumns+` FROM invoices
+    UNION ALL
+    SELECT`+originalColumns+` FROM invoices_archive
+) o ON o.tenant_id = r.tenant_id AND o.codigo = r.factura_rectificada
+WHERE r.tenant_id = $1 AND r.fecha >= $2 AND r.fecha < $3;`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying issued rectifying invoices: %w", err)
+	}
+	defer rrows.Close()
+	for rrows.Next() {
+		var d dto.IssuedDocumentDTO
+		var h, o dto.InvoiceHeaderDTO
+		var rect dto.RectificationDTO
+		var fecha, originalFecha time.Time
+		var terminal, cliente1, cliente3, causaExencion, motivo, originalSerie sql.NullString
+		var baseRectificada, cuotaRectificada, originalTotal money.NullDecimal
+		var original int
+		payment, setPayment := paymentFields(&d)
+		cols := append([]interface{}{&d.Serie, &d.Codigo, &fecha, &d.Total, &terminal, &cliente1, &cliente3, &causaExencion}, payment...)
+		cols = append(cols, &rect.Tipo, &rect.Metodo, &motivo, &baseRectificada, &cuotaRectificada, &originalSerie, &original, &originalFecha, &originalTotal)
+		groups := append(vatGroupFields(&h, 3, false), vatGroupFields(&o, 6, true)...)
+		err := scanDocument(rrows, groups, cols...)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning issued rectifying invoice: %w", err)
+		}
+		d.Fecha = fecha.Format("2006-01-02")
+		if terminal.Valid { d.Terminal = &terminal.String }
+		if cliente1.Valid { d.Nombre = &cliente1.String }
+		if cliente3.Valid { d.NIF = &cliente3.String }
+		if causaExencion.Valid { d.CausaExencion = &causaExencion.String }
+		if motivo.Valid { rect.Motivo = &motivo.String }
+		if baseRectificada.Valid { rect.BaseRectificada = &baseRectificada.Decimal }
+		if cuotaRectificada.Valid { rect.CuotaRectificada = &cuotaRectificada.Decimal }
+		rect.Original = originalSerie.String + "-" + strconv.Itoa(original)
+		of := originalFecha.Format("2006-01-02")
+		rect.OriginalFecha = &of
+		if originalTotal.Valid { rect.OriginalTotal = originalTotal.Decimal }
+		rect.OriginalVATGroups = o.VATGroups()
+		setPayment()
+		d.Rectification = &rect
+		d.VATGroups = h.VATGroups()
+		docs = append(docs, d)
+	}
+	if err := rrows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating issued rectifying invoices: %w", err)
+	}
+
+	sort.SliceStable(docs, func(i, j int) bool {
+		a, b := docs[i], docs[j]
+		if a.Fecha != b.Fecha {
+			return a.Fecha < b.Fecha
+		}
+		if (a.Rectification == nil) != (b.Rectification == nil) {
+			return a.Rectification == nil // Invoices before rectifying invoices
+		}
+		if a.Serie != b.Serie {
+			return a.Serie < b.Serie
+		}
+		return a.Codigo < b.Codigo
+	})
+	return docs, nil
+}
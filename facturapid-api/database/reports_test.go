@@ -0,0 +1,126 @@
+package database
+
+import (
+	"encoding/json"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func intPtr(i int) *int { return &i }
+
+// TestGetDailyReport aggregates two days of seeded sales: a voided invoice is left out,
+// and a rectifying invoice is not netted against the sales of its day, while the
+// invoice it rectifies still counts in full.
+func TestGetDailyReport(t *testing.T) {
+	db := testDB(t)
+	tenantID := testTenant(t, db)
+
+	inv1 := testInvoice(1, "2025-04-07", "10")
+	inv1.Header.Vendedor, inv1.Header.Comensales = strPtr("Ana"), intPtr(2)
+	inv2 := testInvoice(2, "2025-04-07", "20")
+	inv2.Header.Vendedor, inv2.Header.TipoCobro = strPtr("Luis"), strPtr("TARJETA")
+	inv3 := testInvoice(3, "2025-04-07", "100")
+	inv4 := testInvoice(4, "2025-04-08", "40")
+	inv4.Header.Vendedor, inv4.Header.Comensales = strPtr("Ana"), intPtr(3)
+	inv4.Header.Base2, inv4.Header.Iva2, inv4.Header.CuotaIva2 = decPtr("10"), decPtr("10"), decPtr("1")
+	inv4.Header.CuotaIVA, inv4.Header.Total = decPtr("9.40"), money.MustParse("59.40")
+	outside := testInvoice(5, "2025-04-09", "50")
+	createInvoices(t, db, tenantID, inv1, inv2, inv3, inv4, outside)
+
+	actor := dto.SystemActor("test")
+	if _, err := VoidInvoice(db, tenantID, 3, "Ticket duplicado", actor); err != nil {
+		t.Fatal(err)
+	}
+	// A return of half of invoice 2, rectified by differences the next day
+	rectifying := dto.RectifyingInvoiceDTO{
+		Header: dto.RectifyingInvoiceHeaderDTO{
+			Codigo: 1, Serie: "R", Tarifa: "1", Fecha: strPtr("2025-04-08"), Hora: strPtr("13:00:00"),
+			Total: money.MustParse("-12.10"), TipoCobro: strPtr("TARJETA"), Vendedor: strPtr("Luis"),
+			Base1: decPtr("-10"), Iva1: decPtr("21"), CuotaIva1: decPtr("-2.10"), CuotaIVA: decPtr("-2.10"),
+			FacturaRectificada: 2, TipoRectificativa: dto.RectificationR5, TipoRectificacion: dto.RectificationByDifferences,
+		},
+		Lines: []dto.RectifyingInvoiceLineDTO{{CodigoFactura: 1, Linea: 1, Producto: "Menú del día", Unidades: money.MustParse("-1"), Subtotal: money.MustParse("-10"), IvaAplicado: decPtr("21")}},
+	}
+	if _, err := CreateRectifyingInvoice(db, tenantID, rectifying, actor); err != nil {
+		t.Fatal(err)
+	}
+
+	from, to := time.Date(2025, 4, 7, 0, 0, 0, 0, time.UTC), time.Date(2025, 4, 8, 0, 0, 0, 0, time.UTC)
+	report, err := GetDailyReport(db, tenantID, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := money.MustParse
+	efectivo, tarjeta := strPtr("EFECTIVO"), strPtr("TARJETA")
+	want := dto.DailyReportDTO{
+		From: "2025-04-07", To: "2025-04-08",
+		Days: []dto.DailySalesDTO{
+			{
+				Fecha: "2025-04-07", Invoices: 2, Total: d("36.30"), Comensales: 2,
+				AverageTicketPerDiner: decPtr("6.05"), TotalWithComensales: d("12.10"),
+				VATRates: []dto.VATRateSalesDTO{{Rate: d("21"), Base: d("30"), CuotaIVA: d("6.30")}},
+				PaymentMethods: []dto.PaymentSalesDTO{
+					{TipoCobro: efectivo, Invoices: 1, Total: d("12.10")},
+					{TipoCobro: tarjeta, Invoices: 1, Total: d("24.20")},
+				},
+				Vendedores: []dto.VendedorSalesDTO{
+					{Vendedor: strPtr("Ana"), Invoices: 1, Total: d("12.10"), Comensales: 2},
+					{Vendedor: strPtr("Luis"), Invoices: 1, Total: d("24.20")},
+				},
+			},
+			{
+				Fecha: "2025-04-08", Invoices: 1, Total: d("59.40"), Comensales: 3,
+				AverageTicketPerDiner: decPtr("19.80"), TotalWithComensales: d("59.40"),
+				VATRates: []dto.VATRateSalesDTO{
+					{Rate: d("10"), Base: d("10"), CuotaIVA: d("1")},
+					{Rate: d("21"), Base: d("40"), CuotaIVA: d("8.40")},
+				},
+				PaymentMethods: []dto.PaymentSalesDTO{{TipoCobro: efectivo, Invoices: 1, Total: d("59.40")}},
+				Vendedores:     []dto.VendedorSalesDTO{{Vendedor: strPtr("Ana"), Invoices: 1, Total: d("59.40"), Comensales: 3}},
+			},
+		},
+		Totals: dto.DailySalesDTO{
+			Invoices: 3, Total: d("95.70"), Comensales: 5,
+			AverageTicketPerDiner: decPtr("14.30"), TotalWithComensales: d("71.50"),
+			VATRates: []dto.VATRateSalesDTO{
+				{Rate: d("10"), Base: d("10"), CuotaIVA: d("1")},
+				{Rate: d("21"), Base: d("70"), CuotaIVA: d("14.70")},
+			},
+			PaymentMethods: []dto.PaymentSalesDTO{
+				{TipoCobro: efectivo, Invoices: 2, Total: d("71.50")},
+				{TipoCobro: tarjeta, Invoices: 1, Total: d("24.20")},
+			},
+			Vendedores: []dto.VendedorSalesDTO{
+				{Vendedor: strPtr("Ana"), Invoices: 2, Total: d("71.50"), Comensales: 5},
+				{Vendedor: strPtr("Luis"), Invoices: 1, Total: d("24.20")},
+			},
+		},
+	}
+	if !reflect.DeepEqual(report, want) {
+		got, _ := json.MarshalIndent(report, "", "  ")
+		exp, _ := json.MarshalIndent(want, "", "  ")
+		t.Errorf("GetDailyReport =\n%s\nwant\n%s", got, exp)
+	}
+
+	// The rectifying invoice is in the VAT books instead, and the voided invoice is not
+	docs, err := ListIssuedDocuments(db, tenantID, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []string
+	for _, doc := range docs {
+		n := fmt.Sprintf("%s-%d %s", doc.Serie, doc.Codigo, doc.Total)
+		if doc.Rectification != nil {
+			n += " rectifies " + doc.Rectification.Original
+		}
+		numbers = append(numbers, n)
+	}
+	if want := []string{"A-1 12.1", "A-2 24.2", "A-4 59.4", "R-1 -12.1 rectifies A-2"}; !reflect.DeepEqual(numbers, want) {
+		t.Errorf("issued documents = %q, want %q", numbers, want)
+	}
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"database/sql"
+	"facturapid-api/dto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// schemaDB connects to the test database with search_path set to a new, empty schema,
+// dropped after the test, or skips the test.
+func schemaDB(t *testing.T) *sql.DB {
+	t.Helper()
+	connStr := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if connStr == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	admin, err := InitDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+	schema := "upgrade_" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema + `;`); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE;`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+	})
+
+	// lib/pq sends the parameters it does not know as run-time parameters
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		u, err := url.Parse(connStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		connStr = u.String()
+	} else {
+		connStr += " search_path=" + schema
+	}
+	db, err := InitDB(connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// TestCreateSchemaUpgradesBaseline creates the schema over a database of the first
+// release, which has no tenants, partitions nor the tables referencing invoices.
+func TestCreateSchemaUpgradesBaseline(t *testing.T) {
+	db := schemaDB(t)
+	baseline, err := os.ReadFile("testdata/baseline_schema.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(string(baseline)); err != nil {
+		t.Fatalf("creating baseline schema: %v", err)
+	}
+	_, err = db.Exec(`
+INSERT INTO invoices (codigo, fecha, fecha_de_factura, tarifa, serie, cliente1, total)
+VALUES (1, '2025-06-10', NULL, '1', 'A', 'B12345678', 12.1000),
+       (2, NULL, '2025-06-11', '1', 'A', NULL, 24.2000);
+INSERT INTO invoice_lines (codigo_factura, producto, linea, combinado_con, subtotal, unidades)
+VALUES (1, 'Menú del día', 1, '', 10.0000, 1), (2, 'Menú del día', 1, '', 20.0000, 2);`)
+	if err != nil {
+		t.Fatalf("seeding baseline rows: %v", err)
+	}
+
+	if err := CreateSchema(db); err != nil {
+		t.Fatalf("CreateSchema over the baseline: %v", err)
+	}
+	if err := CreateSchema(db); err != nil {
+		t.Fatalf("CreateSchema over the upgraded schema: %v", err)
+	}
+
+	var migrated bool
+	err = db.QueryRow(`
+SELECT EXISTS (
+    SELECT 1 FROM pg_constraint c JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+    WHERE c.conrelid = 'invoices'::regclass AND c.contype = 'p' AND a.attname = 'tenant_id'
+);`).Scan(&migrated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !migrated {
+		t.Error("invoices key has no tenant_id")
+	}
+	for _, table := range []string{"rectifying_invoices", "invoice_pdfs", "email_deliveries", "fiscal_profile_codes", "invoices_archive"} {
+		exists, err := tableExists(db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("table %s not created", table)
+		}
+	}
+
+	for codigo, fecha := range map[int]string{1: "2025-06-10", 2: "2025-06-11"} {
+		inv, err := GetFullInvoiceByID(db, dto.DefaultTenantID, codigo)
+		if err != nil {
+			t.Fatalf("GetFullInvoiceByID(%d): %v", codigo, err)
+		}
+		if inv.Header.Fecha == nil || *inv.Header.Fecha != fecha {
+			t.Errorf("invoice %d: fecha = %v, want %s", codigo, inv.Header.Fecha, fecha)
+		}
+		if len(inv.Lines) != 1 {
+			t.Errorf("invoice %d: %d lines, want 1", codigo, len(inv.Lines))
+		}
+	}
+
+	// New invoices are stored on the upgraded schema
+	createInvoices(t, db, dto.DefaultTenantID, testInvoice(3, "2025-06-12", "10.00"))
+}
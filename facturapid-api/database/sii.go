@@ -0,0 +1,259 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"time"
+)
+
+// ErrSIIBatchNotFound is returned when a tenant has no SII batch with an ID.
+var ErrSIIBatchNotFound = errors.New("SII batch not found")
+
+const (
+	createSIITablesSQL = `
+CREATE TABLE IF NOT EXISTS sii_batches (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    issuer_nif VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'sending', -- sending, accepted, partially_accepted, rejected, failed
+    records INTEGER NOT NULL,
+    xml_sha256 CHAR(64) NOT NULL,
+    csv VARCHAR(30),
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    answered_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_sii_batches_tenant ON sii_batches (tenant_id, id);
+
+-- Not a foreign key to the invoices: rectifying invoices are documents too, and the
+-- state must outlive the archival of the invoice.
+CREATE TABLE IF NOT EXISTS sii_submissions (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    number VARCHAR(20) NOT NULL,
+    issue_date DATE NOT NULL,
+    invoice_type VARCHAR(2) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, accepted, accepted_with_errors, rejected
+    batch_id INTEGER NOT NULL REFERENCES sii_batches(id), -- The last batch it was sent in
+    attempts INTEGER NOT NULL DEFAULT 1,
+    csv VARCHAR(30),
+    error_code INTEGER,
+    error_description TEXT,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    UNIQUE (tenant_id, number)
+);
+CREATE INDEX IF NOT EXISTS idx_sii_submissions_batch ON sii_submissions (batch_id);
+`
+
+	siiBatchColumns = `
+    id, issuer_nif, status, records, xml_sha256, csv, error, created_at, answered_at`
+
+	siiSubmissionColumns = `
+    id, number, issue_date, invoice_type, status, batch_id, attempts, csv, error_code,
+    error_description, updated_at`
+)
+
+func scanSIIBatch(row scanner) (dto.SIIBatchDTO, error) {
+	var b dto.SIIBatchDTO
+	var csv, errorText sql.NullString
+	var answeredAt sql.NullTime
+	err := row.Scan(&b.ID, &b.IssuerNIF, &b.Status, &b.Records, &b.XMLSHA256, &csv, &errorText, &b.CreatedAt, &answeredAt)
+	if err != nil {
+		return dto.SIIBatchDTO{}, err
+	}
+	if csv.Valid { b.CSV = &csv.String }
+	if errorText.Valid { b.Error = &errorText.String }
+	if answeredAt.Valid { b.AnsweredAt = &answeredAt.Time }
+	return b, nil
+}
+
+func scanSIISubmission(row scanner) (dto.SIISubmissionDTO, error) {
+	var s dto.SIISubmissionDTO
+	var issueDate time.Time
+	var csv, errorDescription sql.NullString
+	var errorCode sql.NullInt64
+	err := row.Scan(
+		&s.ID, &s.Number, &issueDate, &s.InvoiceType, &s.Status, &s.BatchID, &s.Attempts, &csv, &errorCode,
+		&errorDescription, &s.UpdatedAt,
+	)
+	if err != nil {
+		return dto.SIISubmissionDTO{}, err
+	}
+	s.IssueDate = issueDate.Format("2006-01-02")
+	if csv.Valid { s.CSV = &csv.String }
+	if errorCode.Valid { code := int(errorCode.Int64); s.ErrorCode = &code }
+	if errorDescription.Valid { s.ErrorDescription = &errorDescription.String }
+	return s, nil
+}
+
+// SIISubmissionStatuses returns the SII status of the documents of a tenant issued
+// from one day to another, both included, by number. Documents never sent are absent.
+func SIISubmissionStatuses(db *sql.DB, tenantID int, from, to time.Time) (map[string]string, error) {
+	rows, err := db.Query(`
+SELECT number, status FROM sii_submissions
+WHERE tenant_id = $1 AND issue_date >= $2 AND issue_date <= $3;`, tenantID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error querying SII submissions: %w", err)
+	}
+	defer rows.Close()
+	statuses := map[string]string{}
+	for rows.Next() {
+		var number, status string
+		if err := rows.Scan(&number, &status); err != nil {
+			return nil, fmt.Errorf("error scanning SII submission: %w", err)
+		}
+		statuses[number] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating SII submissions: %w", err)
+	}
+	return statuses, nil
+}
+
+// CreateSIIBatch records a batch about to be sent and marks its documents as pending
+// in it, in one transaction. Documents sent before count one more attempt.
+func CreateSIIBatch(db *sql.DB, tenantID int, batch dto.SIIBatchDTO, docs []dto.IssuedDocumentDTO) (dto.SIIBatchDTO, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return dto.SIIBatchDTO{}, fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created, err := scanSIIBatch(tx.QueryRow(`
+INSERT INTO sii_batches (tenant_id, issuer_nif, records, xml_sha256)
+VALUES ($1, $2, $3, $4)
+RETURNING`+siiBatchColumns+`;`,
+		tenantID, batch.IssuerNIF, len(docs), batch.XMLSHA256,
+	))
+	if err != nil {
+		return dto.SIIBatchDTO{}, fmt.Errorf("error inserting SII batch: %w", err)
+	}
+	for _, d := range docs {
+		_, err := tx.Exec(`
+INSERT INTO sii_submissions (tenant_id, number, issue_date, invoice_type, batch_id)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (tenant_id, number) DO UPDATE SET
+    issue_date = EXCLUDED.issue_date, invoice_type = EXCLUDED.invoice_type, status = 'pending',
+    batch_id = EXCLUDED.batch_id, attempts = sii_submissions.attempts + 1, updated_at = NOW();`,
+			tenantID, d.Number(), d.Fecha, d.InvoiceType(), created.ID,
+		)
+		if err != nil {
+			return dto.SIIBatchDTO{}, fmt.Errorf("error recording SII submission of %s: %w", d.Number(), err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return dto.SIIBatchDTO{}, fmt.Errorf("error committing SII batch: %w", err)
+	}
+	return created, nil
+}
+
+// RecordSIIBatchAnswer records the SII's answer to a batch: the batch status and CSV,
+// and the result of each document. Documents the answer leaves out stay pending.
+func RecordSIIBatchAnswer(db *sql.DB, tenantID, batchID int, status string, csv *string, results []dto.SIIRecordResultDTO) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE sii_batches SET status = $3, csv = $4, error = NULL, answered_at = NOW() WHERE tenant_id = $1 AND id = $2;`,
+		tenantID, batchID, status, csv)
+	if err != nil {
+		return fmt.Errorf("error recording answer to SII batch %d: %w", batchID, err)
+	}
+	for _, r := range results {
+		_, err := tx.Exec(`
+UPDATE sii_submissions SET status = $4, csv = $5, error_code = $6, error_description = $7, updated_at = NOW()
+WHERE tenant_id = $1 AND batch_id = $2 AND number = $3;`,
+			tenantID, batchID, r.Number, r.Status, r.CSV, r.ErrorCode, r.ErrorDescription,
+		)
+		if err != nil {
+			return fmt.Errorf("error recording SII result of %s: %w", r.Number, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing answer to SII batch %d: %w", batchID, err)
+	}
+	return nil
+}
+
+// MarkSIIBatchFailed records that a batch got no answer, or a SOAP fault. Its documents
+// stay pending, to be sent with the next batch.
+func MarkSIIBatchFailed(db *sql.DB, tenantID, batchID int, cause string) error {
+	_, err := db.Exec(`UPDATE sii_batches SET status = 'failed', error = $3, answered_at = NOW() WHERE tenant_id = $1 AND id = $2;`,
+		tenantID, batchID, cause)
+	if err != nil {
+		return fmt.Errorf("error recording failure of SII batch %d: %w", batchID, err)
+	}
+	return nil
+}
+
+// ListSIIBatches returns up to limit SII batches of a tenant, newest first.
+func ListSIIBatches(db *sql.DB, tenantID, limit int) ([]dto.SIIBatchDTO, error) {
+	rows, err := db.Query(`SELECT`+siiBatchColumns+` FROM sii_batches WHERE tenant_id = $1 ORDER BY id DESC LIMIT $2;`, tenantID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error listing SII batches: %w", err)
+	}
+	defer rows.Close()
+	batches := []dto.SIIBatchDTO{}
+	for rows.Next() {
+		b, err := scanSIIBatch(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning SII batch: %w", err)
+		}
+		batches = append(batches, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating SII batches: %w", err)
+	}
+	return batches, nil
+}
+
+// GetSIIBatch returns an SII batch of a tenant with the documents whose last batch it
+// is.
+func GetSIIBatch(db *sql.DB, tenantID, id int) (dto.SIIBatchDTO, error) {
+	b, err := scanSIIBatch(db.QueryRow(`SELECT`+siiBatchColumns+` FROM sii_batches WHERE tenant_id = $1 AND id = $2;`, tenantID, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.SIIBatchDTO{}, ErrSIIBatchNotFound
+		}
+		return dto.SIIBatchDTO{}, fmt.Errorf("error querying SII batch %d: %w", id, err)
+	}
+	b.Submissions, err = querySIISubmissions(db, `
+SELECT`+siiSubmissionColumns+` FROM sii_submissions WHERE tenant_id = $1 AND batch_id = $2 ORDER BY issue_date, number;`, tenantID, id)
+	if err != nil {
+		return dto.SIIBatchDTO{}, err
+	}
+	return b, nil
+}
+
+// ListSIISubmissions returns up to limit SII submissions of a tenant, all of them or
+// those with a status, the most recently updated first.
+func ListSIISubmissions(db *sql.DB, tenantID int, status string, limit int) ([]dto.SIISubmissionDTO, error) {
+	return querySIISubmissions(db, `
+SELECT`+siiSubmissionColumns+` FROM sii_submissions
+WHERE tenant_id = $1 AND ($2 = '' OR status = $2)
+ORDER BY updated_at DESC, id DESC LIMIT $3;`, tenantID, status, limit)
+}
+
+func querySIISubmissions(db *sql.DB, query string, args ...interface{}) ([]dto.SIISubmissionDTO, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying SII submissions: %w", err)
+	}
+	defer rows.Close()
+	submissions := []dto.SIISubmissionDTO{}
+	for rows.Next() {
+		s, err := scanSIISubmission(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning SII submission: %w", err)
+		}
+		submissions = append(submissions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating SII submissions: %w", err)
+	}
+	return submissions, nil
+}
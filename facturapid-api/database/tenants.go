@@ -0,0 +1,389 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
+
+	"github.com/lib/pq"
+)
+
+// ErrTenantNotFound is returned when no tenant matches an ID or a code.
+var ErrTenantNotFound = errors.New("tenant not found")
+
+// ErrTenantExists is returned by CreateTenant when the code is taken.
+var ErrTenantExists = errors.New("tenant already exists")
+
+// ErrAPIKeyNotFound is returned when no active API key matches a key or an ID.
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+const (
+	// Every invoice, and everything hanging from one, belongs to a tenant: a restaurant
+	// or legal entity with its own invoice numbering. Invoice codigos are unique within
+	// a tenant only, so the keys of the invoice tables start with tenant_id, and every
+	// query of the repository filters by the tenant of the caller's API key.
+	createTenantsTablesSQL = `
+CREATE TABLE IF NOT EXISTS tenants (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(30) NOT NULL UNIQUE, -- The synchronizer's establecimiento
+    name VARCHAR(200) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+INSERT INTO tenants (id, code, name) VALUES (1, 'default', 'Default') ON CONFLICT (id) DO NOTHING;
+SELECT setval('tenants_id_seq', GREATEST((SELECT MAX(id) FROM tenants), 1));
+CREATE TABLE IF NOT EXISTS api_keys (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER REFERENCES tenants(id), -- NULL for platform keys
+    key_hash CHAR(64) NOT NULL UNIQUE,        -- SHA-256 of the key
+    role VARCHAR(10) NOT NULL,                -- client, admin, platform
+    description VARCHAR(200),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    CHECK ((role = 'platform') = (tenant_id IS NULL))
+);
+CREATE INDEX IF NOT EXISTS idx_api_keys_tenant ON api_keys (tenant_id);
+`
+
+	// createTenantIndexesSQL creates the indexes on tenant_id, once migrateTenancy has
+	// added it to the tables of databases created before tenants.
+	createTenantIndexesSQL = `
+DROP INDEX IF EXISTS idx_invoices_fecha_codigo;
+CREATE INDEX IF NOT EXISTS idx_invoices_tenant_fecha_codigo ON invoices (tenant_id, fecha, codigo); -- Listing order
+CREATE INDEX IF NOT EXISTS idx_invoices_archive_tenant_fecha_codigo ON invoices_archive (tenant_id, fecha, codigo);
+DROP INDEX IF EXISTS idx_invoices_archive_codigo;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_invoices_archive_tenant_codigo ON invoices_archive (tenant_id, codigo);
+DROP INDEX IF EXISTS idx_issuer_profiles_default;
+-- At most one default profile per tenant
+CREATE UNIQUE INDEX IF NOT EXISTS idx_issuer_profiles_tenant_default ON issuer_profiles (tenant_id) WHERE is_default;
+CREATE INDEX IF NOT EXISTS idx_webhook_subscriptions_tenant ON webhook_subscriptions (tenant_id);
+`
+
+	tenantColumns = `
+    id, code, name, created_at`
+
+	apiKeyColumns = `
+    id, tenant_id, role, description, created_at, revoked_at`
+)
+
+// tenantTables are the tables whose rows belong to a tenant.
+var tenantTables = []string{
+	"invoices", "invoice_lines", "invoices_archive", "invoice_lines_archive",
+	"issuer_profiles", "rectifying_invoices", "rectifying_invoice_lines",
+	"invoice_pdfs", "rectifying_invoice_pdfs", "email_deliveries",
+	"webhook_subscriptions", "webhook_deliveries", "fiscal_records", "invoice_events",
+	"fiscal_profiles", "fiscal_profile_codes", "data_subject_requests", "sii_batches", "sii_submissions",
+	"account_mappings",
+}
+
+// tenantKeys rebuilds the keys of a database created before tenants, once its tables
+// have a tenant_id: the foreign keys to invoices and rectifying_invoices, dropped
+// first, are added again by migrateTenancy.
+var tenantKeys = []struct{ table, stmt string }{
+	{"invoices", `ALTER TABLE invoices DROP CONSTRAINT invoices_pkey, ADD PRIMARY KEY (tenant_id, codigo, fecha);`},
+	{"invoice_lines", `ALTER TABLE invoice_lines DROP CONSTRAINT invoice_lines_pkey,
+    ADD PRIMARY KEY (tenant_id, codigo_factura, fecha_factura, producto, linea),
+    ADD FOREIGN KEY (tenant_id, codigo_factura, fecha_factura) REFERENCES invoices(tenant_id, codigo, fecha) ON DELETE CASCADE;`},
+	{"invoice_pdfs", `ALTER TABLE invoice_pdfs DROP CONSTRAINT invoice_pdfs_pkey, ADD PRIMARY KEY (tenant_id, invoice_codigo, version, variant);`},
+	{"rectifying_invoices", `ALTER TABLE rectifying_invoices DROP CONSTRAINT rectifying_invoices_pkey, ADD PRIMARY KEY (tenant_id, codigo);`},
+	{"rectifying_invoice_lines", `ALTER TABLE rectifying_invoice_lines DROP CONSTRAINT rectifying_invoice_lines_pkey,
+    ADD PRIMARY KEY (tenant_id, codigo_factura, producto, linea),
+    ADD FOREIGN KEY (tenant_id, codigo_factura) REFERENCES rectifying_invoices(tenant_id, codigo) ON DELETE CASCADE;`},
+	{"rectifying_invoice_pdfs", `ALTER TABLE rectifying_invoice_pdfs DROP CONSTRAINT rectifying_invoice_pdfs_pkey,
+    ADD PRIMARY KEY (tenant_id, invoice_codigo, version, variant),
+    ADD FOREIGN KEY (tenant_id, invoice_codigo) REFERENCES rectifying_invoices(tenant_id, codigo) ON DELETE CASCADE;`},
+	{"fiscal_profiles", `ALTER TABLE fiscal_profiles DROP CONSTRAINT fiscal_profiles_pkey, ADD PRIMARY KEY (tenant_id, nif);`},
+}
+
+// tableExists reports whether table exists.
+func tableExists(q queryRower, table string) (bool, error) {
+	var exists bool
+	if err := q.QueryRow(`SELECT to_regclass($1) IS NOT NULL;`, table).Scan(&exists); err != nil {
+		return false, fmt.Errorf("error querying table %s: %w", table, err)
+	}
+	return exists, nil
+}
+
+// migrateTenancy gives the tables of a database created before tenants a tenant_id,
+// assigning every row to the default tenant, and rebuilds their keys around it, in one
+// transaction. It does nothing once the invoices key has a tenant_id. Only the tables
+// the database has are migrated: it runs before the tables created with a tenant_id
+// are, as their foreign keys need the tenant_id of invoices.
+func migrateTenancy(db *sql.DB) error {
+	var migrated bool
+	err := db.QueryRow(`
+SELECT EXISTS (
+    SELECT 1 FROM pg_constraint c JOIN pg_attribute a ON a.attrelid = c.conrelid AND a.attnum = ANY (c.conkey)
+    WHERE c.conrelid = 'invoices'::regclass AND c.contype = 'p' AND a.attname = 'tenant_id'
+);`).Scan(&migrated)
+	if err != nil {
+		return fmt.Errorf("error querying invoices key: %w", err)
+	}
+	if migrated {
+		return nil
+	}
+	log.Println("Assigning existing data to the default tenant...")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	existing := map[string]bool{}
+	for _, table := range tenantTables {
+		exists, err := tableExists(tx, table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue // Created later, with a tenant_id
+		}
+		existing[table] = true
+		_, err = tx.Exec(fmt.Sprintf(`
+ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS tenant_id INTEGER NOT NULL DEFAULT %[2]d REFERENCES tenants(id);
+ALTER TABLE %[1]s ALTER COLUMN tenant_id DROP DEFAULT;`, table, dto.DefaultTenantID))
+		if err != nil {
+			return fmt.Errorf("error adding tenant_id to %s: %w", table, err)
+		}
+	}
+
+	var drops []string
+	rows, err := tx.Query(`
+SELECT format('ALTER TABLE %s DROP CONSTRAINT %I;', conrelid::regclass, conname)
+FROM pg_constraint
+WHERE contype = 'f' AND conparentid = 0 AND confrelid IN (to_regclass('invoices'), to_regclass('rectifying_invoices'));`)
+	if err != nil {
+		return fmt.Errorf("error querying foreign keys to invoices: %w", err)
+	}
+	for rows.Next() {
+		var drop string
+		if err := rows.Scan(&drop); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning foreign key to invoices: %w", err)
+		}
+		drops = append(drops, drop)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading foreign keys to invoices: %w", err)
+	}
+	for _, key := range tenantKeys {
+		if existing[key.table] {
+			drops = append(drops, key.stmt)
+		}
+	}
+	for _, stmt := range drops {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("error rebuilding keys for tenants (%s): %w", stmt, err)
+		}
+	}
+	for _, ref := range invoiceReferences {
+		if !existing[ref.table] {
+			continue
+		}
+		onDelete := ""
+		if ref.cascade {
+			onDelete = " ON DELETE CASCADE"
+		}
+		_, err := tx.Exec(fmt.Sprintf(`ALTER TABLE %s ADD FOREIGN KEY (tenant_id, %s, %s) REFERENCES invoices(tenant_id, codigo, fecha)%s;`,
+			ref.table, ref.codigo, ref.fecha, onDelete))
+		if err != nil {
+			return fmt.Errorf("error adding foreign key of %s to invoices: %w", ref.table, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing tenant migration: %w", err)
+	}
+	log.Println("Existing data assigned to the default tenant.")
+	return nil
+}
+
+// EnableRowLevelSecurity adds to every tenant table a row-level security policy that
+// only shows the rows of the tenant in the facturapid.tenant_id setting. The API's own
+// queries filter by tenant themselves and, run as the tables' owner, are not subject to
+// the policies: they isolate the other database users, such as reporting tools, which
+// must SET facturapid.tenant_id to see any row. Partitions are not covered, only
+// queries through the partitioned tables.
+func EnableRowLevelSecurity(db *sql.DB) error {
+	for _, table := range tenantTables {
+		_, err := db.Exec(fmt.Sprintf(`
+ALTER TABLE %[1]s ENABLE ROW LEVEL SECURITY;
+DROP POLICY IF EXISTS tenant_isolation ON %[1]s;
+CREATE POLICY tenant_isolation ON %[1]s
+    USING (tenant_id = NULLIF(current_setting('facturapid.tenant_id', true), '')::integer);`, table))
+		if err != nil {
+			return fmt.Errorf("error enabling row-level security on %s: %w", table, err)
+		}
+	}
+	log.Println("Row-level security enabled on the tenant tables.")
+	return nil
+}
+
+func scanTenant(row scanner) (dto.TenantDTO, error) {
+	var t dto.TenantDTO
+	err := row.Scan(&t.ID, &t.Code, &t.Name, &t.CreatedAt)
+	return t, err
+}
+
+// CreateTenant inserts a tenant and returns it. It returns ErrTenantExists when its
+// code is taken.
+func CreateTenant(db *sql.DB, t dto.TenantDTO) (dto.TenantDTO, error) {
+	created, err := scanTenant(db.QueryRow(`
+INSERT INTO tenants (code, name) VALUES ($1, $2)
+ON CONFLICT (code) DO NOTHING
+RETURNING`+tenantColumns+`;`, t.Code, t.Name))
+	if err == sql.ErrNoRows {
+		return dto.TenantDTO{}, ErrTenantExists
+	}
+	if err != nil {
+		return dto.TenantDTO{}, fmt.Errorf("error inserting tenant: %w", err)
+	}
+	log.Printf("Created tenant %d (%s).", created.ID, created.Code)
+	return created, nil
+}
+
+// GetTenant returns a single tenant.
+func GetTenant(db *sql.DB, id int) (dto.TenantDTO, error) {
+	t, err := scanTenant(db.QueryRow(`SELECT`+tenantColumns+` FROM tenants WHERE id = $1;`, id))
+	if err == sql.ErrNoRows {
+		return dto.TenantDTO{}, ErrTenantNotFound
+	}
+	if err != nil {
+		return dto.TenantDTO{}, fmt.Errorf("error querying tenant %d: %w", id, err)
+	}
+	return t, nil
+}
+
+// ListTenants returns every tenant, ordered by ID.
+func ListTenants(db *sql.DB) ([]dto.TenantDTO, error) {
+	rows, err := db.Query(`SELECT` + tenantColumns + ` FROM tenants ORDER BY id;`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying tenants: %w", err)
+	}
+	defer rows.Close()
+	tenants := []dto.TenantDTO{}
+	for rows.Next() {
+		t, err := scanTenant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning tenant: %w", err)
+		}
+		tenants = append(tenants, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tenants: %w", err)
+	}
+	return tenants, nil
+}
+
+// TenantIDs returns the IDs of every tenant, for the jobs that go through them one by
+// one.
+func TenantIDs(db *sql.DB) ([]int, error) {
+	return queryInts(db, `SELECT id FROM tenants ORDER BY id;`)
+}
+
+func apiKeyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func scanAPIKey(row scanner) (dto.APIKeyDTO, error) {
+	var k dto.APIKeyDTO
+	var tenantID sql.NullInt64
+	var description sql.NullString
+	var revokedAt sql.NullTime
+	err := row.Scan(&k.ID, &tenantID, &k.Role, &description, &k.CreatedAt, &revokedAt)
+	if err != nil {
+		return dto.APIKeyDTO{}, err
+	}
+	if tenantID.Valid { v := int(tenantID.Int64); k.TenantID = &v }
+	if description.Valid { k.Description = &description.String }
+	if revokedAt.Valid { k.RevokedAt = &revokedAt.Time }
+	return k, nil
+}
+
+// CreateAPIKey stores key, whose hash only is kept, as an API key of the given role
+// for a tenant (nil for platform keys). It returns ErrTenantNotFound when the tenant
+// does not exist.
+func CreateAPIKey(db *sql.DB, tenantID *int, role, key string, description *string) (dto.APIKeyDTO, error) {
+	k, err := scanAPIKey(db.QueryRow(`
+INSERT INTO api_keys (tenant_id, key_hash, role, description) VALUES ($1, $2, $3, $4)
+RETURNING`+apiKeyColumns+`;`, NullableInt(tenantID), apiKeyHash(key), role, NullableString(description)))
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return dto.APIKeyDTO{}, ErrTenantNotFound
+		}
+		return dto.APIKeyDTO{}, fmt.Errorf("error inserting API key: %w", err)
+	}
+	return k, nil
+}
+
+// EnsureAPIKey stores key as an API key, as CreateAPIKey does, unless it is stored
+// already. It registers the keys of the configuration at startup.
+func EnsureAPIKey(db *sql.DB, tenantID *int, role, key, description string) error {
+	_, err := db.Exec(`
+INSERT INTO api_keys (tenant_id, key_hash, role, description) VALUES ($1, $2, $3, $4)
+ON CONFLICT (key_hash) DO NOTHING;`, NullableInt(tenantID), apiKeyHash(key), role, description)
+	if err != nil {
+		return fmt.Errorf("error registering %s API key: %w", role, err)
+	}
+	return nil
+}
+
+// GetAPIKey returns the active API key matching key. It returns ErrAPIKeyNotFound for
+// unknown and revoked keys.
+func GetAPIKey(db *sql.DB, key string) (dto.APIKeyDTO, error) {
+	k, err := scanAPIKey(db.QueryRow(`SELECT`+apiKeyColumns+`
+FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL;`, apiKeyHash(key)))
+	if err == sql.ErrNoRows {
+		return dto.APIKeyDTO{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return dto.APIKeyDTO{}, fmt.Errorf("error querying API key: %w", err)
+	}
+	return k, nil
+}
+
+// ListAPIKeys returns the API keys of a tenant, revoked ones included, ordered by ID.
+func ListAPIKeys(db *sql.DB, tenantID int) ([]dto.APIKeyDTO, error) {
+	rows, err := db.Query(`SELECT`+apiKeyColumns+` FROM api_keys WHERE tenant_id = $1 ORDER BY id;`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying API keys of tenant %d: %w", tenantID, err)
+	}
+	defer rows.Close()
+	keys := []dto.APIKeyDTO{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning API key: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating API keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key of a tenant. It returns ErrAPIKeyNotFound when the
+// tenant has no such active key.
+func RevokeAPIKey(db *sql.DB, tenantID, id int) error {
+	result, err := db.Exec(`UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND tenant_id = $2 AND revoked_at IS NULL;`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("error revoking API key %d: %w", id, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error fetching rows affected for API key %d: %w", id, err)
+	}
+	if rowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	log.Printf("Revoked API key %d of tenant %d.", id, tenantID)
+	return nil
+}
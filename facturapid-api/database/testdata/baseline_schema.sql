@@ -0,0 +1,69 @@
+CREATE TABLE IF NOT EXISTS invoices (
+    codigo INTEGER PRIMARY KEY,
+    cuenta VARCHAR(20),
+    fecha TIMESTAMP WITHOUT TIME ZONE,
+    hora TIMESTAMP WITHOUT TIME ZONE,
+    total NUMERIC(12,4), 
+    tipo_cobro VARCHAR(50),
+    vendedor VARCHAR(50),
+    cuota_iva NUMERIC(12,4),
+    abonado NUMERIC(12,4),
+    terminal VARCHAR(15),
+    traspasada VARCHAR(1),
+    tarifa VARCHAR(10) NOT NULL,
+    base1 NUMERIC(12,4),
+    base2 NUMERIC(12,4),
+    base3 NUMERIC(12,4),
+    iva1 NUMERIC(5,2),    -- Assuming IVA percentages like 21.00
+    iva2 NUMERIC(5,2),
+    iva3 NUMERIC(5,2),
+    cuota_iva1 NUMERIC(12,4),
+    cuota_iva2 NUMERIC(12,4),
+    cuota_iva3 NUMERIC(12,4),
+    serie VARCHAR(1) NOT NULL,
+    cliente1 VARCHAR(30), 
+    cliente2 VARCHAR(30),
+    cliente3 VARCHAR(30),
+    cliente4 VARCHAR(30), -- This will be used for ClienteEmail
+    revisable VARCHAR(1),
+    impresa VARCHAR(1),   
+    cobro_mixto NUMERIC(12,4),
+    efectivo_mixto NUMERIC(12,4),
+    tipo_cobro_mixto VARCHAR(50),
+    tipo_cobro_mixto2 VARCHAR(50),
+    comensales INTEGER,
+    codigo_de_factura INTEGER,
+    fecha_de_factura TIMESTAMP WITHOUT TIME ZONE,
+    hora_de_factura TIMESTAMP WITHOUT TIME ZONE,
+    cobro_mixto2 NUMERIC(12,4),
+    base4 NUMERIC(12,4),
+    base5 NUMERIC(12,4),
+    base6 NUMERIC(12,4),
+    iva4 NUMERIC(5,2),
+    iva5 NUMERIC(5,2),
+    iva6 NUMERIC(5,2),
+    cuota_iva4 NUMERIC(12,4),
+    cuota_iva5 NUMERIC(12,4),
+    cuota_iva6 NUMERIC(12,4)
+);
+CREATE TABLE IF NOT EXISTS invoice_lines (
+    codigo_factura INTEGER NOT NULL,
+    unidades_old SMALLINT,
+    subtotal NUMERIC(12,4),
+    codigo_producto VARCHAR(15),
+    producto VARCHAR(200) NOT NULL,
+    iva_aplicado NUMERIC(5,2), 
+    linea INTEGER NOT NULL,
+    unidades NUMERIC(10,4),
+    combinado_con VARCHAR(15) NOT NULL, 
+    liga_siguiente VARCHAR(1),
+    serie VARCHAR(1),
+    PRIMARY KEY (codigo_factura, producto, linea),
+    FOREIGN KEY (codigo_factura) REFERENCES invoices(codigo) ON DELETE CASCADE
+);
+CREATE INDEX IF NOT EXISTS idx_invoices_cliente1 ON invoices (cliente1);
+CREATE INDEX IF NOT EXISTS idx_invoices_cliente4 ON invoices (cliente4); -- Index on email
+CREATE INDEX IF NOT EXISTS idx_invoices_fecha ON invoices (fecha);
+CREATE INDEX IF NOT EXISTS idx_invoices_impresa ON invoices (impresa); 
+CREATE INDEX IF NOT EXISTS idx_invoice_lines_codigo_factura ON invoice_lines (codigo_factura);
+CREATE INDEX IF NOT EXISTS idx_invoice_lines_codigo_producto ON invoice_lines (codigo_producto);
@@ -0,0 +1,364 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/dto"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrWebhookNotFound is returned when no webhook subscription or delivery matches an ID.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+const (
+	createWebhooksTablesSQL = `
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id), -- Only its events are delivered
+    url VARCHAR(500) NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    description VARCHAR(200),
+    events TEXT[] NOT NULL DEFAULT '{}', -- Empty: every event type
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    tenant_id INTEGER NOT NULL REFERENCES tenants(id),
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_id VARCHAR(40) NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    invoice_codigo INTEGER, -- Not a foreign key: the log outlives the invoice
+    payload TEXT NOT NULL,  -- Exact bytes sent and signed
+    status VARCHAR(10) NOT NULL DEFAULT 'pending', -- pending, delivered, failed
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_status_code INTEGER,
+    last_error TEXT,
+    replay_of INTEGER REFERENCES webhook_deliveries(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    delivered_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_subscription ON webhook_deliveries (subscription_id, id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+    id SERIAL PRIMARY KEY,
+    delivery_id INTEGER NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    status_code INTEGER,
+    error TEXT,
+    response TEXT,
+    duration_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_delivery_attempts_delivery ON webhook_delivery_attempts (delivery_id);
+`
+
+	webhookSubscriptionColumns = `
+    id, url, secret, description, events, active, created_at`
+
+	webhookDeliveryColumns = `
+    id, tenant_id, subscription_id, event_id, event_type, invoice_codigo, payload, status, attempts,
+    next_attempt_at, last_status_code, last_error, replay_of, created_at, delivered_at`
+)
+
+func scanWebhookSubscription(row scanner) (dto.WebhookSubscriptionDTO, error) {
+	var s dto.WebhookSubscriptionDTO
+	var description sql.NullString
+	var active bool
+	err := row.Scan(&s.ID, &s.URL, &s.Secret, &description, pq.Array(&s.Events), &active, &s.CreatedAt)
+	if err != nil {
+		return dto.WebhookSubscriptionDTO{}, err
+	}
+	if description.Valid { s.Description = &description.String }
+	if s.Events == nil { s.Events = []string{} }
+	s.Active = &active
+	return s, nil
+}
+
+func scanWebhookDelivery(row scanner) (dto.WebhookDeliveryDTO, error) {
+	var d dto.WebhookDeliveryDTO
+	var invoiceID, lastStatusCode, replayOf sql.NullInt64
+	var payload string
+	var nextAttemptAt time.Time
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+	err := row.Scan(
+		&d.ID, &d.TenantID, &d.SubscriptionID, &d.EventID, &d.EventType, &invoiceID, &payload, &d.Status, &d.Attempts,
+		&nextAttemptAt, &lastStatusCode, &lastError, &replayOf, &d.CreatedAt, &deliveredAt,
+	)
+	if err != nil {
+		return dto.WebhookDeliveryDTO{}, err
+	}
+	d.Payload = []byte(payload)
+	if invoiceID.Valid { v := int(invoiceID.Int64); d.InvoiceID = &v }
+	if d.Status == dto.WebhookStatusPending { d.NextAttemptAt = &nextAttemptAt }
+	if lastStatusCode.Valid { v := int(lastStatusCode.Int64); d.LastStatusCode = &v }
+	if lastError.Valid { d.LastError = &lastError.String }
+	if replayOf.Valid { v := int(replayOf.Int64); d.ReplayOf = &v }
+	if deliveredAt.Valid { d.DeliveredAt = &deliveredAt.Time }
+	return d, nil
+}
+
+func queryWebhookDeliveries(db *sql.DB, query string, args ...interface{}) ([]dto.WebhookDeliveryDTO, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []dto.WebhookDeliveryDTO{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// CreateWebhookSubscription inserts a subscription of a tenant and returns it.
+func CreateWebhookSubscription(db *sql.DB, tenantID int, s dto.WebhookSubscriptionDTO) (dto.WebhookSubscriptionDTO, error) {
+	active := s.Active == nil || *s.Active
+	created, err := scanWebhookSubscription(db.QueryRow(`
+INSERT INTO webhook_subscriptions (tenant_id, url, secret, description, events, active)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING`+webhookSubscriptionColumns+`;`,
+		tenantID, s.URL, s.Secret, NullableString(s.Description), pq.Array(nonNilStrings(s.Events)), active,
+	))
+	if err != nil {
+		return dto.WebhookSubscriptionDTO{}, fmt.Errorf("error inserting webhook subscription: %w", err)
+	}
+	return created, nil
+}
+
+// UpdateWebhookSubscription replaces the fields of a subscription of a tenant. An empty
+// Secret keeps the current one; a nil Active keeps the current state.
+func UpdateWebhookSubscription(db *sql.DB, tenantID, id int, s dto.WebhookSubscriptionDTO) (dto.WebhookSubscriptionDTO, error) {
+	var active sql.NullBool
+	if s.Active != nil {
+		active = sql.NullBool{Bool: *s.Active, Valid: true}
+	}
+	updated, err := scanWebhookSubscription(db.QueryRow(`
+UPDATE webhook_subscriptions
+SET url = $2, secret = COALESCE(NULLIF($3, ''), secret), description = $4, events = $5, active = COALESCE($6, active)
+WHERE id = $1 AND tenant_id = $7
+RETURNING`+webhookSubscriptionColumns+`;`,
+		id, s.URL, s.Secret, NullableString(s.Description), pq.Array(nonNilStrings(s.Events)), active, tenantID,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.WebhookSubscriptionDTO{}, ErrWebhookNotFound
+		}
+		return dto.WebhookSubscriptionDTO{}, fmt.Errorf("error updating webhook subscription %d: %w", id, err)
+	}
+	return updated, nil
+}
+
+// DeleteWebhookSubscription removes a subscription of a tenant and its delivery log.
+func DeleteWebhookSubscription(db *sql.DB, tenantID, id int) error {
+	result, err := db.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2;`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("error deleting webhook subscription %d: %w", id, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error fetching rows affected for webhook subscription %d: %w", id, err)
+	}
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// GetWebhookSubscription returns a single subscription of a tenant.
+func GetWebhookSubscription(db *sql.DB, tenantID, id int) (dto.WebhookSubscriptionDTO, error) {
+	s, err := scanWebhookSubscription(db.QueryRow(`SELECT`+webhookSubscriptionColumns+` FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2;`, id, tenantID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.WebhookSubscriptionDTO{}, ErrWebhookNotFound
+		}
+		return dto.WebhookSubscriptionDTO{}, fmt.Errorf("error querying webhook subscription %d: %w", id, err)
+	}
+	return s, nil
+}
+
+// ListWebhookSubscriptions returns every subscription of a tenant, ordered by ID.
+func ListWebhookSubscriptions(db *sql.DB, tenantID int) ([]dto.WebhookSubscriptionDTO, error) {
+	rows, err := db.Query(`SELECT`+webhookSubscriptionColumns+` FROM webhook_subscriptions WHERE tenant_id = $1 ORDER BY id;`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhook subscriptions: %w", err)
+	}
+	defer rows.Close()
+	subs := []dto.WebhookSubscriptionDTO{}
+	for rows.Next() {
+		s, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning webhook subscription: %w", err)
+		}
+		subs = append(subs, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating webhook subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+// CreateWebhookDeliveries queues an event of a tenant for every active subscription of
+// the tenant to its type and returns how many deliveries were queued.
+func CreateWebhookDeliveries(db *sql.DB, tenantID int, eventID, eventType string, invoiceID *int, payload []byte) (int, error) {
+	result, err := db.Exec(`
+INSERT INTO webhook_deliveries (tenant_id, subscription_id, event_id, event_type, invoice_codigo, payload)
+SELECT tenant_id, id, $1, $2, $3, $4 FROM webhook_subscriptions
+WHERE tenant_id = $6 AND active AND (events = '{}' OR $5 = ANY(events));`,
+		eventID, eventType, NullableInt(invoiceID), string(payload), eventType, tenantID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error queueing webhook event %s: %w", eventType, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error fetching rows affected for webhook event %s: %w", eventType, err)
+	}
+	return int(n), nil
+}
+
+// CreateWebhookDelivery queues an event for a single subscription of a tenant, active or
+// not (test events, replays). replayOf is the delivery being replayed, if any. A
+// positive lease inserts the delivery already claimed, as by ClaimDueWebhookDeliveries,
+// for callers that send it themselves.
+func CreateWebhookDelivery(db *sql.DB, tenantID, subscriptionID int, eventID, eventType string, invoiceID *int, payload []byte, replayOf *int, lease time.Duration) (dto.WebhookDeliveryDTO, error) {
+	attempts := 0
+	if lease > 0 {
+		attempts = 1
+	}
+	d, err := scanWebhookDelivery(db.QueryRow(`
+INSERT INTO webhook_deliveries (tenant_id, subscription_id, event_id, event_type, invoice_codigo, payload, replay_of, attempts, next_attempt_at)
+SELECT tenant_id, id, $2, $3, $4, $5, $6, $7, NOW() + $8 * INTERVAL '1 second'
+FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $9
+RETURNING`+webhookDeliveryColumns+`;`,
+		subscriptionID, eventID, eventType, NullableInt(invoiceID), string(payload), NullableInt(replayOf), attempts, lease.Seconds(), tenantID,
+	))
+	if err != nil {
+		var pqErr *pq.Error
+		if err == sql.ErrNoRows || errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return dto.WebhookDeliveryDTO{}, ErrWebhookNotFound
+		}
+		return dto.WebhookDeliveryDTO{}, fmt.Errorf("error queueing webhook delivery: %w", err)
+	}
+	return d, nil
+}
+
+// GetWebhookDelivery returns a delivery of a tenant with its attempt log.
+func GetWebhookDelivery(db *sql.DB, tenantID, id int) (dto.WebhookDeliveryDTO, error) {
+	d, err := scanWebhookDelivery(db.QueryRow(`SELECT`+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = $1 AND tenant_id = $2;`, id, tenantID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dto.WebhookDeliveryDTO{}, ErrWebhookNotFound
+		}
+		return dto.WebhookDeliveryDTO{}, fmt.Errorf("error querying webhook delivery %d: %w", id, err)
+	}
+
+	rows, err := db.Query(`
+SELECT attempted_at, status_code, error, response, duration_ms
+FROM webhook_delivery_attempts WHERE delivery_id = $1 ORDER BY id;`, id)
+	if err != nil {
+		return dto.WebhookDeliveryDTO{}, fmt.Errorf("error querying attempts of webhook delivery %d: %w", id, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a dto.WebhookAttemptDTO
+		var statusCode sql.NullInt64
+		var attemptErr, response sql.NullString
+		if err := rows.Scan(&a.AttemptedAt, &statusCode, &attemptErr, &response, &a.DurationMS); err != nil {
+			return dto.WebhookDeliveryDTO{}, fmt.Errorf("error scanning webhook delivery attempt: %w", err)
+		}
+		if statusCode.Valid { v := int(statusCode.Int64); a.StatusCode = &v }
+		if attemptErr.Valid { a.Error = &attemptErr.String }
+		if response.Valid { a.Response = &response.String }
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	if err := rows.Err(); err != nil {
+		return dto.WebhookDeliveryDTO{}, fmt.Errorf("error iterating webhook delivery attempts: %w", err)
+	}
+	return d, nil
+}
+
+// ListWebhookDeliveries returns the latest deliveries of a subscription of a tenant,
+// newest first, optionally only those in a status.
+func ListWebhookDeliveries(db *sql.DB, tenantID, subscriptionID int, status string, limit int) ([]dto.WebhookDeliveryDTO, error) {
+	deliveries, err := queryWebhookDeliveries(db, `SELECT`+webhookDeliveryColumns+`
+FROM webhook_deliveries
+WHERE tenant_id = $4 AND subscription_id = $1 AND ($2::TEXT = '' OR status = $2::TEXT)
+ORDER BY id DESC
+LIMIT $3;`, subscriptionID, status, limit, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhook deliveries of subscription %d: %w", subscriptionID, err)
+	}
+	return deliveries, nil
+}
+
+// ClaimDueWebhookDeliveries returns up to limit pending deliveries of every tenant whose
+// next attempt is due, counting the attempt, and leases them like
+// ClaimDueEmailDeliveries.
+func ClaimDueWebhookDeliveries(db *sql.DB, limit int, lease time.Duration) ([]dto.WebhookDeliveryDTO, error) {
+	deliveries, err := queryWebhookDeliveries(db, `
+UPDATE webhook_deliveries
+SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 second'
+WHERE id IN (
+    SELECT id FROM webhook_deliveries
+    WHERE status = 'pending' AND next_attempt_at <= NOW()
+    ORDER BY next_attempt_at
+    LIMIT $1
+    FOR UPDATE SKIP LOCKED
+)
+RETURNING`+webhookDeliveryColumns+`;`, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error claiming due webhook deliveries: %w", err)
+	}
+	return deliveries, nil
+}
+
+// RecordWebhookAttempt logs an attempt and updates the delivery: delivered when
+// delivered is true, otherwise retried at retryAt, or failed for good if retryAt is nil.
+func RecordWebhookAttempt(db *sql.DB, deliveryID int, a dto.WebhookAttemptDTO, delivered bool, retryAt *time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting database transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var statusCode sql.NullInt64
+	if a.StatusCode != nil {
+		statusCode = sql.NullInt64{Int64: int64(*a.StatusCode), Valid: true}
+	}
+	_, err = tx.Exec(`
+INSERT INTO webhook_delivery_attempts (delivery_id, attempted_at, status_code, error, response, duration_ms)
+VALUES ($1, $2, $3, $4, $5, $6);`,
+		deliveryID, a.AttemptedAt, statusCode, NullableString(a.Error), NullableString(a.Response), a.DurationMS,
+	)
+	if err != nil {
+		return fmt.Errorf("error logging attempt of webhook delivery %d: %w", deliveryID, err)
+	}
+
+	switch {
+	case delivered:
+		_, err = tx.Exec(`
+UPDATE webhook_deliveries SET status = 'delivered', delivered_at = NOW(), last_status_code = $2, last_error = NULL
+WHERE id = $1;`, deliveryID, statusCode)
+	case retryAt != nil:
+		_, err = tx.Exec(`
+UPDATE webhook_deliveries SET last_status_code = $2, last_error = $3, next_attempt_at = $4
+WHERE id = $1;`, deliveryID, statusCode, NullableString(a.Error), *retryAt)
+	default:
+		_, err = tx.Exec(`
+UPDATE webhook_deliveries SET status = 'failed', last_status_code = $2, last_error = $3
+WHERE id = $1;`, deliveryID, statusCode, NullableString(a.Error))
+	}
+	if err != nil {
+		return fmt.Errorf("error updating webhook delivery %d: %w", deliveryID, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,25 @@
+package dto
+
+import "time"
+
+// ArchivalRunDTO reports a run of the archival job (POST /admin/archival/run). In a
+// dry run nothing is changed and the counts are what a run would have done.
+type ArchivalRunDTO struct {
+	DryRun bool `json:"dry_run"`
+	// Cutoff is the archival horizon: invoices dated before it are archived.
+	Cutoff    time.Time `json:"cutoff"`
+	StartedAt time.Time `json:"started_at"`
+	// InvoicesArchived counts the invoices moved to the archive tables, and
+	// LinesArchived their lines. Their stored PDFs are purged.
+	InvoicesArchived int `json:"invoices_archived"`
+	LinesArchived    int `json:"lines_archived"`
+	// InvoicesKept counts the invoices past the horizon that are not archived yet:
+	// those a rectifying invoice refers to, or with an email delivery pending.
+	InvoicesKept int `json:"invoices_kept"`
+	// PDFsPruned counts the stored PDFs of superseded invoice versions deleted.
+	PDFsPruned int `json:"pdfs_pruned"`
+	// FiscalProfileCodesExpired counts the one-time codes deleted because they were
+	// used or expired.
+	FiscalProfileCodesExpired int       `json:"fiscal_profile_codes_expired"`
+	FinishedAt                time.Time `json:"finished_at"`
+}
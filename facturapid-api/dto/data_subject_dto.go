@@ -0,0 +1,67 @@
+package dto
+
+import (
+	"strings"
+	"time"
+)
+
+// Data subject request kinds (table data_subject_requests).
+const (
+	DataSubjectExport    = "export"    // Access request (GDPR art. 15)
+	DataSubjectErasure   = "erasure"   // Erasure request (GDPR art. 17)
+	DataSubjectRetention = "retention" // Pseudonymisation by the retention job, not requested
+)
+
+// DataSubjectDTO identifies a customer by NIF, email address or both.
+type DataSubjectDTO struct {
+	NIF   string `json:"nif" form:"nif" binding:"omitempty,max=30"`
+	Email string `json:"email" form:"email" binding:"omitempty,email,max=254"`
+}
+
+// Normalized returns the subject with the NIF normalized and the email in lower case,
+// as they are matched.
+func (s DataSubjectDTO) Normalized() DataSubjectDTO {
+	return DataSubjectDTO{NIF: NormalizeNIF(s.NIF), Email: strings.ToLower(strings.TrimSpace(s.Email))}
+}
+
+// Empty reports whether the subject identifies no one.
+func (s DataSubjectDTO) Empty() bool {
+	return s.NIF == "" && s.Email == ""
+}
+
+// EraseDataSubjectDTO is the body of POST /admin/data-subjects/erase.
+type EraseDataSubjectDTO struct {
+	DataSubjectDTO
+	RequestedBy string `json:"requested_by" binding:"required,max=100"` // Who handled the request
+	Reason      string `json:"reason" binding:"required,max=500"`
+}
+
+// DataSubjectExportDTO is everything stored about a data subject.
+type DataSubjectExportDTO struct {
+	Subject            DataSubjectDTO         `json:"subject"`
+	GeneratedAt        time.Time              `json:"generated_at"`
+	FiscalProfiles     []FiscalProfileDTO     `json:"fiscal_profiles"`
+	Invoices           []FullInvoiceDTO       `json:"invoices"`
+	RectifyingInvoices []RectifyingInvoiceDTO `json:"rectifying_invoices"`
+	EmailDeliveries    []EmailDeliveryDTO     `json:"email_deliveries"`
+	InvoiceEvents      []InvoiceEventDTO      `json:"invoice_events"`
+}
+
+// DataSubjectRequestDTO is the audit record of an export, an erasure or a retention
+// run. It never holds the subject's data: SubjectRef is a pseudonym of it.
+type DataSubjectRequestDTO struct {
+	ID                 int64    `json:"id"`
+	Kind               string   `json:"kind"`
+	SubjectRef         *string  `json:"subject_ref,omitempty"`
+	RequestedBy        *string  `json:"requested_by,omitempty"`
+	Reason             *string  `json:"reason,omitempty"`
+	Actor              ActorDTO `json:"actor"`
+	Invoices           []int    `json:"invoices"`            // Exported or pseudonymised
+	RectifyingInvoices []int    `json:"rectifying_invoices"` // Exported or pseudonymised
+	// RetainedInvoices and RetainedRectifyingInvoices were issued and are within the
+	// retention period: tax law requires them to be kept as they are.
+	RetainedInvoices           []int     `json:"retained_invoices,omitempty"`
+	RetainedRectifyingInvoices []int     `json:"retained_rectifying_invoices,omitempty"`
+	FiscalProfilesDeleted      int       `json:"fiscal_profiles_deleted"`
+	CreatedAt                  time.Time `json:"created_at"`
+}
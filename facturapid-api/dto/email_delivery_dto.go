@@ -0,0 +1,34 @@
+package dto
+
+import "time"
+
+// Email delivery statuses.
+const (
+	EmailStatusPending = "pending" // Waiting for its first attempt or for a retry
+	EmailStatusSent    = "sent"
+	EmailStatusFailed  = "failed" // Every attempt failed; resend to try again
+)
+
+// EmailDeliveryDTO is one queued email of an invoice PDF (table email_deliveries).
+type EmailDeliveryDTO struct {
+	ID            int        `json:"id"`
+	TenantID      int        `json:"-"` // The tenant of the invoice, for the mailer
+	InvoiceID     int        `json:"invoice_id"`
+	Recipient     string     `json:"recipient"`
+	Language      string     `json:"language"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"` // Only while pending
+	LastError     *string    `json:"last_error,omitempty"`
+	PDFSHA256     *string    `json:"pdf_sha256,omitempty"` // Digest of the PDF that was sent
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+// SendInvoiceDTO is the optional body of POST /invoices/:id/send.
+type SendInvoiceDTO struct {
+	// Email overrides the invoice's customer email (invoices.cliente4).
+	Email *string `json:"email" binding:"omitempty,email,max=254"`
+	// Language of the message ("es", "en"); taken from Accept-Language when absent.
+	Language *string `json:"language" binding:"omitempty,oneof=es en"`
+}
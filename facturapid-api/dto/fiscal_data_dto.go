@@ -1,5 +1,7 @@
 package dto
 
+import "encoding/json"
+
 // FiscalDataDTO represents the updatable fiscal information for an invoice's customer.
 type FiscalDataDTO struct {
 	// ClienteNombre maps to invoices.cliente1
@@ -15,11 +17,65 @@ type FiscalDataDTO struct {
 // Note on field lengths: max=30 is based on the original DDL for Cliente1-4 VARCHAR(30).
 // If ClienteEmail needs more space, the 'invoices.cliente4' column in PostgreSQL
 // would need to be altered (e.g., to VARCHAR(255)).
-// The `omitempty` tag means these fields are optional in the PUT request.
-// If a field is not provided, it won't be updated (logic to be handled in UPDATE statement or by sending current values).
-// For this implementation, if a field is nil in DTO, we might send NULL or skip updating it.
-// The current plan is to update all specified fields in the UPDATE statement. If a DTO field is nil,
-// the corresponding database field will be set to NULL by the database driver if the pointer is passed directly.
-// This is generally acceptable for optional fields.
-// If the requirement is to only update non-nil fields, the SQL query builder would be more complex.
-// For now, we'll update all fields provided in the DTO, setting to NULL if the DTO field is nil.
+// FiscalDataDTO replaces the whole customer data (PUT /invoices/:id): a nil field is
+// written as NULL. To change some fields and keep the rest, use FiscalDataPatchDTO
+// (PATCH /invoices/:id/fiscal-data).
+
+// PatchString is a member of a JSON Merge Patch (RFC 7396): Set when the member is
+// present, with a nil Value when it is null.
+type PatchString struct {
+	Set   bool
+	Value *string
+}
+
+// UnmarshalJSON is only called for members present in the patch, null included.
+func (p *PatchString) UnmarshalJSON(b []byte) error {
+	p.Set = true
+	return json.Unmarshal(b, &p.Value)
+}
+
+// FiscalDataPatchDTO is the payload of PATCH /invoices/:id/fiscal-data, with JSON Merge
+// Patch semantics: members left out are kept, null members are cleared and the rest
+// are set.
+type FiscalDataPatchDTO struct {
+	ClienteNombre    PatchString `json:"cliente_nombre"`
+	ClienteDireccion PatchString `json:"cliente_direccion"`
+	ClienteNIF       PatchString `json:"cliente_nif"`
+	ClienteEmail     PatchString `json:"cliente_email"`
+}
+
+func (p FiscalDataPatchDTO) members() []*PatchString {
+	return []*PatchString{&p.ClienteNombre, &p.ClienteDireccion, &p.ClienteNIF, &p.ClienteEmail}
+}
+
+// Empty reports whether the patch changes nothing.
+func (p FiscalDataPatchDTO) Empty() bool {
+	for _, m := range p.members() {
+		if m.Set {
+			return false
+		}
+	}
+	return true
+}
+
+// Values returns the values the patch sets, for validation against the FiscalDataDTO
+// rules. Cleared and absent members are nil.
+func (p FiscalDataPatchDTO) Values() FiscalDataDTO {
+	return FiscalDataDTO{
+		ClienteNombre:    p.ClienteNombre.Value,
+		ClienteDireccion: p.ClienteDireccion.Value,
+		ClienteNIF:       p.ClienteNIF.Value,
+		ClienteEmail:     p.ClienteEmail.Value,
+	}
+}
+
+// Apply returns data with the patch applied.
+func (p FiscalDataPatchDTO) Apply(data FiscalDataDTO) FiscalDataDTO {
+	fields := []**string{&data.ClienteNombre, &data.ClienteDireccion, &data.ClienteNIF, &data.ClienteEmail}
+	for i, m := range p.members() {
+		if m.Set {
+			*fields[i] = m.Value
+		}
+	}
+	return data
+}
@@ -0,0 +1,42 @@
+package dto
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFiscalDataPatchApply(t *testing.T) {
+	name, address, nif, email := "Bar Pepe SL", "Calle Mayor 1", "B12345674", "pepe@example.com"
+	data := FiscalDataDTO{ClienteNombre: &name, ClienteDireccion: &address, ClienteNIF: &nif, ClienteEmail: &email}
+
+	var patch FiscalDataPatchDTO
+	if err := json.Unmarshal([]byte(`{"cliente_nombre": null, "cliente_direccion": "Calle Nueva 2"}`), &patch); err != nil {
+		t.Fatal(err)
+	}
+	if patch.Empty() {
+		t.Fatal("patch with two members is empty")
+	}
+	got := patch.Apply(data)
+	if got.ClienteNombre != nil {
+		t.Errorf("cliente_nombre = %q, want cleared by null", *got.ClienteNombre)
+	}
+	if got.ClienteDireccion == nil || *got.ClienteDireccion != "Calle Nueva 2" {
+		t.Errorf("cliente_direccion = %v, want set", got.ClienteDireccion)
+	}
+	if got.ClienteNIF != &nif || got.ClienteEmail != &email {
+		t.Errorf("cliente_nif, cliente_email = %v, %v, want kept when absent", got.ClienteNIF, got.ClienteEmail)
+	}
+	if data.ClienteNombre != &name {
+		t.Error("Apply changed its argument")
+	}
+}
+
+func TestFiscalDataPatchEmpty(t *testing.T) {
+	var patch FiscalDataPatchDTO
+	if err := json.Unmarshal([]byte(`{"unknown": "x"}`), &patch); err != nil {
+		t.Fatal(err)
+	}
+	if !patch.Empty() {
+		t.Errorf("patch without known members is not empty: %+v", patch)
+	}
+}
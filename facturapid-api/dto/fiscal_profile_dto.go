@@ -0,0 +1,47 @@
+package dto
+
+import (
+	"strings"
+	"time"
+)
+
+// FiscalProfileDTO is the fiscal data a returning customer entered on an earlier
+// invoice, keyed by their NIF. It is only disclosed after the customer proves access
+// to Email with a one-time code.
+type FiscalProfileDTO struct {
+	NIF       string    `json:"nif"`
+	Nombre    *string   `json:"nombre"`
+	Direccion *string   `json:"direccion"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FiscalData returns the profile as the fiscal data of an invoice.
+func (p FiscalProfileDTO) FiscalData() FiscalDataDTO {
+	nif, email := p.NIF, p.Email
+	return FiscalDataDTO{ClienteNombre: p.Nombre, ClienteDireccion: p.Direccion, ClienteNIF: &nif, ClienteEmail: &email}
+}
+
+// FiscalProfileCodeRequestDTO is the body of POST /invoices/:id/fiscal-profile/code.
+type FiscalProfileCodeRequestDTO struct {
+	ClienteNIF string `json:"cliente_nif" binding:"required,max=30"`
+}
+
+// FiscalProfileVerifyDTO is the body of POST /invoices/:id/fiscal-profile/verify.
+type FiscalProfileVerifyDTO struct {
+	ClienteNIF string `json:"cliente_nif" binding:"required,max=30"`
+	Code       string `json:"code" binding:"required,len=6,numeric"`
+}
+
+// NormalizeNIF returns a NIF in the form profiles are keyed by: upper case, without
+// spaces, dots or hyphens ("b-12.345.678" becomes "B12345678").
+func NormalizeNIF(nif string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '.', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(strings.TrimSpace(nif)))
+}
@@ -0,0 +1,116 @@
+package dto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"facturapid-api/money"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fiscal record types, as in the AEAT's VeriFactu system.
+const (
+	FiscalRecordIssue        = "alta"      // Registro de alta: the invoice was issued
+	FiscalRecordCancellation = "anulacion" // Registro de anulación: the invoice was voided
+)
+
+// Invoice types of issue records (TipoFactura); rectifying invoices use R1..R5.
+const (
+	InvoiceTypeComplete   = "F1" // Factura completa, with the customer's NIF
+	InvoiceTypeSimplified = "F2" // Factura simplificada (ticket)
+)
+
+// FiscalRecordDTO is one link of the fiscal record chain (table fiscal_records). Every
+// record carries the hash of the one before it, so removing or altering a record
+// breaks every hash after it.
+type FiscalRecordDTO struct {
+	ID          int64  `json:"id"`
+	RecordType  string `json:"record_type"`
+	InvoiceID   int    `json:"invoice_id"`
+	IssuerNIF   string `json:"issuer_nif"`
+	Number      string `json:"number"`                 // "A-123"
+	IssueDate   string `json:"issue_date"`             // YYYY-MM-DD
+	InvoiceType string `json:"invoice_type,omitempty"` // Issue records only
+	// TotalQuota and TotalAmount are only set on issue records.
+	TotalQuota   *money.Decimal `json:"total_quota,omitempty"`
+	TotalAmount  *money.Decimal `json:"total_amount,omitempty"`
+	PreviousHash string         `json:"previous_hash"` // Empty for the first record
+	Hash         string         `json:"hash"`
+	GeneratedAt  time.Time      `json:"generated_at"`
+}
+
+// NewIssueRecord returns the issue record of an invoice, without its place in the chain.
+func NewIssueRecord(header InvoiceHeaderDTO, issuerNIF string) FiscalRecordDTO {
+	quota := money.Zero
+	for _, g := range header.VATGroups() {
+		quota = quota.Add(g.Quota).Add(g.SurchargeQuota)
+	}
+	total := header.Total
+	r := newFiscalRecord(FiscalRecordIssue, header, issuerNIF)
+	r.InvoiceType = InvoiceTypeSimplified
+	if header.Cliente3 != nil && *header.Cliente3 != "" {
+		r.InvoiceType = InvoiceTypeComplete
+	}
+	r.TotalQuota, r.TotalAmount = &quota, &total
+	return r
+}
+
+// NewCancellationRecord returns the cancellation record of an invoice, without its
+// place in the chain.
+func NewCancellationRecord(header InvoiceHeaderDTO, issuerNIF string) FiscalRecordDTO {
+	return newFiscalRecord(FiscalRecordCancellation, header, issuerNIF)
+}
+
+func newFiscalRecord(recordType string, header InvoiceHeaderDTO, issuerNIF string) FiscalRecordDTO {
+	r := FiscalRecordDTO{
+		RecordType: recordType,
+		InvoiceID:  header.Codigo,
+		IssuerNIF:  issuerNIF,
+		Number:     header.Serie + "-" + strconv.Itoa(header.Codigo),
+	}
+	if header.Fecha != nil {
+		r.IssueDate = *header.Fecha
+	}
+	return r
+}
+
+// Fingerprint returns the record's hash (huella) as VeriFactu computes it: the
+// uppercase hex SHA-256 of its fields in a fixed order, previous hash included.
+func (r FiscalRecordDTO) Fingerprint() string {
+	date := r.IssueDate
+	if t, err := time.Parse("2006-01-02", r.IssueDate); err == nil {
+		date = t.Format("02-01-2006")
+	}
+	var fields []string
+	if r.RecordType == FiscalRecordCancellation {
+		fields = []string{
+			"IDEmisorFacturaAnulada=" + r.IssuerNIF,
+			"NumSerieFacturaAnulada=" + r.Number,
+			"FechaExpedicionFacturaAnulada=" + date,
+		}
+	} else {
+		fields = []string{
+			"IDEmisorFactura=" + r.IssuerNIF,
+			"NumSerieFactura=" + r.Number,
+			"FechaExpedicionFactura=" + date,
+			"TipoFactura=" + r.InvoiceType,
+			"CuotaTotal=" + decimalField(r.TotalQuota),
+			"ImporteTotal=" + decimalField(r.TotalAmount),
+		}
+	}
+	fields = append(fields,
+		"Huella="+r.PreviousHash,
+		// In UTC, so the hash does not depend on the time zone the record is read in
+		"FechaHoraHusoGenRegistro="+r.GeneratedAt.UTC().Format("2006-01-02T15:04:05-07:00"),
+	)
+	sum := sha256.Sum256([]byte(strings.Join(fields, "&")))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func decimalField(d *money.Decimal) string {
+	if d == nil {
+		return ""
+	}
+	return d.StringFixed(2)
+}
@@ -1,29 +1,39 @@
 package dto
 
+import (
+	"encoding/json"
+	"facturapid-api/money"
+	"time"
+)
+
 // InvoiceHeaderDTO corresponds to the data expected for an invoice header.
 // It mirrors fields from the 'invoices' table and synchronizer's FacturaData.
+// Amounts, VAT rates and quantities use money.Decimal so they are never rounded through float64.
 type InvoiceHeaderDTO struct {
 	Codigo         int     `json:"codigo" binding:"required"` // Primary key, essential
 	Cuenta         *string `json:"cuenta"`                    // Use pointers for optional fields
-	Fecha          *string `json:"fecha"`                     // Consider time.Time if specific format needed
+	Fecha          *string `json:"fecha" binding:"required"`  // Invoices are partitioned by it
 	Hora           *string `json:"hora"`                      // Consider time.Time
-	Total          float64 `json:"total" binding:"omitempty,gte=0"`
+	Total          money.Decimal `json:"total" binding:"omitempty,gte=0"`
 	TipoCobro      *string `json:"tipo_cobro"`
 	Vendedor       *string `json:"vendedor"`
-	CuotaIVA       *float64 `json:"cuota_iva" binding:"omitempty,gte=0"`
-	Abonado        *float64 `json:"abonado" binding:"omitempty,gte=0"`
+	CuotaIVA       *money.Decimal `json:"cuota_iva" binding:"omitempty,gte=0"`
+	Abonado        *money.Decimal `json:"abonado" binding:"omitempty,gte=0"`
 	Terminal       *string `json:"terminal"`
+	// Establecimiento is the code of the tenant the invoice belongs to. The tenant is the
+	// API key's; the synchronizer sends it as a check, and it is filled in on reads.
+	Establecimiento *string `json:"establecimiento" binding:"omitempty,max=30"`
 	Traspasada     *string `json:"traspasada" binding:"omitempty,len=1"`
 	Tarifa         string  `json:"tarifa" binding:"required"`
-	Base1          *float64 `json:"base1" binding:"omitempty,gte=0"`
-	Base2          *float64 `json:"base2" binding:"omitempty,gte=0"`
-	Base3          *float64 `json:"base3" binding:"omitempty,gte=0"`
-	Iva1           *float64 `json:"iva1" binding:"omitempty,gte=0"`   // Percentage
-	Iva2           *float64 `json:"iva2" binding:"omitempty,gte=0"`   // Percentage
-	Iva3           *float64 `json:"iva3" binding:"omitempty,gte=0"`   // Percentage
-	CuotaIva1      *float64 `json:"cuota_iva1" binding:"omitempty,gte=0"`
-	CuotaIva2      *float64 `json:"cuota_iva2" binding:"omitempty,gte=0"`
-	CuotaIva3      *float64 `json:"cuota_iva3" binding:"omitempty,gte=0"`
+	Base1          *money.Decimal `json:"base1" binding:"omitempty,gte=0"`
+	Base2          *money.Decimal `json:"base2" binding:"omitempty,gte=0"`
+	Base3          *money.Decimal `json:"base3" binding:"omitempty,gte=0"`
+	Iva1           *money.Decimal `json:"iva1" binding:"omitempty,gte=0"`   // Percentage
+	Iva2           *money.Decimal `json:"iva2" binding:"omitempty,gte=0"`   // Percentage
+	Iva3           *money.Decimal `json:"iva3" binding:"omitempty,gte=0"`   // Percentage
+	CuotaIva1      *money.Decimal `json:"cuota_iva1" binding:"omitempty,gte=0"`
+	CuotaIva2      *money.Decimal `json:"cuota_iva2" binding:"omitempty,gte=0"`
+	CuotaIva3      *money.Decimal `json:"cuota_iva3" binding:"omitempty,gte=0"`
 	Serie          string  `json:"serie" binding:"required,len=1"`
 	Cliente1       *string `json:"cliente1"` // Corresponds to synchronizer's Cliente1
 	Cliente2       *string `json:"cliente2"`
@@ -31,24 +41,55 @@ type InvoiceHeaderDTO struct {
 	Cliente4       *string `json:"cliente4"`
 	Revisable      *string `json:"revisable" binding:"omitempty,len=1"`
 	Impresa        *string `json:"impresa" binding:"omitempty,len=1"` // Corresponds to synchronizer's Impresa
-	CobroMixto     *float64 `json:"cobro_mixto" binding:"omitempty,gte=0"`
-	EfectivoMixto  *float64 `json:"efectivo_mixto" binding:"omitempty,gte=0"`
+	CobroMixto     *money.Decimal `json:"cobro_mixto" binding:"omitempty,gte=0"`
+	EfectivoMixto  *money.Decimal `json:"efectivo_mixto" binding:"omitempty,gte=0"`
 	TipoCobroMixto *string `json:"tipo_cobro_mixto"`
 	TipoCobroMixto2 *string `json:"tipo_cobro_mixto2"`
 	Comensales     *int    `json:"comensales" binding:"omitempty,gte=0"`
 	CodigoDeFactura *int   `json:"codigo_de_factura"` // Assuming this is different from Codigo
 	FechaDeFactura *string `json:"fecha_de_factura"`  // Consider time.Time
 	HoraDeFactura  *string `json:"hora_de_factura"`   // Consider time.Time
-	CobroMixto2    *float64 `json:"cobro_mixto2" binding:"omitempty,gte=0"`
-	Base4          *float64 `json:"base4" binding:"omitempty,gte=0"`
-	Base5          *float64 `json:"base5" binding:"omitempty,gte=0"`
-	Base6          *float64 `json:"base6" binding:"omitempty,gte=0"`
-	Iva4           *float64 `json:"iva4" binding:"omitempty,gte=0"` // Percentage
-	Iva5           *float64 `json:"iva5" binding:"omitempty,gte=0"` // Percentage
-	Iva6           *float64 `json:"iva6" binding:"omitempty,gte=0"` // Percentage
-	CuotaIva4      *float64 `json:"cuota_iva4" binding:"omitempty,gte=0"`
-	CuotaIva5      *float64 `json:"cuota_iva5" binding:"omitempty,gte=0"`
-	CuotaIva6      *float64 `json:"cuota_iva6" binding:"omitempty,gte=0"`
+	CobroMixto2    *money.Decimal `json:"cobro_mixto2" binding:"omitempty,gte=0"`
+	Base4          *money.Decimal `json:"base4" binding:"omitempty,gte=0"`
+	Base5          *money.Decimal `json:"base5" binding:"omitempty,gte=0"`
+	Base6          *money.Decimal `json:"base6" binding:"omitempty,gte=0"`
+	Iva4           *money.Decimal `json:"iva4" binding:"omitempty,gte=0"` // Percentage
+	Iva5           *money.Decimal `json:"iva5" binding:"omitempty,gte=0"` // Percentage
+	Iva6           *money.Decimal `json:"iva6" binding:"omitempty,gte=0"` // Percentage
+	CuotaIva4      *money.Decimal `json:"cuota_iva4" binding:"omitempty,gte=0"`
+	CuotaIva5      *money.Decimal `json:"cuota_iva5" binding:"omitempty,gte=0"`
+	CuotaIva6      *money.Decimal `json:"cuota_iva6" binding:"omitempty,gte=0"`
+	Recargo1       *money.Decimal `json:"recargo1" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base1
+	Recargo2       *money.Decimal `json:"recargo2" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base2
+	Recargo3       *money.Decimal `json:"recargo3" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base3
+	Recargo4       *money.Decimal `json:"recargo4" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base4
+	Recargo5       *money.Decimal `json:"recargo5" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base5
+	Recargo6       *money.Decimal `json:"recargo6" binding:"omitempty,gte=0"` // Recargo de equivalencia percentage for Base6
+	CuotaRecargo1  *money.Decimal `json:"cuota_recargo1" binding:"omitempty,gte=0"`
+	CuotaRecargo2  *money.Decimal `json:"cuota_recargo2" binding:"omitempty,gte=0"`
+	CuotaRecargo3  *money.Decimal `json:"cuota_recargo3" binding:"omitempty,gte=0"`
+	CuotaRecargo4  *money.Decimal `json:"cuota_recargo4" binding:"omitempty,gte=0"`
+	CuotaRecargo5  *money.Decimal `json:"cuota_recargo5" binding:"omitempty,gte=0"`
+	CuotaRecargo6  *money.Decimal `json:"cuota_recargo6" binding:"omitempty,gte=0"`
+	// CausaExencion is the AEAT exemption code (E1..E6) of the bases taxed at 0%.
+	// It selects the legal text printed on the invoice; E1 (article 20) is assumed when empty.
+	CausaExencion  *string `json:"causa_exencion" binding:"omitempty,oneof=E1 E2 E3 E4 E5 E6"`
+	// ValidationStatus is set by the API from the arithmetic checks run on ingestion
+	// (valid, warnings or invalid). Any value sent by the client is overwritten.
+	ValidationStatus *string `json:"validation_status,omitempty"`
+	// ValidationReport is the report (status and per-rule results) the status comes
+	// from, as validation.ValidateInvoice returned it; set by the API like the status.
+	ValidationReport json.RawMessage `json:"validation_report,omitempty"`
+	// Version counts changes to the invoice data, starting at 1. It is maintained by the
+	// API (any value sent by the client is ignored) and keys the stored PDFs.
+	Version int `json:"version"`
+	// Void is set by the API once the invoice has been voided (POST /invoices/:id/void).
+	Void *VoidDTO `json:"void,omitempty"`
+	// Estado is the invoice status (InvoiceStatusReceived...), maintained by the API.
+	Estado string `json:"estado"`
+	// ArchivedAt is set by the API when the invoice has been archived by the archival
+	// job. Archived invoices are read-only.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
 }
 
 // InvoiceLineDTO corresponds to the data expected for an invoice line item.
@@ -56,12 +97,12 @@ type InvoiceHeaderDTO struct {
 type InvoiceLineDTO struct {
 	CodigoFactura  int     `json:"codigo_factura" binding:"required"` // Should match InvoiceHeaderDTO.Codigo
 	UnidadesOld    *int16  `json:"unidades_old" binding:"omitempty,gte=0"`
-	Subtotal       float64 `json:"subtotal" binding:"omitempty,gte=0"`
+	Subtotal       money.Decimal `json:"subtotal" binding:"omitempty,gte=0"`
 	CodigoProducto *string `json:"codigo_producto"`
 	Producto       string  `json:"producto" binding:"required"`
-	IvaAplicado    *float64 `json:"iva_aplicado" binding:"omitempty,gte=0"` // Percentage
+	IvaAplicado    *money.Decimal `json:"iva_aplicado" binding:"omitempty,gte=0"` // Percentage
 	Linea          int     `json:"linea" binding:"required,gt=0"` // Line number, should be positive
-	Unidades       float64 `json:"unidades" binding:"omitempty,gte=0"`
+	Unidades       money.Decimal `json:"unidades" binding:"omitempty,gte=0"`
 	// `combinado_con` from DDL seems to be NOT NULL, ensure it's handled.
 	// If it's always system-generated or optional from client, adjust binding.
 	CombinadoCon   string  `json:"combinado_con"` 
@@ -73,4 +114,7 @@ type InvoiceLineDTO struct {
 type FullInvoiceDTO struct {
 	Header InvoiceHeaderDTO   `json:"header" binding:"required"`
 	Lines  []InvoiceLineDTO `json:"lines" binding:"omitempty,dive"` // dive validates each element in slice
+	// Rectification is only set on rectifying invoices converted with
+	// RectifyingInvoiceDTO.Invoice; it is never read from requests.
+	Rectification *RectificationDTO `json:"-"`
 }
@@ -0,0 +1,104 @@
+package dto
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// Invoice event types (table invoice_events).
+const (
+	InvoiceEventCreated           = "created"
+	InvoiceEventFiscalDataUpdated = "fiscal_data_updated"
+	InvoiceEventVoided            = "voided"
+	InvoiceEventIssued            = "issued"
+	InvoiceEventRectified         = "rectified" // A rectifying invoice was stored for it
+	InvoiceEventPDFGenerated      = "pdf_generated"
+	InvoiceEventEmailQueued       = "email_queued"
+	InvoiceEventEmailSent         = "email_sent"
+	InvoiceEventEmailFailed       = "email_failed"  // Every attempt failed
+	InvoiceEventPseudonymised     = "pseudonymised" // Customer data replaced by pseudonyms (GDPR)
+	InvoiceEventArchived          = "archived"      // Moved to the archive tables
+)
+
+// Actor types: who caused an invoice event.
+const (
+	ActorAPIKey    = "api_key"   // The synchronizer or the frontend (X-API-Key)
+	ActorAdmin     = "admin"     // The back office (admin API key)
+	ActorPlatform  = "platform"  // The operator of the API (platform API key)
+	ActorSystem    = "system"    // The API itself, e.g. the mail queue
+	ActorAnonymous = "anonymous" // A request to a route without authentication
+)
+
+// ActorDTO identifies who caused an invoice event. ID never holds a secret: API keys
+// are recorded by a fingerprint.
+type ActorDTO struct {
+	Type     string  `json:"type"`
+	ID       string  `json:"id"`
+	ClientIP *string `json:"client_ip,omitempty"` // Only for requests
+}
+
+// String identifies the actor in a single field, e.g. "admin:key:1a2b3c4d".
+func (a ActorDTO) String() string {
+	return a.Type + ":" + a.ID
+}
+
+// SystemActor is the actor of events caused by the named background component.
+func SystemActor(component string) ActorDTO {
+	return ActorDTO{Type: ActorSystem, ID: component}
+}
+
+// FieldChangeDTO is the before and after value of a changed field; null when absent.
+type FieldChangeDTO struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// InvoiceEventDTO is one entry of an invoice's audit trail. Entries are never updated
+// or deleted.
+type InvoiceEventDTO struct {
+	ID        int64                     `json:"id"`
+	InvoiceID int                       `json:"invoice_id"`
+	EventType string                    `json:"event_type"`
+	Actor     ActorDTO                  `json:"actor"`
+	Changes   map[string]FieldChangeDTO `json:"changes,omitempty"` // Changed fields, by JSON name
+	Details   map[string]interface{}    `json:"details,omitempty"` // Other facts, e.g. the PDF digest
+	CreatedAt time.Time                 `json:"created_at"`
+}
+
+// Diff returns the fields that differ between before and after, compared by their JSON
+// encoding. Either may be nil: the diff of a creation has every field of after.
+func Diff(before, after interface{}) (map[string]FieldChangeDTO, error) {
+	b, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]FieldChangeDTO{}
+	for k, v := range a {
+		if !reflect.DeepEqual(b[k], v) {
+			changes[k] = FieldChangeDTO{Before: b[k], After: v}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok && v != nil {
+			changes[k] = FieldChangeDTO{Before: v}
+		}
+	}
+	return changes, nil
+}
+
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return fields, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return fields, json.Unmarshal(data, &fields)
+}
@@ -0,0 +1,83 @@
+package dto
+
+import (
+	"encoding/base64"
+	"errors"
+	"facturapid-api/money"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes of GET /admin/invoices.
+const (
+	DefaultInvoiceListLimit = 50
+	MaxInvoiceListLimit     = 500
+)
+
+// InvoiceListQueryDTO holds the query parameters of GET /admin/invoices. From and To
+// bound the fecha, both days included; a listing without them reads every partition.
+type InvoiceListQueryDTO struct {
+	From     string `form:"from" binding:"omitempty,datetime=2006-01-02"`
+	To       string `form:"to" binding:"omitempty,datetime=2006-01-02"`
+	Serie    string `form:"serie" binding:"omitempty,len=1"`
+	Estado   string `form:"estado" binding:"omitempty,oneof=received fiscal_data_pending issued rectified voided"`
+	Archived bool   `form:"archived"` // List the archived invoices instead
+	Limit    int    `form:"limit" binding:"omitempty,min=1,max=500"`
+	// Cursor is the next_cursor of the previous page.
+	Cursor string `form:"cursor"`
+}
+
+// InvoiceSummaryDTO is an invoice as listed by GET /admin/invoices.
+type InvoiceSummaryDTO struct {
+	Codigo           int           `json:"codigo"`
+	Serie            string        `json:"serie"`
+	Fecha            string        `json:"fecha"`
+	Hora             *string       `json:"hora"`
+	Terminal         *string       `json:"terminal"`
+	Total            money.Decimal `json:"total"`
+	Cliente1         *string       `json:"cliente1"`
+	Cliente3         *string       `json:"cliente3"`
+	Estado           string        `json:"estado"`
+	ValidationStatus *string       `json:"validation_status"`
+	Version          int           `json:"version"`
+}
+
+// InvoiceListDTO is a page of GET /admin/invoices, newest invoices first.
+type InvoiceListDTO struct {
+	Invoices []InvoiceSummaryDTO `json:"invoices"`
+	// NextCursor is set when there are more invoices: pass it as cursor to get them.
+	NextCursor *string `json:"next_cursor,omitempty"`
+}
+
+// ErrInvalidCursor is returned by DecodeInvoiceCursor for a cursor it did not make.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const cursorTimeLayout = "2006-01-02T15:04:05.999999"
+
+// EncodeInvoiceCursor returns the cursor of the invoices listed after the one with
+// fecha and codigo.
+func EncodeInvoiceCursor(fecha time.Time, codigo int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fecha.Format(cursorTimeLayout) + "|" + strconv.Itoa(codigo)))
+}
+
+// DecodeInvoiceCursor returns the fecha and codigo a cursor was made from.
+func DecodeInvoiceCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	fechaStr, codigoStr, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	fecha, err := time.Parse(cursorTimeLayout, fechaStr)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	codigo, err := strconv.Atoi(codigoStr)
+	if err != nil {
+		return time.Time{}, 0, ErrInvalidCursor
+	}
+	return fecha, codigo, nil
+}
@@ -0,0 +1,35 @@
+package dto
+
+// Invoice statuses (invoices.estado). An invoice moves
+//
+//	received → fiscal_data_pending → issued → rectified
+//
+// and can be voided until it is rectified. Its fiscal data can only be updated
+// before it is issued; afterwards a change needs a rectifying invoice.
+const (
+	InvoiceStatusReceived          = "received"            // Stored as sent by the synchronizer
+	InvoiceStatusFiscalDataPending = "fiscal_data_pending" // Customer data entered, which can still be corrected until issuance
+	InvoiceStatusIssued            = "issued"              // A PDF has been generated: the document is final
+	InvoiceStatusRectified         = "rectified"           // A rectifying invoice has been issued for it
+	InvoiceStatusVoided            = "voided"
+)
+
+// invoiceTransitions lists the statuses each status can move to. A PDF can be issued
+// straight from received, and a rectifying invoice from the TPV can arrive before the
+// customer downloads any PDF.
+var invoiceTransitions = map[string][]string{
+	InvoiceStatusReceived:          {InvoiceStatusFiscalDataPending, InvoiceStatusIssued, InvoiceStatusRectified, InvoiceStatusVoided},
+	InvoiceStatusFiscalDataPending: {InvoiceStatusFiscalDataPending, InvoiceStatusIssued, InvoiceStatusRectified, InvoiceStatusVoided},
+	InvoiceStatusIssued:            {InvoiceStatusRectified, InvoiceStatusVoided},
+	InvoiceStatusRectified:         {InvoiceStatusRectified}, // Rectified again
+}
+
+// CanTransition reports whether an invoice in status from can move to status to.
+func CanTransition(from, to string) bool {
+	for _, s := range invoiceTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,23 @@
+package dto
+
+// IssuerProfileDTO is the seller identity printed on invoices (the "emisor").
+// Several legal entities of the group can be configured; each invoice is matched
+// to one of them by terminal, then by series, falling back to the default profile.
+type IssuerProfileDTO struct {
+	ID           int     `json:"id"`
+	LegalName    string  `json:"legal_name" binding:"required,max=200"`  // Razón social
+	TradeName    *string `json:"trade_name" binding:"omitempty,max=200"` // Nombre comercial
+	NIF          string  `json:"nif" binding:"required,max=20"`
+	Address      string  `json:"address" binding:"required,max=300"`
+	RegistryData *string `json:"registry_data" binding:"omitempty,max=300"` // e.g. "Inscrita en el Registro Mercantil de Madrid, Tomo ..."
+	// Logo is the raw image (base64 in JSON). LogoType is its format as understood by gofpdf.
+	Logo         []byte  `json:"logo,omitempty" binding:"omitempty,max=524288"`
+	LogoType     *string `json:"logo_type" binding:"omitempty,oneof=png jpg jpeg gif"`
+	FooterText   *string `json:"footer_text" binding:"omitempty,max=500"`
+	PrimaryColor *string `json:"primary_color" binding:"omitempty,hexcolor"` // Title and table headers, e.g. "#1F3A5F"
+	AccentColor  *string `json:"accent_color" binding:"omitempty,hexcolor"`  // Table header fill, e.g. "#F0F0F0"
+	// Series and Terminals select the invoices issued under this profile.
+	Series    []string `json:"series" binding:"omitempty,dive,len=1"`
+	Terminals []string `json:"terminals" binding:"omitempty,dive,max=15"`
+	IsDefault bool     `json:"is_default"`
+}
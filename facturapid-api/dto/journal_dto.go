@@ -0,0 +1,73 @@
+package dto
+
+import (
+	"facturapid-api/money"
+	"time"
+)
+
+// AccountMappingDTO is the chart of accounts the journal of a tenant (GET
+// /reports/journal) books the sales on, set with PUT /admin/account-mapping. Accounts
+// are those of the Plan General Contable, as the accounting software expects them,
+// e.g. "70000021" or "700.21" written without the dot.
+type AccountMappingDTO struct {
+	// Sales (70x) and VAT (477) are the accounts of the rates that SalesByRate and
+	// VATByRate do not map. Rates are keyed as written, e.g. "21" or "5.5".
+	Sales       string            `json:"sales" binding:"required"`
+	SalesByRate map[string]string `json:"sales_by_rate"`
+	VAT         string            `json:"vat" binding:"required"`
+	VATByRate   map[string]string `json:"vat_by_rate"`
+	Surcharge   string            `json:"surcharge" binding:"required"` // Recargo de equivalencia
+	// PaymentMethods maps each tipo_cobro, compared without case, to its account (570
+	// for cash, 572 for banks); tipo_cobro not mapped are booked on Payment.
+	PaymentMethods map[string]string `json:"payment_methods"`
+	Payment        string            `json:"payment" binding:"required"`
+	Cash           string            `json:"cash" binding:"required"`     // efectivo_mixto of mixed payments
+	Rounding       string            `json:"rounding" binding:"required"` // Cent differences between totals and amounts
+	// UpdatedAt is nil until the tenant saves a mapping; the defaults apply till then.
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// DefaultAccountMapping returns the mapping of tenants that have not saved one:
+// subaccounts of 700 and 477 per rate of the régimen general, 570 for cash and 572
+// for the rest.
+func DefaultAccountMapping() AccountMappingDTO {
+	return AccountMappingDTO{
+		Sales:          "70000000",
+		SalesByRate:    map[string]string{"4": "70000004", "10": "70000010", "21": "70000021"},
+		VAT:            "47700000",
+		VATByRate:      map[string]string{"4": "47700004", "10": "47700010", "21": "47700021"},
+		Surcharge:      "47710000",
+		PaymentMethods: map[string]string{"efectivo": "57000000"},
+		Payment:        "57200000",
+		Cash:           "57000000",
+		Rounding:       "66900000",
+	}
+}
+
+// JournalDTO is the sales journal from one day to another (GET /reports/journal): an
+// entry (asiento) per day with documents, in a generic layout most accounting
+// software can import.
+type JournalDTO struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Entries []JournalEntryDTO `json:"entries"`
+}
+
+// JournalEntryDTO books the documents issued in a day: the payments on the debit side,
+// the sales and their VAT on the credit side. Amounts are to the cent and balance.
+type JournalEntryDTO struct {
+	Asiento   int              `json:"asiento"` // Numbered from 1 in each journal
+	Fecha     string           `json:"fecha"`
+	Concepto  string           `json:"concepto"`
+	Documents int              `json:"documents"`
+	Lines     []JournalLineDTO `json:"lines"`
+}
+
+// JournalLineDTO is an account charged (Debe) or credited (Haber) in an entry; the
+// other side is zero.
+type JournalLineDTO struct {
+	Cuenta   string        `json:"cuenta"`
+	Concepto string        `json:"concepto"`
+	Debe     money.Decimal `json:"debe"`
+	Haber    money.Decimal `json:"haber"`
+}
@@ -0,0 +1,250 @@
+package dto
+
+import (
+	"encoding/json"
+	"errors"
+	"facturapid-api/money"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Rectifying invoice types (tipo de factura rectificativa), as the AEAT keys them.
+const (
+	RectificationR1 = "R1" // Error fundado en derecho y art. 80 Uno, Dos y Seis LIVA
+	RectificationR2 = "R2" // Art. 80 Tres LIVA (concurso de acreedores)
+	RectificationR3 = "R3" // Art. 80 Cuatro LIVA (créditos incobrables)
+	RectificationR4 = "R4" // Resto de causas
+	RectificationR5 = "R5" // Rectificativa de facturas simplificadas (tickets)
+)
+
+// Rectification methods.
+const (
+	RectificationBySubstitution = "S" // The rectifying invoice replaces the original amounts
+	RectificationByDifferences  = "I" // The rectifying invoice carries the differences (negative for returns)
+)
+
+// RectifyingInvoiceHeaderDTO corresponds to a row of the TPV's FacturasR table, plus
+// the reference to the invoice it rectifies. Amounts may be negative: a return
+// rectified by differences is a negative invoice.
+type RectifyingInvoiceHeaderDTO struct {
+	Codigo          int            `json:"codigo" binding:"required"` // FacturasR numbering, separate from invoices
+	Cuenta          *string        `json:"cuenta"`
+	Fecha           *string        `json:"fecha"`
+	Hora            *string        `json:"hora"`
+	Total           money.Decimal  `json:"total"`
+	TipoCobro       *string        `json:"tipo_cobro"`
+	Vendedor        *string        `json:"vendedor"`
+	CuotaIVA        *money.Decimal `json:"cuota_iva"`
+	Abonado         *money.Decimal `json:"abonado"`
+	Terminal        *string        `json:"terminal"`
+	Establecimiento *string        `json:"establecimiento" binding:"omitempty,max=30"` // Tenant code, checked against the API key's
+	Traspasada      *string        `json:"traspasada" binding:"omitempty,len=1"`
+	Revisable       *string        `json:"revisable" binding:"omitempty,len=1"`
+	Impresa         *string        `json:"impresa" binding:"omitempty,len=1"`
+	Tarifa          string         `json:"tarifa" binding:"required"`
+	Base1           *money.Decimal `json:"base1"`
+	Base2           *money.Decimal `json:"base2"`
+	Base3           *money.Decimal `json:"base3"`
+	Iva1            *money.Decimal `json:"iva1" binding:"omitempty,gte=0"` // Percentage
+	Iva2            *money.Decimal `json:"iva2" binding:"omitempty,gte=0"` // Percentage
+	Iva3            *money.Decimal `json:"iva3" binding:"omitempty,gte=0"` // Percentage
+	CuotaIva1       *money.Decimal `json:"cuota_iva1"`
+	CuotaIva2       *money.Decimal `json:"cuota_iva2"`
+	CuotaIva3       *money.Decimal `json:"cuota_iva3"`
+	Serie           string         `json:"serie" binding:"required,len=1"`
+	Cliente1        *string        `json:"cliente1"`
+	Cliente2        *string        `json:"cliente2"`
+	Cliente3        *string        `json:"cliente3"`
+	Cliente4        *string        `json:"cliente4"`
+	CobroMixto      *money.Decimal `json:"cobro_mixto"`
+	EfectivoMixto   *money.Decimal `json:"efectivo_mixto"`
+	TipoCobroMixto  *string        `json:"tipo_cobro_mixto"`
+	TipoCobroMixto2 *string        `json:"tipo_cobro_mixto2"`
+	Comensales      *int           `json:"comensales" binding:"omitempty,gte=0"`
+	CodigoDeFactura *int           `json:"codigo_de_factura"`
+	FechaDeFactura  *string        `json:"fecha_de_factura"`
+	HoraDeFactura   *string        `json:"hora_de_factura"`
+	CobroMixto2     *money.Decimal `json:"cobro_mixto2"`
+
+	// FacturaRectificada is the Codigo of the rectified invoice, which must exist.
+	FacturaRectificada int `json:"factura_rectificada" binding:"required"`
+	// TipoRectificativa is R1..R5. When empty the API picks DefaultRectificationType of
+	// the rectified invoice.
+	TipoRectificativa string `json:"tipo_rectificativa" binding:"omitempty,oneof=R1 R2 R3 R4 R5"`
+	// TipoRectificacion is S (substitution) or I (differences, the default).
+	TipoRectificacion string  `json:"tipo_rectificacion" binding:"omitempty,oneof=S I"`
+	Motivo            *string `json:"motivo" binding:"omitempty,max=500"`
+	// BaseRectificada and CuotaRectificada are the rectified invoice's taxable base
+	// and VAT quota, recorded by the API for rectifications by substitution. Any
+	// values sent by the client are overwritten.
+	BaseRectificada  *money.Decimal `json:"base_rectificada,omitempty"`
+	CuotaRectificada *money.Decimal `json:"cuota_rectificada,omitempty"`
+	// ValidationStatus and ValidationReport are set by the API like those of
+	// InvoiceHeaderDTO.
+	ValidationStatus *string         `json:"validation_status,omitempty"`
+	ValidationReport json.RawMessage `json:"validation_report,omitempty"`
+}
+
+// RectifyingInvoiceLineDTO corresponds to a row of the TPV's FacturasRLin table.
+// Returned goods have negative units and subtotals.
+type RectifyingInvoiceLineDTO struct {
+	CodigoFactura  int            `json:"codigo_factura" binding:"required"` // Should match RectifyingInvoiceHeaderDTO.Codigo
+	CodigoProducto *string        `json:"codigo_producto"`
+	Subtotal       money.Decimal  `json:"subtotal"`
+	Producto       string         `json:"producto" binding:"required"`
+	IvaAplicado    *money.Decimal `json:"iva_aplicado" binding:"omitempty,gte=0"` // Percentage
+	Linea          int            `json:"linea" binding:"required,gt=0"`
+	Unidades       money.Decimal  `json:"unidades"`
+	UnidadesOld    *money.Decimal `json:"unidades_old"` // Moneda in FacturasRLin, unlike FacturasLin
+	CombinadoCon   string         `json:"combinado_con"`
+	LigaSiguiente  *string        `json:"liga_siguiente" binding:"omitempty,len=1"`
+	Serie          *string        `json:"serie" binding:"omitempty,len=1"`
+}
+
+// RectifyingInvoiceDTO is the payload of POST /rectifying-invoices.
+type RectifyingInvoiceDTO struct {
+	Header RectifyingInvoiceHeaderDTO `json:"header" binding:"required"`
+	Lines  []RectifyingInvoiceLineDTO `json:"lines" binding:"omitempty,dive"`
+}
+
+// RectificationDTO is what an invoice document says about the invoice it rectifies.
+type RectificationDTO struct {
+	Tipo          string  // R1..R5
+	Metodo        string  // S or I
+	Original      string  // Number of the rectified invoice ("A-123")
+	OriginalFecha *string // Issue date of the rectified invoice
+	Motivo        *string
+	// BaseRectificada and CuotaRectificada are only set for substitutions.
+	BaseRectificada  *money.Decimal
+	CuotaRectificada *money.Decimal
+	// OriginalTotal and OriginalVATGroups are the amounts of the rectified invoice,
+	// which a substitution replaces.
+	OriginalTotal     money.Decimal
+	OriginalVATGroups []VATGroup
+}
+
+// Invoice returns the rectifying invoice in the shape of an ordinary invoice, so the
+// arithmetic checks, the PDF and the UBL document treat both alike. original is the
+// header of the rectified invoice.
+func (r RectifyingInvoiceDTO) Invoice(original InvoiceHeaderDTO) FullInvoiceDTO {
+	h := r.Header
+	inv := FullInvoiceDTO{Header: InvoiceHeaderDTO{
+		Codigo: h.Codigo, Cuenta: h.Cuenta, Fecha: h.Fecha, Hora: h.Hora, Total: h.Total,
+		TipoCobro: h.TipoCobro, Vendedor: h.Vendedor, CuotaIVA: h.CuotaIVA, Abonado: h.Abonado,
+		Terminal: h.Terminal, Establecimiento: h.Establecimiento, Traspasada: h.Traspasada, Tarifa: h.Tarifa,
+		Base1: h.Base1, Base2: h.Base2, Base3: h.Base3, Iva1: h.Iva1, Iva2: h.Iva2, Iva3: h.Iva3,
+		CuotaIva1: h.CuotaIva1, CuotaIva2: h.CuotaIva2, CuotaIva3: h.CuotaIva3,
+		Serie: h.Serie, Cliente1: h.Cliente1, Cliente2: h.Cliente2, Cliente3: h.Cliente3, Cliente4: h.Cliente4,
+		Revisable: h.Revisable, Impresa: h.Impresa, CobroMixto: h.CobroMixto, EfectivoMixto: h.EfectivoMixto,
+		TipoCobroMixto: h.TipoCobroMixto, TipoCobroMixto2: h.TipoCobroMixto2, Comensales: h.Comensales,
+		CodigoDeFactura: h.CodigoDeFactura, FechaDeFactura: h.FechaDeFactura, HoraDeFactura: h.HoraDeFactura,
+		CobroMixto2: h.CobroMixto2,
+		// The exemption cause of 0% bases is the rectified invoice's
+		CausaExencion:    original.CausaExencion,
+		ValidationStatus: h.ValidationStatus,
+		ValidationReport: h.ValidationReport,
+		Version:          1, // Rectifying invoices are not edited
+	}}
+	for _, l := range r.Lines {
+		inv.Lines = append(inv.Lines, InvoiceLineDTO{
+			CodigoFactura: l.CodigoFactura, Subtotal: l.Subtotal, CodigoProducto: l.CodigoProducto,
+			Producto: l.Producto, IvaAplicado: l.IvaAplicado, Linea: l.Linea, Unidades: l.Unidades,
+			CombinadoCon: l.CombinadoCon, LigaSiguiente: l.LigaSiguiente, Serie: l.Serie,
+		})
+	}
+	inv.Rectification = &RectificationDTO{
+		Tipo:             h.TipoRectificativa,
+		Metodo:           h.TipoRectificacion,
+		Original:         original.Serie + "-" + strconv.Itoa(original.Codigo),
+		OriginalFecha:    original.Fecha,
+		Motivo:           h.Motivo,
+		BaseRectificada:  h.BaseRectificada,
+		CuotaRectificada: h.CuotaRectificada,
+	}
+	return inv
+}
+
+// RectifyInvoiceDTO is the payload of POST /invoices/:id/rectify: the corrected
+// customer data of an issued invoice and the reason for the correction. Fields left
+// out keep the invoice's value.
+type RectifyInvoiceDTO struct {
+	FiscalDataDTO
+	Motivo string `json:"motivo" binding:"required,min=3,max=500"`
+}
+
+// ErrNotRectifiable is returned by NewSubstitution for invoices whose amounts a
+// rectifying invoice cannot carry (FacturasR has three VAT groups and no surcharges).
+var ErrNotRectifiable = errors.New("invoice cannot be rectified by substitution")
+
+// DefaultRectificationType returns the rectification type of a rectifying invoice of
+// original that does not give one: R4 (other causes) when original identifies the
+// customer by NIF, and R5 when it is a simplified invoice.
+func DefaultRectificationType(original InvoiceHeaderDTO) string {
+	if original.Cliente3 != nil && *original.Cliente3 != "" {
+		return RectificationR4
+	}
+	return RectificationR5
+}
+
+// NewSubstitution returns a rectifying invoice that replaces original with the same
+// amounts and lines and the customer data of r, dated at. Its Codigo is 0, so it takes
+// the next API-issued number when stored, and the DefaultRectificationType of original.
+func NewSubstitution(original FullInvoiceDTO, r RectifyInvoiceDTO, at time.Time) (RectifyingInvoiceDTO, error) {
+	o := original.Header
+	for _, d := range []*money.Decimal{
+		o.Base4, o.Base5, o.Base6, o.CuotaIva4, o.CuotaIva5, o.CuotaIva6,
+		o.CuotaRecargo1, o.CuotaRecargo2, o.CuotaRecargo3, o.CuotaRecargo4, o.CuotaRecargo5, o.CuotaRecargo6,
+	} {
+		if d != nil && !d.IsZero() {
+			return RectifyingInvoiceDTO{}, fmt.Errorf("%w: invoice %d has more than three VAT groups or surcharges", ErrNotRectifiable, o.Codigo)
+		}
+	}
+
+	fecha, hora := at.Format("2006-01-02"), at.Format("15:04:05")
+	motivo := r.Motivo
+	base, quota := money.Zero, money.Zero
+	for _, g := range o.VATGroups() {
+		base = base.Add(g.Base)
+		quota = quota.Add(g.Quota)
+	}
+	h := RectifyingInvoiceHeaderDTO{
+		Cuenta: o.Cuenta, Fecha: &fecha, Hora: &hora, Total: o.Total, TipoCobro: o.TipoCobro,
+		Vendedor: o.Vendedor, CuotaIVA: o.CuotaIVA, Abonado: o.Abonado, Terminal: o.Terminal,
+		Traspasada: o.Traspasada, Revisable: o.Revisable, Impresa: o.Impresa, Tarifa: o.Tarifa,
+		Base1: o.Base1, Base2: o.Base2, Base3: o.Base3, Iva1: o.Iva1, Iva2: o.Iva2, Iva3: o.Iva3,
+		CuotaIva1: o.CuotaIva1, CuotaIva2: o.CuotaIva2, CuotaIva3: o.CuotaIva3, Serie: o.Serie,
+		Cliente1: pick(r.ClienteNombre, o.Cliente1), Cliente2: pick(r.ClienteDireccion, o.Cliente2),
+		Cliente3: pick(r.ClienteNIF, o.Cliente3), Cliente4: pick(r.ClienteEmail, o.Cliente4),
+		CobroMixto: o.CobroMixto, EfectivoMixto: o.EfectivoMixto, TipoCobroMixto: o.TipoCobroMixto,
+		TipoCobroMixto2: o.TipoCobroMixto2, Comensales: o.Comensales, CobroMixto2: o.CobroMixto2,
+		FacturaRectificada: o.Codigo,
+		TipoRectificativa:  DefaultRectificationType(o),
+		TipoRectificacion:  RectificationBySubstitution,
+		Motivo:             &motivo,
+		BaseRectificada:    &base,
+		CuotaRectificada:   &quota,
+	}
+	rectifying := RectifyingInvoiceDTO{Header: h, Lines: []RectifyingInvoiceLineDTO{}}
+	for _, l := range original.Lines {
+		var unidadesOld *money.Decimal
+		if l.UnidadesOld != nil {
+			v := money.FromInt(int64(*l.UnidadesOld))
+			unidadesOld = &v
+		}
+		rectifying.Lines = append(rectifying.Lines, RectifyingInvoiceLineDTO{
+			CodigoProducto: l.CodigoProducto, Subtotal: l.Subtotal, Producto: l.Producto,
+			IvaAplicado: l.IvaAplicado, Linea: l.Linea, Unidades: l.Unidades, UnidadesOld: unidadesOld,
+			CombinadoCon: l.CombinadoCon, LigaSiguiente: l.LigaSiguiente, Serie: l.Serie,
+		})
+	}
+	return rectifying, nil
+}
+
+// pick returns v, or def when v is nil.
+func pick(v, def *string) *string {
+	if v != nil {
+		return v
+	}
+	return def
+}
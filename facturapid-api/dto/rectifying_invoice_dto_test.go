@@ -0,0 +1,36 @@
+package dto
+
+import (
+	"facturapid-api/money"
+	"testing"
+	"time"
+)
+
+func TestDefaultRectificationType(t *testing.T) {
+	nif, empty := "B12345678", ""
+	tests := []struct {
+		name     string
+		cliente3 *string
+		want     string
+	}{
+		{"customer NIF", &nif, RectificationR4},
+		{"no NIF", nil, RectificationR5},
+		{"empty NIF", &empty, RectificationR5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			original := InvoiceHeaderDTO{Codigo: 7, Serie: "A", Tarifa: "1", Total: money.MustParse("12.10"), Cliente3: tt.cliente3}
+			if got := DefaultRectificationType(original); got != tt.want {
+				t.Errorf("DefaultRectificationType = %s, want %s", got, tt.want)
+			}
+			// Rectifications by substitution default the same way
+			r, err := NewSubstitution(FullInvoiceDTO{Header: original}, RectifyInvoiceDTO{Motivo: "NIF erróneo"}, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Header.TipoRectificativa != tt.want {
+				t.Errorf("NewSubstitution type = %s, want %s", r.Header.TipoRectificativa, tt.want)
+			}
+		})
+	}
+}
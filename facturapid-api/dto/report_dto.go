@@ -0,0 +1,86 @@
+package dto
+
+import "facturapid-api/money"
+
+// MaxReportDays caps the days a report covers, both days included.
+const MaxReportDays = 366
+
+// Report formats, chosen with the format query parameter.
+const (
+	ReportFormatJSON = "json"
+	ReportFormatCSV  = "csv"
+	ReportFormatXLSX = "xlsx" // The libro registro only
+)
+
+// ReportQueryDTO holds the query parameters of the reports. From and To bound the
+// fecha, both days included.
+type ReportQueryDTO struct {
+	From   string `form:"from" binding:"required,datetime=2006-01-02"`
+	To     string `form:"to" binding:"required,datetime=2006-01-02"`
+	Format string `form:"format" binding:"omitempty,oneof=json csv"` // json by default
+}
+
+// DailyReportDTO is the sales and VAT summary of GET /reports/daily: one entry per day
+// with sales, and the totals of the period. Voided invoices are left out; rectifying
+// invoices are separate documents and are not netted against the day's sales.
+type DailyReportDTO struct {
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Days   []DailySalesDTO `json:"days"`
+	Totals DailySalesDTO   `json:"totals"`
+}
+
+// DailySalesDTO adds up the invoices of a day, or of the whole period in the totals
+// of a report, where Fecha is empty.
+type DailySalesDTO struct {
+	Fecha      string        `json:"fecha,omitempty"`
+	Invoices   int           `json:"invoices"`
+	Total      money.Decimal `json:"total"`
+	Comensales int           `json:"comensales"`
+	// AverageTicketPerDiner is the total of the invoices recording their diners
+	// divided by those diners, to the cent; nil when no invoice records them.
+	AverageTicketPerDiner *money.Decimal `json:"average_ticket_per_diner"`
+	// TotalWithComensales is the total of the invoices recording their diners, the
+	// dividend of AverageTicketPerDiner.
+	TotalWithComensales money.Decimal `json:"-"`
+	// CobroMixto and EfectivoMixto add up the two parts of mixed payments.
+	CobroMixto     money.Decimal      `json:"cobro_mixto"`
+	EfectivoMixto  money.Decimal      `json:"efectivo_mixto"`
+	VATRates       []VATRateSalesDTO  `json:"vat_rates"`
+	PaymentMethods []PaymentSalesDTO  `json:"payment_methods"`
+	Vendedores     []VendedorSalesDTO `json:"vendedores"`
+}
+
+// VATRateSalesDTO adds up the base1..6 and cuota_iva1..6 taxed at a VAT rate.
+type VATRateSalesDTO struct {
+	Rate     money.Decimal `json:"rate"`
+	Base     money.Decimal `json:"base"`
+	CuotaIVA money.Decimal `json:"cuota_iva"`
+}
+
+// PaymentSalesDTO adds up the invoices paid with a tipo_cobro; nil for invoices
+// without one.
+type PaymentSalesDTO struct {
+	TipoCobro     *string       `json:"tipo_cobro"`
+	Invoices      int           `json:"invoices"`
+	Total         money.Decimal `json:"total"`
+	CobroMixto    money.Decimal `json:"cobro_mixto"`
+	EfectivoMixto money.Decimal `json:"efectivo_mixto"`
+}
+
+// VendedorSalesDTO adds up the invoices of a vendedor; nil for invoices without one.
+type VendedorSalesDTO struct {
+	Vendedor   *string       `json:"vendedor"`
+	Invoices   int           `json:"invoices"`
+	Total      money.Decimal `json:"total"`
+	Comensales int           `json:"comensales"`
+}
+
+// SetAverageTicket sets AverageTicketPerDiner from TotalWithComensales and Comensales.
+func (s *DailySalesDTO) SetAverageTicket() {
+	s.AverageTicketPerDiner = nil
+	if s.Comensales > 0 {
+		avg := s.TotalWithComensales.Div(money.FromInt(int64(s.Comensales))).Round(2)
+		s.AverageTicketPerDiner = &avg
+	}
+}
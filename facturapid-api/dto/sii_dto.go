@@ -0,0 +1,78 @@
+package dto
+
+import "time"
+
+// SII submission statuses of a document (table sii_submissions).
+const (
+	SIIStatusPending  = "pending"  // Not sent yet, or its batch got no answer; sent with the next batch
+	SIIStatusAccepted = "accepted" // Correcto
+	// SIIStatusAcceptedWithErrors documents are registered, but must be corrected with
+	// a modification (A1), which the API does not send; they are not sent again.
+	SIIStatusAcceptedWithErrors = "accepted_with_errors" // AceptadoConErrores
+	SIIStatusRejected           = "rejected"             // Incorrecto; sent again with the next batch
+)
+
+// SII batch statuses (table sii_batches).
+const (
+	SIIBatchSending           = "sending"
+	SIIBatchAccepted          = "accepted"           // Correcto
+	SIIBatchPartiallyAccepted = "partially_accepted" // ParcialmenteCorrecto
+	SIIBatchRejected          = "rejected"           // Incorrecto
+	SIIBatchFailed            = "failed"             // No answer, or a SOAP fault
+)
+
+// SIIBatchRequestDTO is the body of POST /admin/sii/batches: the issued documents from
+// one day to another, both included, that are not registered in the SII yet.
+type SIIBatchRequestDTO struct {
+	From string `json:"from" binding:"required,datetime=2006-01-02"`
+	To   string `json:"to" binding:"required,datetime=2006-01-02"`
+	// DryRun returns the batches with their XML without sending or recording them.
+	DryRun bool `json:"dry_run"`
+}
+
+// SIIBatchDTO is a "Facturas Emitidas" batch sent to the SII (table sii_batches). The
+// XML itself is not kept, only its digest, so customer data stays in the invoices.
+type SIIBatchDTO struct {
+	ID         int        `json:"id,omitempty"` // 0 in dry runs
+	IssuerNIF  string     `json:"issuer_nif"`   // Titular of the batch
+	Status     string     `json:"status,omitempty"`
+	Records    int        `json:"records"`
+	XMLSHA256  string     `json:"xml_sha256"`
+	CSV        *string    `json:"csv,omitempty"` // Código seguro de verificación of the answer
+	Error      *string    `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AnsweredAt *time.Time `json:"answered_at,omitempty"`
+	// Submissions are the documents of the batch, in GET /admin/sii/batches/:id.
+	Submissions []SIISubmissionDTO `json:"submissions,omitempty"`
+	XML         string             `json:"xml,omitempty"` // Dry runs only
+}
+
+// SIISubmissionDTO is the SII state of an issued document (table sii_submissions): the
+// outcome of the last batch it was sent in.
+type SIISubmissionDTO struct {
+	ID               int       `json:"id"`
+	Number           string    `json:"number"` // "A-123"
+	IssueDate        string    `json:"issue_date"`
+	InvoiceType      string    `json:"invoice_type"` // F1, F2, R1..R5
+	Status           string    `json:"status"`
+	BatchID          int       `json:"batch_id"`
+	Attempts         int       `json:"attempts"`
+	CSV              *string   `json:"csv,omitempty"`
+	ErrorCode        *int      `json:"error_code,omitempty"`
+	ErrorDescription *string   `json:"error_description,omitempty"`
+	UpdatedAt        time.Time `json:"updated_at"`
+}
+
+// SIISubmissionQueryDTO holds the query parameters of GET /admin/sii/submissions.
+type SIISubmissionQueryDTO struct {
+	Status string `form:"status" binding:"omitempty,oneof=pending accepted accepted_with_errors rejected"`
+}
+
+// SIIRecordResultDTO is the SII's answer for a document of a batch (RespuestaLinea).
+type SIIRecordResultDTO struct {
+	Number           string
+	Status           string // An SIIStatus
+	CSV              *string
+	ErrorCode        *int
+	ErrorDescription *string
+}
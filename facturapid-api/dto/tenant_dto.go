@@ -0,0 +1,39 @@
+package dto
+
+import "time"
+
+// DefaultTenantID is the tenant created with the database. Every invoice and setting
+// stored before tenants existed belongs to it.
+const DefaultTenantID = 1
+
+// API key roles. A client key reaches the invoice routes of its tenant, an admin key
+// the back-office routes of its tenant, and a platform key, which has no tenant,
+// manages the tenants and their keys.
+const (
+	APIKeyRoleClient   = "client"
+	APIKeyRoleAdmin    = "admin"
+	APIKeyRolePlatform = "platform"
+)
+
+// TenantDTO is a restaurant or legal entity whose invoices are kept apart from the
+// others': each has its own invoice numbering, issuer profiles, API keys and settings.
+type TenantDTO struct {
+	ID int `json:"id"`
+	// Code identifies the tenant to the synchronizer, which sends it as the
+	// establecimiento of every invoice.
+	Code      string    `json:"code" binding:"required,max=30"`
+	Name      string    `json:"name" binding:"required,max=200"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyDTO is an API key of a tenant. The key itself is only returned when it is
+// created: the database keeps its hash.
+type APIKeyDTO struct {
+	ID          int        `json:"id"`
+	TenantID    *int       `json:"tenant_id"` // Nil for platform keys
+	Role        string     `json:"role" binding:"required,oneof=client admin"`
+	Description *string    `json:"description" binding:"omitempty,max=200"`
+	Key         string     `json:"key,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
@@ -0,0 +1,60 @@
+package dto
+
+import "facturapid-api/money"
+
+// VATGroup is one of the six base/rate/quota groups (baseN, ivaN, cuotaIvaN) of an
+// invoice header, with its recargo de equivalencia if any.
+type VATGroup struct {
+	Index          int           // 1..6, the N in baseN
+	Base           money.Decimal // baseN
+	Rate           money.Decimal // ivaN, percentage
+	Quota          money.Decimal // cuotaIvaN
+	SurchargeRate  money.Decimal // recargoN, percentage
+	SurchargeQuota money.Decimal // cuotaRecargoN
+}
+
+// Exempt reports whether the group is a base taxed at 0% (an exempt operation).
+func (g VATGroup) Exempt() bool {
+	return g.Rate.IsZero() && !g.Base.IsZero()
+}
+
+// Total returns the base plus VAT and recargo quotas of the group.
+func (g VATGroup) Total() money.Decimal {
+	return g.Base.Add(g.Quota).Add(g.SurchargeQuota)
+}
+
+func decimalOrZero(d *money.Decimal) money.Decimal {
+	if d != nil {
+		return *d
+	}
+	return money.Zero
+}
+
+// VATGroups returns the non-empty VAT groups of the header, in order (Base1 first).
+// A group is empty when its base and quotas are all zero or missing.
+func (h InvoiceHeaderDTO) VATGroups() []VATGroup {
+	raw := [][5]*money.Decimal{
+		{h.Base1, h.Iva1, h.CuotaIva1, h.Recargo1, h.CuotaRecargo1},
+		{h.Base2, h.Iva2, h.CuotaIva2, h.Recargo2, h.CuotaRecargo2},
+		{h.Base3, h.Iva3, h.CuotaIva3, h.Recargo3, h.CuotaRecargo3},
+		{h.Base4, h.Iva4, h.CuotaIva4, h.Recargo4, h.CuotaRecargo4},
+		{h.Base5, h.Iva5, h.CuotaIva5, h.Recargo5, h.CuotaRecargo5},
+		{h.Base6, h.Iva6, h.CuotaIva6, h.Recargo6, h.CuotaRecargo6},
+	}
+	var groups []VATGroup
+	for i, r := range raw {
+		g := VATGroup{
+			Index:          i + 1,
+			Base:           decimalOrZero(r[0]),
+			Rate:           decimalOrZero(r[1]),
+			Quota:          decimalOrZero(r[2]),
+			SurchargeRate:  decimalOrZero(r[3]),
+			SurchargeQuota: decimalOrZero(r[4]),
+		}
+		if g.Base.IsZero() && g.Quota.IsZero() && g.SurchargeQuota.IsZero() {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
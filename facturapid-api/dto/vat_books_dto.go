@@ -0,0 +1,144 @@
+package dto
+
+import (
+	"facturapid-api/money"
+	"strconv"
+	"time"
+)
+
+// QuarterQueryDTO holds the query parameters of the quarterly VAT reports.
+type QuarterQueryDTO struct {
+	Year    int    `form:"year" binding:"required,min=2000,max=2100"`
+	Quarter int    `form:"quarter" binding:"required,min=1,max=4"`
+	Format  string `form:"format" binding:"omitempty,oneof=json csv xlsx"` // json by default
+}
+
+// Bounds returns the first and last day of the quarter.
+func (q QuarterQueryDTO) Bounds() (time.Time, time.Time) {
+	from := time.Date(q.Year, time.Month(3*q.Quarter-2), 1, 0, 0, 0, 0, time.UTC)
+	return from, from.AddDate(0, 3, -1)
+}
+
+// Period returns the quarter as the AEAT writes it: "1T" to "4T".
+func (q QuarterQueryDTO) Period() string {
+	return strconv.Itoa(q.Quarter) + "T"
+}
+
+// IssuedDocumentDTO is an invoice or rectifying invoice as the VAT books and the SII see
+// it. Voided invoices are never issued documents.
+type IssuedDocumentDTO struct {
+	Serie         string
+	Codigo        int
+	Fecha         string // YYYY-MM-DD
+	Total         money.Decimal
+	Terminal      *string // Selects the issuer profile, with the serie
+	Nombre        *string // cliente1
+	NIF           *string // cliente3
+	CausaExencion *string
+	VATGroups     []VATGroup
+	Payment       IssuedPaymentDTO
+	// Rectification is only set on rectifying invoices.
+	Rectification *RectificationDTO
+}
+
+// IssuedPaymentDTO is how an issued document was paid. A mixed payment has up to two
+// parts with their own tipo_cobro, and a part in cash; the rest of the total is paid
+// with TipoCobro.
+type IssuedPaymentDTO struct {
+	TipoCobro       *string
+	CobroMixto      money.Decimal
+	TipoCobroMixto  *string
+	CobroMixto2     money.Decimal
+	TipoCobroMixto2 *string
+	EfectivoMixto   money.Decimal
+}
+
+// Number returns the document number, e.g. "A-123".
+func (d IssuedDocumentDTO) Number() string {
+	return d.Serie + "-" + strconv.Itoa(d.Codigo)
+}
+
+// InvoiceType returns the AEAT invoice type: R1..R5 for rectifying invoices, and F1 or
+// F2 as in NewIssueRecord for the others.
+func (d IssuedDocumentDTO) InvoiceType() string {
+	if d.Rectification != nil {
+		return d.Rectification.Tipo
+	}
+	if d.NIF != nil && *d.NIF != "" {
+		return InvoiceTypeComplete
+	}
+	return InvoiceTypeSimplified
+}
+
+// LibroRegistroDTO is the libro registro de facturas expedidas of a quarter (GET
+// /reports/libro-registro), in the column layout the AEAT recommends.
+type LibroRegistroDTO struct {
+	Ejercicio int                     `json:"ejercicio"`
+	Periodo   string                  `json:"periodo"`
+	Entries   []LibroRegistroEntryDTO `json:"entries"`
+}
+
+// LibroRegistroEntryDTO is a row of the libro registro: a VAT rate of a document. A
+// document with several rates has a row per rate, and its total on the first one only,
+// so the column adds up.
+type LibroRegistroEntryDTO struct {
+	TipoFactura        string  `json:"tipo_factura"` // F1, F2, R1..R5
+	FechaExpedicion    string  `json:"fecha_expedicion"`
+	FechaOperacion     string  `json:"fecha_operacion"`
+	Serie              string  `json:"serie"`
+	Numero             int     `json:"numero"`
+	NIFDestinatario    *string `json:"nif_destinatario"`
+	NombreDestinatario *string `json:"nombre_destinatario"`
+	ClaveOperacion     string  `json:"clave_operacion"` // 01: régimen general
+	// Calificacion is S1 (sujeta y no exenta) for taxed rates; exempt rates have the
+	// exemption cause (E1..E6) in OperacionExenta instead.
+	Calificacion    string         `json:"calificacion"`
+	OperacionExenta string         `json:"operacion_exenta"`
+	TotalFactura    *money.Decimal `json:"total_factura"`
+	BaseImponible   money.Decimal  `json:"base_imponible"`
+	TipoIVA         money.Decimal  `json:"tipo_iva"`
+	CuotaIVA        money.Decimal  `json:"cuota_iva"`
+	TipoRecargo     money.Decimal  `json:"tipo_recargo"`
+	CuotaRecargo    money.Decimal  `json:"cuota_recargo"`
+	// Rectifying invoices only: the rectified invoice and the rectification method,
+	// and for substitutions the rectified base and quota, on the first row.
+	FacturaRectificada      *string        `json:"factura_rectificada,omitempty"`
+	FechaFacturaRectificada *string        `json:"fecha_factura_rectificada,omitempty"`
+	TipoRectificacion       string         `json:"tipo_rectificacion,omitempty"`
+	BaseRectificada         *money.Decimal `json:"base_rectificada,omitempty"`
+	CuotaRectificada        *money.Decimal `json:"cuota_rectificada,omitempty"`
+}
+
+// Modelo303DTO is the pre-calculation of the IVA devengado of a quarter's Modelo 303
+// (GET /reports/modelo-303) from the documents the API issued. The IVA deducible comes
+// from purchase invoices the API does not have, so it is left to the gestoría.
+type Modelo303DTO struct {
+	Ejercicio int    `json:"ejercicio"`
+	Periodo   string `json:"periodo"`
+	// RegimenGeneral and RecargoEquivalencia add up the bases and quotas of the
+	// invoices per rate, with the boxes (casillas) of the form they go in.
+	RegimenGeneral      []Modelo303LineDTO `json:"regimen_general"`
+	RecargoEquivalencia []Modelo303LineDTO `json:"recargo_equivalencia"`
+	// ModificacionBases and ModificacionCuotas (boxes 14 and 15) add up what the
+	// rectifying invoices changed: their amounts, less the rectified ones for
+	// substitutions.
+	ModificacionBases  money.Decimal `json:"modificacion_bases"`
+	ModificacionCuotas money.Decimal `json:"modificacion_cuotas"`
+	// BaseExenta adds up the bases taxed at 0%, which have no box of their own.
+	BaseExenta money.Decimal `json:"base_exenta"`
+	// TotalCuotaDevengada (box 27) adds up every quota above.
+	TotalCuotaDevengada money.Decimal `json:"total_cuota_devengada"`
+	Invoices            int           `json:"invoices"`
+	RectifyingInvoices  int           `json:"rectifying_invoices"`
+	// Warnings lists what the pre-calculation could not place in a box.
+	Warnings []string `json:"warnings"`
+}
+
+// Modelo303LineDTO is a rate of the Modelo 303: its base, rate and quota boxes, and
+// their amounts. Casillas is empty for rates the form has no boxes for.
+type Modelo303LineDTO struct {
+	Casillas []string      `json:"casillas"`
+	Base     money.Decimal `json:"base"`
+	Rate     money.Decimal `json:"rate"`
+	Cuota    money.Decimal `json:"cuota"`
+}
@@ -0,0 +1,17 @@
+package dto
+
+import "time"
+
+// VoidDTO records the voiding of an invoice. Voided invoices are kept, not deleted,
+// so the numbering has no gaps and the fiscal record chain stays complete.
+type VoidDTO struct {
+	VoidedAt time.Time `json:"voided_at"`
+	VoidedBy string    `json:"voided_by"` // The authenticated actor, as ActorDTO.String
+	Reason   string    `json:"reason"`
+}
+
+// VoidInvoiceDTO is the body of POST /invoices/:id/void. Who voided the invoice is
+// taken from the request's credentials, not from the body.
+type VoidInvoiceDTO struct {
+	Reason string `json:"reason" binding:"required,min=3,max=500"`
+}
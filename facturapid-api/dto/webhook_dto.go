@@ -0,0 +1,58 @@
+package dto
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Webhook delivery statuses.
+const (
+	WebhookStatusPending   = "pending" // Waiting for its first attempt or for a retry
+	WebhookStatusDelivered = "delivered"
+	WebhookStatusFailed    = "failed" // Every attempt failed; replay to try again
+)
+
+// WebhookSubscriptionDTO is an endpoint notified of invoice lifecycle events.
+type WebhookSubscriptionDTO struct {
+	ID  int    `json:"id"`
+	URL string `json:"url" binding:"required,url,max=500"`
+	// Secret keys the HMAC-SHA256 signature of every payload. It is generated when
+	// created without one, and kept when updated without one.
+	Secret      string  `json:"secret" binding:"omitempty,min=16,max=128"`
+	Description *string `json:"description" binding:"omitempty,max=200"`
+	// Events selects the event types delivered; empty means all of them.
+	Events []string `json:"events" binding:"omitempty,dive,oneof=invoice.received invoice.fiscal_data_completed invoice.pdf_issued invoice.voided"`
+	// Active defaults to true. Inactive subscriptions receive nothing.
+	Active    *bool     `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDeliveryDTO is one event sent (or to be sent) to one subscription.
+type WebhookDeliveryDTO struct {
+	ID             int             `json:"id"`
+	TenantID       int             `json:"-"` // The tenant of the subscription, for the worker
+	SubscriptionID int             `json:"subscription_id"`
+	EventID        string          `json:"event_id"` // Shared by the deliveries of the same event, and by replays
+	EventType      string          `json:"event_type"`
+	InvoiceID      *int            `json:"invoice_id,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"` // Only while pending
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	ReplayOf       *int            `json:"replay_of,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	// AttemptLog is only filled in when a single delivery is requested.
+	AttemptLog []WebhookAttemptDTO `json:"attempt_log,omitempty"`
+}
+
+// WebhookAttemptDTO is one HTTP request of a delivery.
+type WebhookAttemptDTO struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  *int      `json:"status_code,omitempty"` // Absent when no response was received
+	Error       *string   `json:"error,omitempty"`
+	Response    *string   `json:"response,omitempty"` // Start of the response body
+	DurationMS  int       `json:"duration_ms"`
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"facturapid-api/money"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validAccount reports whether s is an account number: 3 to 12 digits.
+func validAccount(s string) bool {
+	if len(s) < 3 || len(s) > 12 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeAccountMapping checks the accounts of m and rewrites its keys the way the
+// journal looks them up: rates as money.Decimal.String() ("21.00" as "21"), tipo_cobro
+// trimmed and in lower case. It returns what is wrong, or "".
+func normalizeAccountMapping(m *dto.AccountMappingDTO) string {
+	accounts := []struct{ field, cuenta string }{
+		{"sales", m.Sales}, {"vat", m.VAT}, {"surcharge", m.Surcharge},
+		{"payment", m.Payment}, {"cash", m.Cash}, {"rounding", m.Rounding},
+	}
+	for _, a := range accounts {
+		if !validAccount(a.cuenta) {
+			return fmt.Sprintf("%s must be an account number of 3 to 12 digits.", a.field)
+		}
+	}
+
+	byRate := []struct {
+		field   string
+		mapping *map[string]string
+	}{{"sales_by_rate", &m.SalesByRate}, {"vat_by_rate", &m.VATByRate}}
+	for _, b := range byRate {
+		field, mapping := b.field, b.mapping
+		normalized := map[string]string{}
+		for rate, cuenta := range *mapping {
+			r, err := money.Parse(strings.TrimSpace(rate))
+			if err != nil || r.Sign() < 0 {
+				return fmt.Sprintf("%s: %q is not a VAT rate.", field, rate)
+			}
+			if !validAccount(cuenta) {
+				return fmt.Sprintf("%s: the account of %s%% must have 3 to 12 digits.", field, rate)
+			}
+			normalized[r.String()] = cuenta
+		}
+		*mapping = normalized
+	}
+
+	methods := map[string]string{}
+	for tipo, cuenta := range m.PaymentMethods {
+		key := strings.ToLower(strings.TrimSpace(tipo))
+		if key == "" {
+			return "payment_methods: the tipo_cobro must not be empty."
+		}
+		if !validAccount(cuenta) {
+			return fmt.Sprintf("payment_methods: the account of %q must have 3 to 12 digits.", tipo)
+		}
+		methods[key] = cuenta
+	}
+	m.PaymentMethods = methods
+	return ""
+}
+
+// GetAccountMappingHandler returns the account mapping the journal is booked with: the
+// tenant's, or the default one.
+func GetAccountMappingHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mapping, err := database.GetAccountMapping(db, middleware.TenantID(c))
+		if err != nil {
+			log.Printf("Error retrieving account mapping: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve account mapping"})
+			return
+		}
+		c.JSON(http.StatusOK, mapping)
+	}
+}
+
+// UpdateAccountMappingHandler replaces the tenant's account mapping.
+func UpdateAccountMappingHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var mapping dto.AccountMappingDTO
+		if err := c.ShouldBindJSON(&mapping); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		if msg := normalizeAccountMapping(&mapping); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "details": msg})
+			return
+		}
+
+		saved, err := database.SaveAccountMapping(db, middleware.TenantID(c), mapping)
+		if err != nil {
+			log.Printf("Error saving account mapping: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save account mapping"})
+			return
+		}
+		c.JSON(http.StatusOK, saved)
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"facturapid-api/archive"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RunArchivalHandler runs the archival job now, outside its schedule, and returns the
+// report of the run. With ?dry_run=true nothing is changed and the report counts what
+// the run would do.
+func RunArchivalHandler(svc *archive.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid query parameters",
+				"details": "dry_run must be true or false.",
+			})
+			return
+		}
+
+		run, err := svc.Run(dryRun)
+		if err != nil {
+			log.Printf("Error running archival job: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to run archival job", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, run)
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"facturapid-api/privacy"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDataSubjectRequestsListed caps GET /admin/data-subject-requests.
+const maxDataSubjectRequestsListed = 200
+
+// ExportDataSubjectHandler returns everything stored about the customer identified by
+// the nif and/or email query parameters (GDPR access request), as a JSON download.
+func ExportDataSubjectHandler(svc *privacy.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var subject dto.DataSubjectDTO
+		if err := c.ShouldBindQuery(&subject); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid query parameters",
+				"details": err.Error(),
+			})
+			return
+		}
+		if subject.Normalized().Empty() {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid query parameters",
+				"details": "A nif or an email must be given.",
+			})
+			return
+		}
+
+		export, err := svc.Export(middleware.TenantID(c), subject, middleware.Actor(c))
+		if err != nil {
+			log.Printf("Error exporting data subject: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export data subject"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"data-subject-%s.json\"", export.GeneratedAt.Format("20060102T150405Z")))
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+// EraseDataSubjectHandler handles an erasure request (GDPR art. 17). Documents tax law
+// still requires are kept and reported as retained; the response is the audit record.
+func EraseDataSubjectHandler(svc *privacy.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req dto.EraseDataSubjectDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		if req.DataSubjectDTO.Normalized().Empty() {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": "A nif or an email must be given.",
+			})
+			return
+		}
+
+		record, err := svc.Erase(middleware.TenantID(c), req, middleware.Actor(c))
+		if err != nil {
+			log.Printf("Error erasing data subject: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to erase data subject"})
+			return
+		}
+		c.JSON(http.StatusOK, record)
+	}
+}
+
+// ListDataSubjectRequestsHandler returns the audit records of exports, erasures and
+// retention runs, newest first.
+func ListDataSubjectRequestsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requests, err := database.ListDataSubjectRequests(db, middleware.TenantID(c), maxDataSubjectRequestsListed)
+		if err != nil {
+			log.Printf("Error listing data subject requests: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve data subject requests"})
+			return
+		}
+		c.JSON(http.StatusOK, requests)
+	}
+}
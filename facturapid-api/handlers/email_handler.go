@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/mailer"
+	"facturapid-api/middleware"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SendInvoiceHandler queues the invoice PDF to be emailed (again) to the customer, or
+// to the address given in the body. The mail worker sends it shortly after.
+func SendInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		invoiceID, err := strconv.Atoi(idStr)
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID format"})
+			return
+		}
+
+		var req dto.SendInvoiceDTO
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) { // The body is optional
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		if _, err := database.GetInvoiceVersion(db, middleware.TenantID(c), invoiceID); errors.Is(err, database.ErrInvoiceVoided) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice has been voided"})
+			return
+		}
+
+		recipient := ""
+		if req.Email != nil {
+			recipient = *req.Email
+		} else {
+			invoice, err := database.GetFullInvoiceByID(db, middleware.TenantID(c), invoiceID)
+			if err != nil {
+				if errors.Is(err, database.ErrInvoiceNotFound) {
+					c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+					return
+				}
+				log.Printf("Error retrieving invoice (ID: %d) to send it: %v", invoiceID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invoice"})
+				return
+			}
+			if invoice.Header.Cliente4 != nil {
+				recipient = *invoice.Header.Cliente4
+			}
+		}
+		if recipient == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "No email address",
+				"details": "The invoice has no customer email; provide one in the request body.",
+			})
+			return
+		}
+
+		language := mailer.LanguageFromHeader(c.GetHeader("Accept-Language"))
+		if req.Language != nil {
+			language = *req.Language
+		}
+		delivery, err := database.EnqueueEmailDelivery(db, middleware.TenantID(c), invoiceID, recipient, language)
+		if err != nil {
+			if errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+				return
+			}
+			if errors.Is(err, database.ErrInvoiceArchived) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Invoice is archived", "details": "Download its PDF instead."})
+				return
+			}
+			log.Printf("Error queueing email for invoice (ID: %d): %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue invoice email"})
+			return
+		}
+		recordEmailQueued(c, db, delivery)
+		c.JSON(http.StatusAccepted, delivery)
+	}
+}
+
+// ListEmailDeliveriesHandler returns the email deliveries of an invoice and their status.
+func ListEmailDeliveriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		invoiceID, err := strconv.Atoi(idStr)
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid invoice ID format"})
+			return
+		}
+		deliveries, err := database.ListEmailDeliveries(db, middleware.TenantID(c), invoiceID)
+		if err != nil {
+			log.Printf("Error listing email deliveries for invoice (ID: %d): %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list email deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// recordEmailQueued adds a queued email to the invoice's audit trail. The email is
+// queued already, so a failure is only logged.
+func recordEmailQueued(c *gin.Context, db *sql.DB, d dto.EmailDeliveryDTO) {
+	details := map[string]interface{}{"delivery_id": d.ID, "recipient": d.Recipient}
+	if err := database.RecordInvoiceEvent(db, middleware.TenantID(c), d.InvoiceID, dto.InvoiceEventEmailQueued, middleware.Actor(c), details); err != nil {
+		log.Printf("Error recording email event for invoice %d: %v", d.InvoiceID, err)
+	}
+}
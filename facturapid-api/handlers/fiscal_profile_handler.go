@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/mailer"
+	"facturapid-api/middleware"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestFiscalProfileCodeHandler starts the prefill of an invoice's fiscal data from
+// the customer's saved profile: it emails a one-time code, valid for ttl, to the
+// address stored for the NIF. The response is the same whether or not a profile
+// exists, and as fast, the code being queued to codes, so knowing a NIF reveals nothing.
+func RequestFiscalProfileCodeHandler(db *sql.DB, codes *mailer.CodeSender, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		var req dto.FiscalProfileCodeRequestDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		nif := dto.NormalizeNIF(req.ClienteNIF)
+		if nif == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "details": "cliente_nif is empty."})
+			return
+		}
+
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			log.Printf("Error generating fiscal profile code: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+			return
+		}
+		code := fmt.Sprintf("%06d", n.Int64())
+
+		err = database.CreateFiscalProfileCode(db, middleware.TenantID(c), nif, invoiceID, code, ttl)
+		if err != nil {
+			if errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+				return
+			}
+			if errors.Is(err, database.ErrInvoiceArchived) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Invoice is archived"})
+				return
+			}
+			if errors.Is(err, database.ErrTooManyFiscalProfileCodes) {
+				c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many verification codes requested for this NIF, try again later"})
+				return
+			}
+			log.Printf("Error storing fiscal profile code for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+			return
+		}
+
+		profile, err := database.GetFiscalProfile(db, middleware.TenantID(c), nif)
+		switch {
+		case errors.Is(err, database.ErrFiscalProfileNotFound):
+			// Nothing to send; answer as if there were
+		case err != nil:
+			log.Printf("Error retrieving fiscal profile for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification code"})
+			return
+		default:
+			language := mailer.LanguageFromHeader(c.GetHeader("Accept-Language"))
+			data := mailer.FiscalProfileCodeMailData{NIF: profile.NIF, Code: code, Minutes: int(ttl / time.Minute)}
+			if !codes.Enqueue(profile.Email, language, data) {
+				// Failing the request would tell that the NIF has a profile
+				log.Printf("Warning: fiscal profile code for invoice %d dropped, the code queue is full", invoiceID)
+			}
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"message":            "If there are saved fiscal data for this NIF, a verification code has been sent to their email address.",
+			"expires_in_seconds": int(ttl / time.Second),
+		})
+	}
+}
+
+// VerifyFiscalProfileCodeHandler checks a code sent by RequestFiscalProfileCodeHandler
+// and returns the saved fiscal data, for the customer to review and submit with
+// PUT /invoices/:id. The invoice itself is not changed.
+func VerifyFiscalProfileCodeHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		var req dto.FiscalProfileVerifyDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		profile, err := database.VerifyFiscalProfileCode(db, middleware.TenantID(c), req.ClienteNIF, invoiceID, req.Code)
+		if err != nil {
+			if errors.Is(err, database.ErrFiscalProfileCodeInvalid) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired verification code"})
+				return
+			}
+			log.Printf("Error verifying fiscal profile code for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"invoice_id":  invoiceID,
+			"fiscal_data": profile.FiscalData(),
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/mailer"
+	"net/http"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+// chanTransport hands the recipients of each message sent to a channel.
+type chanTransport chan []string
+
+func (t chanTransport) Send(from string, to []string, msg []byte) error {
+	t <- to
+	return nil
+}
+
+func TestRequestFiscalProfileCodeWithoutProfile(t *testing.T) {
+	db := testDB(t)
+	tenantID, key := testTenant(t, db)
+	testInvoice(t, db, tenantID, 1, "10.00")
+
+	// B12345678 has a profile, saved with the fiscal data of the invoice
+	version, err := database.GetInvoiceVersion(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := dto.FiscalDataDTO{ClienteNombre: strPtr("Bar Pepe SL"), ClienteNIF: strPtr("B12345678"), ClienteEmail: strPtr("pepe@example.com")}
+	if _, err := database.UpdateInvoiceFiscalData(db, tenantID, 1, data, version, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := make(chanTransport, 2)
+	codes := mailer.NewCodeSender(sent, mail.Address{Address: "facturas@example.com"}, 2)
+	r := clientRouter(db)
+	r.POST("/invoices/:id/fiscal-profile/code", RequestFiscalProfileCodeHandler(db, codes, 10*time.Minute))
+
+	// Codes are queued before the sender runs, so neither request waits for the mail
+	without := serve(r, key, http.MethodPost, "/invoices/1/fiscal-profile/code", `{"cliente_nif":"A87654321"}`, nil)
+	with := serve(r, key, http.MethodPost, "/invoices/1/fiscal-profile/code", `{"cliente_nif":"B12345678"}`, nil)
+	if without.Code != http.StatusAccepted || with.Code != http.StatusAccepted {
+		t.Fatalf("status = %d without profile, %d with profile, want %d", without.Code, with.Code, http.StatusAccepted)
+	}
+	if without.Body.String() != with.Body.String() {
+		t.Errorf("responses differ:\nwithout profile: %s\nwith profile:    %s", without.Body, with.Body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go codes.Run(ctx)
+	// The queue is in order: the first code sent is the profile's, none was queued
+	// for the NIF without one
+	select {
+	case to := <-sent:
+		if len(to) != 1 || to[0] != "pepe@example.com" {
+			t.Errorf("code sent to %v, want [pepe@example.com]", to)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no code sent")
+	}
+	select {
+	case to := <-sent:
+		t.Errorf("unexpected code sent to %v", to)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var codesStored int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM fiscal_profile_codes WHERE tenant_id = $1;`, tenantID).Scan(&codesStored); err != nil {
+		t.Fatal(err)
+	}
+	if codesStored != 2 {
+		t.Errorf("%d codes stored, want 2: one is stored whether or not there is a profile", codesStored)
+	}
+}
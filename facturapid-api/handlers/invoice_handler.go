@@ -5,17 +5,27 @@ import (
 	"errors" // For checking sql.ErrNoRows or custom db errors
 	"facturapid-api/database"
 	"facturapid-api/dto"
+	"facturapid-api/invoicepdf"
+	"facturapid-api/mailer"
+	"facturapid-api/middleware"
 	"facturapid-api/pdfgenerator" // Import the pdfgenerator package
+	"facturapid-api/validation"
+	"facturapid-api/webhooks"
 	"fmt"
 	"log" // For logging errors
 	"net/http"
 	"strconv" // For parsing ID from string
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // CreateInvoiceHandler handles the creation of new invoices.
-func CreateInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+// Totals, VAT bases and line sums are cross-checked with validationCfg; the outcome is
+// stored as the invoice's validation_status and returned in the response, but a failed
+// check does not reject the invoice (the TPV has already issued the ticket).
+func CreateInvoiceHandler(db *sql.DB, validationCfg validation.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var fullInvoice dto.FullInvoiceDTO
 
@@ -53,7 +63,37 @@ func CreateInvoiceHandler(db *sql.DB) gin.HandlerFunc {
 			}
 		}
 
-		err := database.CreateFullInvoice(db, fullInvoice)
+		if fullInvoice.Header.Establecimiento != nil {
+			tenant, err := database.GetTenant(db, middleware.TenantID(c))
+			if err != nil {
+				log.Printf("Error querying tenant for CreateInvoice (Codigo: %d): %v", fullInvoice.Header.Codigo, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process invoice"})
+				return
+			}
+			if *fullInvoice.Header.Establecimiento != tenant.Code {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":   "Establecimiento mismatch",
+					"details": fmt.Sprintf("The API key belongs to establecimiento %q, not %q.", tenant.Code, *fullInvoice.Header.Establecimiento),
+				})
+				return
+			}
+		}
+
+		report := validation.ValidateInvoice(fullInvoice, validationCfg)
+		fullInvoice.Header.ValidationStatus = &report.Status
+		fullInvoice.Header.ValidationReport = report.JSON()
+		if report.Status != validation.StatusValid {
+			log.Printf("Invoice %d did not pass all validation checks (%s): %+v", fullInvoice.Header.Codigo, report.Status, report.Results)
+		}
+
+		inserted, err := database.CreateFullInvoice(db, middleware.TenantID(c), fullInvoice, middleware.Actor(c))
+		if errors.Is(err, database.ErrInvoiceDateMissing) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": "header.fecha must be a date (YYYY-MM-DD).",
+			})
+			return
+		}
 		if err != nil {
 			log.Printf("Error creating full invoice (Codigo: %d) in database: %v", fullInvoice.Header.Codigo, err)
 			c.JSON(http.StatusInternalServerError, gin.H{
@@ -62,9 +102,31 @@ func CreateInvoiceHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !inserted {
+			// Sent again: the invoice was left as stored, and so was its validation
+			stored, err := database.GetFullInvoiceByID(db, middleware.TenantID(c), fullInvoice.Header.Codigo)
+			if err != nil {
+				log.Printf("Error retrieving stored invoice (Codigo: %d): %v", fullInvoice.Header.Codigo, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process invoice"})
+				return
+			}
+			c.JSON(http.StatusOK, gin.H{
+				"invoice_id":        fullInvoice.Header.Codigo,
+				"message":           "Invoice already received; the stored invoice was kept",
+				"validation_status": stored.Header.ValidationStatus,
+				"validation":        stored.Header.ValidationReport,
+			})
+			return
+		}
+
+		if err := webhooks.EmitInvoice(db, middleware.TenantID(c), webhooks.EventInvoiceReceived, fullInvoice.Header.Codigo); err != nil {
+			log.Printf("Error emitting webhook for invoice (Codigo: %d): %v", fullInvoice.Header.Codigo, err)
+		}
+
 		c.JSON(http.StatusCreated, gin.H{
 			"invoice_id": fullInvoice.Header.Codigo,
 			"message":    "Invoice created successfully",
+			"validation": report,
 		})
 	}
 }
@@ -85,7 +147,7 @@ func GetInvoiceHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		fullInvoice, err := database.GetFullInvoiceByID(db, invoiceID)
+		fullInvoice, err := database.GetFullInvoiceByID(db, middleware.TenantID(c), invoiceID)
 		if err != nil {
 			if errors.Is(err, database.ErrInvoiceNotFound) { 
 				log.Printf("Invoice not found for ID %d: %v", invoiceID, err)
@@ -96,11 +158,14 @@ func GetInvoiceHandler(db *sql.DB) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invoice"})
 			return
 		}
+		c.Header("ETag", invoiceETag(fullInvoice.Header.Version))
 		c.JSON(http.StatusOK, fullInvoice)
 	}
 }
 
 // UpdateInvoiceFiscalDataHandler handles updating fiscal data for an existing invoice.
+// It replaces all the fields: those left out are cleared. An If-Match header, when
+// sent, makes the update conditional on the invoice version.
 func UpdateInvoiceFiscalDataHandler(db *sql.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		idStr := c.Param("id")
@@ -136,27 +201,158 @@ func UpdateInvoiceFiscalDataHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		err = database.UpdateInvoiceFiscalData(db, invoiceID, fiscalData)
+		ifVersion, ok := parseIfMatch(c, false)
+		if !ok {
+			return
+		}
+		version, err := database.UpdateInvoiceFiscalData(db, middleware.TenantID(c), invoiceID, fiscalData, ifVersion, middleware.Actor(c))
 		if err != nil {
-			if errors.Is(err, database.ErrInvoiceNotFound) {
-				log.Printf("Invoice not found for fiscal data update (ID: %d): %v", invoiceID, err)
-				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
-				return
-			}
-			log.Printf("Error updating fiscal data for invoice (ID: %d) in database: %v", invoiceID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update invoice fiscal data"})
+			respondFiscalDataError(c, invoiceID, err)
 			return
 		}
+		respondFiscalDataUpdated(c, db, invoiceID, version, fiscalData.ClienteEmail)
+	}
+}
 
-		c.JSON(http.StatusOK, gin.H{
-			"invoice_id": invoiceID,
-			"message":    "Invoice fiscal data updated successfully",
+// PatchInvoiceFiscalDataHandler handles partial updates of an invoice's fiscal data with
+// a JSON Merge Patch: fields left out are kept and null fields are cleared. The
+// If-Match header must carry the invoice version the client read (its ETag), so
+// concurrent edits cannot overwrite each other.
+func PatchInvoiceFiscalDataHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		var patch dto.FiscalDataPatchDTO
+		if err := c.ShouldBindJSON(&patch); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload for fiscal data",
+				"details": err.Error(),
+			})
+			return
+		}
+		if err := binding.Validator.ValidateStruct(patch.Values()); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload for fiscal data",
+				"details": err.Error(),
+			})
+			return
+		}
+		if patch.Empty() {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": "At least one fiscal data field must be provided for update.",
+			})
+			return
+		}
+
+		ifVersion, ok := parseIfMatch(c, true)
+		if !ok {
+			return
+		}
+		version, err := database.PatchInvoiceFiscalData(db, middleware.TenantID(c), invoiceID, patch, ifVersion, middleware.Actor(c))
+		if err != nil {
+			respondFiscalDataError(c, invoiceID, err)
+			return
+		}
+		respondFiscalDataUpdated(c, db, invoiceID, version, patch.ClienteEmail.Value)
+	}
+}
+
+// invoiceETag is the entity tag of an invoice's data at a version.
+func invoiceETag(version int) string {
+	return fmt.Sprintf("\"v%d\"", version)
+}
+
+// parseIfMatch returns the invoice version in the request's If-Match header, or 0 when
+// the header is absent or "*". On failure it writes the error response and returns
+// false: 400 for a malformed header, 428 when it is required and absent.
+func parseIfMatch(c *gin.Context, required bool) (int, bool) {
+	ifMatch := strings.TrimSpace(c.GetHeader("If-Match"))
+	if ifMatch == "" && required {
+		c.JSON(http.StatusPreconditionRequired, gin.H{
+			"error":   "If-Match header required",
+			"details": "Send the ETag of the invoice as read with GET /invoices/:id.",
+		})
+		return 0, false
+	}
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, true
+	}
+	tag := strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`)
+	version, err := strconv.Atoi(strings.TrimPrefix(tag, "v"))
+	if err != nil || version <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid If-Match header",
+			"details": fmt.Sprintf("Expected an invoice ETag such as %s.", invoiceETag(1)),
+		})
+		return 0, false
+	}
+	return version, true
+}
+
+// respondFiscalDataError writes the response for a failed fiscal data update.
+func respondFiscalDataError(c *gin.Context, invoiceID int, err error) {
+	switch {
+	case errors.Is(err, database.ErrInvoiceNotFound):
+		log.Printf("Invoice not found for fiscal data update (ID: %d): %v", invoiceID, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+	case errors.Is(err, database.ErrInvoiceVoided):
+		c.JSON(http.StatusConflict, gin.H{"error": "Invoice has been voided"})
+	case errors.Is(err, database.ErrInvoiceArchived):
+		c.JSON(http.StatusConflict, gin.H{"error": "Invoice is archived", "details": "Archived invoices are read-only."})
+	case errors.Is(err, database.ErrInvalidStatusTransition):
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Invoice has been issued",
+			"details": fmt.Sprintf("The fiscal data of an issued invoice is final. Use POST /admin/invoices/%d/rectify to issue a rectifying invoice.", invoiceID),
+		})
+	case errors.Is(err, database.ErrVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, gin.H{
+			"error":   "Invoice has been modified",
+			"details": "Reload the invoice and apply the change again.",
 		})
+	default:
+		log.Printf("Error updating fiscal data for invoice (ID: %d) in database: %v", invoiceID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update invoice fiscal data"})
+	}
+}
+
+// respondFiscalDataUpdated finishes a successful fiscal data update: it notifies the
+// webhooks, queues the invoice email when the customer gave an address, and writes
+// the response with the invoice's new ETag.
+func respondFiscalDataUpdated(c *gin.Context, db *sql.DB, invoiceID, version int, email *string) {
+	if err := webhooks.EmitInvoice(db, middleware.TenantID(c), webhooks.EventInvoiceFiscalDataComplete, invoiceID); err != nil {
+		log.Printf("Error emitting webhook for invoice (ID: %d): %v", invoiceID, err)
+	}
+
+	response := gin.H{
+		"invoice_id": invoiceID,
+		"version":    version,
+		"message":    "Invoice fiscal data updated successfully",
+	}
+	// The customer gave an email address: send them the invoice. The update itself
+	// has succeeded, so a queueing failure is only logged (they can ask to resend).
+	if email != nil && *email != "" {
+		language := mailer.LanguageFromHeader(c.GetHeader("Accept-Language"))
+		delivery, err := database.EnqueueEmailDelivery(db, middleware.TenantID(c), invoiceID, *email, language)
+		if err != nil {
+			log.Printf("Error queueing email for invoice (ID: %d): %v", invoiceID, err)
+		} else {
+			recordEmailQueued(c, db, delivery)
+			response["email_delivery"] = delivery
+		}
 	}
+	c.Header("ETag", invoiceETag(version))
+	c.JSON(http.StatusOK, response)
 }
 
-// GetInvoicePDFHandler handles generating and returning a PDF for a single invoice.
-func GetInvoicePDFHandler(db *sql.DB) gin.HandlerFunc {
+// GetInvoicePDFHandler handles returning the PDF of a single invoice.
+// The PDF is generated once per invoice data version and layout, stored, and served
+// from the store afterwards, with an ETag so clients can revalidate cheaply.
+func GetInvoicePDFHandler(pdfs *invoicepdf.Service) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		idStr := c.Param("id")
 		invoiceID, err := strconv.Atoi(idStr)
@@ -170,32 +366,166 @@ func GetInvoicePDFHandler(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		// 1. Fetch invoice data
-		fullInvoice, err := database.GetFullInvoiceByID(db, invoiceID)
+		// 1. The requested layout (A4 by default, "ticket80" for receipt printers)
+		layout := c.DefaultQuery("layout", pdfgenerator.DefaultTemplateName)
+		tmpl, err := pdfgenerator.LoadTemplate(layout)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid layout",
+				"details": fmt.Sprintf("Available layouts: %v", pdfgenerator.TemplateNames()),
+			})
+			return
+		}
+
+		// 2. The stored PDF of the current version of the invoice, generated if needed
+		artifact, err := pdfs.Get(middleware.TenantID(c), invoiceID, tmpl, middleware.Actor(c))
 		if err != nil {
 			if errors.Is(err, database.ErrInvoiceNotFound) {
 				log.Printf("Invoice not found for PDF generation (ID %d): %v", invoiceID, err)
 				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
 				return
 			}
-			log.Printf("Error retrieving invoice for PDF (ID: %d) from database: %v", invoiceID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invoice data"})
+			if errors.Is(err, database.ErrInvoiceVoided) {
+				c.JSON(http.StatusGone, gin.H{"error": "Invoice has been voided"})
+				return
+			}
+			if errors.Is(err, database.ErrIssuerProfileNotFound) {
+				log.Printf("No issuer profile configured for invoice %d", invoiceID)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "No issuer profile configured for this invoice"})
+				return
+			}
+			log.Printf("Error getting PDF for invoice (ID: %d): %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice PDF"})
 			return
 		}
 
-		// 2. Generate PDF
-		pdfBytes, err := pdfgenerator.GenerateInvoicePDF(fullInvoice)
-		if err != nil {
-			log.Printf("Error generating PDF for invoice (ID: %d): %v", invoiceID, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice PDF"})
+		// 3. Set headers and return PDF (or 304 if the client has it already)
+		c.Header("ETag", artifact.ETag())
+		c.Header("Cache-Control", "private, no-cache")
+		if etagMatches(c.GetHeader("If-None-Match"), artifact.ETag()) {
+			c.Status(http.StatusNotModified)
 			return
 		}
-
-		// 3. Set headers and return PDF
-		c.Header("Content-Type", "application/pdf")
 		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"factura_%d.pdf\"", invoiceID))
 		// Use "attachment" instead of "inline" to force download.
-		
-		c.Data(http.StatusOK, "application/pdf", pdfBytes)
+		c.Header("Content-Length", strconv.Itoa(len(artifact.Data)))
+		c.Data(http.StatusOK, "application/pdf", artifact.Data)
+	}
+}
+
+// VoidInvoiceHandler voids an invoice sent in error. The invoice is kept (deleting it
+// would leave a gap in the numbering) but can no longer be edited, downloaded or
+// emailed, and the cancellation of its issue record, if it was issued, is chained to
+// the fiscal records.
+func VoidInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		var req dto.VoidInvoiceDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		void, err := database.VoidInvoice(db, middleware.TenantID(c), invoiceID, req.Reason, middleware.Actor(c))
+		if err != nil {
+			if errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+				return
+			}
+			if errors.Is(err, database.ErrInvoiceVoided) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Invoice has already been voided"})
+				return
+			}
+			if errors.Is(err, database.ErrInvoiceArchived) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Invoice is archived", "details": "Archived invoices are read-only."})
+				return
+			}
+			if errors.Is(err, database.ErrInvalidStatusTransition) {
+				c.JSON(http.StatusConflict, gin.H{
+					"error":   "Invoice has been rectified",
+					"details": "A rectified invoice cannot be voided.",
+				})
+				return
+			}
+			log.Printf("Error voiding invoice (ID: %d): %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to void invoice"})
+			return
+		}
+
+		if err := webhooks.EmitInvoice(db, middleware.TenantID(c), webhooks.EventInvoiceVoided, invoiceID); err != nil {
+			log.Printf("Error emitting webhook for invoice (ID: %d): %v", invoiceID, err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"invoice_id": invoiceID,
+			"message":    "Invoice voided successfully",
+			"void":       void,
+		})
+	}
+}
+
+// ListFiscalRecordsHandler lists the fiscal records (issue and cancellation) chained
+// for an invoice.
+func ListFiscalRecordsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		records, err := database.ListFiscalRecords(db, middleware.TenantID(c), invoiceID)
+		if err != nil {
+			log.Printf("Error listing fiscal records for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve fiscal records"})
+			return
+		}
+		c.JSON(http.StatusOK, records)
+	}
+}
+
+// GetInvoiceHistoryHandler returns the audit trail of an invoice: who created, changed,
+// voided, downloaded or emailed it, and when.
+func GetInvoiceHistoryHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		events, err := database.ListInvoiceEvents(db, middleware.TenantID(c), invoiceID)
+		if err != nil {
+			log.Printf("Error listing events for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve invoice history"})
+			return
+		}
+		if len(events) == 0 { // Either no such invoice, or one that predates the trail
+			if _, err := database.GetInvoiceVersion(db, middleware.TenantID(c), invoiceID); errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+				return
+			}
+		}
+		c.JSON(http.StatusOK, events)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header value matches etag.
+// The comparison is weak, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
 	}
+	return false
 }
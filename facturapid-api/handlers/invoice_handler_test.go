@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// patchRouter stores invoice 1 of a new tenant with complete fiscal data and returns a
+// router serving PATCH /invoices/:id/fiscal-data, the tenant, its client key and the
+// ETag of the invoice.
+func patchRouter(t *testing.T) (*sql.DB, *gin.Engine, int, string, string) {
+	t.Helper()
+	db := testDB(t)
+	tenantID, key := testTenant(t, db)
+	testInvoice(t, db, tenantID, 1, "10.00")
+	version, err := database.GetInvoiceVersion(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := dto.FiscalDataDTO{
+		ClienteNombre: strPtr("Bar Pepe SL"), ClienteDireccion: strPtr("Calle Mayor 1"),
+		ClienteNIF: strPtr("B12345674"), ClienteEmail: strPtr("pepe@example.com"),
+	}
+	version, err = database.UpdateInvoiceFiscalData(db, tenantID, 1, data, version, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := clientRouter(db)
+	r.PATCH("/invoices/:id/fiscal-data", PatchInvoiceFiscalDataHandler(db))
+	return db, r, tenantID, key, invoiceETag(version)
+}
+
+// fiscalData reads back the customer data of invoice 1.
+func fiscalData(t *testing.T, db *sql.DB, tenantID int) dto.InvoiceHeaderDTO {
+	t.Helper()
+	inv, err := database.GetFullInvoiceByID(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv.Header
+}
+
+func equal(got *string, want string) bool {
+	return got != nil && *got == want
+}
+
+func TestPatchInvoiceFiscalDataMerges(t *testing.T) {
+	db, r, tenantID, key, etag := patchRouter(t)
+
+	// cliente_nombre is cleared, cliente_direccion set, the NIF and email kept
+	w := serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data",
+		`{"cliente_nombre": null, "cliente_direccion": "Calle Nueva 2"}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var resp struct {
+		Version       int             `json:"version"`
+		EmailDelivery json.RawMessage `json:"email_delivery"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Header().Get("ETag"); got != invoiceETag(resp.Version) || got == etag {
+		t.Errorf("ETag %s for version %d, previous %s", got, resp.Version, etag)
+	}
+	if resp.EmailDelivery != nil {
+		t.Errorf("email queued although the patch left cliente_email out: %s", resp.EmailDelivery)
+	}
+
+	h := fiscalData(t, db, tenantID)
+	if h.Cliente1 != nil {
+		t.Errorf("cliente1 = %q, want NULL", *h.Cliente1)
+	}
+	if !equal(h.Cliente2, "Calle Nueva 2") {
+		t.Errorf("cliente2 = %v, want Calle Nueva 2", h.Cliente2)
+	}
+	if !equal(h.Cliente3, "B12345674") || !equal(h.Cliente4, "pepe@example.com") {
+		t.Errorf("cliente3, cliente4 = %v, %v, want them kept", h.Cliente3, h.Cliente4)
+	}
+}
+
+func TestPatchInvoiceFiscalDataPreconditions(t *testing.T) {
+	db, r, tenantID, key, etag := patchRouter(t)
+	body := `{"cliente_nombre": "Otro Nombre"}`
+
+	w := serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", body, nil)
+	if w.Code != http.StatusPreconditionRequired {
+		t.Errorf("without If-Match: status %d, want %d: %s", w.Code, http.StatusPreconditionRequired, w.Body)
+	}
+	w = serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", body, map[string]string{"If-Match": "version 1"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("malformed If-Match: status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	w = serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", `{}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("empty patch: status %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+
+	// A change made since etag was read
+	w = serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", `{"cliente_direccion": "Calle Nueva 2"}`, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	w = serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", body, map[string]string{"If-Match": etag})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: status %d, want %d: %s", w.Code, http.StatusPreconditionFailed, w.Body)
+	}
+
+	if h := fiscalData(t, db, tenantID); !equal(h.Cliente1, "Bar Pepe SL") {
+		t.Errorf("cliente1 = %v after the refused patches, want Bar Pepe SL", h.Cliente1)
+	}
+}
+
+func TestPatchInvoiceFiscalDataRefusesIssued(t *testing.T) {
+	db, r, tenantID, key, _ := patchRouter(t)
+	version, err := database.IssueInvoice(db, tenantID, 1, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(r, key, http.MethodPatch, "/invoices/1/fiscal-data", `{"cliente_nombre": "Otro Nombre"}`,
+		map[string]string{"If-Match": invoiceETag(version)})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp["error"] != "Invoice has been issued" {
+		t.Errorf("error %q, want Invoice has been issued", resp["error"])
+	}
+	if h := fiscalData(t, db, tenantID); !equal(h.Cliente1, "Bar Pepe SL") {
+		t.Errorf("cliente1 = %v, want the issued invoice unchanged", h.Cliente1)
+	}
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bindInvoiceListQuery binds the query parameters of an invoice listing, responding
+// with 400 when they are invalid.
+func bindInvoiceListQuery(c *gin.Context) (dto.InvoiceListQueryDTO, bool) {
+	var q dto.InvoiceListQueryDTO
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": err.Error(),
+		})
+		return q, false
+	}
+	if q.From != "" && q.To != "" && q.To < q.From {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": "to must not be before from.",
+		})
+		return q, false
+	}
+	if q.Limit == 0 {
+		q.Limit = dto.DefaultInvoiceListLimit
+	}
+	return q, true
+}
+
+// ListInvoicesHandler lists the invoices, newest first, a page at a time. They can be
+// filtered by fecha (from, to), serie and estado; with archived=true the archived
+// invoices are listed instead.
+func ListInvoicesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := bindInvoiceListQuery(c)
+		if !ok {
+			return
+		}
+
+		list, err := database.ListInvoices(db, middleware.TenantID(c), q)
+		if err != nil {
+			if errors.Is(err, dto.ErrInvalidCursor) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query parameters", "details": "cursor is not valid."})
+				return
+			}
+			log.Printf("Error listing invoices: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list invoices"})
+			return
+		}
+		c.JSON(http.StatusOK, list)
+	}
+}
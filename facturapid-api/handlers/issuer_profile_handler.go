@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validateIssuerProfile checks the rules that binding tags cannot express.
+func validateIssuerProfile(p dto.IssuerProfileDTO) string {
+	if len(p.Logo) > 0 && (p.LogoType == nil || *p.LogoType == "") {
+		return "logo_type is required when a logo is provided."
+	}
+	return ""
+}
+
+// ListIssuerProfilesHandler returns every configured issuer profile.
+func ListIssuerProfilesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		profiles, err := database.ListIssuerProfiles(db, middleware.TenantID(c))
+		if err != nil {
+			log.Printf("Error listing issuer profiles: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve issuer profiles"})
+			return
+		}
+		c.JSON(http.StatusOK, profiles)
+	}
+}
+
+// CreateIssuerProfileHandler creates a new issuer profile.
+func CreateIssuerProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var profile dto.IssuerProfileDTO
+		if err := c.ShouldBindJSON(&profile); err != nil {
+			log.Printf("Error binding JSON for CreateIssuerProfile: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		if msg := validateIssuerProfile(profile); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "details": msg})
+			return
+		}
+
+		id, err := database.CreateIssuerProfile(db, middleware.TenantID(c), profile)
+		if err != nil {
+			log.Printf("Error creating issuer profile: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create issuer profile"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{
+			"issuer_profile_id": id,
+			"message":           "Issuer profile created successfully",
+		})
+	}
+}
+
+// GetIssuerProfileHandler returns a single issuer profile.
+func GetIssuerProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid issuer profile ID"})
+			return
+		}
+
+		profile, err := database.GetIssuerProfileByID(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrIssuerProfileNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Issuer profile not found"})
+				return
+			}
+			log.Printf("Error retrieving issuer profile %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve issuer profile"})
+			return
+		}
+		c.JSON(http.StatusOK, profile)
+	}
+}
+
+// UpdateIssuerProfileHandler replaces an existing issuer profile.
+func UpdateIssuerProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid issuer profile ID"})
+			return
+		}
+
+		var profile dto.IssuerProfileDTO
+		if err := c.ShouldBindJSON(&profile); err != nil {
+			log.Printf("Error binding JSON for UpdateIssuerProfile (ID: %d): %v", id, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		if msg := validateIssuerProfile(profile); msg != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload", "details": msg})
+			return
+		}
+
+		if err := database.UpdateIssuerProfile(db, middleware.TenantID(c), id, profile); err != nil {
+			if errors.Is(err, database.ErrIssuerProfileNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Issuer profile not found"})
+				return
+			}
+			log.Printf("Error updating issuer profile %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update issuer profile"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"issuer_profile_id": id,
+			"message":           "Issuer profile updated successfully",
+		})
+	}
+}
+
+// DeleteIssuerProfileHandler removes an issuer profile.
+func DeleteIssuerProfileHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		idStr := c.Param("id")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid issuer profile ID"})
+			return
+		}
+
+		if err := database.DeleteIssuerProfile(db, middleware.TenantID(c), id); err != nil {
+			if errors.Is(err, database.ErrIssuerProfileNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Issuer profile not found"})
+				return
+			}
+			log.Printf("Error deleting issuer profile %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete issuer profile"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
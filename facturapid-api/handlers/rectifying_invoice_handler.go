@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/invoicepdf"
+	"facturapid-api/middleware"
+	"facturapid-api/money"
+	"facturapid-api/pdfgenerator"
+	"facturapid-api/validation"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateRectifyingInvoiceHandler handles the creation of rectifying invoices (FacturasR).
+// The rectified invoice must exist. The rectification type defaults to the
+// dto.DefaultRectificationType of the rectified invoice, and the method to differences. The arithmetic checks run as for invoices, on the
+// signed amounts.
+func CreateRectifyingInvoiceHandler(db *sql.DB, validationCfg validation.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rectifying dto.RectifyingInvoiceDTO
+
+		if err := c.ShouldBindJSON(&rectifying); err != nil {
+			log.Printf("Error binding JSON for CreateRectifyingInvoice: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		header := &rectifying.Header
+		for _, line := range rectifying.Lines {
+			if line.CodigoFactura != header.Codigo {
+				errMsg := fmt.Sprintf("Mismatch in CodigoFactura for line item (Producto: %s, Linea: %d). Expected %d, got %d.",
+					line.Producto, line.Linea, header.Codigo, line.CodigoFactura)
+				log.Printf("Validation Error for CreateRectifyingInvoice: %s", errMsg)
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":   "Invalid request payload",
+					"details": errMsg,
+				})
+				return
+			}
+		}
+
+		if header.Establecimiento != nil {
+			tenant, err := database.GetTenant(db, middleware.TenantID(c))
+			if err != nil {
+				log.Printf("Error querying tenant for CreateRectifyingInvoice (Codigo: %d): %v", header.Codigo, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process rectifying invoice"})
+				return
+			}
+			if *header.Establecimiento != tenant.Code {
+				c.JSON(http.StatusForbidden, gin.H{
+					"error":   "Establecimiento mismatch",
+					"details": fmt.Sprintf("The API key belongs to establecimiento %q, not %q.", tenant.Code, *header.Establecimiento),
+				})
+				return
+			}
+		}
+
+		original, err := database.GetFullInvoiceByID(db, middleware.TenantID(c), header.FacturaRectificada)
+		if err != nil {
+			if errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{
+					"error":   "Rectified invoice not found",
+					"details": fmt.Sprintf("Invoice %d does not exist.", header.FacturaRectificada),
+				})
+				return
+			}
+			log.Printf("Error retrieving rectified invoice (ID: %d): %v", header.FacturaRectificada, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process rectifying invoice"})
+			return
+		}
+
+		if header.TipoRectificacion == "" {
+			header.TipoRectificacion = dto.RectificationByDifferences
+		}
+		if header.TipoRectificativa == "" {
+			header.TipoRectificativa = dto.DefaultRectificationType(original.Header)
+		}
+		header.BaseRectificada, header.CuotaRectificada = nil, nil
+		if header.TipoRectificacion == dto.RectificationBySubstitution {
+			base, quota := money.Zero, money.Zero
+			for _, g := range original.Header.VATGroups() {
+				base = base.Add(g.Base)
+				quota = quota.Add(g.Quota)
+			}
+			header.BaseRectificada, header.CuotaRectificada = &base, &quota
+		}
+
+		report := validation.ValidateInvoice(rectifying.Invoice(original.Header), validationCfg)
+		header.ValidationStatus = &report.Status
+		header.ValidationReport = report.JSON()
+		if report.Status != validation.StatusValid {
+			log.Printf("Rectifying invoice %d did not pass all arithmetic checks (%s): %+v", header.Codigo, report.Status, report.Results)
+		}
+
+		if _, err := storeRectifyingInvoice(c, db, rectifying); err != nil {
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"rectifying_invoice_id": header.Codigo,
+			"tipo_rectificativa":    header.TipoRectificativa,
+			"tipo_rectificacion":    header.TipoRectificacion,
+			"message":               "Rectifying invoice created successfully",
+			"validation":            report,
+		})
+	}
+}
+
+// storeRectifyingInvoice stores a rectifying invoice and returns its Codigo. On
+// failure it writes the error response and returns a non-nil error.
+func storeRectifyingInvoice(c *gin.Context, db *sql.DB, rectifying dto.RectifyingInvoiceDTO) (int, error) {
+	h := rectifying.Header
+	codigo, err := database.CreateRectifyingInvoice(db, middleware.TenantID(c), rectifying, middleware.Actor(c))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrRectifyingInvoiceExists):
+			c.JSON(http.StatusConflict, gin.H{"error": "Rectifying invoice already exists"})
+		case errors.Is(err, database.ErrInvoiceNotFound):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Rectified invoice not found",
+				"details": fmt.Sprintf("Invoice %d does not exist.", h.FacturaRectificada),
+			})
+		case errors.Is(err, database.ErrInvoiceVoided):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Rectified invoice has been voided",
+				"details": fmt.Sprintf("Invoice %d has been voided.", h.FacturaRectificada),
+			})
+		case errors.Is(err, database.ErrInvoiceArchived):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Rectified invoice is archived",
+				"details": fmt.Sprintf("Invoice %d is archived and read-only.", h.FacturaRectificada),
+			})
+		case errors.Is(err, database.ErrInvalidStatusTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice cannot be rectified", "details": err.Error()})
+		default:
+			log.Printf("Error creating rectifying invoice (Codigo: %d) in database: %v", h.Codigo, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process rectifying invoice"})
+		}
+		return 0, err
+	}
+	return codigo, nil
+}
+
+// RectifyInvoiceHandler corrects the customer data of an issued invoice by issuing a
+// rectifying invoice by substitution, with the invoice's amounts and the corrected data.
+// Invoices not yet issued are corrected with PUT /invoices/:id instead.
+func RectifyInvoiceHandler(db *sql.DB, validationCfg validation.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		var req dto.RectifyInvoiceDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		original, err := database.GetFullInvoiceByID(db, middleware.TenantID(c), invoiceID)
+		if err != nil {
+			if errors.Is(err, database.ErrInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invoice not found"})
+				return
+			}
+			log.Printf("Error retrieving invoice (ID: %d) to rectify: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rectify invoice"})
+			return
+		}
+		switch original.Header.Estado {
+		case dto.InvoiceStatusIssued, dto.InvoiceStatusRectified:
+		case dto.InvoiceStatusVoided:
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice has been voided"})
+			return
+		default:
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "Invoice has not been issued",
+				"details": fmt.Sprintf("Its fiscal data can still be changed with PUT /invoices/%d.", invoiceID),
+			})
+			return
+		}
+
+		rectifying, err := dto.NewSubstitution(original, req, time.Now())
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invoice cannot be rectified", "details": err.Error()})
+			return
+		}
+		report := validation.ValidateInvoice(rectifying.Invoice(original.Header), validationCfg)
+		rectifying.Header.ValidationStatus = &report.Status
+		rectifying.Header.ValidationReport = report.JSON()
+
+		codigo, err := storeRectifyingInvoice(c, db, rectifying)
+		if err != nil {
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"invoice_id":            invoiceID,
+			"rectifying_invoice_id": codigo,
+			"tipo_rectificativa":    rectifying.Header.TipoRectificativa,
+			"tipo_rectificacion":    rectifying.Header.TipoRectificacion,
+			"message":               "Rectifying invoice created successfully",
+			"validation":            report,
+		})
+	}
+}
+
+// GetRectifyingInvoiceHandler returns a rectifying invoice with its lines.
+func GetRectifyingInvoiceHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Rectifying invoice ID must be a positive integer"})
+			return
+		}
+
+		rectifying, err := database.GetRectifyingInvoiceByID(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrRectifyingInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Rectifying invoice not found"})
+				return
+			}
+			log.Printf("Error retrieving rectifying invoice (ID: %d) from database: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rectifying invoice"})
+			return
+		}
+		c.JSON(http.StatusOK, rectifying)
+	}
+}
+
+// GetRectifyingInvoicePDFHandler returns the PDF of a rectifying invoice, like
+// GetInvoicePDFHandler does for invoices.
+func GetRectifyingInvoicePDFHandler(pdfs *invoicepdf.Service) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Rectifying invoice ID must be a positive integer"})
+			return
+		}
+
+		layout := c.DefaultQuery("layout", pdfgenerator.DefaultTemplateName)
+		tmpl, err := pdfgenerator.LoadTemplate(layout)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid layout",
+				"details": fmt.Sprintf("Available layouts: %v", pdfgenerator.TemplateNames()),
+			})
+			return
+		}
+
+		artifact, err := pdfs.GetRectifying(middleware.TenantID(c), id, tmpl)
+		if err != nil {
+			if errors.Is(err, database.ErrRectifyingInvoiceNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Rectifying invoice not found"})
+				return
+			}
+			if errors.Is(err, database.ErrIssuerProfileNotFound) {
+				log.Printf("No issuer profile configured for rectifying invoice %d", id)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "No issuer profile configured for this invoice"})
+				return
+			}
+			log.Printf("Error getting PDF for rectifying invoice (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate invoice PDF"})
+			return
+		}
+
+		c.Header("ETag", artifact.ETag())
+		c.Header("Cache-Control", "private, no-cache")
+		if etagMatches(c.GetHeader("If-None-Match"), artifact.ETag()) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("inline; filename=\"factura_rectificativa_%d.pdf\"", id))
+		c.Header("Content-Length", strconv.Itoa(len(artifact.Data)))
+		c.Data(http.StatusOK, "application/pdf", artifact.Data)
+	}
+}
+
+// ListInvoiceRectificationsHandler lists the rectifying invoices issued for an invoice.
+func ListInvoiceRectificationsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invoiceID, err := strconv.Atoi(c.Param("id"))
+		if err != nil || invoiceID <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invoice ID must be a positive integer"})
+			return
+		}
+
+		rectifications, err := database.ListRectifyingInvoicesFor(db, middleware.TenantID(c), invoiceID)
+		if err != nil {
+			log.Printf("Error listing rectifying invoices for invoice %d: %v", invoiceID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve rectifying invoices"})
+			return
+		}
+		c.JSON(http.StatusOK, rectifications)
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"facturapid-api/reports"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bindReportQuery binds the query parameters of a report and returns its first and
+// last day, responding with 400 when they are invalid.
+func bindReportQuery(c *gin.Context) (dto.ReportQueryDTO, time.Time, time.Time, bool) {
+	var q dto.ReportQueryDTO
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": err.Error(),
+		})
+		return q, time.Time{}, time.Time{}, false
+	}
+	from, _ := time.Parse("2006-01-02", q.From) // Checked by binding
+	to, _ := time.Parse("2006-01-02", q.To)
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": "to must not be before from.",
+		})
+		return q, from, to, false
+	}
+	if to.After(from.AddDate(0, 0, dto.MaxReportDays-1)) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": fmt.Sprintf("A report covers at most %d days.", dto.MaxReportDays),
+		})
+		return q, from, to, false
+	}
+	if q.Format == "" {
+		q.Format = dto.ReportFormatJSON
+	}
+	return q, from, to, true
+}
+
+// GetDailyReportHandler returns the daily sales and VAT summary from one day to
+// another (from, to), as JSON or, with format=csv, as a CSV file.
+func GetDailyReportHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, from, to, ok := bindReportQuery(c)
+		if !ok {
+			return
+		}
+
+		report, err := database.GetDailyReport(db, middleware.TenantID(c), from, to)
+		if err != nil {
+			log.Printf("Error building daily report from %s to %s: %v", q.From, q.To, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build daily report"})
+			return
+		}
+		if q.Format != dto.ReportFormatCSV {
+			c.JSON(http.StatusOK, report)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := reports.WriteDailyCSV(&buf, report); err != nil {
+			log.Printf("Error writing daily report CSV: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build daily report"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"ventas_%s_%s.csv\"", q.From, q.To))
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	}
+}
+
+// bindQuarterQuery binds the query parameters of a quarterly VAT report, responding
+// with 400 when they are invalid.
+func bindQuarterQuery(c *gin.Context) (dto.QuarterQueryDTO, bool) {
+	var q dto.QuarterQueryDTO
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid query parameters",
+			"details": err.Error(),
+		})
+		return q, false
+	}
+	if q.Format == "" {
+		q.Format = dto.ReportFormatJSON
+	}
+	return q, true
+}
+
+// GetLibroRegistroHandler returns the libro registro de facturas expedidas of a quarter
+// (year, quarter), as JSON or, with format=csv or format=xlsx, as a file in the column
+// layout of the AEAT.
+func GetLibroRegistroHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := bindQuarterQuery(c)
+		if !ok {
+			return
+		}
+
+		from, to := q.Bounds()
+		docs, err := database.ListIssuedDocuments(db, middleware.TenantID(c), from, to)
+		if err != nil {
+			log.Printf("Error listing issued documents of %d %s: %v", q.Year, q.Period(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build libro registro"})
+			return
+		}
+		libro := reports.LibroRegistro(docs, q)
+		if q.Format == dto.ReportFormatJSON {
+			c.JSON(http.StatusOK, libro)
+			return
+		}
+
+		var buf bytes.Buffer
+		write, contentType := reports.WriteCSV, "text/csv; charset=utf-8"
+		if q.Format == dto.ReportFormatXLSX {
+			write, contentType = reports.WriteXLSX, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		}
+		if err := write(&buf, reports.LibroRegistroTable(libro)); err != nil {
+			log.Printf("Error writing libro registro %s: %v", q.Format, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build libro registro"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"libro_registro_expedidas_%d_%s.%s\"", q.Year, q.Period(), q.Format))
+		c.Data(http.StatusOK, contentType, buf.Bytes())
+	}
+}
+
+// GetModelo303Handler returns the pre-calculation of the IVA devengado of a quarter's
+// Modelo 303 (year, quarter).
+func GetModelo303Handler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, ok := bindQuarterQuery(c)
+		if !ok {
+			return
+		}
+		if q.Format != dto.ReportFormatJSON {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid query parameters",
+				"details": "The Modelo 303 is only available as JSON.",
+			})
+			return
+		}
+
+		from, to := q.Bounds()
+		docs, err := database.ListIssuedDocuments(db, middleware.TenantID(c), from, to)
+		if err != nil {
+			log.Printf("Error listing issued documents of %d %s: %v", q.Year, q.Period(), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build Modelo 303"})
+			return
+		}
+		c.JSON(http.StatusOK, reports.Modelo303(docs, q))
+	}
+}
+
+// GetJournalHandler returns the sales journal from one day to another (from, to), an
+// entry per day booked with the tenant's account mapping, as JSON or, with format=csv,
+// as a CSV file.
+func GetJournalHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		q, from, to, ok := bindReportQuery(c)
+		if !ok {
+			return
+		}
+
+		tenantID := middleware.TenantID(c)
+		mapping, err := database.GetAccountMapping(db, tenantID)
+		if err != nil {
+			log.Printf("Error retrieving account mapping: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build journal"})
+			return
+		}
+		docs, err := database.ListIssuedDocuments(db, tenantID, from, to)
+		if err != nil {
+			log.Printf("Error listing issued documents from %s to %s: %v", q.From, q.To, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build journal"})
+			return
+		}
+		journal := reports.Journal(docs, mapping, q.From, q.To)
+		if q.Format != dto.ReportFormatCSV {
+			c.JSON(http.StatusOK, journal)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := reports.WriteCSV(&buf, reports.JournalTable(journal)); err != nil {
+			log.Printf("Error writing journal CSV: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build journal"})
+			return
+		}
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"diario_%s_%s.csv\"", q.From, q.To))
+		c.Data(http.StatusOK, "text/csv; charset=utf-8", buf.Bytes())
+	}
+}
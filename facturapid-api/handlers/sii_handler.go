@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"facturapid-api/sii"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSIIListed caps GET /admin/sii/batches and GET /admin/sii/submissions.
+const maxSIIListed = 200
+
+// CreateSIIBatchesHandler sends to the SII the documents issued from one day to
+// another that it has not registered yet, in as many batches as issuers, and returns
+// the batches with the state of their documents. With dry_run the batches are returned
+// with their XML, and nothing is sent or recorded. Without exp, when no SII endpoint is
+// configured, it responds with 503.
+func CreateSIIBatchesHandler(exp *sii.Exporter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if exp == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":   "SII not configured",
+				"details": "No SII endpoint is configured, so no batches can be sent.",
+			})
+			return
+		}
+		var req dto.SIIBatchRequestDTO
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		from, _ := time.Parse("2006-01-02", req.From) // Checked by binding
+		to, _ := time.Parse("2006-01-02", req.To)
+		if to.Before(from) || to.After(from.AddDate(0, 0, dto.MaxReportDays-1)) {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": fmt.Sprintf("to must not be before from, and at most %d days after.", dto.MaxReportDays-1),
+			})
+			return
+		}
+		tenantID := middleware.TenantID(c)
+
+		if req.DryRun {
+			batches, err := exp.Prepare(tenantID, from, to)
+			if err != nil {
+				log.Printf("Error preparing SII batches from %s to %s: %v", req.From, req.To, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to prepare SII batches"})
+				return
+			}
+			out := make([]dto.SIIBatchDTO, len(batches))
+			for i, b := range batches {
+				out[i] = b.Summary()
+				out[i].XML = string(b.XML)
+			}
+			c.JSON(http.StatusOK, out)
+			return
+		}
+
+		batches, err := exp.Submit(tenantID, from, to)
+		if err != nil {
+			log.Printf("Error submitting SII batches from %s to %s: %v", req.From, req.To, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to submit SII batches", "details": err.Error()})
+			return
+		}
+		c.JSON(http.StatusCreated, batches)
+	}
+}
+
+// ListSIIBatchesHandler returns the latest SII batches, newest first.
+func ListSIIBatchesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		batches, err := database.ListSIIBatches(db, middleware.TenantID(c), maxSIIListed)
+		if err != nil {
+			log.Printf("Error listing SII batches: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve SII batches"})
+			return
+		}
+		c.JSON(http.StatusOK, batches)
+	}
+}
+
+// GetSIIBatchHandler returns an SII batch with the state of its documents.
+func GetSIIBatchHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid batch ID"})
+			return
+		}
+		batch, err := database.GetSIIBatch(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrSIIBatchNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Batch not found"})
+				return
+			}
+			log.Printf("Error retrieving SII batch (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve SII batch"})
+			return
+		}
+		c.JSON(http.StatusOK, batch)
+	}
+}
+
+// ListSIISubmissionsHandler returns the SII state of the documents sent, all of them or
+// those with a status, the most recently updated first.
+func ListSIISubmissionsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var q dto.SIISubmissionQueryDTO
+		if err := c.ShouldBindQuery(&q); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid query parameters",
+				"details": err.Error(),
+			})
+			return
+		}
+		submissions, err := database.ListSIISubmissions(db, middleware.TenantID(c), q.Status, maxSIIListed)
+		if err != nil {
+			log.Printf("Error listing SII submissions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve SII submissions"})
+			return
+		}
+		c.JSON(http.StatusOK, submissions)
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tenantParam parses the :id of a platform tenant route, responding with 400 when it
+// is invalid.
+func tenantParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tenant ID"})
+		return 0, false
+	}
+	return id, true
+}
+
+// ListTenantsHandler returns every tenant.
+func ListTenantsHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tenants, err := database.ListTenants(db)
+		if err != nil {
+			log.Printf("Error listing tenants: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tenants"})
+			return
+		}
+		c.JSON(http.StatusOK, tenants)
+	}
+}
+
+// CreateTenantHandler creates a tenant. Its code is the establecimiento the
+// synchronizer sends with its invoices.
+func CreateTenantHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var tenant dto.TenantDTO
+		if err := c.ShouldBindJSON(&tenant); err != nil {
+			log.Printf("Error binding JSON for CreateTenant: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		created, err := database.CreateTenant(db, tenant)
+		if err != nil {
+			if errors.Is(err, database.ErrTenantExists) {
+				c.JSON(http.StatusConflict, gin.H{"error": "Tenant already exists", "details": "code is taken."})
+				return
+			}
+			log.Printf("Error creating tenant: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create tenant"})
+			return
+		}
+		c.JSON(http.StatusCreated, created)
+	}
+}
+
+// GetTenantHandler returns a single tenant.
+func GetTenantHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := tenantParam(c)
+		if !ok {
+			return
+		}
+
+		tenant, err := database.GetTenant(db, id)
+		if err != nil {
+			if errors.Is(err, database.ErrTenantNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+				return
+			}
+			log.Printf("Error retrieving tenant %d: %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve tenant"})
+			return
+		}
+		c.JSON(http.StatusOK, tenant)
+	}
+}
+
+// ListTenantAPIKeysHandler returns the API keys of a tenant.
+func ListTenantAPIKeysHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := tenantParam(c); ok {
+			listAPIKeys(c, db, id)
+		}
+	}
+}
+
+// CreateTenantAPIKeyHandler creates a client or admin API key for a tenant.
+func CreateTenantAPIKeyHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := tenantParam(c); ok {
+			createAPIKey(c, db, id)
+		}
+	}
+}
+
+// RevokeTenantAPIKeyHandler revokes an API key of a tenant.
+func RevokeTenantAPIKeyHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if id, ok := tenantParam(c); ok {
+			revokeAPIKey(c, db, id, c.Param("keyId"))
+		}
+	}
+}
+
+// ListAPIKeysHandler returns the API keys of the caller's tenant.
+func ListAPIKeysHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		listAPIKeys(c, db, middleware.TenantID(c))
+	}
+}
+
+// CreateAPIKeyHandler creates a client or admin API key for the caller's tenant.
+func CreateAPIKeyHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		createAPIKey(c, db, middleware.TenantID(c))
+	}
+}
+
+// RevokeAPIKeyHandler revokes an API key of the caller's tenant.
+func RevokeAPIKeyHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		revokeAPIKey(c, db, middleware.TenantID(c), c.Param("id"))
+	}
+}
+
+func listAPIKeys(c *gin.Context, db *sql.DB, tenantID int) {
+	keys, err := database.ListAPIKeys(db, tenantID)
+	if err != nil {
+		log.Printf("Error listing API keys of tenant %d: %v", tenantID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// createAPIKey creates an API key for a tenant. The response includes the key, which
+// cannot be retrieved again.
+func createAPIKey(c *gin.Context, db *sql.DB, tenantID int) {
+	var req dto.APIKeyDTO
+	if err := c.ShouldBindJSON(&req); err != nil {
+		log.Printf("Error binding JSON for CreateAPIKey: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":   "Invalid request payload",
+			"details": err.Error(),
+		})
+		return
+	}
+
+	key, err := middleware.NewAPIKey()
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	created, err := database.CreateAPIKey(db, &tenantID, req.Role, key, req.Description)
+	if err != nil {
+		if errors.Is(err, database.ErrTenantNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+			return
+		}
+		log.Printf("Error creating API key for tenant %d: %v", tenantID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	created.Key = key
+	c.JSON(http.StatusCreated, created)
+}
+
+func revokeAPIKey(c *gin.Context, db *sql.DB, tenantID int, idStr string) {
+	id, err := strconv.Atoi(idStr)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	if err := database.RevokeAPIKey(db, tenantID, id); err != nil {
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+			return
+		}
+		log.Printf("Error revoking API key %d: %v", id, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked successfully"})
+}
@@ -0,0 +1,277 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/middleware"
+	"facturapid-api/webhooks"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxWebhookDeliveriesListed caps the deliveries returned by ListWebhookDeliveriesHandler.
+	maxWebhookDeliveriesListed = 100
+	// testWebhookLease keeps the worker off a test delivery while the handler sends it.
+	testWebhookLease = time.Minute
+)
+
+// ListWebhooksHandler returns every webhook subscription.
+func ListWebhooksHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		subs, err := database.ListWebhookSubscriptions(db, middleware.TenantID(c))
+		if err != nil {
+			log.Printf("Error listing webhook subscriptions: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook subscriptions"})
+			return
+		}
+		c.JSON(http.StatusOK, subs)
+	}
+}
+
+// CreateWebhookHandler creates a webhook subscription. The response includes the
+// secret, which is generated if none was given.
+func CreateWebhookHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var sub dto.WebhookSubscriptionDTO
+		if err := c.ShouldBindJSON(&sub); err != nil {
+			log.Printf("Error binding JSON for CreateWebhook: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+		if sub.Secret == "" {
+			secret, err := webhooks.NewSecret()
+			if err != nil {
+				log.Printf("Error creating webhook subscription: %v", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook subscription"})
+				return
+			}
+			sub.Secret = secret
+		}
+
+		created, err := database.CreateWebhookSubscription(db, middleware.TenantID(c), sub)
+		if err != nil {
+			log.Printf("Error creating webhook subscription: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook subscription"})
+			return
+		}
+		c.JSON(http.StatusCreated, created)
+	}
+}
+
+// GetWebhookHandler returns a single webhook subscription.
+func GetWebhookHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+		sub, err := database.GetWebhookSubscription(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			log.Printf("Error retrieving webhook subscription (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook subscription"})
+			return
+		}
+		c.JSON(http.StatusOK, sub)
+	}
+}
+
+// UpdateWebhookHandler replaces a webhook subscription. Omitting the secret keeps it.
+func UpdateWebhookHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+		var sub dto.WebhookSubscriptionDTO
+		if err := c.ShouldBindJSON(&sub); err != nil {
+			log.Printf("Error binding JSON for UpdateWebhook (ID: %d): %v", id, err)
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request payload",
+				"details": err.Error(),
+			})
+			return
+		}
+
+		updated, err := database.UpdateWebhookSubscription(db, middleware.TenantID(c), id, sub)
+		if err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			log.Printf("Error updating webhook subscription (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook subscription"})
+			return
+		}
+		c.JSON(http.StatusOK, updated)
+	}
+}
+
+// DeleteWebhookHandler deletes a webhook subscription and its delivery log.
+func DeleteWebhookHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+		if err := database.DeleteWebhookSubscription(db, middleware.TenantID(c), id); err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			log.Printf("Error deleting webhook subscription (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook subscription"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+	}
+}
+
+// TestWebhookHandler sends a ping event to a subscription right away, active or not,
+// and returns the delivery with the outcome. Failed pings are not retried.
+func TestWebhookHandler(db *sql.DB, client *http.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+		sub, err := database.GetWebhookSubscription(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			log.Printf("Error retrieving webhook subscription (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook subscription"})
+			return
+		}
+
+		event, err := webhooks.NewEvent(webhooks.EventPing, gin.H{"webhook_id": sub.ID})
+		var delivery dto.WebhookDeliveryDTO
+		if err == nil {
+			payload, _ := json.Marshal(event)
+			delivery, err = database.CreateWebhookDelivery(db, middleware.TenantID(c), sub.ID, event.ID, event.Type, nil, payload, nil, testWebhookLease)
+		}
+		if err != nil {
+			log.Printf("Error creating test delivery for webhook (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to test webhook"})
+			return
+		}
+
+		attempt := webhooks.Send(client, sub.URL, sub.Secret, delivery)
+		if err := database.RecordWebhookAttempt(db, delivery.ID, attempt, attempt.Error == nil, nil); err != nil {
+			log.Printf("Error recording test delivery %d: %v", delivery.ID, err)
+		}
+		delivery, err = database.GetWebhookDelivery(db, middleware.TenantID(c), delivery.ID)
+		if err != nil {
+			log.Printf("Error retrieving test delivery for webhook (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to test webhook"})
+			return
+		}
+		c.JSON(http.StatusOK, delivery)
+	}
+}
+
+// ListWebhookDeliveriesHandler returns the latest deliveries of a subscription, newest
+// first. ?status= filters them by status.
+func ListWebhookDeliveriesHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid webhook ID"})
+			return
+		}
+		status := c.Query("status")
+		switch status {
+		case "", dto.WebhookStatusPending, dto.WebhookStatusDelivered, dto.WebhookStatusFailed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status filter"})
+			return
+		}
+		if _, err := database.GetWebhookSubscription(db, middleware.TenantID(c), id); err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+				return
+			}
+			log.Printf("Error retrieving webhook subscription (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook subscription"})
+			return
+		}
+
+		deliveries, err := database.ListWebhookDeliveries(db, middleware.TenantID(c), id, status, maxWebhookDeliveriesListed)
+		if err != nil {
+			log.Printf("Error listing deliveries for webhook (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook deliveries"})
+			return
+		}
+		c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+// GetWebhookDeliveryHandler returns a delivery and the log of its attempts.
+func GetWebhookDeliveryHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+			return
+		}
+		delivery, err := database.GetWebhookDelivery(db, middleware.TenantID(c), id)
+		if err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+				return
+			}
+			log.Printf("Error retrieving webhook delivery (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook delivery"})
+			return
+		}
+		c.JSON(http.StatusOK, delivery)
+	}
+}
+
+// ReplayWebhookDeliveryHandler queues a delivery again, with the same event and payload,
+// as a new delivery. The worker sends it shortly after.
+func ReplayWebhookDeliveryHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid delivery ID"})
+			return
+		}
+		var replay dto.WebhookDeliveryDTO
+		original, err := database.GetWebhookDelivery(db, middleware.TenantID(c), id)
+		if err == nil {
+			replay, err = database.CreateWebhookDelivery(db, middleware.TenantID(c), original.SubscriptionID, original.EventID,
+				original.EventType, original.InvoiceID, original.Payload, &original.ID, 0)
+		}
+		if err != nil {
+			if errors.Is(err, database.ErrWebhookNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+				return
+			}
+			log.Printf("Error replaying webhook delivery (ID: %d): %v", id, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replay webhook delivery"})
+			return
+		}
+		c.JSON(http.StatusAccepted, replay)
+	}
+}
@@ -0,0 +1,166 @@
+// Package invoicepdf returns the PDF of an invoice: the stored one for the invoice's
+// current data version if there is one, or a freshly generated (and then stored) one.
+// Both the PDF endpoint and the mail queue go through it, so a customer always gets
+// the same document whichever way they receive it.
+package invoicepdf
+
+import (
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/pdfgenerator"
+	"facturapid-api/pdfsign"
+	"facturapid-api/pdfstore"
+	"facturapid-api/ubl"
+	"facturapid-api/webhooks"
+	"log"
+	"time"
+)
+
+// Service generates and stores invoice PDFs.
+type Service struct {
+	db     *sql.DB
+	signer *pdfsign.Signer // nil: PDFs are not signed
+	store  pdfstore.Store
+}
+
+// NewService returns a Service. When signer is not nil the PDFs are digitally signed
+// (PAdES) with the issuer certificate.
+func NewService(db *sql.DB, signer *pdfsign.Signer, store pdfstore.Store) *Service {
+	return &Service{db: db, signer: signer, store: store}
+}
+
+// Get returns the PDF of the current version of an invoice of a tenant in the given
+// layout.
+// It returns database.ErrInvoiceNotFound or database.ErrIssuerProfileNotFound when the
+// invoice, or the issuer profile it was issued under, do not exist, and
+// database.ErrInvoiceVoided for voided invoices. The invoice is marked issued first, so
+// its fiscal data can no longer change. A newly generated PDF is recorded in the
+// invoice's audit trail as generated by actor.
+func (s *Service) Get(tenantID, invoiceID int, tmpl *pdfgenerator.Template, actor dto.ActorDTO) (*pdfstore.Artifact, error) {
+	variant := s.variant(tmpl)
+
+	version, err := database.IssueInvoice(s.db, tenantID, invoiceID, actor)
+	if errors.Is(err, database.ErrInvoiceArchived) {
+		return s.getArchived(tenantID, invoiceID, tmpl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	artifact, err := s.store.Get(pdfstore.Key{TenantID: tenantID, InvoiceID: invoiceID, Version: version, Variant: variant})
+	if !errors.Is(err, pdfstore.ErrNotFound) {
+		return artifact, err
+	}
+
+	fullInvoice, err := database.GetFullInvoiceByID(s.db, tenantID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	// The version read with the invoice, not the one looked up earlier: the data
+	// may have changed in between.
+	key := pdfstore.Key{TenantID: tenantID, InvoiceID: invoiceID, Version: fullInvoice.Header.Version, Variant: variant}
+	artifact, issued, err := s.generate(key, fullInvoice, tmpl)
+	if err != nil || !issued {
+		return artifact, err
+	}
+	log.Printf("Generated PDF for invoice %d, version %d (%s).", invoiceID, artifact.Version, variant)
+	details := map[string]interface{}{"version": artifact.Version, "variant": variant, "sha256": artifact.SHA256}
+	if err := database.RecordInvoiceEvent(s.db, tenantID, invoiceID, dto.InvoiceEventPDFGenerated, actor, details); err != nil {
+		log.Printf("Error recording PDF event for invoice %d: %v", invoiceID, err)
+	}
+	_, err = webhooks.Emit(s.db, tenantID, webhooks.EventInvoicePDFIssued, &invoiceID, map[string]interface{}{
+		"invoice_id": invoiceID,
+		"number":     ubl.InvoiceID(fullInvoice.Header),
+		"version":    artifact.Version,
+		"variant":    variant,
+		"sha256":     artifact.SHA256,
+	})
+	if err != nil {
+		log.Printf("Error emitting webhook for invoice %d: %v", invoiceID, err)
+	}
+	return artifact, nil
+}
+
+// GetRectifying returns the PDF of a rectifying invoice of a tenant in the given layout.
+// It returns database.ErrRectifyingInvoiceNotFound when it does not exist. Rectifying
+// invoices are not edited, so there is a single version.
+func (s *Service) GetRectifying(tenantID, id int, tmpl *pdfgenerator.Template) (*pdfstore.Artifact, error) {
+	key := pdfstore.Key{TenantID: tenantID, Kind: pdfstore.KindRectifying, InvoiceID: id, Version: 1, Variant: s.variant(tmpl)}
+	artifact, err := s.store.Get(key)
+	if !errors.Is(err, pdfstore.ErrNotFound) {
+		return artifact, err
+	}
+
+	rectifying, err := database.GetRectifyingInvoiceByID(s.db, tenantID, id)
+	if err != nil {
+		return nil, err
+	}
+	original, err := database.GetFullInvoiceByID(s.db, tenantID, rectifying.Header.FacturaRectificada)
+	if err != nil {
+		return nil, err
+	}
+	artifact, issued, err := s.generate(key, rectifying.Invoice(original.Header), tmpl)
+	if err == nil && issued {
+		log.Printf("Generated PDF for rectifying invoice %d (%s).", id, key.Variant)
+	}
+	return artifact, err
+}
+
+// getArchived returns the PDF of an archived invoice. The archival job purged its
+// stored PDFs, so it is generated from the archived data on every request, and not
+// stored again.
+func (s *Service) getArchived(tenantID, invoiceID int, tmpl *pdfgenerator.Template) (*pdfstore.Artifact, error) {
+	fullInvoice, err := database.GetFullInvoiceByID(s.db, tenantID, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	if fullInvoice.Header.Void != nil {
+		return nil, database.ErrInvoiceVoided
+	}
+	pdfBytes, err := s.render(tenantID, fullInvoice, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &pdfstore.Artifact{
+		Key:       pdfstore.Key{TenantID: tenantID, InvoiceID: invoiceID, Version: fullInvoice.Header.Version, Variant: s.variant(tmpl)},
+		Data:      pdfBytes,
+		SHA256:    pdfstore.Digest(pdfBytes),
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+func (s *Service) variant(tmpl *pdfgenerator.Template) string {
+	if s.signer != nil {
+		return tmpl.Name + "+signed"
+	}
+	return tmpl.Name
+}
+
+// generate generates the PDF of an invoice and stores it under key. If another
+// request stored one first, that one is returned instead and issued is false.
+func (s *Service) generate(key pdfstore.Key, fullInvoice dto.FullInvoiceDTO, tmpl *pdfgenerator.Template) (artifact *pdfstore.Artifact, issued bool, err error) {
+	pdfBytes, err := s.render(key.TenantID, fullInvoice, tmpl)
+	if err != nil {
+		return nil, false, err
+	}
+
+	artifact, err = s.store.Put(key, pdfBytes)
+	if err != nil {
+		return nil, false, err
+	}
+	return artifact, artifact.SHA256 == pdfstore.Digest(pdfBytes), nil
+}
+
+// render generates the PDF of an invoice of a tenant, signed if the service has a signer.
+func (s *Service) render(tenantID int, fullInvoice dto.FullInvoiceDTO, tmpl *pdfgenerator.Template) ([]byte, error) {
+	// Resolve the issuer (legal entity) the invoice was issued under
+	issuer, err := database.GetIssuerProfileForInvoice(s.db, tenantID, fullInvoice.Header)
+	if err != nil {
+		return nil, err
+	}
+	if s.signer != nil {
+		return pdfgenerator.GenerateSignedInvoicePDF(fullInvoice, issuer, tmpl, s.signer)
+	}
+	return pdfgenerator.GenerateInvoicePDFWithTemplate(fullInvoice, issuer, tmpl)
+}
@@ -0,0 +1,73 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+)
+
+// SendFiscalProfileCode emails a one-time code to the address of a fiscal profile.
+func SendFiscalProfileCode(t Transport, from mail.Address, to, lang string, data FiscalProfileCodeMailData) error {
+	subject, body, err := Render("fiscal_profile_code", lang, data)
+	if err != nil {
+		return err
+	}
+	msg := Message{
+		From:    from,
+		To:      []mail.Address{{Address: to}},
+		Subject: subject,
+		Body:    body,
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return fmt.Errorf("error building email: %w", err)
+	}
+	return t.Send(from.Address, msg.Recipients(), raw)
+}
+
+// codeMail is a fiscal profile code waiting to be sent.
+type codeMail struct {
+	to, lang string
+	data     FiscalProfileCodeMailData
+}
+
+// CodeSender emails fiscal profile codes from a queue in memory, so that a code
+// request is answered as fast whether or not the NIF has a profile to send a code to.
+// Codes are sent at once rather than through email_deliveries, as the customer is
+// waiting for them at the counter; one lost on a restart is simply requested again.
+type CodeSender struct {
+	Transport Transport
+	From      mail.Address
+	queue     chan codeMail
+}
+
+// NewCodeSender returns a CodeSender that holds up to size codes waiting to be sent.
+func NewCodeSender(t Transport, from mail.Address, size int) *CodeSender {
+	return &CodeSender{Transport: t, From: from, queue: make(chan codeMail, size)}
+}
+
+// Enqueue queues a code to be emailed to to. It does not wait: when the queue is
+// full the code is dropped and false returned.
+func (s *CodeSender) Enqueue(to, lang string, data FiscalProfileCodeMailData) bool {
+	select {
+	case s.queue <- codeMail{to: to, lang: lang, data: data}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run sends the queued codes until ctx is cancelled.
+func (s *CodeSender) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-s.queue:
+			if err := SendFiscalProfileCode(s.Transport, s.From, m.to, m.lang, m.data); err != nil {
+				log.Printf("Error emailing fiscal profile code: %v", err)
+			}
+		}
+	}
+}
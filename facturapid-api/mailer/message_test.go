@@ -0,0 +1,132 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parsedMessage is a message as a mail client reads it.
+type parsedMessage struct {
+	Header      mail.Header
+	Body        string
+	Attachments []Attachment
+}
+
+// parseMessage reads a message written by Message.Bytes.
+func parseMessage(t *testing.T, raw []byte) parsedMessage {
+	t.Helper()
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q (%v), want multipart/mixed", msg.Header.Get("Content-Type"), err)
+	}
+	p := parsedMessage{Header: msg.Header}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch part.Header.Get("Content-Transfer-Encoding") {
+		case "quoted-printable":
+			body, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.Body = string(body)
+		case "base64":
+			for _, line := range strings.Split(strings.TrimRight(string(raw), "\r\n"), "\r\n") {
+				if len(line) > 76 {
+					t.Errorf("base64 line of %d characters", len(line))
+				}
+			}
+			data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			_, disposition, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+			p.Attachments = append(p.Attachments, Attachment{Filename: disposition["filename"], ContentType: contentType, Data: data})
+		default:
+			t.Fatalf("part with Content-Transfer-Encoding %q", part.Header.Get("Content-Transfer-Encoding"))
+		}
+	}
+	return p
+}
+
+func TestMessageThroughFileTransport(t *testing.T) {
+	pdf := make([]byte, 1000)
+	for i := range pdf {
+		pdf[i] = byte(i * 7)
+	}
+	msg := Message{
+		From:    mail.Address{Name: "Bar Pepe SL", Address: "facturas@example.com"},
+		To:      []mail.Address{{Name: "Ana Núñez", Address: "ana@example.com"}},
+		Subject: "Factura A-42 de Bar Pepe SL",
+		Body:    "Estimado/a Ana:\n\nLe enviamos adjunta la factura A-42, por un importe total de 12.10 €.\n",
+		Attachments: []Attachment{
+			{Filename: "factura-A-42.pdf", ContentType: "application/pdf", Data: pdf},
+		},
+		Date: time.Date(2025, 6, 10, 12, 0, 0, 0, time.UTC),
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	transport := &FileTransport{Dir: dir}
+	if err := transport.Send(msg.From.Address, msg.Recipients(), raw); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("outbox has %v (%v), want one message", files, err)
+	}
+	written, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parseMessage(t, written)
+	if env := got.Header.Get("X-Envelope-To"); env != "ana@example.com" {
+		t.Errorf("X-Envelope-To = %q", env)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(got.Header.Get("Subject"))
+	if err != nil || subject != msg.Subject {
+		t.Errorf("Subject = %q (%v), want %q", subject, err, msg.Subject)
+	}
+	to, err := got.Header.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Name != "Ana Núñez" || to[0].Address != "ana@example.com" {
+		t.Errorf("To = %v (%v)", to, err)
+	}
+	if want := strings.ReplaceAll(msg.Body, "\n", "\r\n"); got.Body != want {
+		t.Errorf("body = %q, want %q", got.Body, want)
+	}
+	if len(got.Attachments) != 1 {
+		t.Fatalf("%d attachments, want 1", len(got.Attachments))
+	}
+	a := got.Attachments[0]
+	if a.Filename != "factura-A-42.pdf" || a.ContentType != "application/pdf" || !bytes.Equal(a.Data, pdf) {
+		t.Errorf("attachment %s (%s, %d bytes) differs from the PDF sent", a.Filename, a.ContentType, len(a.Data))
+	}
+}
@@ -0,0 +1,79 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Mail templates live in templates/<name>.<language>.txt. The first line is the
+// subject ("Subject: ..."), followed by an empty line and the body.
+
+//go:embed templates/*.txt
+var templateFS embed.FS
+
+// DefaultLanguage is used when the customer's language is unknown or unsupported.
+const DefaultLanguage = "es"
+
+// Languages lists the languages the mail templates exist in.
+var Languages = []string{"es", "en"}
+
+var templates = template.Must(template.New("").Option("missingkey=error").ParseFS(templateFS, "templates/*.txt"))
+
+// InvoiceMailData is what the invoice mail templates are executed against.
+type InvoiceMailData struct {
+	InvoiceID    string // Serie-Codigo, as printed on the invoice
+	Date         string
+	Total        string
+	IssuerName   string
+	CustomerName string
+}
+
+// SupportedLanguage reports whether mail templates exist for lang.
+func SupportedLanguage(lang string) bool {
+	for _, l := range Languages {
+		if l == lang {
+			return true
+		}
+	}
+	return false
+}
+
+// LanguageFromHeader picks the first supported language of an Accept-Language header,
+// or DefaultLanguage.
+func LanguageFromHeader(acceptLanguage string) string {
+	for _, item := range strings.Split(acceptLanguage, ",") {
+		tag := strings.TrimSpace(strings.SplitN(item, ";", 2)[0])
+		primary := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if SupportedLanguage(primary) {
+			return primary
+		}
+	}
+	return DefaultLanguage
+}
+
+// Render executes the template name in lang and returns the subject and the body.
+func Render(name, lang string, data interface{}) (subject, body string, err error) {
+	if !SupportedLanguage(lang) {
+		lang = DefaultLanguage
+	}
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, name+"."+lang+".txt", data); err != nil {
+		return "", "", fmt.Errorf("error rendering mail template %s (%s): %w", name, lang, err)
+	}
+	head, body, ok := strings.Cut(buf.String(), "\n\n")
+	if !ok || !strings.HasPrefix(head, "Subject: ") {
+		return "", "", fmt.Errorf("mail template %s (%s) does not start with a Subject line", name, lang)
+	}
+	return strings.TrimPrefix(head, "Subject: "), strings.TrimSpace(body) + "\n", nil
+}
+
+// FiscalProfileCodeMailData is what the fiscal_profile_code templates are executed
+// against.
+type FiscalProfileCodeMailData struct {
+	NIF     string
+	Code    string
+	Minutes int // How long the code is valid
+}
@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderInvoice(t *testing.T) {
+	data := InvoiceMailData{InvoiceID: "A-42", Date: "2025-06-10", Total: "12.10", IssuerName: "Bar Pepe SL", CustomerName: "Ana"}
+	tests := []struct {
+		lang     string
+		subject  string
+		greeting string
+	}{
+		{"es", "Factura A-42 de Bar Pepe SL", "Estimado/a Ana:"},
+		{"en", "Invoice A-42 from Bar Pepe SL", "Dear Ana,"},
+		{"fr", "Factura A-42 de Bar Pepe SL", "Estimado/a Ana:"}, // Unsupported: DefaultLanguage
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang, func(t *testing.T) {
+			subject, body, err := Render("invoice", tt.lang, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != tt.subject {
+				t.Errorf("subject = %q, want %q", subject, tt.subject)
+			}
+			for _, want := range []string{tt.greeting, "A-42", "2025-06-10", "12.10", "Bar Pepe SL"} {
+				if !strings.Contains(body, want) {
+					t.Errorf("body does not contain %q:\n%s", want, body)
+				}
+			}
+			if !strings.HasSuffix(body, "\n") || strings.HasSuffix(body, "\n\n") {
+				t.Errorf("body does not end in one newline: %q", body)
+			}
+		})
+	}
+}
+
+func TestRenderFiscalProfileCode(t *testing.T) {
+	data := FiscalProfileCodeMailData{NIF: "B12345678", Code: "042017", Minutes: 10}
+	subjects := map[string]string{"es": "Código de verificación 042017", "en": "Verification code 042017"}
+	for _, lang := range Languages {
+		t.Run(lang, func(t *testing.T) {
+			subject, body, err := Render("fiscal_profile_code", lang, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != subjects[lang] {
+				t.Errorf("subject = %q, want %q", subject, subjects[lang])
+			}
+			for _, want := range []string{"B12345678", "042017", "10"} {
+				if !strings.Contains(body, want) {
+					t.Errorf("body does not contain %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMissingData(t *testing.T) {
+	if _, _, err := Render("fiscal_profile_code", "es", InvoiceMailData{}); err == nil {
+		t.Error("rendering with the data of another template succeeded")
+	}
+}
+
+func TestLanguageFromHeader(t *testing.T) {
+	tests := map[string]string{
+		"":                        DefaultLanguage,
+		"en-GB,en;q=0.9":          "en",
+		"fr-FR, en;q=0.8":         "en",
+		"ES":                      "es",
+		"de-DE,fr;q=0.9":          DefaultLanguage,
+		"en;q=0.5, es-ES;q=0.9  ": "en", // First listed, whatever the weights
+	}
+	for header, want := range tests {
+		if got := LanguageFromHeader(header); got != want {
+			t.Errorf("LanguageFromHeader(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
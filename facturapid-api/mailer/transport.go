@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Transport delivers a rendered message to its recipients.
+type Transport interface {
+	Send(from string, to []string, msg []byte) error
+}
+
+// SMTPTransport sends through an SMTP server, upgrading to TLS with STARTTLS when the
+// server offers it. A local mock SMTP server (MailHog, smtp4dev...) works as well.
+type SMTPTransport struct {
+	Addr     string // host:port
+	Username string // Empty for servers that do not require authentication
+	Password string
+}
+
+// Send implements Transport.
+func (t *SMTPTransport) Send(from string, to []string, msg []byte) error {
+	var auth smtp.Auth
+	if t.Username != "" {
+		host, _, err := net.SplitHostPort(t.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP address %q: %w", t.Addr, err)
+		}
+		auth = smtp.PlainAuth("", t.Username, t.Password, host)
+	}
+	if err := smtp.SendMail(t.Addr, auth, from, to, msg); err != nil {
+		return fmt.Errorf("error sending mail through %s: %w", t.Addr, err)
+	}
+	return nil
+}
+
+// FileTransport writes each message to a .eml file in Dir instead of sending it. It is
+// meant for development and tests; the files open in any mail client.
+type FileTransport struct {
+	Dir string
+}
+
+var fileSeq uint64
+
+// Send implements Transport.
+func (t *FileTransport) Send(from string, to []string, msg []byte) error {
+	if err := os.MkdirAll(t.Dir, 0o750); err != nil {
+		return fmt.Errorf("error creating mail outbox: %w", err)
+	}
+	name := fmt.Sprintf("%s-%d.eml", time.Now().UTC().Format("20060102T150405"), atomic.AddUint64(&fileSeq, 1))
+	envelope := fmt.Sprintf("X-Envelope-From: %s\r\nX-Envelope-To: %s\r\n", from, strings.Join(to, ", "))
+	if err := os.WriteFile(filepath.Join(t.Dir, name), append([]byte(envelope), msg...), 0o640); err != nil {
+		return fmt.Errorf("error writing mail to outbox: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package mailer
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/invoicepdf"
+	"facturapid-api/pdfgenerator"
+	"facturapid-api/ubl"
+	"fmt"
+	"log"
+	"net/mail"
+	"time"
+)
+
+// retryDelays are the waits after each failed attempt; once they are exhausted the
+// delivery is marked as failed.
+var retryDelays = []time.Duration{time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 12 * time.Hour}
+
+const (
+	claimBatch = 10
+	// claimLease must be longer than an attempt (PDF generation plus SMTP) can take.
+	claimLease = 10 * time.Minute
+)
+
+// mailerActor is the actor of the invoice events the worker records.
+var mailerActor = dto.SystemActor("mailer")
+
+// Worker sends the queued invoice emails.
+type Worker struct {
+	DB        *sql.DB
+	PDFs      *invoicepdf.Service
+	Transport Transport
+	// From is the sender address. Its name, if empty, is the issuer's legal name.
+	From     mail.Address
+	Interval time.Duration // Time between queue polls
+}
+
+// Run polls the queue until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.ProcessDue(); err != nil {
+			log.Printf("Error processing email queue: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue sends every due delivery and returns how many were attempted.
+func (w *Worker) ProcessDue() (int, error) {
+	total := 0
+	for {
+		deliveries, err := database.ClaimDueEmailDeliveries(w.DB, claimBatch, claimLease)
+		if err != nil {
+			return total, err
+		}
+		for _, d := range deliveries {
+			w.attempt(d)
+		}
+		total += len(deliveries)
+		if len(deliveries) < claimBatch {
+			return total, nil
+		}
+	}
+}
+
+// attempt tries to send one delivery and records the outcome.
+func (w *Worker) attempt(d dto.EmailDeliveryDTO) {
+	sha, err := w.send(d)
+	if err == nil {
+		if err := database.MarkEmailDeliverySent(w.DB, d.ID, sha); err != nil {
+			log.Printf("Error recording email delivery %d: %v", d.ID, err)
+		}
+		log.Printf("Emailed invoice %d to %s (delivery %d).", d.InvoiceID, d.Recipient, d.ID)
+		w.recordEvent(d, dto.InvoiceEventEmailSent, map[string]interface{}{"pdf_sha256": sha})
+		return
+	}
+
+	var retryAt *time.Time
+	// A voided invoice will not become sendable: no point in retrying
+	if d.Attempts <= len(retryDelays) && !errors.Is(err, database.ErrInvoiceVoided) {
+		t := time.Now().Add(retryDelays[d.Attempts-1])
+		retryAt = &t
+		log.Printf("Error emailing invoice %d to %s (delivery %d, attempt %d), retrying at %s: %v",
+			d.InvoiceID, d.Recipient, d.ID, d.Attempts, t.Format(time.RFC3339), err)
+	} else {
+		log.Printf("Error emailing invoice %d to %s (delivery %d), giving up after %d attempts: %v",
+			d.InvoiceID, d.Recipient, d.ID, d.Attempts, err)
+	}
+	if err := database.MarkEmailDeliveryFailed(w.DB, d.ID, err.Error(), retryAt); err != nil {
+		log.Printf("Error recording email delivery %d: %v", d.ID, err)
+	}
+	if retryAt == nil {
+		w.recordEvent(d, dto.InvoiceEventEmailFailed, map[string]interface{}{"attempts": d.Attempts, "error": err.Error()})
+	}
+}
+
+// recordEvent adds the outcome of a delivery to the invoice's audit trail.
+func (w *Worker) recordEvent(d dto.EmailDeliveryDTO, eventType string, details map[string]interface{}) {
+	details["delivery_id"] = d.ID
+	details["recipient"] = d.Recipient
+	if err := database.RecordInvoiceEvent(w.DB, d.TenantID, d.InvoiceID, eventType, mailerActor, details); err != nil {
+		log.Printf("Error recording email event for invoice %d: %v", d.InvoiceID, err)
+	}
+}
+
+// send emails the invoice PDF and returns the digest of the PDF sent.
+func (w *Worker) send(d dto.EmailDeliveryDTO) (string, error) {
+	invoice, err := database.GetFullInvoiceByID(w.DB, d.TenantID, d.InvoiceID)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving invoice: %w", err)
+	}
+	issuer, err := database.GetIssuerProfileForInvoice(w.DB, d.TenantID, invoice.Header)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving issuer profile: %w", err)
+	}
+	tmpl, err := pdfgenerator.LoadTemplate(pdfgenerator.DefaultTemplateName)
+	if err != nil {
+		return "", err
+	}
+	pdf, err := w.PDFs.Get(d.TenantID, d.InvoiceID, tmpl, mailerActor)
+	if err != nil {
+		return "", fmt.Errorf("error getting invoice PDF: %w", err)
+	}
+
+	id := ubl.InvoiceID(invoice.Header)
+	data := InvoiceMailData{
+		InvoiceID:  id,
+		Total:      invoice.Header.Total.StringFixed(2),
+		IssuerName: issuer.LegalName,
+	}
+	if invoice.Header.Fecha != nil {
+		data.Date = *invoice.Header.Fecha
+	}
+	if invoice.Header.Cliente1 != nil {
+		data.CustomerName = *invoice.Header.Cliente1
+	}
+	subject, body, err := Render("invoice", d.Language, data)
+	if err != nil {
+		return "", err
+	}
+
+	from := w.From
+	if from.Name == "" {
+		from.Name = issuer.LegalName
+	}
+	msg := Message{
+		From:    from,
+		To:      []mail.Address{{Name: data.CustomerName, Address: d.Recipient}},
+		Subject: subject,
+		Body:    body,
+		Attachments: []Attachment{{
+			Filename:    "factura-" + id + ".pdf",
+			ContentType: "application/pdf",
+			Data:        pdf.Data,
+		}},
+	}
+	raw, err := msg.Bytes()
+	if err != nil {
+		return "", fmt.Errorf("error building email: %w", err)
+	}
+	if err := w.Transport.Send(from.Address, msg.Recipients(), raw); err != nil {
+		return "", err
+	}
+	return pdf.SHA256, nil
+}
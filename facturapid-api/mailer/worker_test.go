@@ -0,0 +1,236 @@
+package mailer
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/invoicepdf"
+	"facturapid-api/money"
+	"facturapid-api/pdfgenerator"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The worker tests run against the PostgreSQL database in FACTURAPID_TEST_DATABASE_URL,
+// and are skipped without one. Each test works in a tenant of its own and calls
+// Worker.attempt on deliveries it queued itself, so other tests' deliveries are left
+// alone.
+
+// errTransport fails every send.
+type errTransport struct{}
+
+func (errTransport) Send(from string, to []string, msg []byte) error {
+	return errors.New("421 service not available")
+}
+
+// testWorker connects to the test database, creates the schema and a tenant with an
+// issuer profile and invoice 1, and returns a worker sending through transport and
+// the tenant, or skips the test.
+func testWorker(t *testing.T, transport Transport) (*Worker, int) {
+	t.Helper()
+	url := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	db, err := database.InitDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := database.CreateTenant(db, dto.TenantDTO{Code: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := dto.IssuerProfileDTO{LegalName: "Bar Pepe SL", NIF: "B12345678", Address: "Calle Mayor 1, Madrid", IsDefault: true}
+	if _, err := database.CreateIssuerProfile(db, tenant.ID, issuer); err != nil {
+		t.Fatal(err)
+	}
+
+	b, rate := money.MustParse("10.00"), money.MustParse("21")
+	quota := money.VATQuota(b, rate)
+	fecha, hora, customer := "2025-06-10", "12:00:00", "Ana"
+	inv := dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: 1, Serie: "A", Tarifa: "1", Fecha: &fecha, Hora: &hora, Cliente1: &customer,
+			Base1: &b, Iva1: &rate, CuotaIva1: &quota, CuotaIVA: &quota, Total: b.Add(quota),
+		},
+		Lines: []dto.InvoiceLineDTO{{CodigoFactura: 1, Linea: 1, Producto: "Menú del día", Unidades: money.One, Subtotal: b, IvaAplicado: &rate}},
+	}
+	if _, err := database.CreateFullInvoice(db, tenant.ID, inv, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	return &Worker{
+		DB:        db,
+		PDFs:      invoicepdf.NewService(db, nil, database.NewPDFStore(db)),
+		Transport: transport,
+		From:      mail.Address{Address: "facturas@example.com"},
+	}, tenant.ID
+}
+
+// queue queues invoice 1 to be emailed and returns the delivery as claimed for its
+// attempt-th attempt.
+func queue(t *testing.T, w *Worker, tenantID, attempt int) dto.EmailDeliveryDTO {
+	t.Helper()
+	d, err := database.EnqueueEmailDelivery(w.DB, tenantID, 1, "ana@example.com", "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Attempts = attempt
+	return d
+}
+
+// delivery reads back a delivery of invoice 1.
+func delivery(t *testing.T, db *sql.DB, tenantID, id int) dto.EmailDeliveryDTO {
+	t.Helper()
+	deliveries, err := database.ListEmailDeliveries(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range deliveries {
+		if d.ID == id {
+			return d
+		}
+	}
+	t.Fatalf("delivery %d not found", id)
+	return dto.EmailDeliveryDTO{}
+}
+
+// failedEvents counts the email_failed events of invoice 1.
+func failedEvents(t *testing.T, db *sql.DB, tenantID int) int {
+	t.Helper()
+	events, err := database.ListInvoiceEvents(db, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, e := range events {
+		if e.EventType == dto.InvoiceEventEmailFailed {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWorkerSendsInvoicePDF(t *testing.T) {
+	dir := t.TempDir()
+	w, tenantID := testWorker(t, &FileTransport{Dir: dir})
+	d := queue(t, w, tenantID, 1)
+
+	w.attempt(d)
+
+	got := delivery(t, w.DB, tenantID, d.ID)
+	if got.Status != dto.EmailStatusSent || got.PDFSHA256 == nil {
+		t.Fatalf("delivery status = %s, pdf_sha256 = %v, want sent with the digest", got.Status, got.PDFSHA256)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("outbox has %v (%v), want one message", files, err)
+	}
+	raw, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := parseMessage(t, raw)
+	if from, err := msg.Header.AddressList("From"); err != nil || from[0].Name != "Bar Pepe SL" {
+		t.Errorf("From = %v (%v), want the issuer's legal name", from, err)
+	}
+	if len(msg.Attachments) != 1 {
+		t.Fatalf("%d attachments, want 1", len(msg.Attachments))
+	}
+	a := msg.Attachments[0]
+	if a.Filename != "factura-A-1.pdf" || a.ContentType != "application/pdf" {
+		t.Errorf("attachment %s (%s), want factura-A-1.pdf (application/pdf)", a.Filename, a.ContentType)
+	}
+	sum := sha256.Sum256(a.Data)
+	if hex.EncodeToString(sum[:]) != *got.PDFSHA256 {
+		t.Errorf("attachment digest %x, recorded %s", sum, *got.PDFSHA256)
+	}
+	tmpl, err := pdfgenerator.LoadTemplate(pdfgenerator.DefaultTemplateName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := w.PDFs.Get(tenantID, 1, tmpl, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SHA256 != *got.PDFSHA256 {
+		t.Errorf("attachment is not the stored PDF: digest %s, stored %s", *got.PDFSHA256, stored.SHA256)
+	}
+}
+
+func TestWorkerRetrySchedule(t *testing.T) {
+	w, tenantID := testWorker(t, errTransport{})
+	for attempt := 1; attempt <= len(retryDelays); attempt++ {
+		d := queue(t, w, tenantID, attempt)
+		before := time.Now()
+		w.attempt(d)
+		after := time.Now()
+
+		got := delivery(t, w.DB, tenantID, d.ID)
+		if got.Status != dto.EmailStatusPending || got.NextAttemptAt == nil {
+			t.Fatalf("attempt %d: status %s, want pending with a next attempt", attempt, got.Status)
+		}
+		// Timestamps are stored with microsecond precision
+		earliest := before.Add(retryDelays[attempt-1]).Truncate(time.Millisecond)
+		latest := after.Add(retryDelays[attempt-1]).Add(time.Millisecond)
+		if got.NextAttemptAt.Before(earliest) || got.NextAttemptAt.After(latest) {
+			t.Errorf("attempt %d: next attempt at %s, want %s after it", attempt, got.NextAttemptAt, retryDelays[attempt-1])
+		}
+		if got.LastError == nil || *got.LastError == "" {
+			t.Errorf("attempt %d: last_error not recorded", attempt)
+		}
+	}
+	if n := failedEvents(t, w.DB, tenantID); n != 0 {
+		t.Errorf("%d email_failed events while retrying, want 0", n)
+	}
+}
+
+func TestWorkerGivesUp(t *testing.T) {
+	w, tenantID := testWorker(t, errTransport{})
+	d := queue(t, w, tenantID, len(retryDelays)+1)
+
+	w.attempt(d)
+
+	got := delivery(t, w.DB, tenantID, d.ID)
+	if got.Status != dto.EmailStatusFailed {
+		t.Errorf("status %s after %d attempts, want %s", got.Status, d.Attempts, dto.EmailStatusFailed)
+	}
+	if got.LastError == nil || *got.LastError != "421 service not available" {
+		t.Errorf("last_error = %v, want the transport's error", got.LastError)
+	}
+	if n := failedEvents(t, w.DB, tenantID); n != 1 {
+		t.Errorf("%d email_failed events, want 1", n)
+	}
+}
+
+func TestWorkerDoesNotRetryVoidedInvoice(t *testing.T) {
+	dir := t.TempDir()
+	w, tenantID := testWorker(t, &FileTransport{Dir: dir})
+	d := queue(t, w, tenantID, 1)
+	if _, err := database.VoidInvoice(w.DB, tenantID, 1, "Sent in error", dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	w.attempt(d)
+
+	got := delivery(t, w.DB, tenantID, d.ID)
+	if got.Status != dto.EmailStatusFailed {
+		t.Errorf("status %s on the first attempt, want %s", got.Status, dto.EmailStatusFailed)
+	}
+	if n := failedEvents(t, w.DB, tenantID); n != 1 {
+		t.Errorf("%d email_failed events, want 1", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(files) != 0 {
+		t.Errorf("voided invoice emailed: %v", files)
+	}
+}
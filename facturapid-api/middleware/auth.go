@@ -1,29 +1,147 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-// Configuration Note: API Key should ideally come from a secure configuration source.
+// Configuration Note: API keys should ideally come from a secure configuration source.
+// The keys below are registered at startup for the default tenant (and the platform);
+// the keys of other tenants are created through /api/v1/platform/tenants/:id/api-keys.
 const ExpectedAPIKey = "supersecretapikey" // Hardcoded for this example
 
-// APIKeyAuthMiddleware checks for a valid API key in the X-API-Key header.
-func APIKeyAuthMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		apiKey := c.GetHeader("X-API-Key")
+// ExpectedAdminAPIKey grants access to the /admin routes (issuer profiles and other back-office settings).
+// It is deliberately different from ExpectedAPIKey, which is shipped to the synchronizer and the frontend.
+const ExpectedAdminAPIKey = "supersecretadminkey" // Hardcoded for this example
+
+// ExpectedPlatformAPIKey grants access to the /platform routes, which manage the tenants and their keys.
+const ExpectedPlatformAPIKey = "supersecretplatformkey" // Hardcoded for this example
 
-		if apiKey == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+// APIKeyAuthMiddleware checks for a valid client API key in the X-API-Key header and
+// scopes the request to the key's tenant.
+func APIKeyAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := authenticate(c, db)
+		if !ok {
 			return
 		}
-
-		if apiKey != ExpectedAPIKey {
+		if key.Role != dto.APIKeyRoleClient {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
 			return
 		}
+		c.Set(tenantKey, *key.TenantID)
+		setActor(c, dto.ActorAPIKey, c.GetHeader("X-API-Key"))
 
 		c.Next() // Proceed to the next handler
 	}
 }
+
+// AdminAPIKeyAuthMiddleware checks for a valid admin API key in the X-API-Key header
+// and scopes the request to the key's tenant.
+func AdminAPIKeyAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := authenticate(c, db)
+		if !ok {
+			return
+		}
+		if key.Role != dto.APIKeyRoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin API key required"})
+			return
+		}
+		c.Set(tenantKey, *key.TenantID)
+		setActor(c, dto.ActorAdmin, c.GetHeader("X-API-Key"))
+
+		c.Next()
+	}
+}
+
+// PlatformAPIKeyAuthMiddleware checks for a valid platform API key in the X-API-Key
+// header. Platform requests have no tenant of their own.
+func PlatformAPIKeyAuthMiddleware(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, ok := authenticate(c, db)
+		if !ok {
+			return
+		}
+		if key.Role != dto.APIKeyRolePlatform {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Platform API key required"})
+			return
+		}
+		setActor(c, dto.ActorPlatform, c.GetHeader("X-API-Key"))
+
+		c.Next()
+	}
+}
+
+// NewAPIKey returns a new random API key.
+func NewAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating API key: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authenticate looks up the API key of the request. When there is no valid key it
+// aborts the request and returns false.
+func authenticate(c *gin.Context, db *sql.DB) (dto.APIKeyDTO, bool) {
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+		return dto.APIKeyDTO{}, false
+	}
+	key, err := database.GetAPIKey(db, apiKey)
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		return dto.APIKeyDTO{}, false
+	}
+	if err != nil {
+		log.Printf("Error checking API key: %v", err)
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check API key"})
+		return dto.APIKeyDTO{}, false
+	}
+	return key, true
+}
+
+// tenantKey is the gin context key of the tenant of the request.
+const tenantKey = "facturapid.tenant"
+
+// TenantID returns the tenant of the request, as set by the authentication middleware
+// from the API key. Routes without a tenant-scoped key get the default tenant.
+func TenantID(c *gin.Context) int {
+	if tenantID, ok := c.Get(tenantKey); ok {
+		return tenantID.(int)
+	}
+	return dto.DefaultTenantID
+}
+
+// actorKey is the gin context key of the authenticated actor.
+const actorKey = "facturapid.actor"
+
+// setActor records who is making the request, for the audit trail. The key itself is
+// never stored, only a short fingerprint that tells keys apart once there are several.
+func setActor(c *gin.Context, actorType, apiKey string) {
+	sum := sha256.Sum256([]byte(apiKey))
+	ip := c.ClientIP()
+	c.Set(actorKey, dto.ActorDTO{Type: actorType, ID: "key:" + hex.EncodeToString(sum[:4]), ClientIP: &ip})
+}
+
+// Actor returns who is making the request, as set by the authentication middleware.
+// Unauthenticated requests get an anonymous actor with the client IP.
+func Actor(c *gin.Context) dto.ActorDTO {
+	if actor, ok := c.Get(actorKey); ok {
+		return actor.(dto.ActorDTO)
+	}
+	ip := c.ClientIP()
+	return dto.ActorDTO{Type: dto.ActorAnonymous, ID: "-", ClientIP: &ip}
+}
@@ -0,0 +1,386 @@
+// Package money provides the exact decimal type used for every amount, rate and
+// quantity handled by the API. Amounts are never converted to float64: they travel
+// as JSON numbers (or strings), are stored as PostgreSQL NUMERIC(12,4) and are
+// rendered from the same fixed-point value, so the printed totals always match the
+// stored ones.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Scale is the number of fractional digits kept by Decimal. It matches the
+// NUMERIC(12,4) columns of the invoices and invoice_lines tables.
+const Scale = 4
+
+const unit = 10000 // 10^Scale
+
+// Decimal is a fixed-point number with Scale fractional digits.
+// The zero value is 0. Its underlying integer kind keeps the "gte=0" style
+// binding tags working on DTO fields.
+type Decimal int64
+
+// Common values.
+const (
+	Zero Decimal = 0
+	Cent Decimal = unit / 100
+	One  Decimal = unit
+)
+
+// MaxDecimal and MinDecimal bound the results of Add, Sub, Mul, Div and Percent, which
+// saturate instead of wrapping around. Both are far beyond NUMERIC(12,4), so a saturated
+// amount is rejected when stored rather than passing for a plausible one.
+const (
+	MaxDecimal Decimal = math.MaxInt64
+	MinDecimal Decimal = -math.MaxInt64
+)
+
+var ErrInvalidDecimal = errors.New("invalid decimal")
+
+// FromCents returns the Decimal for an amount expressed in cents.
+func FromCents(cents int64) Decimal {
+	return Decimal(cents * (unit / 100))
+}
+
+// FromInt returns the Decimal for a whole number.
+func FromInt(i int64) Decimal {
+	return Decimal(i * unit)
+}
+
+// Parse reads a decimal literal such as "12", "-3.5" or "21.0000".
+// Digits beyond Scale are rounded half away from zero.
+func Parse(s string) (Decimal, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("%w: empty string", ErrInvalidDecimal)
+	}
+	// Accept exponent forms (e.g. 1e-2) by letting big.Rat do the exact conversion.
+	if strings.ContainsAny(s, "eE") {
+		r, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+		}
+		return fromRat(r, s)
+	}
+
+	neg := false
+	switch s[0] {
+	case '-':
+		neg = true
+		s = s[1:]
+	case '+':
+		s = s[1:]
+	}
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for _, ch := range part {
+			if ch < '0' || ch > '9' {
+				return 0, fmt.Errorf("%w: %q", ErrInvalidDecimal, s)
+			}
+		}
+	}
+
+	roundUp := false
+	if len(fracPart) > Scale {
+		roundUp = fracPart[Scale] >= '5'
+		fracPart = fracPart[:Scale]
+	}
+	fracPart += strings.Repeat("0", Scale-len(fracPart))
+	if intPart == "" {
+		intPart = "0"
+	}
+	v, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q out of range", ErrInvalidDecimal, s)
+	}
+	if roundUp {
+		v++
+	}
+	if neg {
+		v = -v
+	}
+	return Decimal(v), nil
+}
+
+// MustParse is like Parse but panics on error. Intended for constants and defaults.
+func MustParse(s string) Decimal {
+	d, err := Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func fromRat(r *big.Rat, src string) (Decimal, error) {
+	scaled := new(big.Rat).Mul(r, big.NewRat(unit, 1))
+	v := roundRat(scaled)
+	if !v.IsInt64() {
+		return 0, fmt.Errorf("%w: %q out of range", ErrInvalidDecimal, src)
+	}
+	return Decimal(v.Int64()), nil
+}
+
+// saturate returns v as a Decimal, or the bound it is beyond.
+func saturate(v *big.Int) Decimal {
+	switch {
+	case v.IsInt64() && v.Int64() >= int64(MinDecimal):
+		return Decimal(v.Int64())
+	case v.Sign() > 0:
+		return MaxDecimal
+	}
+	return MinDecimal
+}
+
+// roundRat rounds r to the nearest integer, half away from zero.
+func roundRat(r *big.Rat) *big.Int {
+	num := new(big.Int).Abs(r.Num())
+	den := r.Denom()
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(den) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q
+}
+
+// Add returns d + o, saturated at MaxDecimal and MinDecimal.
+func (d Decimal) Add(o Decimal) Decimal {
+	s := d + o
+	switch {
+	case o > 0 && s < d:
+		return MaxDecimal
+	case o < 0 && s > d, s < MinDecimal:
+		return MinDecimal
+	}
+	return s
+}
+
+// Sub returns d - o, saturated like Add.
+func (d Decimal) Sub(o Decimal) Decimal {
+	s := d - o
+	switch {
+	case o < 0 && s < d:
+		return MaxDecimal
+	case o > 0 && s > d, s < MinDecimal:
+		return MinDecimal
+	}
+	return s
+}
+
+// Neg returns -d.
+func (d Decimal) Neg() Decimal { return -d }
+
+// Abs returns |d|.
+func (d Decimal) Abs() Decimal {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// Sign returns -1, 0 or 1.
+func (d Decimal) Sign() int {
+	switch {
+	case d < 0:
+		return -1
+	case d > 0:
+		return 1
+	}
+	return 0
+}
+
+// IsZero reports whether d is 0.
+func (d Decimal) IsZero() bool { return d == 0 }
+
+// Cmp returns -1, 0 or 1 depending on whether d is less than, equal to or greater than o.
+func (d Decimal) Cmp(o Decimal) int { return d.Sub(o).Sign() }
+
+// Mul returns d * o rounded half away from zero to Scale digits, saturated at
+// MaxDecimal and MinDecimal.
+func (d Decimal) Mul(o Decimal) Decimal {
+	r := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(o))),
+		big.NewInt(unit),
+	)
+	return saturate(roundRat(r))
+}
+
+// Div returns d / o rounded half away from zero to Scale digits, saturated like Mul.
+// Dividing by zero returns 0.
+func (d Decimal) Div(o Decimal) Decimal {
+	if o == 0 {
+		return 0
+	}
+	r := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(unit)),
+		big.NewInt(int64(o)),
+	)
+	return saturate(roundRat(r))
+}
+
+// Percent returns rate percent of d (d * rate / 100), rounded to Scale digits and
+// saturated like Mul.
+func (d Decimal) Percent(rate Decimal) Decimal {
+	r := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(int64(d)), big.NewInt(int64(rate))),
+		big.NewInt(unit*100),
+	)
+	return saturate(roundRat(r))
+}
+
+// Round rounds d half away from zero to the given number of fractional digits (0..Scale).
+func (d Decimal) Round(places int) Decimal {
+	if places >= Scale {
+		return d
+	}
+	if places < 0 {
+		places = 0
+	}
+	step := int64(1)
+	for i := places; i < Scale; i++ {
+		step *= 10
+	}
+	v := int64(d)
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	q, rem := v/step, v%step
+	if rem*2 >= step {
+		q++
+	}
+	v = q * step
+	if neg {
+		v = -v
+	}
+	return Decimal(v)
+}
+
+// StringFixed formats d with exactly places fractional digits, rounding half away from zero.
+func (d Decimal) StringFixed(places int) string {
+	if places > Scale {
+		places = Scale
+	}
+	if places < 0 {
+		places = 0
+	}
+	v := int64(d.Round(places))
+	neg := v < 0
+	if neg {
+		v = -v
+	}
+	s := fmt.Sprintf("%d.%04d", v/unit, v%unit)
+	s = s[:len(s)-(Scale-places)]
+	s = strings.TrimSuffix(s, ".")
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// String formats d with trailing fractional zeros removed ("12.5", "21", "-0.0125").
+func (d Decimal) String() string {
+	s := d.StringFixed(Scale)
+	if strings.Contains(s, ".") {
+		s = strings.TrimRight(s, "0")
+		s = strings.TrimSuffix(s, ".")
+	}
+	return s
+}
+
+// MarshalJSON encodes d as a JSON number with no loss of precision.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON accepts JSON numbers and numeric strings. null leaves d unchanged.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" {
+		return nil
+	}
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*d = v
+	return nil
+}
+
+// Scan implements sql.Scanner for NUMERIC columns.
+func (d *Decimal) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		p, err := Parse(string(v))
+		if err != nil {
+			return err
+		}
+		*d = p
+	case string:
+		p, err := Parse(v)
+		if err != nil {
+			return err
+		}
+		*d = p
+	case int64:
+		*d = FromInt(v)
+	case float64:
+		// Only reached with drivers that do not return NUMERIC as text.
+		p, err := Parse(strconv.FormatFloat(v, 'f', -1, 64))
+		if err != nil {
+			return err
+		}
+		*d = p
+	case nil:
+		return fmt.Errorf("%w: cannot scan NULL into money.Decimal, use NullDecimal", ErrInvalidDecimal)
+	default:
+		return fmt.Errorf("%w: cannot scan %T", ErrInvalidDecimal, src)
+	}
+	return nil
+}
+
+// Value implements driver.Valuer. The value is sent as text so PostgreSQL parses it exactly.
+func (d Decimal) Value() (driver.Value, error) {
+	return d.StringFixed(Scale), nil
+}
+
+// NullDecimal is a Decimal that may be NULL, in the style of sql.NullFloat64.
+type NullDecimal struct {
+	Decimal Decimal
+	Valid   bool
+}
+
+// Scan implements sql.Scanner.
+func (n *NullDecimal) Scan(src interface{}) error {
+	if src == nil {
+		n.Decimal, n.Valid = 0, false
+		return nil
+	}
+	n.Valid = true
+	return n.Decimal.Scan(src)
+}
+
+// Value implements driver.Valuer.
+func (n NullDecimal) Value() (driver.Value, error) {
+	if !n.Valid {
+		return nil, nil
+	}
+	return n.Decimal.Value()
+}
@@ -0,0 +1,289 @@
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+// maxStored is the largest magnitude of a NUMERIC(12,4) column, in units of Decimal.
+const maxStored = 1e12
+
+var quickConfig = &quick.Config{
+	MaxCount: 5000,
+	Rand:     rand.New(rand.NewSource(1)),
+}
+
+// storedAmount is a Decimal that fits a NUMERIC(12,4) column.
+type storedAmount Decimal
+
+func (storedAmount) Generate(r *rand.Rand, _ int) reflect.Value {
+	return reflect.ValueOf(storedAmount(r.Int63n(2*maxStored) - maxStored))
+}
+
+// centAmount is an amount in cents as the TPV sends it, up to a million euros.
+type centAmount int64
+
+func (centAmount) Generate(r *rand.Rand, _ int) reflect.Value {
+	return reflect.ValueOf(centAmount(r.Int63n(2e8) - 1e8))
+}
+
+// vatRate is a VAT rate of the régimen general, or any with two decimals up to 30%.
+type vatRate Decimal
+
+func (vatRate) Generate(r *rand.Rand, _ int) reflect.Value {
+	rates := []string{"0", "4", "5", "10", "21"}
+	if i := r.Intn(len(rates) + 1); i < len(rates) {
+		return reflect.ValueOf(vatRate(MustParse(rates[i])))
+	}
+	return reflect.ValueOf(vatRate(FromCents(r.Int63n(3001))))
+}
+
+// formatCents formats an amount in cents the way the TPV sends it ("-12.05").
+func formatCents(c int64) string {
+	sign := ""
+	if c < 0 {
+		sign, c = "-", -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+// anyDecimal is a Decimal anywhere in [MinDecimal, MaxDecimal], most often next to
+// one of the bounds, where arithmetic overflows int64.
+type anyDecimal Decimal
+
+func (anyDecimal) Generate(r *rand.Rand, _ int) reflect.Value {
+	var d Decimal
+	switch r.Intn(5) {
+	case 0:
+		d = MaxDecimal - Decimal(r.Int63n(1e6))
+	case 1:
+		d = MinDecimal + Decimal(r.Int63n(1e6))
+	case 2:
+		d = Decimal(r.Int63n(2*maxStored) - maxStored)
+	default:
+		d = Decimal(r.Int63())
+		if r.Intn(2) == 0 {
+			d = -d
+		}
+	}
+	return reflect.ValueOf(anyDecimal(d))
+}
+
+// roundHalfAwayFromZero returns num/den rounded to an integer, computed apart from
+// the package to check it.
+func roundHalfAwayFromZero(num, den *big.Int) int64 {
+	return roundBig(num, den).Int64()
+}
+
+// roundBig is roundHalfAwayFromZero without the int64 bounds.
+func roundBig(num, den *big.Int) *big.Int {
+	q, rem := new(big.Int).QuoRem(num, den, new(big.Int)) // Truncated towards zero
+	twice := new(big.Int).Mul(new(big.Int).Abs(rem), big.NewInt(2))
+	if twice.Cmp(new(big.Int).Abs(den)) >= 0 {
+		if num.Sign()*den.Sign() < 0 {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
+
+// clamp returns v bounded to [MinDecimal, MaxDecimal], computed apart from the package
+// to check it.
+func clamp(v *big.Int) Decimal {
+	if v.Cmp(big.NewInt(int64(MaxDecimal))) > 0 {
+		return MaxDecimal
+	}
+	if v.Cmp(big.NewInt(int64(MinDecimal))) < 0 {
+		return MinDecimal
+	}
+	return Decimal(v.Int64())
+}
+
+func TestParseFormatRoundTrip(t *testing.T) {
+	prop := func(a storedAmount) bool {
+		d := Decimal(a)
+		fixed, err1 := Parse(d.StringFixed(Scale))
+		short, err2 := Parse(d.String())
+		return err1 == nil && err2 == nil && fixed == d && short == d
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoredValueRoundTrip(t *testing.T) {
+	prop := func(a storedAmount) bool {
+		d := Decimal(a)
+		v, err := d.Value()
+		if err != nil {
+			return false
+		}
+		// PostgreSQL returns NUMERIC as text, which lib/pq hands over as []byte
+		var scanned Decimal
+		if err := scanned.Scan([]byte(v.(string))); err != nil {
+			return false
+		}
+		return scanned == d && scanned.StringFixed(2) == d.StringFixed(2)
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSumHasNoCentDrift(t *testing.T) {
+	prop := func(amounts []centAmount) bool {
+		var sum Decimal
+		var cents int64
+		for _, a := range amounts {
+			d, err := Parse(formatCents(int64(a)))
+			if err != nil {
+				return false
+			}
+			sum = sum.Add(d)
+			cents += int64(a)
+		}
+		return sum == FromCents(cents) && sum.StringFixed(2) == formatCents(cents)
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVATQuotaIsExact(t *testing.T) {
+	prop := func(base centAmount, rate vatRate) bool {
+		// base (cents) * rate (hundredths of a percent) / 10000 = quota in cents
+		rateHundredths := int64(Decimal(rate)) / (unit / 100)
+		num := new(big.Int).Mul(big.NewInt(int64(base)), big.NewInt(rateHundredths))
+		want := roundHalfAwayFromZero(num, big.NewInt(10000))
+		return VATQuota(FromCents(int64(base)), Decimal(rate)) == FromCents(want)
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestPrintedTotalsMatchStored builds invoices from random lines the way the API does,
+// rounding the quota once per rate, and checks that what is printed adds up to the
+// printed total and survives storage.
+func TestPrintedTotalsMatchStored(t *testing.T) {
+	type line struct {
+		Subtotal centAmount
+		Rate     vatRate
+	}
+	prop := func(lines []line) bool {
+		bases := SumByRate{}
+		for _, l := range lines {
+			bases.Add(Decimal(l.Rate), FromCents(int64(l.Subtotal)))
+		}
+		var total Decimal
+		var printedSum Decimal
+		for _, b := range bases.Sorted() {
+			quota := VATQuota(b.Amount, b.Rate)
+			total = total.Add(b.Amount).Add(quota)
+			printedBase, err1 := Parse(b.Amount.StringFixed(2))
+			printedQuota, err2 := Parse(quota.StringFixed(2))
+			if err1 != nil || err2 != nil {
+				return false
+			}
+			printedSum = printedSum.Add(printedBase).Add(printedQuota)
+		}
+		var stored Decimal
+		v, _ := total.Value()
+		if err := stored.Scan([]byte(v.(string))); err != nil {
+			return false
+		}
+		return printedSum.StringFixed(2) == total.StringFixed(2) && stored.StringFixed(2) == total.StringFixed(2)
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVATQuotaRoundsPerRate(t *testing.T) {
+	// Three lines of 0.07 at 21%: 0.0147 each, which per line would print 0.01 three
+	// times (0.03), while the quota of the whole base (0.21) is 0.0441, 0.04.
+	bases := SumByRate{}
+	for i := 0; i < 3; i++ {
+		bases.Add(MustParse("21"), MustParse("0.07"))
+	}
+	got := VATQuota(bases[MustParse("21")], MustParse("21"))
+	if got != MustParse("0.04") {
+		t.Errorf("VATQuota of 0.21 at 21%% = %s, want 0.04", got)
+	}
+}
+
+func TestArithmeticSaturates(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Decimal
+		want Decimal
+	}{
+		{"Mul overflow", MaxDecimal.Mul(FromInt(2)), MaxDecimal},
+		{"Mul negative overflow", MaxDecimal.Mul(FromInt(-2)), MinDecimal},
+		{"Mul below MinDecimal", MinDecimal.Mul(One.Add(Cent)), MinDecimal},
+		{"Div overflow", FromInt(1e14).Div(Decimal(1)), MaxDecimal},
+		{"Div negative overflow", FromInt(-1e14).Div(Decimal(1)), MinDecimal},
+		{"Percent overflow", MaxDecimal.Percent(FromInt(200)), MaxDecimal},
+		{"Add overflow", MaxDecimal.Add(Cent), MaxDecimal},
+		{"Add negative overflow", MinDecimal.Add(-Cent), MinDecimal},
+		{"Add below MinDecimal", MinDecimal.Add(Decimal(-1)), MinDecimal},
+		{"Sub overflow", MaxDecimal.Sub(MinDecimal), MaxDecimal},
+		{"Sub negative overflow", MinDecimal.Sub(One), MinDecimal},
+		{"Add to the bound", (MaxDecimal - One).Add(One), MaxDecimal},
+		{"Add in range", MustParse("12.5").Add(MustParse("-3")), MustParse("9.5")},
+		{"Sub in range", MustParse("12.5").Sub(MustParse("-3")), MustParse("15.5")},
+		{"Mul in range", MustParse("12.5").Mul(MustParse("-3")), MustParse("-37.5")},
+		{"Div in range", FromInt(10).Div(FromInt(3)), MustParse("3.3333")},
+		{"Percent in range", MustParse("100").Percent(MustParse("21")), MustParse("21")},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %s, want %s", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestAddSubSaturate(t *testing.T) {
+	prop := func(a, b anyDecimal) bool {
+		x, y := big.NewInt(int64(a)), big.NewInt(int64(b))
+		d, o := Decimal(a), Decimal(b)
+		return d.Add(o) == clamp(new(big.Int).Add(x, y)) && d.Sub(o) == clamp(new(big.Int).Sub(x, y)) &&
+			d.Cmp(o) == x.Cmp(y)
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMulDivPercentSaturate(t *testing.T) {
+	prop := func(a, b anyDecimal) bool {
+		x, y := big.NewInt(int64(a)), big.NewInt(int64(b))
+		d, o := Decimal(a), Decimal(b)
+		product := new(big.Int).Mul(x, y)
+		if d.Mul(o) != clamp(roundBig(product, big.NewInt(unit))) ||
+			d.Percent(o) != clamp(roundBig(product, big.NewInt(unit*100))) {
+			return false
+		}
+		if o == 0 {
+			return d.Div(o) == 0
+		}
+		return d.Div(o) == clamp(roundBig(new(big.Int).Mul(x, big.NewInt(unit)), y))
+	}
+	if err := quick.Check(prop, quickConfig); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseOutOfRange(t *testing.T) {
+	for _, s := range []string{"1e20", "9223372036854775807", "-1e15"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an out of range error", s)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package money
+
+import (
+	"math/big"
+	"sort"
+)
+
+// VATQuota returns the VAT due on base at rate percent, rounded to the cent.
+//
+// Spanish invoicing rules (art. 10 of the Reglamento de facturación) round the quota
+// once per VAT rate, over the whole base taxed at that rate, and not line by line.
+// Callers must therefore add up the lines of a rate first and call VATQuota on the sum.
+//
+// The quota is rounded once, straight to the cent: rounding to Scale digits first
+// (Percent) and then to the cent can round up a quota such as 0.01495 to 0.02.
+func VATQuota(base, rate Decimal) Decimal {
+	r := new(big.Rat).SetFrac(
+		new(big.Int).Mul(big.NewInt(int64(base)), big.NewInt(int64(rate))),
+		big.NewInt(unit*100*int64(unit/Cent)),
+	)
+	return saturate(new(big.Int).Mul(roundRat(r), big.NewInt(int64(Cent))))
+}
+
+// RateAmount is an amount accumulated for a single VAT rate.
+type RateAmount struct {
+	Rate   Decimal
+	Amount Decimal
+}
+
+// SumByRate adds up amounts grouped by their VAT rate without any intermediate rounding.
+// The result is sorted by rate.
+type SumByRate map[Decimal]Decimal
+
+// Add accumulates amount under rate.
+func (s SumByRate) Add(rate, amount Decimal) {
+	s[rate] = s[rate].Add(amount)
+}
+
+// Sorted returns the accumulated amounts ordered by rate.
+func (s SumByRate) Sorted() []RateAmount {
+	out := make([]RateAmount, 0, len(s))
+	for rate, amount := range s {
+		out = append(out, RateAmount{Rate: rate, Amount: amount})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Rate < out[j].Rate })
+	return out
+}
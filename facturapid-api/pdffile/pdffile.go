@@ -0,0 +1,240 @@
+// Package pdffile reads and writes PDF files at the object level. It is deliberately
+// small: it understands the classic cross-reference tables written by gofpdf and by this
+// package, which is all the PDF/A conversion and the signer need, and nothing else
+// (no xref streams, object streams or encryption).
+package pdffile
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	trailerRootRe = regexp.MustCompile(`/Root (\d+) 0 R`)
+	trailerInfoRe = regexp.MustCompile(`/Info (\d+) 0 R`)
+	trailerIDRe   = regexp.MustCompile(`/ID\s*\[\s*<([0-9A-Fa-f]*)>`)
+	refRe         = regexp.MustCompile(`(\d+) 0 R`)
+)
+
+// File is a parsed PDF with a single revision.
+type File struct {
+	Raw        []byte
+	Objects    map[int][]byte // Object number -> "N 0 obj ... endobj"
+	Size       int            // Trailer /Size: one more than the highest object number
+	Root       int
+	Info       int
+	ID         string // First element of the trailer /ID, in hex; empty if absent
+	XrefOffset int
+}
+
+// Parse reads the object table of raw.
+func Parse(raw []byte) (*File, error) {
+	at := bytes.LastIndex(raw, []byte("startxref"))
+	if at < 0 {
+		return nil, fmt.Errorf("no startxref")
+	}
+	fields := strings.Fields(string(raw[at+len("startxref"):]))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("malformed startxref")
+	}
+	xrefOffset, err := strconv.Atoi(fields[0])
+	if err != nil || xrefOffset <= 0 || xrefOffset >= len(raw) {
+		return nil, fmt.Errorf("malformed startxref offset %q", fields[0])
+	}
+
+	// "xref", then subsections of "first count" followed by count 20-byte entries,
+	// then the trailer.
+	lines := strings.Split(string(raw[xrefOffset:at]), "\n")
+	if len(lines) < 3 || strings.TrimSpace(lines[0]) != "xref" {
+		return nil, fmt.Errorf("no xref table at offset %d", xrefOffset)
+	}
+	offsets := map[int]int{}
+	size := 0
+	i := 1
+	for i < len(lines) && !strings.HasPrefix(lines[i], "trailer") {
+		var first, count int
+		if _, err := fmt.Sscanf(lines[i], "%d %d", &first, &count); err != nil {
+			return nil, fmt.Errorf("malformed xref subsection %q", lines[i])
+		}
+		if i+count >= len(lines) {
+			return nil, fmt.Errorf("truncated xref table")
+		}
+		for j := 0; j < count; j++ {
+			num, entry := first+j, strings.Fields(lines[i+1+j])
+			if len(entry) != 3 {
+				return nil, fmt.Errorf("malformed xref entry %q", lines[i+1+j])
+			}
+			if entry[2] == "n" {
+				off, err := strconv.Atoi(entry[0])
+				if err != nil {
+					return nil, fmt.Errorf("malformed xref entry %q", lines[i+1+j])
+				}
+				offsets[num] = off
+			}
+			if num+1 > size {
+				size = num + 1
+			}
+		}
+		i += 1 + count
+	}
+	trailer := strings.Join(lines[i:], "\n")
+	if strings.Contains(trailer, "/Prev") {
+		return nil, fmt.Errorf("incrementally updated files are not supported")
+	}
+	rootMatch, infoMatch := trailerRootRe.FindStringSubmatch(trailer), trailerInfoRe.FindStringSubmatch(trailer)
+	if rootMatch == nil || infoMatch == nil {
+		return nil, fmt.Errorf("trailer lacks /Root or /Info")
+	}
+
+	// Objects are not necessarily written in number order, so each one ends where the
+	// next one in file order (or the xref table) starts.
+	starts := make([]int, 0, len(offsets))
+	for _, off := range offsets {
+		starts = append(starts, off)
+	}
+	sort.Ints(starts)
+	f := &File{Raw: raw, Objects: map[int][]byte{}, Size: size, XrefOffset: xrefOffset}
+	f.Root, _ = strconv.Atoi(rootMatch[1])
+	f.Info, _ = strconv.Atoi(infoMatch[1])
+	if m := trailerIDRe.FindStringSubmatch(trailer); m != nil {
+		f.ID = m[1]
+	}
+	for num, off := range offsets {
+		end := xrefOffset
+		if i := sort.SearchInts(starts, off+1); i < len(starts) {
+			end = starts[i]
+		}
+		obj := bytes.TrimRight(raw[off:end], "\r\n ")
+		if !bytes.HasPrefix(obj, []byte(strconv.Itoa(num)+" 0 obj")) || !bytes.HasSuffix(obj, []byte("endobj")) {
+			return nil, fmt.Errorf("object %d is not where the xref table says", num)
+		}
+		f.Objects[num] = obj
+	}
+	return f, nil
+}
+
+// Dict returns the dictionary of a non-stream object, without the enclosing << >>.
+func (f *File) Dict(num int) (string, error) {
+	obj, ok := f.Objects[num]
+	if !ok {
+		return "", fmt.Errorf("object %d not found", num)
+	}
+	s := string(obj)
+	open, end := strings.Index(s, "<<"), strings.LastIndex(s, ">>")
+	if open < 0 || end < open || strings.Contains(s, "\nstream") {
+		return "", fmt.Errorf("object %d is not a dictionary", num)
+	}
+	return s[open+2 : end], nil
+}
+
+// Refs returns the object numbers of the indirect references in s, in order.
+func Refs(s string) []int {
+	var nums []int
+	for _, m := range refRe.FindAllStringSubmatch(s, -1) {
+		n, _ := strconv.Atoi(m[1])
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// Writer serialises objects, keeping their offsets for the cross-reference table.
+type Writer struct {
+	buf     bytes.Buffer
+	offsets map[int]int
+	next    int // Next free object number
+}
+
+// NewWriter starts a file (or, for an incremental update, an existing file) with prefix.
+// New objects are numbered from next.
+func NewWriter(prefix []byte, next int) *Writer {
+	w := &Writer{offsets: map[int]int{}, next: next}
+	w.buf.Write(prefix)
+	return w
+}
+
+// Len is the number of bytes written so far.
+func (w *Writer) Len() int { return w.buf.Len() }
+
+// Bytes returns the bytes written so far.
+func (w *Writer) Bytes() []byte { return w.buf.Bytes() }
+
+// Alloc reserves a new object number.
+func (w *Writer) Alloc() int {
+	n := w.next
+	w.next++
+	return n
+}
+
+// Raw writes a complete "N 0 obj ... endobj" object.
+func (w *Writer) Raw(num int, obj []byte) {
+	w.offsets[num] = w.buf.Len()
+	w.buf.Write(obj)
+	w.buf.WriteString("\n")
+}
+
+// Object writes a non-stream object whose value is dict.
+func (w *Writer) Object(num int, dict string) {
+	w.Raw(num, []byte(fmt.Sprintf("%d 0 obj\n%s\nendobj", num, dict)))
+}
+
+// Stream writes a stream object; extra holds additional dictionary entries.
+func (w *Writer) Stream(num int, extra string, data []byte, compress bool) {
+	if compress {
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(data)
+		zw.Close()
+		data = z.Bytes()
+		extra += " /Filter /FlateDecode"
+	}
+	w.Raw(num, []byte(fmt.Sprintf("%d 0 obj\n<< %s /Length %d >>\nstream\n%s\nendstream\nendobj", num, extra, len(data), data)))
+}
+
+// Finish writes the cross-reference table for the objects written by w and the trailer.
+// entries are trailer keys besides /Size.
+func (w *Writer) Finish(entries string) []byte {
+	nums := make([]int, 0, len(w.offsets))
+	for num := range w.offsets {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	xref := w.buf.Len()
+	w.buf.WriteString("xref\n0 1\n0000000000 65535 f \n")
+	for i := 0; i < len(nums); {
+		j := i + 1
+		for j < len(nums) && nums[j] == nums[j-1]+1 {
+			j++
+		}
+		fmt.Fprintf(&w.buf, "%d %d\n", nums[i], j-i)
+		for _, num := range nums[i:j] {
+			fmt.Fprintf(&w.buf, "%010d 00000 n \n", w.offsets[num])
+		}
+		i = j
+	}
+	fmt.Fprintf(&w.buf, "trailer\n<< /Size %d %s >>\nstartxref\n%d\n%%%%EOF\n", w.next, entries, xref)
+	return w.buf.Bytes()
+}
+
+// TextString encodes s as a PDF text string (UTF-16BE with byte order mark).
+func TextString(s string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, u := range utf16.Encode([]rune(s)) {
+		fmt.Fprintf(&b, "%04X", u)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// Date formats t as a PDF date string, in UTC.
+func Date(t time.Time) string {
+	return "(D:" + t.UTC().Format("20060102150405") + "+00'00')"
+}
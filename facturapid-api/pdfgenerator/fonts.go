@@ -0,0 +1,68 @@
+package pdfgenerator
+
+import (
+	"embed"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// The layout fonts are TrueType files embedded in the binary and registered as UTF-8
+// fonts, so generation does not depend on the working directory and Spanish text
+// ("Descripción", "Nº", "€") is written as-is. gofpdf subsets them, so only the glyphs
+// actually used end up in each PDF. See fonts/LICENSE.
+
+//go:embed fonts/*.ttf
+var fontFS embed.FS
+
+const (
+	fontSans = "DejaVuSans"     // Default text font
+	fontMono = "DejaVuSansMono" // Fixed-width, for codes and aligned figures
+)
+
+// embeddedFonts maps each family to its files by style.
+var embeddedFonts = map[string]map[string]string{
+	fontSans: {
+		styleRegular:    "DejaVuSansCondensed.ttf",
+		styleBold:       "DejaVuSansCondensed-Bold.ttf",
+		styleItalic:     "DejaVuSansCondensed-Oblique.ttf",
+		styleBoldItalic: "DejaVuSansCondensed-BoldOblique.ttf",
+	},
+	fontMono: {
+		styleRegular: "DejaVuSansMono.ttf",
+		styleBold:    "DejaVuSansMono-Bold.ttf",
+	},
+}
+
+// checkFont reports whether family/style can be used in a layout.
+func checkFont(family, style string) error {
+	styles, ok := embeddedFonts[family]
+	if !ok {
+		families := make([]string, 0, len(embeddedFonts))
+		for name := range embeddedFonts {
+			families = append(families, name)
+		}
+		sort.Strings(families)
+		return fmt.Errorf("unknown font family %q (available: %s)", family, strings.Join(families, ", "))
+	}
+	if _, ok := styles[style]; !ok {
+		return fmt.Errorf("font family %q has no style %q", family, style)
+	}
+	return nil
+}
+
+// registerFonts makes the embedded fonts available to pdf. Failures are recorded in pdf.Error().
+func registerFonts(pdf *gofpdf.Fpdf) {
+	for family, styles := range embeddedFonts {
+		for style, file := range styles {
+			data, err := fontFS.ReadFile("fonts/" + file)
+			if err != nil {
+				pdf.SetError(fmt.Errorf("error reading embedded font %s: %w", file, err))
+				return
+			}
+			pdf.AddUTF8FontFromBytes(family, style, data)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package pdfgenerator
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestGenerateFromEmptyDir generates a PDF from a working directory with no font files
+// and checks that the Spanish characters come out as written.
+func TestGenerateFromEmptyDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	out, err := GenerateInvoicePDF(testInvoice(), testIssuer())
+	if err != nil {
+		t.Fatalf("GenerateInvoicePDF: %v", err)
+	}
+	text := extractText(t, out)
+	for _, want := range []string{"Peñalara", "Jesús Muñoz Ibáñez", "Descripción", "Menú del día", "Factura Nº:", "26.63 €"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("extracted text lacks %q:\n%s", want, text)
+		}
+	}
+}
+
+func TestCheckFont(t *testing.T) {
+	if err := checkFont(fontSans, styleBoldItalic); err != nil {
+		t.Errorf("checkFont(%s, BI): %v", fontSans, err)
+	}
+	if err := checkFont("Arial", styleRegular); err == nil {
+		t.Error("checkFont(Arial) succeeded, want an unknown family error")
+	}
+	if err := checkFont(fontMono, styleItalic); err == nil {
+		t.Errorf("checkFont(%s, I) succeeded, want a missing style error", fontMono)
+	}
+}
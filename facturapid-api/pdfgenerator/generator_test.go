@@ -0,0 +1,134 @@
+package pdfgenerator
+
+import (
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func strPtr(s string) *string { return &s }
+
+func decPtr(s string) *money.Decimal {
+	d := money.MustParse(s)
+	return &d
+}
+
+func testIssuer() dto.IssuerProfileDTO {
+	return dto.IssuerProfileDTO{
+		LegalName:    "Cafetería Peñalara S.L.",
+		TradeName:    strPtr("Café Peñalara"),
+		NIF:          "B12345678",
+		Address:      "Calle Mayor 1, 28013 Madrid",
+		RegistryData: strPtr("Inscrita en el Registro Mercantil de Madrid, Tomo 1, Folio 2, Hoja M-3"),
+	}
+}
+
+// testInvoice is a simplified invoice with two rates and a line at 0%.
+func testInvoice() dto.FullInvoiceDTO {
+	return dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: 1042, Serie: "A", Tarifa: "1",
+			Fecha: strPtr("2026-03-14"), Hora: strPtr("13:05:00"),
+			Cliente1: strPtr("Jesús Muñoz Ibáñez"), Cliente2: strPtr("Avenida de la Constitución 4, Sevilla"), Cliente3: strPtr("12345678Z"),
+			Base1: decPtr("12.40"), Iva1: decPtr("10"), CuotaIva1: decPtr("1.24"),
+			Base2: decPtr("8.26"), Iva2: decPtr("21"), CuotaIva2: decPtr("1.73"),
+			Base3: decPtr("3.00"), Iva3: decPtr("0"), CuotaIva3: decPtr("0"),
+			CuotaIVA: decPtr("2.97"), Total: money.MustParse("26.63"),
+			CausaExencion: strPtr("E1"),
+		},
+		Lines: []dto.InvoiceLineDTO{
+			{CodigoFactura: 1042, Linea: 1, Producto: "Café con leche", Unidades: money.MustParse("2"), Subtotal: money.MustParse("3.40"), IvaAplicado: decPtr("10")},
+			{CodigoFactura: 1042, Linea: 2, Producto: "Menú del día", Unidades: money.MustParse("1"), Subtotal: money.MustParse("9.00"), IvaAplicado: decPtr("10")},
+			{CodigoFactura: 1042, Linea: 3, Producto: "Vino Ribera (botella)", Unidades: money.MustParse("1"), Subtotal: money.MustParse("8.26"), IvaAplicado: decPtr("21")},
+			{CodigoFactura: 1042, Linea: 4, Producto: "Curso de cata", Unidades: money.MustParse("1"), Subtotal: money.MustParse("3.00"), IvaAplicado: decPtr("0")},
+		},
+	}
+}
+
+// testRectifyingInvoice rectifies testInvoice by differences, refunding the wine.
+func testRectifyingInvoice() dto.FullInvoiceDTO {
+	return dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: 7, Serie: "R", Tarifa: "1",
+			Fecha: strPtr("2026-03-20"), Hora: strPtr("10:00:00"),
+			Cliente1: strPtr("Jesús Muñoz Ibáñez"), Cliente3: strPtr("12345678Z"),
+			Base1: decPtr("-8.26"), Iva1: decPtr("21"), CuotaIva1: decPtr("-1.73"),
+			CuotaIVA: decPtr("-1.73"), Total: money.MustParse("-9.99"),
+		},
+		Lines: []dto.InvoiceLineDTO{
+			{CodigoFactura: 7, Linea: 1, Producto: "Devolución vino Ribera", Unidades: money.MustParse("-1"), Subtotal: money.MustParse("-8.26"), IvaAplicado: decPtr("21")},
+		},
+		Rectification: &dto.RectificationDTO{
+			Tipo: dto.RectificationR4, Metodo: dto.RectificationByDifferences,
+			Original: "A-1042", OriginalFecha: strPtr("2026-03-14"), Motivo: strPtr("Botella devuelta"),
+		},
+	}
+}
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("text of the PDF differs from %s (run go test -update if the change is intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestTemplatesGolden(t *testing.T) {
+	tests := []struct {
+		template string
+		invoice  dto.FullInvoiceDTO
+		golden   string
+	}{
+		{"a4", testInvoice(), "a4_invoice.txt"},
+		{"a4", testRectifyingInvoice(), "a4_rectifying.txt"},
+		{"ticket80", testInvoice(), "ticket80_invoice.txt"},
+		{"ticket80", testRectifyingInvoice(), "ticket80_rectifying.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			tmpl, err := LoadTemplate(tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := GenerateInvoicePDFWithTemplate(tt.invoice, testIssuer(), tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkGolden(t, tt.golden, extractText(t, out))
+		})
+	}
+}
+
+func TestTicketPageFitsContent(t *testing.T) {
+	tmpl, err := LoadTemplate("ticket80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	short, err := GenerateInvoicePDFWithTemplate(testRectifyingInvoice(), testIssuer(), tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long, err := GenerateInvoicePDFWithTemplate(testInvoice(), testIssuer(), tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1, h2 := mediaBoxHeight(t, short), mediaBoxHeight(t, long); h1 >= h2 || h2 >= maxAutoPageHeight*72/25.4 {
+		t.Errorf("ticket heights: %v for 1 line, %v for 4 lines", h1, h2)
+	}
+}
@@ -0,0 +1,117 @@
+package pdfgenerator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// PDF/A requires an output intent whenever device colours (our RGB fills and text) are
+// used. srgbProfile builds the ICC profile for it: a version 2 matrix/TRC display
+// profile with the sRGB primaries (adapted to D50) and tone curve. Building it here
+// keeps a binary blob of unclear origin out of the tree.
+
+var srgbProfile = buildSRGBProfile()
+
+// s15Fixed16 encodes v as an ICC signed 15.16 fixed-point number.
+func s15Fixed16(v float64) uint32 {
+	return uint32(int32(math.Round(v * 65536)))
+}
+
+func iccXYZ(x, y, z float64) []byte {
+	var b bytes.Buffer
+	b.WriteString("XYZ \x00\x00\x00\x00")
+	for _, v := range []float64{x, y, z} {
+		binary.Write(&b, binary.BigEndian, s15Fixed16(v))
+	}
+	return b.Bytes()
+}
+
+func iccText(s string) []byte {
+	return append([]byte("text\x00\x00\x00\x00"+s), 0)
+}
+
+func iccDescription(s string) []byte {
+	var b bytes.Buffer
+	b.WriteString("desc\x00\x00\x00\x00")
+	binary.Write(&b, binary.BigEndian, uint32(len(s)+1))
+	b.WriteString(s)
+	b.WriteByte(0)
+	b.Write(make([]byte, 4+4+2+1+67)) // No Unicode or ScriptCode descriptions
+	return b.Bytes()
+}
+
+// iccSRGBCurve samples the sRGB transfer function.
+func iccSRGBCurve() []byte {
+	const points = 1024
+	var b bytes.Buffer
+	b.WriteString("curv\x00\x00\x00\x00")
+	binary.Write(&b, binary.BigEndian, uint32(points))
+	for i := 0; i < points; i++ {
+		v := float64(i) / (points - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		binary.Write(&b, binary.BigEndian, uint16(math.Round(v*65535)))
+	}
+	return b.Bytes()
+}
+
+func buildSRGBProfile() []byte {
+	curve := iccSRGBCurve()
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", iccDescription("sRGB IEC61966-2.1")},
+		{"cprt", iccText("No copyright, use freely")},
+		{"wtpt", iccXYZ(0.9642, 1.0, 0.8249)},
+		{"rXYZ", iccXYZ(0.4360747, 0.2225045, 0.0139322)},
+		{"gXYZ", iccXYZ(0.3850649, 0.7168786, 0.0971045)},
+		{"bXYZ", iccXYZ(0.1430804, 0.0606169, 0.7141733)},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// Tag data follows the header (128 bytes) and the tag table, 4-byte aligned.
+	// The three TRC tags share one copy of the curve.
+	var table, data bytes.Buffer
+	offset := 128 + 4 + 12*len(tags)
+	shared := map[*byte]uint32{}
+	binary.Write(&table, binary.BigEndian, uint32(len(tags)))
+	for _, t := range tags {
+		at, ok := shared[&t.data[0]]
+		if !ok {
+			at = uint32(offset + data.Len())
+			shared[&t.data[0]] = at
+			data.Write(t.data)
+			for data.Len()%4 != 0 {
+				data.WriteByte(0)
+			}
+		}
+		table.WriteString(t.sig)
+		binary.Write(&table, binary.BigEndian, at)
+		binary.Write(&table, binary.BigEndian, uint32(len(t.data)))
+	}
+
+	size := offset + data.Len()
+	var h bytes.Buffer
+	binary.Write(&h, binary.BigEndian, uint32(size))
+	h.WriteString("\x00\x00\x00\x00")                      // Preferred CMM
+	binary.Write(&h, binary.BigEndian, uint32(0x02100000)) // Version 2.1
+	h.WriteString("mntrRGB XYZ ")                          // Display class, RGB data, XYZ connection space
+	for _, v := range []uint16{2024, 1, 1, 0, 0, 0} {      // Creation date
+		binary.Write(&h, binary.BigEndian, v)
+	}
+	h.WriteString("acsp")
+	h.Write(make([]byte, 4+4+4+4+8))                   // Platform, flags, manufacturer, model, attributes
+	binary.Write(&h, binary.BigEndian, uint32(0))      // Perceptual rendering intent
+	for _, v := range []float64{0.9642, 1.0, 0.8249} { // D50 illuminant
+		binary.Write(&h, binary.BigEndian, s15Fixed16(v))
+	}
+	h.Write(make([]byte, 4+44)) // Creator, reserved
+	return append(append(h.Bytes(), table.Bytes()...), data.Bytes()...)
+}
@@ -0,0 +1,144 @@
+package pdfgenerator
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"facturapid-api/pdffile"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PDF/A-3b conversion.
+//
+// gofpdf writes plain PDF 1.3: it has no output intent, does not reference XMP metadata
+// from the catalog, omits the trailer ID and the binary header comment, and its file
+// attachments lack the associated-file keys PDF/A-3 needs. Rather than fork it, the
+// finished document is rewritten with package pdffile: every object is copied as-is
+// except the catalog and the Info dictionary, the PDF/A objects are appended, and a
+// fresh cross-reference table is built.
+
+// pdfaInfo is the document information, written both to the Info dictionary and to the
+// XMP metadata; PDF/A requires the two to agree.
+type pdfaInfo struct {
+	Title    string
+	Author   string
+	Subject  string
+	Creator  string
+	Producer string
+	Date     time.Time
+}
+
+// pdfaFile is an associated file embedded in the document.
+type pdfaFile struct {
+	Name         string
+	MimeType     string
+	Description  string
+	Relationship string // AFRelationship: Data, Source, Alternative, Supplement...
+	Data         []byte
+	ModDate      time.Time
+}
+
+const srgbConditionID = "sRGB IEC61966-2.1"
+
+var catalogPagesRe = regexp.MustCompile(`/Pages (\d+) 0 R`)
+
+func xmpDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05+00:00")
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmpMetadata returns the XMP packet identifying the file as PDF/A-3b, mirroring info.
+func xmpMetadata(info pdfaInfo) []byte {
+	var b strings.Builder
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about="" xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/">
+<pdfaid:part>3</pdfaid:part>
+<pdfaid:conformance>B</pdfaid:conformance>
+</rdf:Description>
+<rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<dc:format>application/pdf</dc:format>
+`)
+	fmt.Fprintf(&b, "<dc:title><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:title>\n", xmlEscape(info.Title))
+	fmt.Fprintf(&b, "<dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", xmlEscape(info.Author))
+	fmt.Fprintf(&b, "<dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", xmlEscape(info.Subject))
+	b.WriteString("</rdf:Description>\n")
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/">` + "\n")
+	fmt.Fprintf(&b, "<xmp:CreatorTool>%s</xmp:CreatorTool>\n", xmlEscape(info.Creator))
+	fmt.Fprintf(&b, "<xmp:CreateDate>%s</xmp:CreateDate>\n", xmpDate(info.Date))
+	fmt.Fprintf(&b, "<xmp:ModifyDate>%s</xmp:ModifyDate>\n", xmpDate(info.Date))
+	fmt.Fprintf(&b, "<xmp:MetadataDate>%s</xmp:MetadataDate>\n", xmpDate(info.Date))
+	b.WriteString("</rdf:Description>\n")
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:pdf="http://ns.adobe.com/pdf/1.3/">` + "\n")
+	fmt.Fprintf(&b, "<pdf:Producer>%s</pdf:Producer>\n", xmlEscape(info.Producer))
+	b.WriteString("</rdf:Description>\n</rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
+
+// convertToPDFA3 rewrites a gofpdf document as PDF/A-3b with files attached as
+// associated files of the document.
+func convertToPDFA3(raw []byte, info pdfaInfo, files []pdfaFile) ([]byte, error) {
+	p, err := pdffile.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error reading generated PDF: %w", err)
+	}
+	pages := catalogPagesRe.FindSubmatch(p.Objects[p.Root])
+	if pages == nil {
+		return nil, fmt.Errorf("error reading generated PDF: catalog has no /Pages")
+	}
+
+	// The comment of high-bit bytes after the header marks the file as binary (PDF/A 6.1.2).
+	w := pdffile.NewWriter([]byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), p.Size)
+	for num := 1; num < p.Size; num++ {
+		if num != p.Root && num != p.Info {
+			w.Raw(num, p.Objects[num])
+		}
+	}
+
+	metadata := w.Alloc()
+	w.Stream(metadata, "/Type /Metadata /Subtype /XML", xmpMetadata(info), false)
+
+	profile := w.Alloc()
+	w.Stream(profile, "/N 3", srgbProfile, true)
+	intent := w.Alloc()
+	w.Object(intent, fmt.Sprintf("<< /Type /OutputIntent /S /GTS_PDFA1 /OutputConditionIdentifier (%s) /Info (%s) /DestOutputProfile %d 0 R >>",
+		srgbConditionID, srgbConditionID, profile))
+
+	var af, names []string
+	for _, f := range files {
+		data := w.Alloc()
+		w.Stream(data, fmt.Sprintf("/Type /EmbeddedFile /Subtype /%s /Params << /Size %d /ModDate %s /CheckSum <%x> >>",
+			strings.ReplaceAll(f.MimeType, "/", "#2F"), len(f.Data), pdffile.Date(f.ModDate), md5.Sum(f.Data)), f.Data, true)
+		spec := w.Alloc()
+		w.Object(spec, fmt.Sprintf("<< /Type /Filespec /F %s /UF %s /Desc %s /AFRelationship /%s /EF << /F %d 0 R /UF %d 0 R >> >>",
+			pdffile.TextString(f.Name), pdffile.TextString(f.Name), pdffile.TextString(f.Description), f.Relationship, data, data))
+		af = append(af, fmt.Sprintf("%d 0 R", spec))
+		names = append(names, fmt.Sprintf("%s %d 0 R", pdffile.TextString(f.Name), spec))
+	}
+
+	w.Object(p.Info, fmt.Sprintf("<< /Title %s /Author %s /Subject %s /Creator %s /Producer %s /CreationDate %s /ModDate %s >>",
+		pdffile.TextString(info.Title), pdffile.TextString(info.Author), pdffile.TextString(info.Subject), pdffile.TextString(info.Creator), pdffile.TextString(info.Producer),
+		pdffile.Date(info.Date), pdffile.Date(info.Date)))
+
+	catalog := fmt.Sprintf("<< /Type /Catalog /Pages %s 0 R /Metadata %d 0 R /OutputIntents [%d 0 R]", pages[1], metadata, intent)
+	if len(files) > 0 {
+		// Names must be sorted in a name tree; UTF-16 order matches for the names we use.
+		sort.Strings(names)
+		catalog += fmt.Sprintf(" /AF [%s] /Names << /EmbeddedFiles << /Names [%s] >> >> /PageMode /UseAttachments",
+			strings.Join(af, " "), strings.Join(names, " "))
+	}
+	w.Object(p.Root, catalog+" >>")
+
+	id := md5.Sum(w.Bytes())
+	return w.Finish(fmt.Sprintf("/Root %d 0 R /Info %d 0 R /ID [<%x> <%x>]", p.Root, p.Info, id, id)), nil
+}
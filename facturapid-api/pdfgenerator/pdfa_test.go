@@ -0,0 +1,207 @@
+package pdfgenerator
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/xml"
+	"facturapid-api/pdffile"
+	"facturapid-api/ubl"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// refIn returns the object number of the indirect reference under key in dict.
+func refIn(t *testing.T, dict, key string) int {
+	t.Helper()
+	m := regexp.MustCompile(regexp.QuoteMeta(key) + ` (\d+) 0 R`).FindStringSubmatch(dict)
+	if m == nil {
+		t.Fatalf("%s not found in << %s >>", key, dict)
+	}
+	var num int
+	fmt.Sscan(m[1], &num)
+	return num
+}
+
+// streamDict returns the dictionary of stream object num.
+func streamDict(t *testing.T, p *pdffile.File, num int) string {
+	t.Helper()
+	obj := string(p.Objects[num])
+	at := strings.Index(obj, "stream")
+	if at < 0 {
+		t.Fatalf("object %d is not a stream", num)
+	}
+	return obj[:at]
+}
+
+// TestPDFAStructure checks the parts of PDF/A-3b that the conversion writes: the
+// header, the trailer ID, the XMP metadata and its agreement with the Info dictionary,
+// the sRGB output intent, the embedded fonts and the UBL invoice as associated file.
+func TestPDFAStructure(t *testing.T) {
+	invoice, issuer := testInvoice(), testIssuer()
+	out, err := GenerateInvoicePDF(invoice, issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out, []byte("%PDF-1.7\n%")) || out[10] < 128 {
+		t.Errorf("header %q lacks the binary comment", out[:16])
+	}
+	p, err := pdffile.Parse(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.ID) != 32 {
+		t.Errorf("trailer /ID = %q, want an MD5 digest", p.ID)
+	}
+	catalog, err := p.Dict(p.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("metadata", func(t *testing.T) {
+		num := refIn(t, catalog, "/Metadata")
+		if d := streamDict(t, p, num); !strings.Contains(d, "/Subtype /XML") || strings.Contains(d, "/Filter") {
+			t.Errorf("metadata stream << %s >> must be uncompressed XML", d)
+		}
+		var meta struct {
+			Descriptions []struct {
+				Part        string `xml:"part"`
+				Conformance string `xml:"conformance"`
+				Title       string `xml:"title>Alt>li"`
+				Creator     string `xml:"creator>Seq>li"`
+				CreatorTool string `xml:"CreatorTool"`
+				Producer    string `xml:"Producer"`
+			} `xml:"RDF>Description"`
+		}
+		data := streamData(t, p, num)
+		if err := xml.Unmarshal(data, &meta); err != nil {
+			t.Fatalf("XMP packet is not XML: %v", err)
+		}
+		got := map[string]string{}
+		for _, d := range meta.Descriptions {
+			for k, v := range map[string]string{"part": d.Part, "conformance": d.Conformance, "title": d.Title,
+				"creator": d.Creator, "tool": d.CreatorTool, "producer": d.Producer} {
+				if v != "" {
+					got[k] = v
+				}
+			}
+		}
+		want := map[string]string{"part": "3", "conformance": "B", "title": "Factura A-1042",
+			"creator": issuer.LegalName, "tool": pdfCreator, "producer": pdfProducer}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("XMP %s = %q, want %q", k, got[k], v)
+			}
+		}
+
+		info, err := p.Dict(p.Info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, v := range map[string]string{"/Title": want["title"], "/Author": want["creator"], "/Creator": pdfCreator, "/Producer": pdfProducer} {
+			if !strings.Contains(info, key+" "+pdffile.TextString(v)) {
+				t.Errorf("Info %s does not match the XMP metadata %q", key, v)
+			}
+		}
+	})
+
+	t.Run("output intent", func(t *testing.T) {
+		intents := regexp.MustCompile(`/OutputIntents \[(\d+) 0 R\]`).FindStringSubmatch(catalog)
+		if intents == nil {
+			t.Fatalf("catalog << %s >> has no single output intent", catalog)
+		}
+		var num int
+		fmt.Sscan(intents[1], &num)
+		intent, err := p.Dict(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(intent, "/S /GTS_PDFA1") || !strings.Contains(intent, "/OutputConditionIdentifier ("+srgbConditionID+")") {
+			t.Errorf("output intent << %s >> is not the sRGB PDF/A one", intent)
+		}
+		profile := refIn(t, intent, "/DestOutputProfile")
+		if d := streamDict(t, p, profile); !strings.Contains(d, "/N 3") {
+			t.Errorf("ICC profile stream << %s >> lacks /N 3", d)
+		}
+		icc := streamData(t, p, profile)
+		if len(icc) < 128 || string(icc[16:20]) != "RGB " || string(icc[36:40]) != "acsp" || int(icc[0])<<24|int(icc[1])<<16|int(icc[2])<<8|int(icc[3]) != len(icc) {
+			t.Error("DestOutputProfile is not a well-formed RGB ICC profile")
+		}
+	})
+
+	t.Run("fonts", func(t *testing.T) {
+		descriptors := 0
+		for num, obj := range p.Objects {
+			if bytes.Contains(obj, []byte("/Type /FontDescriptor")) {
+				descriptors++
+				if !bytes.Contains(obj, []byte("/FontFile2")) {
+					t.Errorf("font descriptor %d does not embed its font", num)
+				}
+			}
+		}
+		if descriptors == 0 {
+			t.Error("no font descriptors found")
+		}
+	})
+
+	t.Run("associated file", func(t *testing.T) {
+		af := regexp.MustCompile(`/AF \[(\d+) 0 R\]`).FindStringSubmatch(catalog)
+		if af == nil {
+			t.Fatalf("catalog << %s >> has no single associated file", catalog)
+		}
+		var num int
+		fmt.Sscan(af[1], &num)
+		if !strings.Contains(catalog, fmt.Sprintf("/EmbeddedFiles << /Names [%s %d 0 R] >>", pdffile.TextString("factura-A-1042.xml"), num)) {
+			t.Errorf("the associated file is not in the EmbeddedFiles name tree: << %s >>", catalog)
+		}
+		spec, err := p.Dict(num)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{"/Type /Filespec", "/AFRelationship /Data", "/UF " + pdffile.TextString("factura-A-1042.xml")} {
+			if !strings.Contains(spec, want) {
+				t.Errorf("file specification << %s >> lacks %s", spec, want)
+			}
+		}
+		file := refIn(t, spec, "/EF << /F")
+		data := streamData(t, p, file)
+		xmlData, err := ubl.BuildInvoice(invoice, issuer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, xmlData) {
+			t.Error("embedded file is not the UBL invoice")
+		}
+		d := streamDict(t, p, file)
+		for _, want := range []string{"/Type /EmbeddedFile", "/Subtype /text#2Fxml", fmt.Sprintf("/Size %d", len(data)), fmt.Sprintf("/CheckSum <%x>", md5.Sum(data)), "/ModDate (D:"} {
+			if !strings.Contains(d, want) {
+				t.Errorf("embedded file stream << %s >> lacks %s", d, want)
+			}
+		}
+	})
+}
+
+// TestPDFAVeraPDF validates the output with veraPDF, the reference PDF/A validator,
+// where it is on the PATH; the structural checks above run everywhere.
+func TestPDFAVeraPDF(t *testing.T) {
+	verapdf, err := exec.LookPath("verapdf")
+	if err != nil {
+		t.Skip("verapdf not installed")
+	}
+	out, err := GenerateInvoicePDF(testInvoice(), testIssuer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "factura.pdf")
+	if err := os.WriteFile(path, out, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := exec.Command(verapdf, "--flavour", "3b", "--format", "text", path).CombinedOutput()
+	if err != nil || !bytes.HasPrefix(bytes.TrimSpace(report), []byte("PASS")) {
+		t.Errorf("veraPDF rejected the PDF (%v):\n%s", err, report)
+	}
+}
@@ -0,0 +1,207 @@
+package pdfgenerator
+
+import (
+	"bytes"
+	"compress/zlib"
+	"facturapid-api/pdffile"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// Text extraction for the tests. It reads what gofpdf writes with the embedded UTF-8
+// fonts: Type0 fonts with Identity-H encoding whose character codes are the UTF-16BE
+// code units of the text, shown with Tj and TJ inside BT ... ET.
+
+var (
+	pagesRe    = regexp.MustCompile(`/Pages (\d+) 0 R`)
+	kidsRe     = regexp.MustCompile(`/Kids \[([^\]]*)\]`)
+	contentsRe = regexp.MustCompile(`/Contents (\d+) 0 R`)
+	mediaBoxRe = regexp.MustCompile(`/MediaBox \[0 0 ([\d.]+) ([\d.]+)\]`)
+)
+
+// streamData returns the decoded data of stream object num.
+func streamData(t *testing.T, p *pdffile.File, num int) []byte {
+	t.Helper()
+	obj := p.Objects[num]
+	start := bytes.Index(obj, []byte("stream"))
+	end := bytes.LastIndex(obj, []byte("endstream"))
+	if start < 0 || end < start {
+		t.Fatalf("object %d is not a stream", num)
+	}
+	data := obj[start+len("stream") : end]
+	data = bytes.TrimPrefix(bytes.TrimPrefix(data, []byte("\r")), []byte("\n"))
+	data = bytes.TrimSuffix(bytes.TrimSuffix(data, []byte("\n")), []byte("\r"))
+	if !bytes.Contains(obj[:start], []byte("/FlateDecode")) {
+		return data
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("object %d: %v", num, err)
+	}
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("object %d: %v", num, err)
+	}
+	return out
+}
+
+// mediaBoxHeight returns the height, in points, of the first page of a PDF.
+func mediaBoxHeight(t *testing.T, doc []byte) float64 {
+	t.Helper()
+	m := mediaBoxRe.FindSubmatch(doc)
+	if m == nil {
+		t.Fatal("PDF has no /MediaBox")
+	}
+	var h float64
+	fmt.Sscan(string(m[2]), &h)
+	return h
+}
+
+// extractText returns the text of every page of a PDF, a line per row of text: the
+// runs shown at the same height are joined with " | ". Pages are separated by a line
+// with a form feed.
+func extractText(t *testing.T, doc []byte) string {
+	t.Helper()
+	p, err := pdffile.Parse(doc)
+	if err != nil {
+		t.Fatalf("error parsing PDF: %v", err)
+	}
+	m := pagesRe.FindSubmatch(p.Objects[p.Root])
+	if m == nil {
+		t.Fatal("catalog has no /Pages")
+	}
+	var pagesNum int
+	fmt.Sscan(string(m[1]), &pagesNum)
+	kids := kidsRe.FindSubmatch(p.Objects[pagesNum])
+	if kids == nil {
+		t.Fatal("page tree has no /Kids")
+	}
+
+	var pages []string
+	for _, page := range pdffile.Refs(string(kids[1])) {
+		c := contentsRe.FindSubmatch(p.Objects[page])
+		if c == nil {
+			t.Fatalf("page %d has no /Contents", page)
+		}
+		var contents int
+		fmt.Sscan(string(c[1]), &contents)
+		pages = append(pages, contentText(streamData(t, p, contents)))
+	}
+	return strings.Join(pages, "\f\n")
+}
+
+// contentText returns the text shown by a content stream.
+func contentText(data []byte) string {
+	var lines []string
+	var line, run strings.Builder
+	var operands []string
+	lastY, y := "", ""
+	for i := 0; i < len(data); {
+		switch c := data[i]; {
+		case c == '(':
+			s, n := literalString(data[i:])
+			run.WriteString(s)
+			i += n
+		case c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '[' || c == ']':
+			i++
+		default:
+			j := i
+			for j < len(data) && !strings.ContainsRune(" \n\r\t[]()", rune(data[j])) {
+				j++
+			}
+			tok := string(data[i:j])
+			i = j
+			switch tok {
+			case "Td":
+				if len(operands) >= 2 {
+					y = operands[len(operands)-1]
+				}
+			case "ET":
+				if run.Len() > 0 {
+					if y != lastY && line.Len() > 0 {
+						lines = append(lines, line.String())
+						line.Reset()
+					}
+					if line.Len() > 0 {
+						line.WriteString(" | ")
+					}
+					line.WriteString(strings.TrimSpace(run.String()))
+					lastY = y
+				}
+				run.Reset()
+			}
+			operands = append(operands, tok)
+		}
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// literalString decodes the PDF string literal at the start of data, whose bytes are
+// UTF-16BE, and returns it with the number of bytes it takes.
+func literalString(data []byte) (string, int) {
+	var raw []byte
+	depth := 0
+	i := 0
+	for ; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '\\' && i+1 < len(data):
+			i++
+			switch e := data[i]; e {
+			case 'n':
+				raw = append(raw, '\n')
+			case 'r':
+				raw = append(raw, '\r')
+			case 't':
+				raw = append(raw, '\t')
+			case 'b':
+				raw = append(raw, '\b')
+			case 'f':
+				raw = append(raw, '\f')
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(data) && data[i] >= '0' && data[i] <= '7'; k++ {
+						v = v*8 + int(data[i]-'0')
+						i++
+					}
+					i--
+					raw = append(raw, byte(v))
+				} else {
+					raw = append(raw, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				raw = append(raw, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return decodeUTF16BE(raw), i + 1
+			}
+			raw = append(raw, c)
+		default:
+			raw = append(raw, c)
+		}
+	}
+	return decodeUTF16BE(raw), i
+}
+
+func decodeUTF16BE(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
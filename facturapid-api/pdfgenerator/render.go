@@ -0,0 +1,564 @@
+package pdfgenerator
+
+import (
+	"bytes"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// templateData is the value the text templates of a layout are executed against.
+type templateData struct {
+	Invoice dto.FullInvoiceDTO
+	Header  dto.InvoiceHeaderDTO
+	Issuer  dto.IssuerProfileDTO
+	// Signature is set only when the PDF is going to be signed.
+	Signature *signatureData
+	// Rectification is set only for rectifying invoices.
+	Rectification *rectificationData
+}
+
+// rectificationData is what a layout can show about the invoice a rectifying invoice
+// rectifies, as article 15 of the Reglamento de facturación requires.
+type rectificationData struct {
+	Number       string // Of the rectifying invoice itself ("RA-12")
+	Type         string // R1..R5
+	Ground       string // Legal ground of the type
+	Method       string // "por sustitución" or "por diferencias"
+	Original     string // Number of the rectified invoice
+	OriginalDate string
+	Reason       string
+	// RectifiedBase and RectifiedQuota are the rectified invoice's figures, only
+	// set for substitutions ("" otherwise).
+	RectifiedBase, RectifiedQuota string
+}
+
+// signatureData is what a signature block can show about the signature.
+type signatureData struct {
+	Signer string // Certificate holder
+	Date   string
+}
+
+// stampArea is where the signature block was drawn, in mm from the top-left corner.
+type stampArea struct {
+	page       int
+	x, y, w, h float64
+}
+
+// templateFuncs are available in every text template.
+var templateFuncs = template.FuncMap{
+	// str dereferences an optional string field ("" when nil).
+	"str": getString,
+	// amount formats a money.Decimal (or *money.Decimal) with two decimals.
+	"amount": func(v interface{}) string {
+		switch d := v.(type) {
+		case money.Decimal:
+			return d.StringFixed(2)
+		case *money.Decimal:
+			return getDecimal(d).StringFixed(2)
+		}
+		return ""
+	},
+}
+
+// taxTotals are the figures a totals block can show.
+type taxTotals struct {
+	groups                             []dto.VATGroup
+	base, quota, surcharge, grandTotal money.Decimal
+	hasSurcharge, hasExempt            bool
+}
+
+func computeTaxTotals(header dto.InvoiceHeaderDTO) taxTotals {
+	t := taxTotals{groups: header.VATGroups(), grandTotal: header.Total}
+	for _, g := range t.groups {
+		if !g.SurchargeQuota.IsZero() || !g.SurchargeRate.IsZero() {
+			t.hasSurcharge = true
+		}
+		if g.Exempt() {
+			t.hasExempt = true
+		}
+		t.base = t.base.Add(g.Base)
+		t.quota = t.quota.Add(g.Quota)
+		t.surcharge = t.surcharge.Add(g.SurchargeQuota)
+	}
+	return t
+}
+
+// renderer draws a layout template for one invoice.
+type renderer struct {
+	pdf    *gofpdf.Fpdf
+	tmpl   *Template
+	data   templateData
+	colors palette
+	totals taxTotals
+	// sameLineTop/sameLineBottom remember the extent of a same_line block, so the next
+	// block starts beside it and the flow resumes below the taller of the two.
+	sameLineTop, sameLineBottom float64
+	pendingSameLine             bool
+	// stamp is set once a signature block has been drawn.
+	stamp *stampArea
+}
+
+// render draws every block on a single page of the given height.
+func (r *renderer) render(pageHeight float64) error {
+	t := r.tmpl
+	r.pdf = gofpdf.NewCustom(&gofpdf.InitType{
+		OrientationStr: t.Page.Orientation,
+		UnitStr:        "mm",
+		Size:           gofpdf.SizeType{Wd: t.Page.Width, Ht: pageHeight},
+	})
+	r.pdf.SetMargins(t.Page.Margins.Left, t.Page.Margins.Top, t.Page.Margins.Right)
+	r.pdf.SetAutoPageBreak(t.Page.Height > 0, t.Page.Margins.Bottom)
+	registerFonts(r.pdf)
+	if err := r.pdf.Error(); err != nil {
+		return fmt.Errorf("error setting up fonts: %w", err)
+	}
+	r.pdf.AddPage()
+
+	for _, b := range t.Blocks {
+		r.renderBlock(b)
+	}
+	return r.pdf.Error()
+}
+
+func (r *renderer) contentWidth() float64 {
+	return r.tmpl.Page.Width - r.tmpl.Page.Margins.Left - r.tmpl.Page.Margins.Right
+}
+
+func (r *renderer) setFont(f FontSpec) {
+	family, size, style := r.tmpl.Font.Family, r.tmpl.Font.Size, f.Style
+	if f.Family != "" {
+		family = f.Family
+	}
+	if f.Size > 0 {
+		size = f.Size
+	}
+	r.pdf.SetFont(family, style, size)
+}
+
+func (r *renderer) setTextColor(b BlockSpec) {
+	c := rgb{0, 0, 0}
+	if b.Color == "primary" {
+		c = r.colors.primary
+	} else if b.TextColor != "" {
+		c = parseHexColor(&b.TextColor, c)
+	}
+	r.pdf.SetTextColor(c.r, c.g, c.b)
+}
+
+func (r *renderer) lineHeight(b BlockSpec) float64 {
+	if b.LineHeight > 0 {
+		return b.LineHeight
+	}
+	return r.tmpl.LineHeight
+}
+
+// blockX returns the left edge of a block of width w.
+func (r *renderer) blockX(b BlockSpec, w float64) float64 {
+	if b.X != nil {
+		return *b.X
+	}
+	left := r.tmpl.Page.Margins.Left
+	switch b.Align {
+	case "R":
+		return left + r.contentWidth() - w
+	case "C":
+		return left + (r.contentWidth()-w)/2
+	}
+	return left
+}
+
+func (r *renderer) blockWidth(b BlockSpec) float64 {
+	if b.Width > 0 {
+		return b.Width
+	}
+	if b.X != nil {
+		return r.tmpl.Page.Width - r.tmpl.Page.Margins.Right - *b.X
+	}
+	return r.contentWidth()
+}
+
+func border(b BlockSpec, fallback string) string {
+	switch b.Border {
+	case "":
+		return fallback
+	case "none":
+		return ""
+	}
+	return b.Border
+}
+
+// execute runs a compiled text template; errors are recorded on the PDF.
+func (r *renderer) execute(tmpl *template.Template) string {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, r.data); err != nil {
+		r.pdf.SetError(fmt.Errorf("layout template %q: %w", r.tmpl.Name, err))
+		return ""
+	}
+	return strings.TrimSpace(buf.String())
+}
+
+func (r *renderer) renderBlock(b BlockSpec) {
+	if b.Type == blockRectification && r.data.Rectification == nil {
+		return // Not even its spacing: ordinary invoices keep their layout
+	}
+	pdf := r.pdf
+	startY := pdf.GetY()
+	if r.pendingSameLine {
+		// Start beside the previous block.
+		startY = r.sameLineTop
+		pdf.SetY(startY)
+	}
+	if b.Y != nil {
+		pdf.SetY(*b.Y)
+	} else if b.SpaceBefore > 0 {
+		pdf.Ln(b.SpaceBefore)
+	}
+	r.setFont(b.Font)
+	r.setTextColor(b)
+
+	switch b.Type {
+	case blockText:
+		r.renderText(b)
+	case blockRectification:
+		r.renderWrappedText(b)
+	case blockFooter:
+		// The footer sits inside the bottom margin; it must not trigger a page break.
+		auto, margin := pdf.GetAutoPageBreak()
+		pdf.SetAutoPageBreak(false, margin)
+		r.renderText(b)
+		pdf.SetAutoPageBreak(auto, margin)
+	case blockKeyValues:
+		r.renderKeyValues(b)
+	case blockLogo:
+		r.renderLogo(b)
+	case blockLinesTable:
+		r.renderLinesTable(b)
+	case blockTaxSummary:
+		r.renderTaxSummary(b)
+	case blockTotals:
+		r.renderTotals(b)
+	case blockExemptionNote:
+		if r.totals.hasExempt {
+			pdf.SetX(r.blockX(b, r.blockWidth(b)))
+			pdf.MultiCell(r.blockWidth(b), r.lineHeight(b), exemptionText(r.data.Header), "", "L", false)
+		}
+	case blockSpacer:
+		pdf.Ln(b.Height)
+	case blockSignature:
+		if r.data.Signature != nil {
+			r.renderSignature(b)
+		}
+	}
+	pdf.SetTextColor(0, 0, 0)
+	if b.SpaceAfter > 0 {
+		pdf.Ln(b.SpaceAfter)
+	}
+	endY := pdf.GetY()
+
+	switch {
+	case b.Y != nil && b.Type != blockFooter:
+		// Absolutely positioned blocks do not move the flow.
+		pdf.SetY(startY)
+	case b.SameLine:
+		r.pendingSameLine, r.sameLineTop, r.sameLineBottom = true, startY, endY
+	case r.pendingSameLine:
+		r.pendingSameLine = false
+		if r.sameLineBottom > endY {
+			pdf.SetY(r.sameLineBottom)
+		}
+	}
+}
+
+func (r *renderer) renderText(b BlockSpec) {
+	w := r.blockWidth(b)
+	x := r.blockX(b, w)
+	align := b.Align
+	if align == "" {
+		align = "L"
+	}
+	var lines []string
+	for _, tmpl := range b.compiled {
+		line := r.execute(tmpl)
+		if line == "" && b.SkipEmpty {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	for i, line := range lines {
+		cellBorder := ""
+		if i == 0 {
+			cellBorder = border(b, "")
+		}
+		r.pdf.SetX(x)
+		r.pdf.CellFormat(w, r.lineHeight(b), line, cellBorder, 1, align, false, 0, "")
+	}
+}
+
+// renderWrappedText is renderText for free-form content (a rectification reason can be
+// long): lines wider than the block wrap instead of overflowing it.
+func (r *renderer) renderWrappedText(b BlockSpec) {
+	w := r.blockWidth(b)
+	x := r.blockX(b, w)
+	align := b.Align
+	if align == "" {
+		align = "L"
+	}
+	top := r.pdf.GetY()
+	for _, tmpl := range b.compiled {
+		line := r.execute(tmpl)
+		if line == "" && b.SkipEmpty {
+			continue
+		}
+		r.pdf.SetX(x)
+		r.pdf.MultiCell(w, r.lineHeight(b), line, "", align, false)
+	}
+	if border(b, "") != "" {
+		r.pdf.Rect(x, top, w, r.pdf.GetY()-top, "D")
+	}
+}
+
+// renderSignature draws the visible part of the signature: its lines in a frame. The
+// signature field is later placed over the same area.
+func (r *renderer) renderSignature(b BlockSpec) {
+	w := r.blockWidth(b)
+	x := r.blockX(b, w)
+	top := r.pdf.GetY()
+	inner := b
+	inner.Border = "none" // The frame goes around all the lines, not the first one
+	r.renderText(inner)
+	h := r.pdf.GetY() - top
+	if border(b, "1") != "" {
+		r.pdf.Rect(x, top, w, h, "D")
+	}
+	r.stamp = &stampArea{page: r.pdf.PageNo(), x: x, y: top, w: w, h: h}
+}
+
+func (r *renderer) renderKeyValues(b BlockSpec) {
+	w := r.blockWidth(b)
+	x := r.blockX(b, w)
+	labelWidth := b.LabelWidth
+	if labelWidth <= 0 {
+		labelWidth = w / 2
+	}
+	for i, item := range b.Items {
+		value := r.execute(b.compiled[i])
+		if value == "" && b.SkipEmpty {
+			continue
+		}
+		r.pdf.SetX(x)
+		r.setFont(FontSpec{Family: b.Font.Family, Size: b.Font.Size, Style: styleBold})
+		r.pdf.CellFormat(labelWidth, r.lineHeight(b), item.Label, "", 0, "L", false, 0, "")
+		r.setFont(b.Font)
+		r.pdf.CellFormat(w-labelWidth, r.lineHeight(b), value, "", 1, "R", false, 0, "")
+	}
+}
+
+func (r *renderer) renderLogo(b BlockSpec) {
+	issuer := r.data.Issuer
+	if len(issuer.Logo) == 0 {
+		return
+	}
+	opts := gofpdf.ImageOptions{ImageType: getString(issuer.LogoType), ReadDpi: true}
+	info := r.pdf.RegisterImageOptionsReader("issuer_logo", opts, bytes.NewReader(issuer.Logo))
+	if info == nil || info.Width() == 0 {
+		return // The error, if any, is reported by pdf.Error()
+	}
+	w := b.Width
+	if w <= 0 {
+		w = logoWidth
+	}
+	h := w * info.Height() / info.Width()
+	y := r.pdf.GetY()
+	r.pdf.ImageOptions("issuer_logo", r.blockX(b, w), y, w, h, false, opts, 0, "")
+	r.pdf.SetY(y + h)
+}
+
+// lineCell returns the text of a lines_table column for one invoice line.
+func lineCell(field string, line dto.InvoiceLineDTO) string {
+	switch field {
+	case "description":
+		return line.Producto
+	case "product_code":
+		return getString(line.CodigoProducto)
+	case "units":
+		return line.Unidades.StringFixed(2)
+	case "unit_price":
+		return getUnitPrice(line).StringFixed(2)
+	case "vat_rate":
+		return getDecimal(line.IvaAplicado).StringFixed(2)
+	case "subtotal":
+		return line.Subtotal.StringFixed(2)
+	}
+	return ""
+}
+
+func columnsWidth(cols []ColumnSpec) float64 {
+	var w float64
+	for _, col := range cols {
+		w += col.Width
+	}
+	return w
+}
+
+func (r *renderer) renderTableHeader(b BlockSpec, x float64, cols []ColumnSpec, h float64) {
+	pdf := r.pdf
+	style := b.Font.Style
+	if !strings.Contains(style, styleBold) {
+		style += styleBold
+	}
+	r.setFont(FontSpec{Family: b.Font.Family, Size: b.Font.Size, Style: style})
+	pdf.SetFillColor(r.colors.accent.r, r.colors.accent.g, r.colors.accent.b)
+	pdf.SetTextColor(r.colors.primary.r, r.colors.primary.g, r.colors.primary.b)
+	fill := border(b, "1") != ""
+	pdf.SetX(x)
+	for _, col := range cols {
+		pdf.CellFormat(col.Width, h, col.Title, border(b, "1"), 0, "C", fill, 0, "")
+	}
+	pdf.Ln(h)
+	pdf.SetTextColor(0, 0, 0)
+	r.setFont(b.Font)
+}
+
+func (r *renderer) renderLinesTable(b BlockSpec) {
+	pdf := r.pdf
+	x := r.blockX(b, columnsWidth(b.Columns))
+	lh := r.lineHeight(b)
+	headerHeight := b.HeaderHeight
+	if headerHeight <= 0 {
+		headerHeight = lh
+	}
+	r.renderTableHeader(b, x, b.Columns, headerHeight)
+
+	rowBorder := border(b, "LR")
+	for _, line := range r.data.Invoice.Lines {
+		// The description column may wrap; every other cell spans the same height.
+		rowLines := 1
+		cells := make([][]string, len(b.Columns))
+		for i, col := range b.Columns {
+			text := lineCell(col.Field, line)
+			if col.Field == "description" {
+				cells[i] = pdf.SplitText(text, col.Width-cellGap)
+				if len(cells[i]) == 0 {
+					cells[i] = []string{""}
+				}
+			} else {
+				cells[i] = []string{text}
+			}
+			if len(cells[i]) > rowLines {
+				rowLines = len(cells[i])
+			}
+		}
+		rowHeight := lh * float64(rowLines)
+		if pdf.GetY()+rowHeight > r.tmpl.Page.Height-r.tmpl.Page.Margins.Bottom && r.tmpl.Page.Height > 0 {
+			pdf.AddPage()
+			r.renderTableHeader(b, x, b.Columns, headerHeight)
+		}
+		rowY := pdf.GetY()
+		cellX := x
+		for i, col := range b.Columns {
+			align := col.Align
+			if align == "" {
+				align = "R"
+			}
+			if len(cells[i]) == 1 {
+				pdf.SetXY(cellX, rowY)
+				pdf.CellFormat(col.Width, rowHeight, cells[i][0], rowBorder, 0, align, false, 0, "")
+			} else {
+				for j, text := range cells[i] {
+					pdf.SetXY(cellX, rowY+float64(j)*lh)
+					pdf.CellFormat(col.Width, lh, text, rowBorder, 0, align, false, 0, "")
+				}
+			}
+			cellX += col.Width
+		}
+		pdf.SetXY(x, rowY+rowHeight)
+	}
+	// Bottom line of the table
+	if rowBorder != "" {
+		pdf.SetX(x)
+		pdf.CellFormat(columnsWidth(b.Columns), 0, "", "T", 1, "", false, 0, "")
+	}
+}
+
+// summaryCell returns the text of a tax_summary column for one VAT group.
+func summaryCell(field string, g dto.VATGroup) string {
+	switch field {
+	case "base":
+		return g.Base.StringFixed(2)
+	case "rate":
+		if g.Exempt() {
+			return "Exento"
+		}
+		return g.Rate.StringFixed(2)
+	case "quota":
+		return g.Quota.StringFixed(2)
+	case "surcharge_rate":
+		return g.SurchargeRate.StringFixed(2)
+	case "surcharge_quota":
+		return g.SurchargeQuota.StringFixed(2)
+	case "total":
+		return g.Total().StringFixed(2)
+	}
+	return ""
+}
+
+func (r *renderer) renderTaxSummary(b BlockSpec) {
+	if len(r.totals.groups) == 0 {
+		return
+	}
+	// Recargo de equivalencia columns only appear when some group carries it.
+	var cols []ColumnSpec
+	for _, col := range b.Columns {
+		if !r.totals.hasSurcharge && strings.HasPrefix(col.Field, "surcharge_") {
+			continue
+		}
+		cols = append(cols, col)
+	}
+	x := r.blockX(b, columnsWidth(cols))
+	lh := r.lineHeight(b)
+	r.renderTableHeader(b, x, cols, lh)
+	for _, g := range r.totals.groups {
+		r.pdf.SetX(x)
+		for _, col := range cols {
+			align := col.Align
+			if align == "" {
+				align = "R"
+			}
+			r.pdf.CellFormat(col.Width, lh, summaryCell(col.Field, g), border(b, "1"), 0, align, false, 0, "")
+		}
+		r.pdf.Ln(lh)
+	}
+}
+
+func (r *renderer) renderTotals(b BlockSpec) {
+	w := r.blockWidth(b)
+	x := r.blockX(b, w)
+	labelWidth := b.LabelWidth
+	if labelWidth <= 0 {
+		labelWidth = w / 2
+	}
+	for _, item := range b.Items {
+		var value money.Decimal
+		switch item.Field {
+		case "total_base":
+			value = r.totals.base
+		case "total_quota":
+			value = r.totals.quota
+		case "total_surcharge":
+			if !r.totals.hasSurcharge {
+				continue
+			}
+			value = r.totals.surcharge
+		case "grand_total":
+			value = r.totals.grandTotal
+		}
+		r.pdf.SetX(x)
+		r.pdf.CellFormat(labelWidth, r.lineHeight(b), item.Label, "", 0, "R", false, 0, "")
+		r.pdf.CellFormat(w-labelWidth, r.lineHeight(b), value.StringFixed(2)+item.Suffix, "", 1, "R", false, 0, "")
+	}
+}
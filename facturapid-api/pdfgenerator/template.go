@@ -0,0 +1,227 @@
+package pdfgenerator
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// Layout templates describe the invoice declaratively: page size and margins, fonts, and
+// an ordered list of blocks. Blocks are rendered top to bottom ("flow") unless they set
+// an absolute position. Free text uses Go text/template syntax over templateData, so a
+// layout can show, hide or reword fields without touching the renderer.
+//
+// The built-in layouts live in templates/*.json and are embedded in the binary.
+
+//go:embed templates/*.json
+var templateFS embed.FS
+
+// DefaultTemplateName is the layout used when none is requested.
+const DefaultTemplateName = "a4"
+
+// Block types understood by the renderer.
+const (
+	blockText          = "text"           // Lines of templated text
+	blockKeyValues     = "key_values"     // Label/value pairs (invoice number, date...)
+	blockLogo          = "logo"           // Issuer logo, if any
+	blockLinesTable    = "lines_table"    // Invoice lines; columns select line fields
+	blockTaxSummary    = "tax_summary"    // One row per VAT group; columns select group fields
+	blockTotals        = "totals"         // Label/amount pairs from the tax summary totals
+	blockExemptionNote = "exemption_note" // Legal text, only rendered for exempt bases
+	blockFooter        = "footer"         // Like text; usually anchored to the page bottom
+	blockSpacer        = "spacer"         // Vertical gap of Height mm
+	blockSignature     = "signature"      // Framed lines for the visible signature; only in signed PDFs
+	blockRectification = "rectification"  // Like text; only in rectifying invoices
+)
+
+// Template is a parsed layout.
+type Template struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Page        PageSpec    `json:"page"`
+	Font        FontSpec    `json:"font"`
+	LineHeight  float64     `json:"line_height"`
+	Blocks      []BlockSpec `json:"blocks"`
+}
+
+// PageSpec sets the page geometry in millimetres. A Height of 0 makes the page as tall
+// as its content, which is what roll-paper ticket printers need.
+type PageSpec struct {
+	Orientation string  `json:"orientation"`
+	Width       float64 `json:"width"`
+	Height      float64 `json:"height"`
+	Margins     struct {
+		Left   float64 `json:"left"`
+		Top    float64 `json:"top"`
+		Right  float64 `json:"right"`
+		Bottom float64 `json:"bottom"`
+	} `json:"margins"`
+}
+
+// FontSpec overrides the template font. Zero values inherit from the template.
+type FontSpec struct {
+	Family string  `json:"family"`
+	Size   float64 `json:"size"`
+	Style  string  `json:"style"` // "", "B", "I" or "BI"
+}
+
+// ColumnSpec is a column of a lines_table or tax_summary block.
+type ColumnSpec struct {
+	Title string  `json:"title"`
+	Field string  `json:"field"`
+	Width float64 `json:"width"`
+	Align string  `json:"align"`
+}
+
+// ItemSpec is a row of a key_values (Value template) or totals (Field) block.
+type ItemSpec struct {
+	Label  string `json:"label"`
+	Value  string `json:"value"`
+	Field  string `json:"field"`
+	Suffix string `json:"suffix"`
+}
+
+// BlockSpec is one element of the layout.
+type BlockSpec struct {
+	Type string `json:"type"`
+	// X and Y place the block absolutely (mm from the top-left corner; a negative Y is
+	// measured from the bottom). When Y is set the flow position is left untouched.
+	X *float64 `json:"x"`
+	Y *float64 `json:"y"`
+	// Width defaults to the content width (or, for tables, the sum of the columns).
+	Width        float64      `json:"width"`
+	Height       float64      `json:"height"`
+	LabelWidth   float64      `json:"label_width"`
+	HeaderHeight float64      `json:"header_height"`
+	LineHeight   float64      `json:"line_height"`
+	Align        string       `json:"align"`  // L, C or R
+	Border       string       `json:"border"` // gofpdf border string, or "none"
+	Font         FontSpec     `json:"font"`
+	Color        string       `json:"color"`      // "primary" uses the issuer's primary colour
+	TextColor    string       `json:"text_color"` // Explicit "#RRGGBB"
+	Lines        []string     `json:"lines"`
+	Items        []ItemSpec   `json:"items"`
+	Columns      []ColumnSpec `json:"columns"`
+	SkipEmpty    bool         `json:"skip_empty"` // Drop lines/items that render to ""
+	SameLine     bool         `json:"same_line"`  // The next block starts at this block's top
+	SpaceBefore  float64      `json:"space_before"`
+	SpaceAfter   float64      `json:"space_after"`
+
+	compiled []*template.Template // Lines, or Items' values, parsed once at load time
+}
+
+var (
+	lineFields    = map[string]bool{"description": true, "units": true, "unit_price": true, "vat_rate": true, "subtotal": true, "product_code": true}
+	summaryFields = map[string]bool{"base": true, "rate": true, "quota": true, "surcharge_rate": true, "surcharge_quota": true, "total": true}
+	totalFields   = map[string]bool{"total_base": true, "total_quota": true, "total_surcharge": true, "grand_total": true}
+)
+
+// ParseTemplate parses and checks a JSON layout.
+func ParseTemplate(data []byte) (*Template, error) {
+	var t Template
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&t); err != nil {
+		return nil, fmt.Errorf("error decoding layout template: %w", err)
+	}
+	if t.Page.Width <= 0 || t.Page.Height < 0 {
+		return nil, fmt.Errorf("layout template %q: invalid page size %.1fx%.1f", t.Name, t.Page.Width, t.Page.Height)
+	}
+	if t.Page.Orientation == "" {
+		t.Page.Orientation = "P"
+	}
+	if t.Font.Family == "" {
+		t.Font.Family = fontSans
+	}
+	if t.Font.Size <= 0 {
+		t.Font.Size = defaultFontSize
+	}
+	if t.LineHeight <= 0 {
+		t.LineHeight = lineHeight
+	}
+	if err := checkFont(t.Font.Family, t.Font.Style); err != nil {
+		return nil, fmt.Errorf("layout template %q: %w", t.Name, err)
+	}
+
+	for i := range t.Blocks {
+		b := &t.Blocks[i]
+		where := fmt.Sprintf("layout template %q, block %d (%s)", t.Name, i, b.Type)
+		family := b.Font.Family
+		if family == "" {
+			family = t.Font.Family
+		}
+		if err := checkFont(family, b.Font.Style); err != nil {
+			return nil, fmt.Errorf("%s: %w", where, err)
+		}
+		var sources []string
+		switch b.Type {
+		case blockText, blockFooter, blockSignature, blockRectification:
+			sources = b.Lines
+		case blockKeyValues:
+			for _, item := range b.Items {
+				sources = append(sources, item.Value)
+			}
+		case blockLinesTable, blockTaxSummary:
+			if len(b.Columns) == 0 {
+				return nil, fmt.Errorf("%s: no columns", where)
+			}
+			allowed := lineFields
+			if b.Type == blockTaxSummary {
+				allowed = summaryFields
+			}
+			for _, col := range b.Columns {
+				if !allowed[col.Field] {
+					return nil, fmt.Errorf("%s: unknown column field %q (allowed: %s)", where, col.Field, fieldList(allowed))
+				}
+			}
+		case blockTotals:
+			for _, item := range b.Items {
+				if !totalFields[item.Field] {
+					return nil, fmt.Errorf("%s: unknown totals field %q (allowed: %s)", where, item.Field, fieldList(totalFields))
+				}
+			}
+		case blockLogo, blockExemptionNote, blockSpacer:
+		default:
+			return nil, fmt.Errorf("%s: unknown block type", where)
+		}
+		for j, src := range sources {
+			tmpl, err := template.New(fmt.Sprintf("%s[%d]", b.Type, j)).Funcs(templateFuncs).Option("missingkey=error").Parse(src)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", where, err)
+			}
+			b.compiled = append(b.compiled, tmpl)
+		}
+	}
+	return &t, nil
+}
+
+func fieldList(fields map[string]bool) string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// LoadTemplate returns one of the built-in layouts ("a4", "ticket80").
+func LoadTemplate(name string) (*Template, error) {
+	data, err := templateFS.ReadFile("templates/" + name + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("unknown layout template %q", name)
+	}
+	return ParseTemplate(data)
+}
+
+// TemplateNames lists the built-in layouts.
+func TemplateNames() []string {
+	entries, _ := templateFS.ReadDir("templates")
+	var names []string
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".json"))
+	}
+	return names
+}
@@ -0,0 +1,209 @@
+package pdfsign
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// CMS (RFC 5652) SignedData in the CAdES form PAdES baseline signatures use: detached
+// content, a signing-certificate-v2 attribute binding the signer certificate, and no
+// signing-time attribute (the time goes in the signature dictionary's /M).
+
+var (
+	oidData               = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidSHA256             = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA256WithRSA      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidECDSAWithSHA256    = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAttrContentType    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningCertV2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 47}
+	oidAttrTimeStampToken = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+)
+
+const (
+	tagSet           = 17
+	tagSequence      = 16
+	classContext     = 2
+	tagDirectoryName = 4
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue // [0] EXPLICIT, built by hand
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue // [0] IMPLICIT SET OF Certificate
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                issuerAndSerialNumber
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue // [0] IMPLICIT SET OF Attribute
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional"` // [1] IMPLICIT SET OF Attribute
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // SET OF value
+}
+
+type issuerSerial struct {
+	Issuer       asn1.RawValue // GeneralNames
+	SerialNumber *big.Int
+}
+
+type essCertIDv2 struct {
+	// HashAlgorithm defaults to SHA-256 and is omitted.
+	CertHash     []byte
+	IssuerSerial issuerSerial
+}
+
+type signingCertificateV2 struct {
+	Certs []essCertIDv2
+}
+
+func rawSet(class, tag int, elements [][]byte) asn1.RawValue {
+	// DER orders the elements of a SET OF by their encoding.
+	sorted := append([][]byte(nil), elements...)
+	sort.Slice(sorted, func(i, j int) bool { return string(sorted[i]) < string(sorted[j]) })
+	var content []byte
+	for _, e := range sorted {
+		content = append(content, e...)
+	}
+	return asn1.RawValue{Class: class, Tag: tag, IsCompound: true, Bytes: content}
+}
+
+func newAttribute(oid asn1.ObjectIdentifier, value interface{}) ([]byte, error) {
+	der, err := asn1.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(attribute{Type: oid, Values: rawSet(asn1.ClassUniversal, tagSet, [][]byte{der})})
+}
+
+// signatureAlgorithm returns the CMS signature algorithm for key.
+func signatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported key type %T", key.Public())
+}
+
+// buildCMS returns a detached CMS SignedData over content. If tsa is not nil the
+// signature value is timestamped and the token added as an unsigned attribute.
+func buildCMS(content []byte, key crypto.Signer, cert *x509.Certificate, chain []*x509.Certificate, tsa func(signature []byte) ([]byte, error)) ([]byte, error) {
+	sigAlg, err := signatureAlgorithm(key)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	certHash := sha256.Sum256(cert.Raw)
+
+	directoryName, err := asn1.Marshal(asn1.RawValue{Class: classContext, Tag: tagDirectoryName, IsCompound: true, Bytes: cert.RawIssuer})
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([][]byte, 0, 3)
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidAttrContentType, oidData},
+		{oidAttrMessageDigest, digest[:]},
+		{oidAttrSigningCertV2, signingCertificateV2{Certs: []essCertIDv2{{
+			CertHash: certHash[:],
+			IssuerSerial: issuerSerial{
+				Issuer:       asn1.RawValue{Class: asn1.ClassUniversal, Tag: tagSequence, IsCompound: true, Bytes: directoryName},
+				SerialNumber: cert.SerialNumber,
+			},
+		}}}},
+	} {
+		der, err := newAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding signed attribute %s: %w", a.oid, err)
+		}
+		attrs = append(attrs, der)
+	}
+
+	// The signature covers the signed attributes encoded as a SET; inside SignerInfo the
+	// same bytes carry the [0] IMPLICIT tag instead.
+	signedAttrs := rawSet(asn1.ClassUniversal, tagSet, attrs)
+	toSign, err := asn1.Marshal(signedAttrs)
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(toSign)
+	signature, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("error signing: %w", err)
+	}
+
+	si := signerInfo{
+		Version:            1,
+		SID:                issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber},
+		DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+		SignedAttrs:        asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: signedAttrs.Bytes},
+		SignatureAlgorithm: sigAlg,
+		Signature:          signature,
+	}
+	if tsa != nil {
+		token, err := tsa(signature)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{Type: oidAttrTimeStampToken, Values: rawSet(asn1.ClassUniversal, tagSet, [][]byte{token})})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding timestamp attribute: %w", err)
+		}
+		si.UnsignedAttrs = asn1.RawValue{Class: classContext, Tag: 1, IsCompound: true, Bytes: attr}
+	}
+
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{cert}, chain...) {
+		certs = append(certs, c.Raw...)
+	}
+	sd, err := asn1.Marshal(signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: oidData},
+		Certificates:     asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      []signerInfo{si},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding SignedData: %w", err)
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
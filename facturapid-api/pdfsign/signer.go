@@ -0,0 +1,281 @@
+// Package pdfsign applies PAdES baseline signatures (B-B, or B-T with a timestamp
+// authority) to PDF files.
+//
+// The signature is added as an incremental update, so the signed bytes of the original
+// file, including its PDF/A conformance, are left untouched. The visible stamp is not
+// drawn here: the caller draws it on the page and passes its rectangle, which becomes
+// the signature field's area.
+package pdfsign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"facturapid-api/pdffile"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// Signer signs PDFs with a certificate and its private key.
+type Signer struct {
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+	Chain       []*x509.Certificate // Intermediate certificates, embedded in the signature
+	// TSAURL is an RFC 3161 timestamp authority. When set, every signature is
+	// timestamped (PAdES-B-T); signing fails if the authority cannot be reached.
+	TSAURL     string
+	HTTPClient *http.Client // For the TSA; http.DefaultClient if nil
+}
+
+// LoadPKCS12 reads the signing key and certificates from a PKCS#12 (.p12/.pfx) file.
+// The certificate matching the key is the signer's; the others form the chain.
+func LoadPKCS12(path, password string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PKCS#12 file: %w", err)
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding PKCS#12 file %s: %w", path, err)
+	}
+
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, b := range blocks {
+		switch b.Type {
+		case "PRIVATE KEY":
+			// ToPEM uses PKCS#1 for RSA keys and SEC 1 for EC keys.
+			if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+				key = k
+			} else if k, err := x509.ParseECPrivateKey(b.Bytes); err == nil {
+				key = k
+			} else {
+				return nil, fmt.Errorf("unsupported private key in %s", path)
+			}
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing certificate in %s: %w", path, err)
+			}
+			certs = append(certs, c)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no private key in %s", path)
+	}
+
+	s := &Signer{Key: key}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range certs {
+		if s.Certificate == nil && bytes.Equal(c.RawSubjectPublicKeyInfo, pub) {
+			s.Certificate = c
+		} else {
+			s.Chain = append(s.Chain, c)
+		}
+	}
+	if s.Certificate == nil {
+		return nil, fmt.Errorf("no certificate for the private key in %s", path)
+	}
+	return s, nil
+}
+
+// Name is the signer's name as shown in the visible stamp: the certificate's common
+// name, or its organisation when the common name is empty.
+func (s *Signer) Name() string {
+	if cn := s.Certificate.Subject.CommonName; cn != "" {
+		return cn
+	}
+	return strings.Join(s.Certificate.Subject.Organization, ", ")
+}
+
+// CertificatePEM returns the signer certificate in PEM form, e.g. for publishing it.
+func (s *Signer) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate.Raw})
+}
+
+// TLSCertificate returns the certificate, its chain and key as a TLS client
+// certificate, e.g. for the AEAT web services, which authenticate with the same
+// certificate.
+func (s *Signer) TLSCertificate() tls.Certificate {
+	cert := tls.Certificate{Certificate: [][]byte{s.Certificate.Raw}, PrivateKey: s.Key, Leaf: s.Certificate}
+	for _, c := range s.Chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert
+}
+
+// Options describe one signature.
+type Options struct {
+	Time     time.Time // Signing time, written to /M; time.Now() if zero
+	Reason   string
+	Location string
+	// Page (1-based) and Rect ([llx lly urx ury] in PDF points) place the signature field
+	// over the stamp drawn by the caller. A zero Rect makes the signature invisible.
+	Page int
+	Rect [4]float64
+}
+
+var (
+	catalogPagesRe = regexp.MustCompile(`/Pages (\d+) 0 R`)
+	kidsRe         = regexp.MustCompile(`/Kids\s*\[([^\]]*)\]`)
+)
+
+// Room for the CMS blob beyond the certificates, and for a timestamp token.
+const (
+	signatureReserve = 4096
+	timestampReserve = 8192
+)
+
+// pages returns the page object numbers in order.
+func pages(f *pdffile.File) ([]int, error) {
+	catalog, err := f.Dict(f.Root)
+	if err != nil {
+		return nil, err
+	}
+	m := catalogPagesRe.FindStringSubmatch(catalog)
+	if m == nil {
+		return nil, fmt.Errorf("catalog has no /Pages")
+	}
+	var walk func(num, depth int) ([]int, error)
+	walk = func(num, depth int) ([]int, error) {
+		dict, err := f.Dict(num)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(dict, "/Type /Pages") {
+			return []int{num}, nil
+		}
+		kids := kidsRe.FindStringSubmatch(dict)
+		if kids == nil || depth > 32 {
+			return nil, fmt.Errorf("malformed page tree at object %d", num)
+		}
+		var out []int
+		for _, kid := range pdffile.Refs(kids[1]) {
+			sub, err := walk(kid, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, sub...)
+		}
+		return out, nil
+	}
+	return walk(pdffile.Refs(m[0])[0], 0)
+}
+
+// Sign returns pdf with a PAdES signature appended.
+func (s *Signer) Sign(pdf []byte, opts Options) ([]byte, error) {
+	f, err := pdffile.Parse(pdf)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PDF to sign: %w", err)
+	}
+	if opts.Time.IsZero() {
+		opts.Time = time.Now()
+	}
+	pageNums, err := pages(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PDF to sign: %w", err)
+	}
+	if opts.Page < 1 {
+		opts.Page = 1
+	}
+	if opts.Page > len(pageNums) {
+		return nil, fmt.Errorf("signature page %d out of range (%d pages)", opts.Page, len(pageNums))
+	}
+	page := pageNums[opts.Page-1]
+	catalog, err := f.Dict(f.Root)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(catalog, "/AcroForm") {
+		return nil, fmt.Errorf("PDF already has a form; signing it is not supported")
+	}
+	pageDict, err := f.Dict(page)
+	if err != nil {
+		return nil, err
+	}
+
+	reserve := signatureReserve + len(s.Certificate.Raw)
+	for _, c := range s.Chain {
+		reserve += len(c.Raw)
+	}
+	if s.TSAURL != "" {
+		reserve += timestampReserve
+	}
+
+	if !bytes.HasSuffix(pdf, []byte("\n")) {
+		pdf = append(pdf, '\n')
+	}
+	w := pdffile.NewWriter(pdf, f.Size)
+	sig, widget, appearance := w.Alloc(), w.Alloc(), w.Alloc()
+
+	// /ByteRange and /Contents are placeholders, filled in once the offsets are known.
+	byteRangePlaceholder := "/ByteRange [0 0000000000 0000000000 0000000000]"
+	sigOffset := w.Len()
+	w.Object(sig, fmt.Sprintf("<< /Type /Sig /Filter /Adobe.PPKLite /SubFilter /ETSI.CAdES.detached %s /Contents <%s> /M %s /Name %s /Reason %s /Location %s >>",
+		byteRangePlaceholder, strings.Repeat("0", 2*reserve), pdffile.Date(opts.Time),
+		pdffile.TextString(s.Name()), pdffile.TextString(opts.Reason), pdffile.TextString(opts.Location)))
+
+	width, height := opts.Rect[2]-opts.Rect[0], opts.Rect[3]-opts.Rect[1]
+	w.Stream(appearance, fmt.Sprintf("/Type /XObject /Subtype /Form /BBox [0 0 %.2f %.2f]", width, height), nil, false)
+	// Flags 132: Print (PDF/A requires it) and Locked.
+	w.Object(widget, fmt.Sprintf("<< /Type /Annot /Subtype /Widget /FT /Sig /T %s /V %d 0 R /F 132 /P %d 0 R /Rect [%.2f %.2f %.2f %.2f] /AP << /N %d 0 R >> >>",
+		pdffile.TextString("Firma"), sig, page, opts.Rect[0], opts.Rect[1], opts.Rect[2], opts.Rect[3], appearance))
+
+	if strings.Contains(pageDict, "/Annots [") {
+		pageDict = strings.Replace(pageDict, "/Annots [", fmt.Sprintf("/Annots [%d 0 R ", widget), 1)
+	} else if strings.Contains(pageDict, "/Annots") {
+		return nil, fmt.Errorf("page %d has indirect annotations; signing it is not supported", opts.Page)
+	} else {
+		pageDict += fmt.Sprintf(" /Annots [%d 0 R]", widget)
+	}
+	w.Object(page, "<<"+pageDict+">>")
+	w.Object(f.Root, fmt.Sprintf("<<%s /AcroForm << /Fields [%d 0 R] /SigFlags 3 >> >>", catalog, widget))
+
+	trailer := fmt.Sprintf("/Root %d 0 R /Info %d 0 R /Prev %d", f.Root, f.Info, f.XrefOffset)
+	if f.ID != "" {
+		// The first ID element identifies the document and must not change.
+		trailer += fmt.Sprintf(" /ID [<%s> <%x>]", f.ID, opts.Time.UnixNano())
+	}
+	out := w.Finish(trailer)
+
+	// Locate the placeholders and sign everything but the /Contents value.
+	contentsStart := sigOffset + bytes.Index(out[sigOffset:], []byte("/Contents <")) + len("/Contents ")
+	contentsEnd := contentsStart + 2 + 2*reserve
+	byteRange := fmt.Sprintf("/ByteRange [0 %d %d %d]", contentsStart, contentsEnd, len(out)-contentsEnd)
+	if len(byteRange) > len(byteRangePlaceholder) {
+		return nil, fmt.Errorf("PDF too large to sign")
+	}
+	rangeAt := sigOffset + bytes.Index(out[sigOffset:], []byte(byteRangePlaceholder))
+	copy(out[rangeAt:], byteRange+strings.Repeat(" ", len(byteRangePlaceholder)-len(byteRange)))
+
+	signed := append(append([]byte(nil), out[:contentsStart]...), out[contentsEnd:]...)
+	var tsa func([]byte) ([]byte, error)
+	if s.TSAURL != "" {
+		client := s.HTTPClient
+		if client == nil {
+			client = http.DefaultClient
+		}
+		tsa = func(signature []byte) ([]byte, error) { return timestamp(client, s.TSAURL, signature) }
+	}
+	cms, err := buildCMS(signed, s.Key, s.Certificate, s.Chain, tsa)
+	if err != nil {
+		return nil, err
+	}
+	if len(cms) > reserve {
+		return nil, fmt.Errorf("signature (%d bytes) exceeds the space reserved for it (%d bytes)", len(cms), reserve)
+	}
+	hex.Encode(out[contentsStart+1:], cms)
+	return out, nil
+}
@@ -0,0 +1,358 @@
+package pdfsign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"facturapid-api/pdffile"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var oidTSTInfo = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+// newCertificate returns a self-signed certificate and its key.
+func newCertificate(t *testing.T, cn string, usage ...x509.ExtKeyUsage) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Pruebas"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// minimalPDF returns a one-page PDF as pdffile writes it.
+func minimalPDF() []byte {
+	w := pdffile.NewWriter([]byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"), 1)
+	catalog, pages, page, info := w.Alloc(), w.Alloc(), w.Alloc(), w.Alloc()
+	w.Object(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", pages))
+	w.Object(pages, fmt.Sprintf("<< /Type /Pages /Kids [%d 0 R] /Count 1 >>", page))
+	w.Object(page, fmt.Sprintf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 595.28 841.89] >>", pages))
+	w.Object(info, "<< /Producer (test) >>")
+	return w.Finish(fmt.Sprintf("/Root %d 0 R /Info %d 0 R /ID [<00112233445566778899aabbccddeeff> <00112233445566778899aabbccddeeff>]", catalog, info))
+}
+
+// Types of the stub's replies, with the fields the client skips.
+type stubTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time `asn1:"generalized"`
+	Nonce          *big.Int  `asn1:"optional"`
+}
+
+type stubSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,tag:0"`
+	}
+	Certificates asn1.RawValue
+	SignerInfos  []signerInfo `asn1:"set"`
+}
+
+// tsaStub is an RFC 3161 timestamp authority that grants every request, or answers
+// with status when it is not zero.
+type tsaStub struct {
+	cert     *x509.Certificate
+	key      crypto.Signer
+	status   int
+	requests int
+}
+
+func (s *tsaStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	body, _ := io.ReadAll(r.Body)
+	var req timeStampReq
+	if r.Header.Get("Content-Type") != timestampQueryType {
+		http.Error(w, "bad content type", http.StatusBadRequest)
+		return
+	}
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.status != statusGranted {
+		reply, _ := asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: s.status}})
+		w.Write(reply)
+		return
+	}
+	token, err := s.token(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	reply, _ := asn1.Marshal(timeStampResp{Status: pkiStatusInfo{Status: statusGranted}, TimeStampToken: asn1.RawValue{FullBytes: token}})
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(reply)
+}
+
+// token returns a TimeStampToken for req, signed by the stub.
+func (s *tsaStub) token(req timeStampReq) ([]byte, error) {
+	info, err := asn1.Marshal(stubTSTInfo{
+		Version: 1, Policy: asn1.ObjectIdentifier{1, 2, 3, 4}, MessageImprint: req.MessageImprint,
+		SerialNumber: big.NewInt(int64(s.requests)), GenTime: time.Now().UTC().Truncate(time.Second), Nonce: req.Nonce,
+	})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(info)
+	var attrs [][]byte
+	for _, a := range []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{{oidAttrContentType, oidTSTInfo}, {oidAttrMessageDigest, digest[:]}} {
+		der, err := newAttribute(a.oid, a.value)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, der)
+	}
+	signedAttrs := rawSet(asn1.ClassUniversal, tagSet, attrs)
+	toSign, _ := asn1.Marshal(signedAttrs)
+	attrsDigest := sha256.Sum256(toSign)
+	signature, err := s.key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	sd := stubSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		Certificates:     asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: s.cert.Raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                issuerAndSerialNumber{Issuer: asn1.RawValue{FullBytes: s.cert.RawIssuer}, SerialNumber: s.cert.SerialNumber},
+			DigestAlgorithm:    pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			SignedAttrs:        asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: signedAttrs.Bytes},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+			Signature:          signature,
+		}},
+	}
+	sd.EncapContentInfo.EContentType = oidTSTInfo
+	sd.EncapContentInfo.EContent = info
+	der, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{ContentType: oidSignedData, Content: asn1.RawValue{Class: classContext, Tag: 0, IsCompound: true, Bytes: der}})
+}
+
+// attributes decodes a SET OF Attribute by type.
+func attributes(t *testing.T, set []byte) map[string][]byte {
+	t.Helper()
+	out := map[string][]byte{}
+	for rest := set; len(rest) > 0; {
+		var a attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &a); err != nil {
+			t.Fatalf("malformed attribute: %v", err)
+		}
+		var value asn1.RawValue
+		if _, err := asn1.Unmarshal(a.Values.Bytes, &value); err != nil {
+			t.Fatalf("malformed attribute value: %v", err)
+		}
+		out[a.Type.String()] = value.FullBytes
+	}
+	return out
+}
+
+// verifySignerInfo checks that si signs digest (a messageDigest attribute) with cert.
+func verifySignerInfo(t *testing.T, si signerInfo, cert *x509.Certificate, digest []byte) map[string][]byte {
+	t.Helper()
+	attrs := attributes(t, si.SignedAttrs.Bytes)
+	var got []byte
+	if _, err := asn1.Unmarshal(attrs[oidAttrMessageDigest.String()], &got); err != nil || !bytes.Equal(got, digest) {
+		t.Errorf("messageDigest attribute does not match the signed content")
+	}
+	if si.SID.SerialNumber.Cmp(cert.SerialNumber) != 0 || !bytes.Equal(si.SID.Issuer.FullBytes, cert.RawIssuer) {
+		t.Error("signer identifier is not the certificate's")
+	}
+	toSign, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: tagSet, IsCompound: true, Bytes: si.SignedAttrs.Bytes})
+	if err := cert.CheckSignature(x509.ECDSAWithSHA256, toSign, si.Signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+	return attrs
+}
+
+var (
+	byteRangeRe = regexp.MustCompile(`/ByteRange \[(\d+) (\d+) (\d+) (\d+)\s*\]`)
+	contentsRe  = regexp.MustCompile(`/Contents <([0-9a-fA-F]+)>`)
+)
+
+// verifyPAdES checks the signature of signed, appended to original, and returns the
+// signer info.
+func verifyPAdES(t *testing.T, original, signed []byte, cert *x509.Certificate) signerInfo {
+	t.Helper()
+	if !bytes.HasPrefix(signed, original) {
+		t.Fatal("the signature is not an incremental update of the original")
+	}
+	update := string(signed[len(original):])
+	if !strings.Contains(update, "/SubFilter /ETSI.CAdES.detached") {
+		t.Error("signature is not a PAdES (ETSI.CAdES.detached) one")
+	}
+	br := byteRangeRe.FindStringSubmatch(update)
+	contents := contentsRe.FindStringSubmatch(update)
+	if br == nil || contents == nil {
+		t.Fatal("signature dictionary lacks /ByteRange or /Contents")
+	}
+	var r [4]int
+	for i := range r {
+		r[i], _ = strconv.Atoi(br[i+1])
+	}
+	if r[0] != 0 || r[2] != r[1]+len(contents[1])+2 || r[2]+r[3] != len(signed) {
+		t.Fatalf("/ByteRange %v does not cover the file but /Contents", r)
+	}
+	if string(signed[r[1]]) != "<" || string(signed[r[2]-1]) != ">" {
+		t.Fatal("/ByteRange gap is not the /Contents string")
+	}
+	digest := sha256.Sum256(append(append([]byte(nil), signed[r[0]:r[1]]...), signed[r[2]:r[2]+r[3]]...))
+
+	blob, err := hex.DecodeString(contents[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(blob, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		t.Fatalf("/Contents is not a CMS SignedData: %v", err)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatalf("malformed SignedData: %v", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		t.Fatalf("%d signer infos, want 1", len(sd.SignerInfos))
+	}
+	if !bytes.Contains(sd.Certificates.Bytes, cert.Raw) {
+		t.Error("the signer certificate is not embedded")
+	}
+	si := sd.SignerInfos[0]
+	attrs := verifySignerInfo(t, si, cert, digest[:])
+	if _, ok := attrs[oidAttrSigningCertV2.String()]; !ok {
+		t.Error("signing-certificate-v2 attribute missing (required by PAdES)")
+	}
+	return si
+}
+
+func TestSignWithTimestamp(t *testing.T) {
+	cert, key := newCertificate(t, "Cafetería Peñalara S.L.")
+	tsaCert, tsaKey := newCertificate(t, "TSA de pruebas", x509.ExtKeyUsageTimeStamping)
+	stub := &tsaStub{cert: tsaCert, key: tsaKey}
+	tsa := httptest.NewServer(stub)
+	defer tsa.Close()
+
+	signer := &Signer{Key: key, Certificate: cert, TSAURL: tsa.URL, HTTPClient: tsa.Client()}
+	original := minimalPDF()
+	signed, err := signer.Sign(original, Options{Reason: "Factura A-1042", Page: 1, Rect: [4]float64{50, 50, 250, 100}})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if stub.requests != 1 {
+		t.Errorf("%d requests to the TSA, want 1", stub.requests)
+	}
+	update := string(signed[len(original):])
+	for _, want := range []string{"/Rect [50.00 50.00 250.00 100.00]", "/AcroForm << /Fields [", "/SigFlags 3", "/ID [<00112233445566778899aabbccddeeff>"} {
+		if !strings.Contains(update, want) {
+			t.Errorf("incremental update lacks %s", want)
+		}
+	}
+
+	si := verifyPAdES(t, original, signed, cert)
+	unsigned := attributes(t, si.UnsignedAttrs.Bytes)
+	token, ok := unsigned[oidAttrTimeStampToken.String()]
+	if !ok {
+		t.Fatal("signature has no timestamp token (PAdES-B-T)")
+	}
+	var ci contentInfo
+	var sd stubSignedData
+	var info stubTSTInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		t.Fatal(err)
+	}
+	imprint := sha256.Sum256(si.Signature)
+	if !bytes.Equal(info.MessageImprint.HashedMessage, imprint[:]) {
+		t.Error("the timestamp does not cover the signature value")
+	}
+	tstDigest := sha256.Sum256(sd.EncapContentInfo.EContent)
+	verifySignerInfo(t, sd.SignerInfos[0], tsaCert, tstDigest[:])
+}
+
+func TestSignWithoutTimestamp(t *testing.T) {
+	cert, key := newCertificate(t, "Cafetería Peñalara S.L.")
+	signer := &Signer{Key: key, Certificate: cert}
+	original := minimalPDF()
+	signed, err := signer.Sign(original, Options{})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	si := verifyPAdES(t, original, signed, cert)
+	if len(si.UnsignedAttrs.Bytes) != 0 {
+		t.Error("signature without TSA has unsigned attributes")
+	}
+	if !strings.Contains(string(signed[len(original):]), "/Rect [0.00 0.00 0.00 0.00]") {
+		t.Error("signature without a rectangle is not invisible")
+	}
+}
+
+func TestSignTSAFailures(t *testing.T) {
+	cert, key := newCertificate(t, "Cafetería Peñalara S.L.")
+	tsaCert, tsaKey := newCertificate(t, "TSA de pruebas", x509.ExtKeyUsageTimeStamping)
+
+	rejecting := httptest.NewServer(&tsaStub{cert: tsaCert, key: tsaKey, status: 2})
+	defer rejecting.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	for _, tt := range []struct {
+		name, url, want string
+	}{
+		{"rejection", rejecting.URL, "refused the request (status 2)"},
+		{"HTTP error", failing.URL, "HTTP 503"},
+	} {
+		signer := &Signer{Key: key, Certificate: cert, TSAURL: tt.url}
+		if _, err := signer.Sign(minimalPDF(), Options{}); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Sign error = %v, want one containing %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package pdfsign
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+)
+
+// RFC 3161 time-stamp protocol, over HTTP.
+
+const (
+	timestampQueryType = "application/timestamp-query"
+	maxTimestampReply  = 1 << 20
+)
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int
+	CertReq        bool
+}
+
+type pkiStatusInfo struct {
+	Status int
+	// statusString and failInfo follow; they are not needed.
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// The parts of the token needed to check that it covers our signature.
+type tokenSignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,tag:0"` // DER TSTInfo
+	}
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+}
+
+// PKIStatus values meaning the token was issued.
+const (
+	statusGranted         = 0
+	statusGrantedWithMods = 1
+)
+
+// timestamp asks the TSA at url for a token over signature and returns the token
+// (a CMS ContentInfo), after checking that it covers signature.
+func timestamp(client *http.Client, url string, signature []byte) ([]byte, error) {
+	digest := sha256.Sum256(signature)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version:        1,
+		MessageImprint: messageImprint{HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256}, HashedMessage: digest[:]},
+		Nonce:          nonce,
+		CertReq:        true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error encoding timestamp request: %w", err)
+	}
+
+	resp, err := client.Post(url, timestampQueryType, bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("error contacting timestamp authority: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTimestampReply))
+	if err != nil {
+		return nil, fmt.Errorf("error reading timestamp reply: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("timestamp authority returned HTTP %d", resp.StatusCode)
+	}
+
+	var reply timeStampResp
+	if _, err := asn1.Unmarshal(body, &reply); err != nil {
+		return nil, fmt.Errorf("error decoding timestamp reply: %w", err)
+	}
+	if reply.Status.Status != statusGranted && reply.Status.Status != statusGrantedWithMods {
+		return nil, fmt.Errorf("timestamp authority refused the request (status %d)", reply.Status.Status)
+	}
+	token := reply.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, fmt.Errorf("timestamp reply has no token")
+	}
+
+	var ci contentInfo
+	var sd tokenSignedData
+	var info tstInfo
+	if _, err := asn1.Unmarshal(token, &ci); err != nil || !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("timestamp token is not a SignedData")
+	}
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("error decoding timestamp token: %w", err)
+	}
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, fmt.Errorf("error decoding timestamp token info: %w", err)
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, digest[:]) {
+		return nil, fmt.Errorf("timestamp token does not cover the signature")
+	}
+	return token, nil
+}
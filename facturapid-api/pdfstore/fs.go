@@ -0,0 +1,192 @@
+package pdfstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// FSStore keeps the PDFs as files under a directory, one subdirectory per invoice:
+// <dir>/<invoice>/v<version>-<variant>.pdf, and <dir>/rectifying/<invoice>/... for
+// rectifying invoices. Those are the PDFs of the default tenant, which were stored
+// before tenants existed; other tenants have the same layout under
+// <dir>/tenants/<tenant>. The directory can be a mounted object store bucket.
+type FSStore struct {
+	dir string
+}
+
+// defaultTenantID is the tenant whose PDFs are stored at the root of the directory.
+const defaultTenantID = 1
+
+// NewFSStore returns a store rooted at dir, creating it if needed.
+func NewFSStore(dir string) (*FSStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating PDF store directory: %w", err)
+	}
+	return &FSStore{dir: dir}, nil
+}
+
+// root returns the directory of a tenant's PDFs.
+func (s *FSStore) root(tenantID int) string {
+	if tenantID == defaultTenantID {
+		return s.dir
+	}
+	return filepath.Join(s.dir, "tenants", strconv.Itoa(tenantID))
+}
+
+func (s *FSStore) path(key Key) string {
+	return filepath.Join(s.root(key.TenantID), key.Kind, strconv.Itoa(key.InvoiceID), fmt.Sprintf("v%d-%s.pdf", key.Version, key.Variant))
+}
+
+// Get reads the PDF stored under key.
+func (s *FSStore) Get(key Key) (*Artifact, error) {
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored PDF: %w", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading stored PDF: %w", err)
+	}
+	return &Artifact{Key: key, Data: data, SHA256: Digest(data), CreatedAt: info.ModTime()}, nil
+}
+
+// Put stores data under key unless a PDF is already stored there. The file is written
+// under a temporary name and then linked into place, so readers never see a partial
+// file and the first writer wins.
+func (s *FSStore) Put(key Key, data []byte) (*Artifact, error) {
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*.pdf")
+	if err != nil {
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return s.Get(key)
+		}
+		return nil, fmt.Errorf("error storing PDF: %w", err)
+	}
+	return s.Get(key)
+}
+
+// Purge deletes the directory of a document's PDFs.
+func (s *FSStore) Purge(tenantID int, kind string, invoiceID int) error {
+	if tenantID <= 0 || (kind != KindInvoice && kind != KindRectifying) || invoiceID <= 0 {
+		return fmt.Errorf("invalid PDF document %q %d of tenant %d", kind, invoiceID, tenantID)
+	}
+	if err := os.RemoveAll(filepath.Join(s.root(tenantID), kind, strconv.Itoa(invoiceID))); err != nil {
+		return fmt.Errorf("error purging stored PDFs: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes the PDFs of superseded versions, or only counts them when dryRun is
+// set.
+func (s *FSStore) Prune(dryRun bool) (int, error) {
+	roots := []string{s.dir}
+	tenants, err := os.ReadDir(filepath.Join(s.dir, "tenants"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("error listing stored PDFs: %w", err)
+	}
+	for _, tenant := range tenants {
+		if _, err := strconv.Atoi(tenant.Name()); err == nil && tenant.IsDir() {
+			roots = append(roots, filepath.Join(s.dir, "tenants", tenant.Name()))
+		}
+	}
+	pruned := 0
+	for _, root := range roots {
+		n, err := pruneRoot(root, dryRun)
+		pruned += n
+		if err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
+
+// pruneRoot prunes the PDFs of the documents of one tenant.
+func pruneRoot(dir string, dryRun bool) (int, error) {
+	pruned := 0
+	for _, kind := range []string{KindInvoice, KindRectifying} {
+		root := filepath.Join(dir, kind)
+		docs, err := os.ReadDir(root)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return pruned, fmt.Errorf("error listing stored PDFs: %w", err)
+		}
+		for _, doc := range docs {
+			if _, err := strconv.Atoi(doc.Name()); err != nil || !doc.IsDir() {
+				continue // The rectifying and tenants directories, within the invoice kind's root
+			}
+			n, err := pruneDir(filepath.Join(root, doc.Name()), dryRun)
+			pruned += n
+			if err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// pruneDir deletes the PDFs of a document's directory whose version is older than the
+// newest one in it.
+func pruneDir(dir string, dryRun bool) (int, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, fmt.Errorf("error listing stored PDFs: %w", err)
+	}
+	versions := map[string]int{}
+	newest := 0
+	for _, f := range files {
+		var version int
+		if _, err := fmt.Sscanf(f.Name(), "v%d-", &version); err != nil || f.IsDir() {
+			continue
+		}
+		versions[f.Name()] = version
+		if version > newest {
+			newest = version
+		}
+	}
+	pruned := 0
+	for name, version := range versions {
+		if version == newest {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return pruned, fmt.Errorf("error pruning stored PDF: %w", err)
+			}
+		}
+		pruned++
+	}
+	return pruned, nil
+}
@@ -0,0 +1,76 @@
+// Package pdfstore keeps the PDFs generated for invoices. Once an invoice PDF has been
+// served it is a legal document: later requests must get the same bytes, even if the
+// layout templates or the issuer profile change in between. A new PDF is only
+// generated when the invoice data itself changes, which bumps its version.
+package pdfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// ErrNotFound is returned by Get when no PDF is stored under a key.
+var ErrNotFound = errors.New("stored PDF not found")
+
+// Document kinds. Rectifying invoices are numbered apart from invoices, so their
+// PDFs are kept apart too.
+const (
+	KindInvoice    = ""
+	KindRectifying = "rectifying"
+)
+
+// Key identifies one stored PDF.
+type Key struct {
+	TenantID  int    // Invoices are numbered per tenant
+	Kind      string // KindInvoice or KindRectifying
+	InvoiceID int
+	Version   int    // Invoice data version the PDF was generated from
+	Variant   string // Layout name, plus "+signed" for signed PDFs
+}
+
+// Artifact is a stored PDF.
+type Artifact struct {
+	Key
+	Data      []byte
+	SHA256    string // Hex digest of Data
+	CreatedAt time.Time
+}
+
+// ETag returns the strong entity tag for the artifact.
+func (a *Artifact) ETag() string {
+	return `"` + a.SHA256 + `"`
+}
+
+// Store persists invoice PDFs. Stored PDFs are immutable: Put never replaces an
+// existing PDF, it returns the one already stored so that concurrent requests
+// generating the same PDF all end up serving the first one. Purge deletes every PDF of
+// a document, for when its data must no longer be kept (GDPR erasure) or the document
+// is archived. Prune deletes the PDFs of superseded versions, those older than the
+// newest version stored for the same document, which are never served again; with
+// dryRun set it only counts them.
+type Store interface {
+	Get(key Key) (*Artifact, error)
+	Put(key Key, data []byte) (*Artifact, error)
+	Purge(tenantID int, kind string, invoiceID int) error
+	Prune(dryRun bool) (int, error)
+}
+
+var variantRe = regexp.MustCompile(`^[a-z0-9_-]+(\+signed)?$`)
+
+// Validate checks the key fields, which end up in file names and database keys.
+func (k Key) Validate() error {
+	if k.TenantID <= 0 || (k.Kind != KindInvoice && k.Kind != KindRectifying) || k.InvoiceID <= 0 || k.Version <= 0 || len(k.Variant) > 40 || !variantRe.MatchString(k.Variant) {
+		return fmt.Errorf("invalid PDF key %+v", k)
+	}
+	return nil
+}
+
+// Digest returns the hex SHA-256 of data, as stored in Artifact.SHA256.
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
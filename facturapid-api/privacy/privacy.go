@@ -0,0 +1,113 @@
+// Package privacy handles the personal data of customers under the GDPR: access
+// (export) and erasure requests, and the retention job that pseudonymises invoices once
+// tax law no longer requires their customer data.
+package privacy
+
+import (
+	"context"
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/pdfstore"
+	"log"
+	"time"
+)
+
+// retentionBatch is how many documents of each kind a retention run pseudonymises in
+// one transaction.
+const retentionBatch = 100
+
+// retentionActor is the actor of the pseudonymisations the retention job makes.
+var retentionActor = dto.SystemActor("retention")
+
+// Service exports and erases the data of data subjects.
+type Service struct {
+	DB   *sql.DB
+	PDFs pdfstore.Store
+	// Key is the secret pseudonyms are derived with. Changing it breaks the link
+	// between the pseudonyms made before and after.
+	Key []byte
+	// RetentionYears is how long tax law requires issued invoices to be kept intact.
+	RetentionYears int
+}
+
+// Export returns everything a tenant stores about a data subject.
+func (s *Service) Export(tenantID int, subject dto.DataSubjectDTO, actor dto.ActorDTO) (dto.DataSubjectExportDTO, error) {
+	return database.ExportDataSubject(s.DB, tenantID, s.Key, subject, actor)
+}
+
+// Erase handles an erasure request in a tenant (see database.EraseDataSubject) and
+// purges the stored PDFs of the pseudonymised documents.
+func (s *Service) Erase(tenantID int, req dto.EraseDataSubjectDTO, actor dto.ActorDTO) (dto.DataSubjectRequestDTO, error) {
+	record, err := database.EraseDataSubject(s.DB, tenantID, s.Key, s.RetentionYears, req, actor)
+	if err != nil {
+		return dto.DataSubjectRequestDTO{}, err
+	}
+	s.purgePDFs(tenantID, record)
+	return record, nil
+}
+
+// PseudonymiseExpired pseudonymises the documents of every tenant whose retention
+// period is over, and returns how many it pseudonymised.
+func (s *Service) PseudonymiseExpired() (int, error) {
+	tenants, err := database.TenantIDs(s.DB)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, tenantID := range tenants {
+		for {
+			record, err := database.PseudonymiseExpired(s.DB, tenantID, s.Key, s.RetentionYears, retentionBatch, retentionActor)
+			if err != nil {
+				return total, err
+			}
+			s.purgePDFs(tenantID, record)
+			n := len(record.Invoices) + len(record.RectifyingInvoices)
+			total += n
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+// purgePDFs deletes the stored PDFs of the documents a request pseudonymised. The data
+// is already pseudonymised, so a failure is only logged; the next erasure or retention
+// run of the document does not retry it, so it needs an operator.
+func (s *Service) purgePDFs(tenantID int, record dto.DataSubjectRequestDTO) {
+	for _, id := range record.Invoices {
+		if err := s.PDFs.Purge(tenantID, pdfstore.KindInvoice, id); err != nil {
+			log.Printf("ERROR: Stored PDFs of pseudonymised invoice %d of tenant %d were not purged: %v", id, tenantID, err)
+		}
+	}
+	for _, id := range record.RectifyingInvoices {
+		if err := s.PDFs.Purge(tenantID, pdfstore.KindRectifying, id); err != nil {
+			log.Printf("ERROR: Stored PDFs of pseudonymised rectifying invoice %d of tenant %d were not purged: %v", id, tenantID, err)
+		}
+	}
+}
+
+// Worker runs the retention job.
+type Worker struct {
+	Service  *Service
+	Interval time.Duration // Time between runs
+}
+
+// Run pseudonymises the expired documents every Interval until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if n, err := w.Service.PseudonymiseExpired(); err != nil {
+			log.Printf("Error running retention job: %v", err)
+		} else if n > 0 {
+			log.Printf("Retention job pseudonymised %d documents.", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
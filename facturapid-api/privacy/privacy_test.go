@@ -0,0 +1,119 @@
+package privacy
+
+import (
+	"errors"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"facturapid-api/pdfstore"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The privacy tests run against the PostgreSQL database in FACTURAPID_TEST_DATABASE_URL,
+// and are skipped without one. Each test works in a tenant of its own.
+
+// testService connects to the test database, creates the schema and a tenant, and
+// returns a Service storing PDFs in a temporary directory and the tenant, or skips the
+// test.
+func testService(t *testing.T) (*Service, int) {
+	t.Helper()
+	url := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	db, err := database.InitDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	tenant, err := database.CreateTenant(db, dto.TenantDTO{Code: "test-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: t.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pdfs, err := pdfstore.NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Service{DB: db, PDFs: pdfs, Key: []byte("test pseudonym key"), RetentionYears: 6}, tenant.ID
+}
+
+// customerInvoice stores invoice codigo of last month with the customer's fiscal data,
+// issues it when issued is set, and stores a PDF of it.
+func customerInvoice(t *testing.T, s *Service, tenantID, codigo int, issued bool) {
+	t.Helper()
+	b, rate := money.MustParse("10.00"), money.MustParse("21")
+	quota := money.VATQuota(b, rate)
+	fecha, hora := time.Now().UTC().AddDate(0, -1, 0).Format("2006-01-02"), "12:00:00"
+	inv := dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: codigo, Serie: "A", Tarifa: "1", Fecha: &fecha, Hora: &hora,
+			Base1: &b, Iva1: &rate, CuotaIva1: &quota, CuotaIVA: &quota, Total: b.Add(quota),
+		},
+		Lines: []dto.InvoiceLineDTO{{CodigoFactura: codigo, Linea: 1, Producto: "Menú del día", Unidades: money.One, Subtotal: b, IvaAplicado: &rate}},
+	}
+	if _, err := database.CreateFullInvoice(s.DB, tenantID, inv, dto.SystemActor("test")); err != nil {
+		t.Fatal(err)
+	}
+	name, nif, email := "Ana Núñez", "12345678Z", "ana@example.com"
+	data := dto.FiscalDataDTO{ClienteNombre: &name, ClienteNIF: &nif, ClienteEmail: &email}
+	version, err := database.UpdateInvoiceFiscalData(s.DB, tenantID, codigo, data, 1, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued {
+		if version, err = database.IssueInvoice(s.DB, tenantID, codigo, dto.SystemActor("test")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.PDFs.Put(pdfKey(tenantID, codigo, version), []byte("%PDF-1.4 Ana Núñez")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pdfKey(tenantID, codigo, version int) pdfstore.Key {
+	return pdfstore.Key{TenantID: tenantID, Kind: pdfstore.KindInvoice, InvoiceID: codigo, Version: version, Variant: "a4"}
+}
+
+func TestErasePurgesPDFsOfPseudonymisedInvoices(t *testing.T) {
+	s, tenantID := testService(t)
+	customerInvoice(t, s, tenantID, 1, true)  // Issued: retained
+	customerInvoice(t, s, tenantID, 2, false) // Never issued: pseudonymised
+
+	retained, err := database.GetFullInvoiceByID(s.DB, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	erased, err := database.GetFullInvoiceByID(s.DB, tenantID, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := dto.EraseDataSubjectDTO{DataSubjectDTO: dto.DataSubjectDTO{NIF: "12345678Z"}, RequestedBy: "DPO", Reason: "Art. 17 RGPD"}
+	record, err := s.Erase(tenantID, req, dto.SystemActor("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Invoices) != 1 || record.Invoices[0] != 2 || len(record.RetainedInvoices) != 1 || record.RetainedInvoices[0] != 1 {
+		t.Fatalf("pseudonymised %v, retained %v, want [2] and [1]", record.Invoices, record.RetainedInvoices)
+	}
+
+	if _, err := s.PDFs.Get(pdfKey(tenantID, 1, retained.Header.Version)); err != nil {
+		t.Errorf("PDF of the retained invoice: %v, want it kept", err)
+	}
+	if _, err := s.PDFs.Get(pdfKey(tenantID, 2, erased.Header.Version)); !errors.Is(err, pdfstore.ErrNotFound) {
+		t.Errorf("PDF of the pseudonymised invoice: %v, want it purged", err)
+	}
+	after, err := database.GetFullInvoiceByID(s.DB, tenantID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Header.Cliente3 == nil || *after.Header.Cliente3 != "12345678Z" || after.Header.Cliente1 == nil || *after.Header.Cliente1 != "Ana Núñez" {
+		t.Errorf("retained invoice customer %v, %v, want it kept", after.Header.Cliente1, after.Header.Cliente3)
+	}
+}
@@ -0,0 +1,105 @@
+// Package reports renders the reports of the API in the formats other than JSON, for
+// spreadsheets and accounting software.
+package reports
+
+import (
+	"encoding/csv"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"io"
+	"strconv"
+)
+
+// noValue is the column name of the invoices without a tipo_cobro or a vendedor.
+const noValue = "(none)"
+
+// WriteDailyCSV writes a daily report as CSV: one row per day with sales and a last
+// row with the totals, whose fecha is "total". After the fixed columns come, for each
+// VAT rate, payment method and vendedor of the period, its columns, so every day is a
+// single row a spreadsheet can add up.
+func WriteDailyCSV(w io.Writer, report dto.DailyReportDTO) error {
+	totals := report.Totals
+	header := []string{
+		"fecha", "invoices", "total", "comensales", "average_ticket_per_diner", "cobro_mixto", "efectivo_mixto",
+	}
+	for _, r := range totals.VATRates {
+		rate := r.Rate.String()
+		header = append(header, "base_"+rate, "cuota_iva_"+rate)
+	}
+	for _, p := range totals.PaymentMethods {
+		header = append(header, "total_tipo_cobro_"+valueOrNone(p.TipoCobro))
+	}
+	for _, v := range totals.Vendedores {
+		header = append(header, "total_vendedor_"+valueOrNone(v.Vendedor))
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, d := range report.Days {
+		if err := cw.Write(dailyCSVRow(d.Fecha, d, totals)); err != nil {
+			return err
+		}
+	}
+	if err := cw.Write(dailyCSVRow("total", totals, totals)); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// dailyCSVRow returns the row of a day, with the columns of the VAT rates, payment
+// methods and vendedores of the period; those the day has none of are 0.
+func dailyCSVRow(fecha string, d, totals dto.DailySalesDTO) []string {
+	average := ""
+	if d.AverageTicketPerDiner != nil {
+		average = d.AverageTicketPerDiner.String()
+	}
+	row := []string{
+		fecha, strconv.Itoa(d.Invoices), d.Total.String(), strconv.Itoa(d.Comensales), average,
+		d.CobroMixto.String(), d.EfectivoMixto.String(),
+	}
+	for _, t := range totals.VATRates {
+		base, quota := money.Zero, money.Zero
+		for _, r := range d.VATRates {
+			if r.Rate == t.Rate {
+				base, quota = r.Base, r.CuotaIVA
+			}
+		}
+		row = append(row, base.String(), quota.String())
+	}
+	for _, t := range totals.PaymentMethods {
+		total := money.Zero
+		for _, p := range d.PaymentMethods {
+			if sameValue(p.TipoCobro, t.TipoCobro) {
+				total = p.Total
+			}
+		}
+		row = append(row, total.String())
+	}
+	for _, t := range totals.Vendedores {
+		total := money.Zero
+		for _, v := range d.Vendedores {
+			if sameValue(v.Vendedor, t.Vendedor) {
+				total = v.Total
+			}
+		}
+		row = append(row, total.String())
+	}
+	return row
+}
+
+func valueOrNone(s *string) string {
+	if s == nil {
+		return noValue
+	}
+	return *s
+}
+
+func sameValue(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
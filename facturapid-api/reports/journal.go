@@ -0,0 +1,201 @@
+package reports
+
+import (
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Kinds of journal lines, in the order they are listed in an entry; the rounding line
+// comes last.
+const (
+	linePayment = iota
+	lineSales
+	lineVAT
+	lineSurcharge
+)
+
+type journalKey struct {
+	kind     int
+	cuenta   string
+	concepto string
+}
+
+// journalEntry adds up the amounts of a day per account and concept: positive on the
+// debit side, negative on the credit side.
+type journalEntry struct {
+	fecha     string
+	documents int
+	amounts   map[journalKey]money.Decimal
+}
+
+func (e *journalEntry) add(kind int, cuenta, concepto string, amount money.Decimal) {
+	k := journalKey{kind, cuenta, concepto}
+	e.amounts[k] = e.amounts[k].Add(amount)
+}
+
+// Journal returns the journal of the documents issued from one day to another, in the
+// order ListIssuedDocuments returns them, booked with mapping m. Rectifying invoices
+// are booked with their days' invoices: by differences as they are, negative amounts
+// on the other side; by substitution as what they change, their amounts less those
+// of the rectified invoice.
+func Journal(docs []dto.IssuedDocumentDTO, m dto.AccountMappingDTO, from, to string) dto.JournalDTO {
+	j := dto.JournalDTO{From: from, To: to, Entries: []dto.JournalEntryDTO{}}
+	var day *journalEntry
+	for _, d := range docs {
+		if day == nil || day.fecha != d.Fecha {
+			if day != nil {
+				j.Entries = append(j.Entries, day.entry(len(j.Entries)+1, m))
+			}
+			day = &journalEntry{fecha: d.Fecha, amounts: map[journalKey]money.Decimal{}}
+		}
+		day.documents++
+		bookDocument(day, d, m)
+	}
+	if day != nil {
+		j.Entries = append(j.Entries, day.entry(len(j.Entries)+1, m))
+	}
+	return j
+}
+
+func bookDocument(e *journalEntry, d dto.IssuedDocumentDTO, m dto.AccountMappingDTO) {
+	groups, total := d.VATGroups, d.Total
+	p := d.Payment
+	if r := d.Rectification; r != nil && r.Metodo == dto.RectificationBySubstitution {
+		for _, g := range r.OriginalVATGroups {
+			groups = append(groups, dto.VATGroup{
+				Rate: g.Rate, Base: g.Base.Neg(), Quota: g.Quota.Neg(),
+				SurchargeRate: g.SurchargeRate, SurchargeQuota: g.SurchargeQuota.Neg(),
+			})
+		}
+		total = total.Sub(r.OriginalTotal)
+		// What was paid for the rectified invoice is not known: the difference is
+		// booked on the rectifying invoice's tipo_cobro
+		p = dto.IssuedPaymentDTO{TipoCobro: p.TipoCobro}
+	}
+
+	for _, g := range groups {
+		rate := g.Rate.String()
+		if g.Exempt() {
+			e.add(lineSales, rateAccount(m.SalesByRate, rate, m.Sales), "Ventas exentas", g.Base.Neg())
+		} else {
+			e.add(lineSales, rateAccount(m.SalesByRate, rate, m.Sales), "Ventas IVA "+rate+"%", g.Base.Neg())
+			e.add(lineVAT, rateAccount(m.VATByRate, rate, m.VAT), "IVA repercutido "+rate+"%", g.Quota.Neg())
+		}
+		if !g.SurchargeQuota.IsZero() {
+			e.add(lineSurcharge, m.Surcharge, "Recargo de equivalencia "+g.SurchargeRate.String()+"%", g.SurchargeQuota.Neg())
+		}
+	}
+
+	// The parts of a mixed payment are booked on their own accounts, the rest of the
+	// total on the tipo_cobro's
+	rest := total
+	parts := []struct {
+		tipo   *string
+		amount money.Decimal
+	}{{p.TipoCobroMixto, p.CobroMixto}, {p.TipoCobroMixto2, p.CobroMixto2}}
+	for _, part := range parts {
+		if !part.amount.IsZero() {
+			cuenta, concepto := paymentAccount(m, part.tipo)
+			e.add(linePayment, cuenta, concepto, part.amount)
+			rest = rest.Sub(part.amount)
+		}
+	}
+	if !p.EfectivoMixto.IsZero() {
+		e.add(linePayment, m.Cash, "Cobros efectivo", p.EfectivoMixto)
+		rest = rest.Sub(p.EfectivoMixto)
+	}
+	cuenta, concepto := paymentAccount(m, p.TipoCobro)
+	e.add(linePayment, cuenta, concepto, rest)
+}
+
+func rateAccount(byRate map[string]string, rate, fallback string) string {
+	if cuenta, ok := byRate[rate]; ok {
+		return cuenta
+	}
+	return fallback
+}
+
+// paymentAccount returns the account and concept of the payments with a tipo_cobro.
+func paymentAccount(m dto.AccountMappingDTO, tipoCobro *string) (string, string) {
+	tipo := ""
+	if tipoCobro != nil {
+		tipo = strings.TrimSpace(*tipoCobro)
+	}
+	if tipo == "" {
+		return m.Payment, "Cobros sin tipo de cobro"
+	}
+	cuenta, ok := m.PaymentMethods[strings.ToLower(tipo)]
+	if !ok {
+		cuenta = m.Payment
+	}
+	return cuenta, "Cobros " + strings.ToLower(tipo)
+}
+
+// entry rounds the amounts of the day to the cent, and books on the rounding account
+// what the entry is then off balance.
+func (e *journalEntry) entry(asiento int, m dto.AccountMappingDTO) dto.JournalEntryDTO {
+	keys := make([]journalKey, 0, len(e.amounts))
+	for k := range e.amounts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.cuenta != b.cuenta {
+			return a.cuenta < b.cuenta
+		}
+		return a.concepto < b.concepto
+	})
+
+	je := dto.JournalEntryDTO{
+		Asiento:   asiento,
+		Fecha:     e.fecha,
+		Concepto:  "Ventas del " + bookDate(&e.fecha),
+		Documents: e.documents,
+		Lines:     []dto.JournalLineDTO{},
+	}
+	var balance money.Decimal
+	appendLine := func(cuenta, concepto string, amount money.Decimal) {
+		if amount.IsZero() {
+			return
+		}
+		l := dto.JournalLineDTO{Cuenta: cuenta, Concepto: concepto}
+		if amount.Sign() > 0 {
+			l.Debe = amount
+		} else {
+			l.Haber = amount.Neg()
+		}
+		je.Lines = append(je.Lines, l)
+		balance = balance.Add(amount)
+	}
+	for _, k := range keys {
+		appendLine(k.cuenta, k.concepto, e.amounts[k].Round(2))
+	}
+	appendLine(m.Rounding, "Diferencias de redondeo", balance.Neg())
+	return je
+}
+
+// JournalTable lays the journal out a line per row, with the entry number and date
+// (DD/MM/YYYY) on each, as accounting software imports it.
+func JournalTable(j dto.JournalDTO) Table {
+	t := Table{
+		Name:   "Diario",
+		Header: []string{"Asiento", "Fecha", "Cuenta", "Concepto", "Debe", "Haber"},
+		Rows:   [][]Cell{},
+	}
+	for _, e := range j.Entries {
+		for _, l := range e.Lines {
+			debe, haber := l.Debe, l.Haber
+			t.Rows = append(t.Rows, []Cell{
+				Number(strconv.Itoa(e.Asiento)), Text(bookDate(&e.Fecha)), Text(l.Cuenta), Text(l.Concepto),
+				amountCell(&debe), amountCell(&haber),
+			})
+		}
+	}
+	return t
+}
@@ -0,0 +1,103 @@
+package reports
+
+import (
+	"bytes"
+	"encoding/json"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"testing"
+)
+
+// testJournal is three days of a restaurant, in the order ListIssuedDocuments returns
+// them: payments in cash, by card, mixed and without tipo_cobro, recargo de
+// equivalencia, an exempt invoice, a rate the mapping has no account for, a total a
+// cent off its amounts, and two rectifying invoices, by differences and by
+// substitution. Cards have an account of their own in the mapping.
+func testJournal() ([]dto.IssuedDocumentDTO, dto.AccountMappingDTO) {
+	efectivo, tarjeta := strPtr("EFECTIVO"), strPtr("Tarjeta")
+	docs := []dto.IssuedDocumentDTO{
+		{Serie: "A", Codigo: 1, Fecha: "2026-01-15", Total: money.MustParse("12.10"),
+			VATGroups: []dto.VATGroup{group(1, "10", "21", "2.10")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: efectivo}},
+		{Serie: "A", Codigo: 2, Fecha: "2026-01-15", Total: money.MustParse("79.20"),
+			Nombre: strPtr("Muñoz, Ibáñez & Hijos S.L."), NIF: strPtr("B87654321"),
+			VATGroups: []dto.VATGroup{group(1, "50", "10", "5"), group(2, "20", "21", "4.20")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: tarjeta}},
+		{Serie: "A", Codigo: 3, Fecha: "2026-01-15", Total: money.MustParse("30.25"),
+			VATGroups: []dto.VATGroup{group(1, "25", "21", "5.25")},
+			Payment: dto.IssuedPaymentDTO{TipoCobro: strPtr("Bizum"),
+				CobroMixto: money.MustParse("10"), TipoCobroMixto: strPtr("tarjeta"), EfectivoMixto: money.MustParse("5")}},
+		{Serie: "A", Codigo: 4, Fecha: "2026-01-16", Total: money.MustParse("126.20"),
+			Nombre: strPtr("Ultramarinos Sol"), NIF: strPtr("12345678Z"),
+			VATGroups: []dto.VATGroup{group(1, "100", "21", "21", "5.2", "5.20")}},
+		{Serie: "A", Codigo: 5, Fecha: "2026-01-16", Total: money.MustParse("30"), CausaExencion: strPtr("E2"),
+			VATGroups: []dto.VATGroup{group(1, "30", "0", "0")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: efectivo}},
+		{Serie: "A", Codigo: 6, Fecha: "2026-01-16", Total: money.MustParse("10.55"),
+			VATGroups: []dto.VATGroup{group(1, "10", "5.5", "0.55")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: efectivo}},
+		{Serie: "A", Codigo: 7, Fecha: "2026-01-16", Total: money.MustParse("12.11"),
+			VATGroups: []dto.VATGroup{group(1, "10", "21", "2.10")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: efectivo}},
+		{Serie: "A", Codigo: 8, Fecha: "2026-01-20", Total: money.MustParse("12.10"),
+			VATGroups: []dto.VATGroup{group(1, "10", "21", "2.10")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: tarjeta}},
+		{Serie: "R", Codigo: 1, Fecha: "2026-01-20", Total: money.MustParse("-6.05"),
+			VATGroups: []dto.VATGroup{group(1, "-5", "21", "-1.05")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: efectivo},
+			Rectification: &dto.RectificationDTO{Tipo: dto.RectificationR5, Metodo: dto.RectificationByDifferences,
+				Original: "A-1", OriginalFecha: strPtr("2026-01-15"), Motivo: strPtr("Devolución")}},
+		{Serie: "R", Codigo: 2, Fecha: "2026-01-20", Total: money.MustParse("68.20"),
+			Nombre: strPtr("Muñoz, Ibáñez & Hijos S.L."), NIF: strPtr("B87654321"),
+			VATGroups: []dto.VATGroup{group(1, "40", "10", "4"), group(2, "20", "21", "4.20")},
+			Payment:   dto.IssuedPaymentDTO{TipoCobro: tarjeta},
+			Rectification: &dto.RectificationDTO{Tipo: dto.RectificationR1, Metodo: dto.RectificationBySubstitution,
+				Original: "A-2", OriginalFecha: strPtr("2026-01-15"),
+				BaseRectificada: decPtr("70"), CuotaRectificada: decPtr("9.20"),
+				OriginalTotal:     money.MustParse("79.20"),
+				OriginalVATGroups: []dto.VATGroup{group(1, "50", "10", "5"), group(2, "20", "21", "4.20")}}},
+	}
+	m := dto.DefaultAccountMapping()
+	m.PaymentMethods["tarjeta"] = "57200001"
+	return docs, m
+}
+
+// TestJournal checks the entries against the golden file, and that each balances.
+func TestJournal(t *testing.T) {
+	docs, m := testJournal()
+	j := Journal(docs, m, "2026-01-15", "2026-01-20")
+	for _, e := range j.Entries {
+		var debe, haber money.Decimal
+		for _, l := range e.Lines {
+			debe, haber = debe.Add(l.Debe), haber.Add(l.Haber)
+		}
+		if debe.Cmp(haber) != 0 {
+			t.Errorf("entry %d of %s: debe %s, haber %s", e.Asiento, e.Fecha, debe, haber)
+		}
+	}
+	got, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "journal.json", append(got, '\n'))
+}
+
+func TestJournalCSV(t *testing.T) {
+	docs, m := testJournal()
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, JournalTable(Journal(docs, m, "2026-01-15", "2026-01-20"))); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "journal.csv", buf.Bytes())
+}
+
+func TestJournalEmpty(t *testing.T) {
+	j := Journal(nil, dto.DefaultAccountMapping(), "2026-01-15", "2026-01-20")
+	got, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"from":"2026-01-15","to":"2026-01-20","entries":[]}`; string(got) != want {
+		t.Errorf("journal without documents = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,143 @@
+package reports
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Table is a report laid out as a single sheet: a header row and the data rows, which
+// WriteCSV and WriteXLSX render alike.
+type Table struct {
+	Name   string // Sheet name of the XLSX, at most 31 characters
+	Header []string
+	Rows   [][]Cell
+}
+
+// Cell is a value of a Table. Numbers are written as numbers in the XLSX so the
+// spreadsheet can add them up; Text then holds them with a dot as decimal separator.
+type Cell struct {
+	Text   string
+	Number bool
+}
+
+// Text returns a text cell.
+func Text(s string) Cell { return Cell{Text: s} }
+
+// Number returns a number cell.
+func Number(s string) Cell { return Cell{Text: s, Number: true} }
+
+// WriteCSV writes t as CSV, the header first.
+func WriteCSV(w io.Writer, t Table) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(t.Header); err != nil {
+		return err
+	}
+	for _, row := range t.Rows {
+		record := make([]string, len(row))
+		for i, cell := range row {
+			record[i] = cell.Text
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// xlsxParts are the fixed parts of a workbook with a single sheet; WriteXLSX adds the
+// workbook, which names the sheet, and the sheet itself.
+var xlsxParts = []struct{ name, content string }{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// WriteXLSX writes t as an Office Open XML workbook with a single sheet. Text cells
+// are inline strings, so the workbook needs no shared strings nor styles.
+func WriteXLSX(w io.Writer, t Table) error {
+	zw := zip.NewWriter(w)
+	for _, p := range xlsxParts {
+		if err := writeZipPart(zw, p.name, p.content); err != nil {
+			return err
+		}
+	}
+
+	workbook := xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+		`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="` + escapeXML(t.Name) + `" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	if err := writeZipPart(zw, "xl/workbook.xml", workbook); err != nil {
+		return err
+	}
+
+	var sheet strings.Builder
+	sheet.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]Cell, len(t.Header))
+	for i, h := range t.Header {
+		header[i] = Text(h)
+	}
+	writeXLSXRow(&sheet, 1, header)
+	for i, row := range t.Rows {
+		writeXLSXRow(&sheet, i+2, row)
+	}
+	sheet.WriteString(`</sheetData></worksheet>`)
+	if err := writeZipPart(zw, "xl/worksheets/sheet1.xml", sheet.String()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func writeZipPart(zw *zip.Writer, name, content string) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+	_, err = io.WriteString(f, content)
+	return err
+}
+
+// writeXLSXRow writes the row r (1-based) of a sheet. Empty cells are left out.
+func writeXLSXRow(sb *strings.Builder, r int, cells []Cell) {
+	sb.WriteString(`<row r="` + strconv.Itoa(r) + `">`)
+	for i, cell := range cells {
+		if cell.Text == "" {
+			continue
+		}
+		ref := columnName(i) + strconv.Itoa(r)
+		if cell.Number {
+			sb.WriteString(`<c r="` + ref + `"><v>` + escapeXML(cell.Text) + `</v></c>`)
+		} else {
+			sb.WriteString(`<c r="` + ref + `" t="inlineStr"><is><t>` + escapeXML(cell.Text) + `</t></is></c>`)
+		}
+	}
+	sb.WriteString(`</row>`)
+}
+
+// columnName returns the letters of the column i (0-based): A..Z, AA, AB...
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func escapeXML(s string) string {
+	var sb strings.Builder
+	xml.EscapeText(&sb, []byte(s))
+	return sb.String()
+}
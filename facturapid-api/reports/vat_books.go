@@ -0,0 +1,201 @@
+package reports
+
+import (
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"strconv"
+)
+
+// Operation codes of the libro registro.
+const (
+	claveRegimenGeneral = "01"
+	calificacionSujeta  = "S1" // Sujeta y no exenta, sin inversión del sujeto pasivo
+	defaultExencion     = "E1" // Same default as the printed exemption note
+)
+
+// LibroRegistro returns the libro registro de facturas expedidas of the quarter q from
+// its issued documents, in the order given: a row per VAT rate of each document.
+func LibroRegistro(docs []dto.IssuedDocumentDTO, q dto.QuarterQueryDTO) dto.LibroRegistroDTO {
+	l := dto.LibroRegistroDTO{Ejercicio: q.Year, Periodo: q.Period(), Entries: []dto.LibroRegistroEntryDTO{}}
+	for _, d := range docs {
+		groups := d.VATGroups
+		if len(groups) == 0 {
+			groups = []dto.VATGroup{{Index: 1}} // Still a row, so no number is missing
+		}
+		for i, g := range groups {
+			e := dto.LibroRegistroEntryDTO{
+				TipoFactura:        d.InvoiceType(),
+				FechaExpedicion:    d.Fecha,
+				FechaOperacion:     d.Fecha,
+				Serie:              d.Serie,
+				Numero:             d.Codigo,
+				NIFDestinatario:    d.NIF,
+				NombreDestinatario: d.Nombre,
+				ClaveOperacion:     claveRegimenGeneral,
+				Calificacion:       calificacionSujeta,
+				BaseImponible:      g.Base,
+				TipoIVA:            g.Rate,
+				CuotaIVA:           g.Quota,
+				TipoRecargo:        g.SurchargeRate,
+				CuotaRecargo:       g.SurchargeQuota,
+			}
+			if g.Exempt() {
+				e.Calificacion = ""
+				e.OperacionExenta = defaultExencion
+				if d.CausaExencion != nil && *d.CausaExencion != "" {
+					e.OperacionExenta = *d.CausaExencion
+				}
+			}
+			if i == 0 {
+				total := d.Total
+				e.TotalFactura = &total
+			}
+			if r := d.Rectification; r != nil {
+				original := r.Original
+				e.FacturaRectificada = &original
+				e.FechaFacturaRectificada = r.OriginalFecha
+				e.TipoRectificacion = r.Metodo
+				if i == 0 {
+					e.BaseRectificada, e.CuotaRectificada = r.BaseRectificada, r.CuotaRectificada
+				}
+			}
+			l.Entries = append(l.Entries, e)
+		}
+	}
+	return l
+}
+
+// LibroRegistroTable lays the libro registro out in the columns of the AEAT model for
+// the libros registro of IVA, with the dates as DD/MM/YYYY.
+func LibroRegistroTable(l dto.LibroRegistroDTO) Table {
+	t := Table{
+		Name: "Facturas expedidas",
+		Header: []string{
+			"Ejercicio", "Periodo", "Tipo de Factura", "Fecha Expedición", "Fecha Operación", "Serie",
+			"Número", "NIF Destinatario", "Nombre Destinatario", "Clave de Operación",
+			"Calificación de la Operación", "Operación Exenta", "Total Factura", "Base Imponible",
+			"Tipo de IVA", "Cuota IVA Repercutida", "Tipo de Recargo eq.", "Cuota Recargo eq.",
+			"Factura Rectificada", "Fecha Factura Rectificada", "Tipo Rectificación", "Base Rectificada",
+			"Cuota Rectificada",
+		},
+		Rows: [][]Cell{},
+	}
+	for _, e := range l.Entries {
+		t.Rows = append(t.Rows, []Cell{
+			Number(strconv.Itoa(l.Ejercicio)), Text(l.Periodo), Text(e.TipoFactura),
+			Text(bookDate(&e.FechaExpedicion)), Text(bookDate(&e.FechaOperacion)), Text(e.Serie),
+			Number(strconv.Itoa(e.Numero)), Text(stringOrEmpty(e.NIFDestinatario)),
+			Text(stringOrEmpty(e.NombreDestinatario)), Text(e.ClaveOperacion), Text(e.Calificacion),
+			Text(e.OperacionExenta), amountCell(e.TotalFactura), amountCell(&e.BaseImponible),
+			Number(e.TipoIVA.String()), amountCell(&e.CuotaIVA), Number(e.TipoRecargo.String()),
+			amountCell(&e.CuotaRecargo), Text(stringOrEmpty(e.FacturaRectificada)),
+			Text(bookDate(e.FechaFacturaRectificada)), Text(e.TipoRectificacion),
+			amountCell(e.BaseRectificada), amountCell(e.CuotaRectificada),
+		})
+	}
+	return t
+}
+
+// Boxes of the Modelo 303 for the IVA devengado: base, rate and quota of each rate.
+var (
+	regimenGeneralBoxes = map[money.Decimal][]string{
+		money.MustParse("4"):  {"01", "02", "03"},
+		money.MustParse("10"): {"04", "05", "06"},
+		money.MustParse("21"): {"07", "08", "09"},
+		money.MustParse("5"):  {"153", "154", "155"},
+	}
+	recargoEquivalenciaBoxes = map[money.Decimal][]string{
+		money.MustParse("0.5"):  {"16", "17", "18"},
+		money.MustParse("1.4"):  {"19", "20", "21"},
+		money.MustParse("5.2"):  {"22", "23", "24"},
+		money.MustParse("1.75"): {"156", "157", "158"},
+		money.MustParse("0.62"): {"168", "169", "170"},
+	}
+)
+
+// Modelo303 returns the pre-calculation of the IVA devengado of the quarter q from its
+// issued documents. The invoices add up per rate; the rectifying invoices go to the
+// boxes of modifications (14 and 15), whatever their rates.
+func Modelo303(docs []dto.IssuedDocumentDTO, q dto.QuarterQueryDTO) dto.Modelo303DTO {
+	m := dto.Modelo303DTO{Ejercicio: q.Year, Periodo: q.Period(), Warnings: []string{}}
+	bases, quotas := money.SumByRate{}, money.SumByRate{}
+	surchargeBases, surchargeQuotas := money.SumByRate{}, money.SumByRate{}
+	for _, d := range docs {
+		if r := d.Rectification; r != nil {
+			m.RectifyingInvoices++
+			for _, g := range d.VATGroups {
+				m.ModificacionBases = m.ModificacionBases.Add(g.Base)
+				m.ModificacionCuotas = m.ModificacionCuotas.Add(g.Quota).Add(g.SurchargeQuota)
+			}
+			if r.Metodo == dto.RectificationBySubstitution {
+				if r.BaseRectificada != nil {
+					m.ModificacionBases = m.ModificacionBases.Sub(*r.BaseRectificada)
+				}
+				if r.CuotaRectificada != nil {
+					m.ModificacionCuotas = m.ModificacionCuotas.Sub(*r.CuotaRectificada)
+				}
+			}
+			continue
+		}
+		m.Invoices++
+		for _, g := range d.VATGroups {
+			if g.Rate.IsZero() {
+				m.BaseExenta = m.BaseExenta.Add(g.Base)
+			} else {
+				bases.Add(g.Rate, g.Base)
+				quotas.Add(g.Rate, g.Quota)
+			}
+			if !g.SurchargeRate.IsZero() {
+				surchargeBases.Add(g.SurchargeRate, g.Base)
+				surchargeQuotas.Add(g.SurchargeRate, g.SurchargeQuota)
+			}
+		}
+	}
+
+	m.RegimenGeneral = modelo303Lines(bases, quotas, regimenGeneralBoxes, "VAT rate", &m.Warnings)
+	m.RecargoEquivalencia = modelo303Lines(surchargeBases, surchargeQuotas, recargoEquivalenciaBoxes, "Recargo de equivalencia rate", &m.Warnings)
+	m.TotalCuotaDevengada = m.ModificacionCuotas
+	for _, l := range append(append([]dto.Modelo303LineDTO{}, m.RegimenGeneral...), m.RecargoEquivalencia...) {
+		m.TotalCuotaDevengada = m.TotalCuotaDevengada.Add(l.Cuota)
+	}
+	return m
+}
+
+// modelo303Lines returns a line per rate of bases, sorted by rate, with its boxes; rates
+// without boxes get a warning.
+func modelo303Lines(bases, quotas money.SumByRate, boxes map[money.Decimal][]string, kind string, warnings *[]string) []dto.Modelo303LineDTO {
+	lines := []dto.Modelo303LineDTO{}
+	for _, b := range bases.Sorted() {
+		casillas, ok := boxes[b.Rate]
+		if !ok {
+			casillas = []string{}
+			*warnings = append(*warnings, fmt.Sprintf("%s %s%% has no box in the Modelo 303.", kind, b.Rate))
+		}
+		lines = append(lines, dto.Modelo303LineDTO{Casillas: casillas, Base: b.Amount, Rate: b.Rate, Cuota: quotas[b.Rate]})
+	}
+	return lines
+}
+
+// bookDate turns a YYYY-MM-DD date into the DD/MM/YYYY of the libros registro.
+func bookDate(s *string) string {
+	if s == nil || len(*s) != len("2006-01-02") {
+		return stringOrEmpty(s)
+	}
+	d := *s
+	return d[8:10] + "/" + d[5:7] + "/" + d[0:4]
+}
+
+func amountCell(d *money.Decimal) Cell {
+	if d == nil {
+		return Text("")
+	}
+	return Number(d.StringFixed(2))
+}
+
+func stringOrEmpty(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,138 @@
+package reports
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func strPtr(s string) *string { return &s }
+
+func decPtr(s string) *money.Decimal {
+	d := money.MustParse(s)
+	return &d
+}
+
+// group returns the VAT group index: base at rate with its quota, and the rate and
+// quota of its recargo de equivalencia when given.
+func group(index int, base, rate, quota string, surcharge ...string) dto.VATGroup {
+	g := dto.VATGroup{Index: index, Base: money.MustParse(base), Rate: money.MustParse(rate), Quota: money.MustParse(quota)}
+	if len(surcharge) == 2 {
+		g.SurchargeRate, g.SurchargeQuota = money.MustParse(surcharge[0]), money.MustParse(surcharge[1])
+	}
+	return g
+}
+
+// testQuarter is the first quarter of 2026 of a restaurant: a ticket, an invoice to a
+// company with two rates, one with recargo de equivalencia, an exempt one, one at a
+// rate the Modelo 303 has no box for, and two rectifying invoices, by differences and
+// by substitution.
+func testQuarter() ([]dto.IssuedDocumentDTO, dto.QuarterQueryDTO) {
+	docs := []dto.IssuedDocumentDTO{
+		{Serie: "A", Codigo: 1, Fecha: "2026-01-15", Total: money.MustParse("12.10"),
+			VATGroups: []dto.VATGroup{group(1, "10", "21", "2.10")}},
+		{Serie: "A", Codigo: 2, Fecha: "2026-01-20", Total: money.MustParse("79.20"),
+			Nombre: strPtr("Muñoz, Ibáñez & Hijos S.L."), NIF: strPtr("B87654321"),
+			VATGroups: []dto.VATGroup{group(1, "50", "10", "5"), group(2, "20", "21", "4.20")}},
+		{Serie: "A", Codigo: 3, Fecha: "2026-02-03", Total: money.MustParse("126.20"),
+			Nombre: strPtr("Ultramarinos Sol"), NIF: strPtr("12345678Z"),
+			VATGroups: []dto.VATGroup{group(1, "100", "21", "21", "5.2", "5.20")}},
+		{Serie: "A", Codigo: 4, Fecha: "2026-02-10", Total: money.MustParse("30"), CausaExencion: strPtr("E2"),
+			VATGroups: []dto.VATGroup{group(1, "30", "0", "0")}},
+		{Serie: "A", Codigo: 5, Fecha: "2026-03-01", Total: money.MustParse("10.20"),
+			VATGroups: []dto.VATGroup{group(1, "10", "2", "0.20")}},
+		{Serie: "R", Codigo: 1, Fecha: "2026-03-05", Total: money.MustParse("-6.05"),
+			VATGroups: []dto.VATGroup{group(1, "-5", "21", "-1.05")},
+			Rectification: &dto.RectificationDTO{Tipo: dto.RectificationR5, Metodo: dto.RectificationByDifferences,
+				Original: "A-1", OriginalFecha: strPtr("2026-01-15"), Motivo: strPtr("Devolución")}},
+		{Serie: "R", Codigo: 2, Fecha: "2026-03-06", Total: money.MustParse("68.20"),
+			Nombre: strPtr("Muñoz, Ibáñez & Hijos S.L."), NIF: strPtr("B87654321"),
+			VATGroups: []dto.VATGroup{group(1, "40", "10", "4"), group(2, "20", "21", "4.20")},
+			Rectification: &dto.RectificationDTO{Tipo: dto.RectificationR1, Metodo: dto.RectificationBySubstitution,
+				Original: "A-2", OriginalFecha: strPtr("2026-01-20"),
+				BaseRectificada: decPtr("70"), CuotaRectificada: decPtr("9.20")}},
+	}
+	return docs, dto.QuarterQueryDTO{Year: 2026, Quarter: 1}
+}
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run go test -update if the change is intended)\ngot:\n%s\nwant:\n%s", path, got, want)
+	}
+}
+
+func TestLibroRegistroCSV(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, LibroRegistroTable(LibroRegistro(testQuarter()))); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "libro_registro.csv", buf.Bytes())
+}
+
+// TestLibroRegistroXLSX checks the parts of the workbook, and the sheet and workbook
+// against the golden files: the zip itself depends on the compressor.
+func TestLibroRegistroXLSX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteXLSX(&buf, LibroRegistroTable(LibroRegistro(testQuarter()))); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip file: %v", err)
+	}
+	parts := map[string][]byte{}
+	var names []string
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name] = data
+		names = append(names, f.Name)
+	}
+	want := []string{"[Content_Types].xml", "_rels/.rels", "xl/_rels/workbook.xml.rels", "xl/workbook.xml", "xl/worksheets/sheet1.xml"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("workbook parts = %q, want %q", names, want)
+	}
+	checkGolden(t, "libro_registro_workbook.xml", parts["xl/workbook.xml"])
+	checkGolden(t, "libro_registro_sheet1.xml", parts["xl/worksheets/sheet1.xml"])
+}
+
+// TestModelo303Boxes checks the boxes each rate goes to, the modifications of the
+// rectifying invoices and the total, against the golden file.
+func TestModelo303Boxes(t *testing.T) {
+	m := Modelo303(testQuarter())
+	got, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "modelo303.json", append(got, '\n'))
+}
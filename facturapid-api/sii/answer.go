@@ -0,0 +1,126 @@
+package sii
+
+import (
+	"encoding/xml"
+	"facturapid-api/dto"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const siiRNS = "https://www2.agenciatributaria.gob.es/static_files/common/internet/dep/aplicaciones/es/aeat/ssii/fact/ws/RespuestaSuministro.xsd"
+
+// Values of EstadoEnvio and EstadoRegistro in the SII's answers.
+const (
+	estadoCorrecto             = "Correcto"
+	estadoParcialmenteCorrecto = "ParcialmenteCorrecto"
+	estadoAceptadoConErrores   = "AceptadoConErrores"
+	estadoIncorrecto           = "Incorrecto"
+)
+
+// errorDuplicate is the error code of a document registered before. The document is
+// in the SII already, so it counts as accepted.
+const errorDuplicate = 3000
+
+// The answer is read by local names only: the AEAT prefixes its elements, the Stub
+// writes them in default namespaces.
+
+type answerEnvelope struct {
+	XMLName xml.Name // Envelope
+	Body    struct {
+		Fault     *fault     `xml:"Fault"`
+		Respuesta *respuesta `xml:"RespuestaLRFacturasEmitidas"`
+	} `xml:"Body"`
+}
+
+type fault struct {
+	Code   string `xml:"faultcode"`
+	String string `xml:"faultstring"`
+}
+
+type respuesta struct {
+	XMLName     xml.Name
+	CSV         string           `xml:"CSV,omitempty"`
+	EstadoEnvio string           `xml:"EstadoEnvio"`
+	Lineas      []respuestaLinea `xml:"RespuestaLinea"`
+}
+
+type respuestaLinea struct {
+	IDFactura struct {
+		NumSerieFacturaEmisor        string `xml:"NumSerieFacturaEmisor"`
+		FechaExpedicionFacturaEmisor string `xml:"FechaExpedicionFacturaEmisor"`
+	} `xml:"IDFactura"`
+	EstadoRegistro           string `xml:"EstadoRegistro"`
+	CodigoErrorRegistro      string `xml:"CodigoErrorRegistro,omitempty"`
+	DescripcionErrorRegistro string `xml:"DescripcionErrorRegistro,omitempty"`
+	CSV                      string `xml:"CSV,omitempty"`
+}
+
+// Answer is the SII's answer to a batch.
+type Answer struct {
+	Status  string  // An SIIBatch status
+	CSV     *string // Código seguro de verificación of the submission
+	Results []dto.SIIRecordResultDTO
+}
+
+// ParseAnswer reads the SII's answer to a batch. A SOAP fault, sent when the whole
+// batch is refused (bad certificate, malformed XML...), is an error.
+func ParseAnswer(body []byte) (Answer, error) {
+	var env answerEnvelope
+	if err := xml.Unmarshal(body, &env); err != nil {
+		return Answer{}, fmt.Errorf("error reading SII answer: %w", err)
+	}
+	if f := env.Body.Fault; f != nil {
+		return Answer{}, fmt.Errorf("SII fault %s: %s", strings.TrimSpace(f.Code), strings.TrimSpace(f.String))
+	}
+	r := env.Body.Respuesta
+	if r == nil {
+		return Answer{}, fmt.Errorf("SII answer without RespuestaLRFacturasEmitidas")
+	}
+
+	a := Answer{Results: []dto.SIIRecordResultDTO{}}
+	switch r.EstadoEnvio {
+	case estadoCorrecto:
+		a.Status = dto.SIIBatchAccepted
+	case estadoParcialmenteCorrecto:
+		a.Status = dto.SIIBatchPartiallyAccepted
+	case estadoIncorrecto:
+		a.Status = dto.SIIBatchRejected
+	default:
+		return Answer{}, fmt.Errorf("unknown SII EstadoEnvio %q", r.EstadoEnvio)
+	}
+	a.CSV = nonEmpty(r.CSV)
+	for _, l := range r.Lineas {
+		res := dto.SIIRecordResultDTO{
+			Number:           l.IDFactura.NumSerieFacturaEmisor,
+			CSV:              nonEmpty(l.CSV),
+			ErrorDescription: nonEmpty(l.DescripcionErrorRegistro),
+		}
+		if code, err := strconv.Atoi(strings.TrimSpace(l.CodigoErrorRegistro)); err == nil {
+			res.ErrorCode = &code
+		}
+		switch l.EstadoRegistro {
+		case estadoCorrecto:
+			res.Status = dto.SIIStatusAccepted
+		case estadoAceptadoConErrores:
+			res.Status = dto.SIIStatusAcceptedWithErrors
+		case estadoIncorrecto:
+			res.Status = dto.SIIStatusRejected
+			if res.ErrorCode != nil && *res.ErrorCode == errorDuplicate {
+				res.Status = dto.SIIStatusAccepted
+			}
+		default:
+			return Answer{}, fmt.Errorf("unknown SII EstadoRegistro %q of %s", l.EstadoRegistro, res.Number)
+		}
+		a.Results = append(a.Results, res)
+	}
+	return a, nil
+}
+
+func nonEmpty(s string) *string {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	return &s
+}
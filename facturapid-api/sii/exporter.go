@@ -0,0 +1,149 @@
+package sii
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"log"
+	"sort"
+	"time"
+)
+
+// Exporter sends the issued documents of a tenant to the SII.
+type Exporter struct {
+	DB        *sql.DB
+	Transport Transport
+}
+
+// Batch is a batch ready to be sent: the documents of an issuer and their envelope.
+type Batch struct {
+	Issuer    dto.IssuerProfileDTO
+	Documents []dto.IssuedDocumentDTO
+	XML       []byte
+}
+
+// Prepare returns the batches of the documents a tenant issued from one day to
+// another, both included, that the SII has not registered yet: those never sent,
+// pending or rejected. Documents are grouped by the NIF of their issuer profile, in
+// batches of at most MaxBatchRecords; documents without an issuer profile are left out
+// with a warning, as they have no Titular.
+func (e *Exporter) Prepare(tenantID int, from, to time.Time) ([]Batch, error) {
+	docs, err := database.ListIssuedDocuments(e.DB, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	statuses, err := database.SIISubmissionStatuses(e.DB, tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	issuers := map[string]dto.IssuerProfileDTO{} // By NIF
+	docsByNIF := map[string][]dto.IssuedDocumentDTO{}
+	profiles := map[string]*dto.IssuerProfileDTO{} // By serie and terminal; nil: none
+	for _, d := range docs {
+		switch statuses[d.Number()] {
+		case dto.SIIStatusAccepted, dto.SIIStatusAcceptedWithErrors:
+			continue
+		}
+		header := dto.InvoiceHeaderDTO{Codigo: d.Codigo, Serie: d.Serie, Terminal: d.Terminal}
+		key := d.Serie + "\x00"
+		if d.Terminal != nil {
+			key += *d.Terminal
+		}
+		issuer, seen := profiles[key]
+		if !seen {
+			p, err := database.GetIssuerProfileForInvoice(e.DB, tenantID, header)
+			switch {
+			case err == nil:
+				issuer = &p
+			case err != database.ErrIssuerProfileNotFound:
+				return nil, err
+			}
+			profiles[key] = issuer
+		}
+		if issuer == nil {
+			log.Printf("WARNING: No issuer profile for %s; it was left out of the SII batch.", d.Number())
+			continue
+		}
+		issuers[issuer.NIF] = *issuer
+		docsByNIF[issuer.NIF] = append(docsByNIF[issuer.NIF], d)
+	}
+
+	nifs := make([]string, 0, len(docsByNIF))
+	for nif := range docsByNIF {
+		nifs = append(nifs, nif)
+	}
+	sort.Strings(nifs)
+	batches := []Batch{}
+	for _, nif := range nifs {
+		pending := docsByNIF[nif]
+		for len(pending) > 0 {
+			n := len(pending)
+			if n > MaxBatchRecords {
+				n = MaxBatchRecords
+			}
+			xml, err := BuildBatch(issuers[nif], pending[:n])
+			if err != nil {
+				return nil, err
+			}
+			batches = append(batches, Batch{Issuer: issuers[nif], Documents: pending[:n], XML: xml})
+			pending = pending[n:]
+		}
+	}
+	return batches, nil
+}
+
+// Submit sends the batches Prepare returns and records the state of their documents
+// from the answers. A batch that gets no answer is recorded as failed, its documents
+// left pending, and the next batches are still sent; the error returned is only for
+// what could not be recorded.
+func (e *Exporter) Submit(tenantID int, from, to time.Time) ([]dto.SIIBatchDTO, error) {
+	batches, err := e.Prepare(tenantID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	sent := []dto.SIIBatchDTO{}
+	for _, b := range batches {
+		created, err := database.CreateSIIBatch(e.DB, tenantID, b.Summary(), b.Documents)
+		if err != nil {
+			return sent, err
+		}
+		if err := e.send(tenantID, created.ID, b); err != nil {
+			return sent, err
+		}
+		stored, err := database.GetSIIBatch(e.DB, tenantID, created.ID)
+		if err != nil {
+			return sent, err
+		}
+		sent = append(sent, stored)
+	}
+	return sent, nil
+}
+
+// send sends a recorded batch and records the answer, or the failure.
+func (e *Exporter) send(tenantID, batchID int, b Batch) error {
+	body, err := e.Transport.Send(b.XML)
+	var answer Answer
+	if err == nil {
+		answer, err = ParseAnswer(body)
+	}
+	if err != nil {
+		log.Printf("Error sending SII batch %d (%d documents of %s): %v", batchID, len(b.Documents), b.Issuer.NIF, err)
+		return database.MarkSIIBatchFailed(e.DB, tenantID, batchID, err.Error())
+	}
+	log.Printf("SII batch %d (%d documents of %s) answered %s.", batchID, len(b.Documents), b.Issuer.NIF, answer.Status)
+	return database.RecordSIIBatchAnswer(e.DB, tenantID, batchID, answer.Status, answer.CSV, answer.Results)
+}
+
+// Summary returns the batch as it is recorded, without an ID.
+func (b Batch) Summary() dto.SIIBatchDTO {
+	sum := sha256.Sum256(b.XML)
+	return dto.SIIBatchDTO{
+		IssuerNIF: b.Issuer.NIF,
+		Records:   len(b.Documents),
+		XMLSHA256: hex.EncodeToString(sum[:]),
+		CreatedAt: time.Now(),
+	}
+}
@@ -0,0 +1,259 @@
+// Package sii reports the issued invoices to the AEAT's Suministro Inmediato de
+// Información (SII): it builds the "Facturas Emitidas" batches (SuministroLRFacturas-
+// Emitidas, version 1.1), sends them through a Transport and records the state of each
+// document from the answer.
+//
+// Only registrations (A0) are sent. Documents accepted with errors must be corrected
+// with a modification (A1), which is left to the gestoría.
+package sii
+
+import (
+	"encoding/xml"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	soapNS  = "http://schemas.xmlsoap.org/soap/envelope/"
+	siiLRNS = "https://www2.agenciatributaria.gob.es/static_files/common/internet/dep/aplicaciones/es/aeat/ssii/fact/ws/SuministroLR.xsd"
+	siiNS   = "https://www2.agenciatributaria.gob.es/static_files/common/internet/dep/aplicaciones/es/aeat/ssii/fact/ws/SuministroInformacion.xsd"
+
+	versionSII          = "1.1"
+	communicationA0     = "A0" // Alta de facturas
+	claveRegimenGeneral = "01"
+	tipoNoExenta        = "S1" // Sujeta y no exenta, sin inversión del sujeto pasivo
+	defaultExencion     = "E1" // Same default as the printed exemption note
+	// operationDescription is the DescripcionOperacion of invoices; rectifying
+	// invoices give their reason instead, when they have one.
+	operationDescription = "Venta"
+)
+
+// MaxBatchRecords is the most documents the SII accepts in a batch.
+const MaxBatchRecords = 10000
+
+// Elements are declared in schema order; the schemas are strict xs:sequences.
+
+type envelope struct {
+	XMLName  xml.Name `xml:"soapenv:Envelope"`
+	XmlnsEnv string   `xml:"xmlns:soapenv,attr"`
+	XmlnsLR  string   `xml:"xmlns:siiLR,attr"`
+	XmlnsSII string   `xml:"xmlns:sii,attr"`
+	Header   struct{} `xml:"soapenv:Header"`
+	Body     struct {
+		Suministro suministro `xml:"siiLR:SuministroLRFacturasEmitidas"`
+	} `xml:"soapenv:Body"`
+}
+
+type suministro struct {
+	Cabecera  cabecera   `xml:"sii:Cabecera"`
+	Registros []registro `xml:"siiLR:RegistroLRFacturasEmitidas"`
+}
+
+type cabecera struct {
+	IDVersionSii     string  `xml:"sii:IDVersionSii"`
+	Titular          persona `xml:"sii:Titular"`
+	TipoComunicacion string  `xml:"sii:TipoComunicacion"`
+}
+
+type persona struct {
+	NombreRazon string `xml:"sii:NombreRazon"`
+	NIF         string `xml:"sii:NIF"`
+}
+
+type registro struct {
+	PeriodoLiquidacion struct {
+		Ejercicio string `xml:"sii:Ejercicio"`
+		Periodo   string `xml:"sii:Periodo"`
+	} `xml:"siiLR:PeriodoLiquidacion"`
+	IDFactura       idFactura       `xml:"siiLR:IDFactura"`
+	FacturaExpedida facturaExpedida `xml:"siiLR:FacturaExpedida"`
+}
+
+type idFactura struct {
+	IDEmisorFactura struct {
+		NIF string `xml:"sii:NIF"`
+	} `xml:"sii:IDEmisorFactura"`
+	NumSerieFacturaEmisor        string `xml:"sii:NumSerieFacturaEmisor"`
+	FechaExpedicionFacturaEmisor string `xml:"sii:FechaExpedicionFacturaEmisor"`
+}
+
+type facturasRectificadas struct {
+	IDFacturaRectificada []facturaRectificada `xml:"sii:IDFacturaRectificada"`
+}
+
+type facturaRectificada struct {
+	NumSerieFacturaEmisor        string `xml:"sii:NumSerieFacturaEmisor"`
+	FechaExpedicionFacturaEmisor string `xml:"sii:FechaExpedicionFacturaEmisor"`
+}
+
+type importeRectificacion struct {
+	BaseRectificada  string `xml:"sii:BaseRectificada"`
+	CuotaRectificada string `xml:"sii:CuotaRectificada"`
+}
+
+type facturaExpedida struct {
+	TipoFactura          string                `xml:"sii:TipoFactura"`
+	TipoRectificativa    string                `xml:"sii:TipoRectificativa,omitempty"`
+	FacturasRectificadas *facturasRectificadas `xml:"sii:FacturasRectificadas"`
+	ImporteRectificacion *importeRectificacion `xml:"sii:ImporteRectificacion"`
+	ClaveRegimen         string                `xml:"sii:ClaveRegimenEspecialOTrascendencia"`
+	ImporteTotal         string                `xml:"sii:ImporteTotal"`
+	DescripcionOperacion string                `xml:"sii:DescripcionOperacion"`
+	Contraparte          *persona              `xml:"sii:Contraparte"` // Complete invoices only
+	Sujeta               sujeta                `xml:"sii:TipoDesglose>sii:DesgloseFactura>sii:Sujeta"`
+}
+
+type sujeta struct {
+	Exenta   *exenta   `xml:"sii:Exenta"`
+	NoExenta *noExenta `xml:"sii:NoExenta"`
+}
+
+type exenta struct {
+	DetalleExenta []detalleExenta `xml:"sii:DetalleExenta"`
+}
+
+type detalleExenta struct {
+	CausaExencion string `xml:"sii:CausaExencion"`
+	BaseImponible string `xml:"sii:BaseImponible"`
+}
+
+type noExenta struct {
+	TipoNoExenta string       `xml:"sii:TipoNoExenta"`
+	DetalleIVA   []detalleIVA `xml:"sii:DesgloseIVA>sii:DetalleIVA"`
+}
+
+type detalleIVA struct {
+	TipoImpositivo           string `xml:"sii:TipoImpositivo"`
+	BaseImponible            string `xml:"sii:BaseImponible"`
+	CuotaRepercutida         string `xml:"sii:CuotaRepercutida"`
+	TipoRecargoEquivalencia  string `xml:"sii:TipoRecargoEquivalencia,omitempty"`
+	CuotaRecargoEquivalencia string `xml:"sii:CuotaRecargoEquivalencia,omitempty"`
+}
+
+// BuildBatch returns the SOAP envelope of a "Facturas Emitidas" batch registering docs,
+// issued by issuer (the Titular). It takes at most MaxBatchRecords documents.
+func BuildBatch(issuer dto.IssuerProfileDTO, docs []dto.IssuedDocumentDTO) ([]byte, error) {
+	if len(docs) > MaxBatchRecords {
+		return nil, fmt.Errorf("an SII batch takes at most %d documents, not %d", MaxBatchRecords, len(docs))
+	}
+	env := envelope{XmlnsEnv: soapNS, XmlnsLR: siiLRNS, XmlnsSII: siiNS}
+	s := &env.Body.Suministro
+	s.Cabecera = cabecera{
+		IDVersionSii:     versionSII,
+		Titular:          persona{NombreRazon: issuer.LegalName, NIF: issuer.NIF},
+		TipoComunicacion: communicationA0,
+	}
+	for _, d := range docs {
+		r, err := newRegistro(issuer.NIF, d)
+		if err != nil {
+			return nil, err
+		}
+		s.Registros = append(s.Registros, r)
+	}
+
+	out, err := xml.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding SII batch: %w", err)
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+func newRegistro(issuerNIF string, d dto.IssuedDocumentDTO) (registro, error) {
+	var r registro
+	issued, err := time.Parse("2006-01-02", d.Fecha)
+	if err != nil {
+		return r, fmt.Errorf("invalid issue date of %s: %w", d.Number(), err)
+	}
+	// The period is the month of issue
+	r.PeriodoLiquidacion.Ejercicio = issued.Format("2006")
+	r.PeriodoLiquidacion.Periodo = issued.Format("01")
+	r.IDFactura.IDEmisorFactura.NIF = issuerNIF
+	r.IDFactura.NumSerieFacturaEmisor = d.Number()
+	r.IDFactura.FechaExpedicionFacturaEmisor = siiDate(d.Fecha)
+
+	f := facturaExpedida{
+		TipoFactura:          d.InvoiceType(),
+		ClaveRegimen:         claveRegimenGeneral,
+		ImporteTotal:         d.Total.StringFixed(2),
+		DescripcionOperacion: operationDescription,
+	}
+	if d.NIF != nil && *d.NIF != "" {
+		f.Contraparte = &persona{NIF: *d.NIF}
+		if d.Nombre != nil {
+			f.Contraparte.NombreRazon = *d.Nombre
+		}
+	}
+	if rect := d.Rectification; rect != nil {
+		f.TipoRectificativa = rect.Metodo
+		original := facturaRectificada{NumSerieFacturaEmisor: rect.Original}
+		if rect.OriginalFecha != nil {
+			original.FechaExpedicionFacturaEmisor = siiDate(*rect.OriginalFecha)
+		}
+		f.FacturasRectificadas = &facturasRectificadas{IDFacturaRectificada: []facturaRectificada{original}}
+		if rect.Metodo == dto.RectificationBySubstitution {
+			f.ImporteRectificacion = &importeRectificacion{
+				BaseRectificada:  decimalOrZero(rect.BaseRectificada).StringFixed(2),
+				CuotaRectificada: decimalOrZero(rect.CuotaRectificada).StringFixed(2),
+			}
+		}
+		if rect.Motivo != nil && strings.TrimSpace(*rect.Motivo) != "" {
+			f.DescripcionOperacion = *rect.Motivo
+		}
+	}
+
+	for _, g := range d.VATGroups {
+		if g.Exempt() {
+			cause := defaultExencion
+			if d.CausaExencion != nil && *d.CausaExencion != "" {
+				cause = *d.CausaExencion
+			}
+			if f.Sujeta.Exenta == nil {
+				f.Sujeta.Exenta = &exenta{}
+			}
+			f.Sujeta.Exenta.DetalleExenta = append(f.Sujeta.Exenta.DetalleExenta, detalleExenta{CausaExencion: cause, BaseImponible: g.Base.StringFixed(2)})
+			continue
+		}
+		f.Sujeta.NoExenta = addDetalleIVA(f.Sujeta.NoExenta, g)
+	}
+	if f.Sujeta.NoExenta == nil && f.Sujeta.Exenta == nil {
+		// A document for nothing still needs a breakdown
+		f.Sujeta.NoExenta = addDetalleIVA(nil, dto.VATGroup{})
+	}
+	r.FacturaExpedida = f
+	return r, nil
+}
+
+func addDetalleIVA(n *noExenta, g dto.VATGroup) *noExenta {
+	if n == nil {
+		n = &noExenta{TipoNoExenta: tipoNoExenta}
+	}
+	detalle := detalleIVA{
+		TipoImpositivo:   g.Rate.StringFixed(2),
+		BaseImponible:    g.Base.StringFixed(2),
+		CuotaRepercutida: g.Quota.StringFixed(2),
+	}
+	if !g.SurchargeRate.IsZero() {
+		detalle.TipoRecargoEquivalencia = g.SurchargeRate.StringFixed(2)
+		detalle.CuotaRecargoEquivalencia = g.SurchargeQuota.StringFixed(2)
+	}
+	n.DetalleIVA = append(n.DetalleIVA, detalle)
+	return n
+}
+
+// siiDate turns a YYYY-MM-DD date into the DD-MM-YYYY of the SII.
+func siiDate(s string) string {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.Format("02-01-2006")
+	}
+	return s
+}
+
+func decimalOrZero(d *money.Decimal) money.Decimal {
+	if d != nil {
+		return *d
+	}
+	return money.Zero
+}
@@ -0,0 +1,150 @@
+package sii
+
+import (
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func strPtr(s string) *string { return &s }
+
+func testIssuer() dto.IssuerProfileDTO {
+	return dto.IssuerProfileDTO{LegalName: "Cafetería Peñalara S.L.", NIF: "B12345678", Address: "Calle Mayor 1, 28013 Madrid"}
+}
+
+func testGroup(base, rate, quota string) []dto.VATGroup {
+	return []dto.VATGroup{{Index: 1, Base: money.MustParse(base), Rate: money.MustParse(rate), Quota: money.MustParse(quota)}}
+}
+
+// testDocs are a ticket, an invoice to a company, one the stub rejects and a
+// rectifying invoice of the ticket.
+func testDocs() []dto.IssuedDocumentDTO {
+	return []dto.IssuedDocumentDTO{
+		{Serie: "A", Codigo: 1, Fecha: "2026-03-02", Total: money.MustParse("12.10"), VATGroups: testGroup("10", "21", "2.10")},
+		{Serie: "A", Codigo: 2, Fecha: "2026-03-02", Total: money.MustParse("55"), VATGroups: testGroup("50", "10", "5"),
+			Nombre: strPtr("Ultramarinos Sol"), NIF: strPtr("12345678Z")},
+		{Serie: "A", Codigo: 3, Fecha: "2026-03-03", Total: money.MustParse("24.20"), VATGroups: testGroup("20", "21", "4.20")},
+		{Serie: "R", Codigo: 1, Fecha: "2026-03-04", Total: money.MustParse("-6.05"), VATGroups: testGroup("-5", "21", "-1.05"),
+			Rectification: &dto.RectificationDTO{Tipo: dto.RectificationR5, Metodo: dto.RectificationByDifferences,
+				Original: "A-1", OriginalFecha: strPtr("2026-03-02")}},
+	}
+}
+
+// stubServer serves stub over HTTP and returns a transport to it.
+func stubServer(t *testing.T, stub *Stub) *HTTPTransport {
+	t.Helper()
+	srv := httptest.NewServer(stub)
+	t.Cleanup(srv.Close)
+	return &HTTPTransport{URL: srv.URL, Client: srv.Client()}
+}
+
+// submit builds a batch of docs of issuer, sends it and reads the answer.
+func submit(t *testing.T, tr Transport, issuer dto.IssuerProfileDTO, docs []dto.IssuedDocumentDTO) Answer {
+	t.Helper()
+	batch, err := BuildBatch(issuer, docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := tr.Send(batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ParseAnswer(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+type wantResult struct {
+	number, status string
+	code           int // 0: none
+}
+
+func checkAnswer(t *testing.T, name string, a Answer, status string, csv bool, want []wantResult) {
+	t.Helper()
+	if a.Status != status {
+		t.Errorf("%s: batch status %s, want %s", name, a.Status, status)
+	}
+	if (a.CSV != nil) != csv {
+		t.Errorf("%s: CSV = %v, want one: %v", name, a.CSV, csv)
+	}
+	if len(a.Results) != len(want) {
+		t.Fatalf("%s: %d results, want %d", name, len(a.Results), len(want))
+	}
+	for i, w := range want {
+		r := a.Results[i]
+		code := 0
+		if r.ErrorCode != nil {
+			code = *r.ErrorCode
+		}
+		if r.Number != w.number || r.Status != w.status || code != w.code {
+			t.Errorf("%s: result %d = %s %s (error %d), want %s %s (error %d)", name, i, r.Number, r.Status, code, w.number, w.status, w.code)
+		}
+		if code != 0 && r.ErrorDescription == nil {
+			t.Errorf("%s: result %s has error %d without description", name, r.Number, code)
+		}
+	}
+}
+
+// TestStubServerRoundTrip sends batches over HTTP to a Stub standing in for the SII,
+// the way the Exporter does, and reads its answers.
+func TestStubServerRoundTrip(t *testing.T) {
+	tr := stubServer(t, &Stub{Rejected: map[string]bool{"A-3": true}, AcceptedWithErrors: map[string]bool{"A-2": true}})
+	docs := testDocs()
+
+	a := submit(t, tr, testIssuer(), docs)
+	checkAnswer(t, "first batch", a, dto.SIIBatchPartiallyAccepted, true, []wantResult{
+		{"A-1", dto.SIIStatusAccepted, 0},
+		{"A-2", dto.SIIStatusAcceptedWithErrors, stubErrorWithError},
+		{"A-3", dto.SIIStatusRejected, stubErrorRejected},
+		{"R-1", dto.SIIStatusAccepted, 0},
+	})
+
+	// Sent again, the registered documents are duplicates, which count as accepted
+	a = submit(t, tr, testIssuer(), docs)
+	checkAnswer(t, "resent batch", a, dto.SIIBatchRejected, false, []wantResult{
+		{"A-1", dto.SIIStatusAccepted, errorDuplicate},
+		{"A-2", dto.SIIStatusAccepted, errorDuplicate},
+		{"A-3", dto.SIIStatusRejected, stubErrorRejected},
+		{"R-1", dto.SIIStatusAccepted, errorDuplicate},
+	})
+
+	// Another Titular's numbers are not duplicates
+	other := testIssuer()
+	other.NIF = "B87654321"
+	a = submit(t, tr, other, docs[:1])
+	checkAnswer(t, "another Titular", a, dto.SIIBatchAccepted, true, []wantResult{{"A-1", dto.SIIStatusAccepted, 0}})
+}
+
+func TestStubServerFault(t *testing.T) {
+	tr := stubServer(t, &Stub{})
+	body, err := tr.Send([]byte(`<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/"><soapenv:Body/></soapenv:Envelope>`))
+	if err != nil {
+		t.Fatalf("Send of a malformed batch: %v, want the fault as answer", err)
+	}
+	if _, err := ParseAnswer(body); err == nil || !strings.Contains(err.Error(), "4102") {
+		t.Errorf("ParseAnswer of the fault = %v, want a 4102 SII fault", err)
+	}
+}
+
+func TestHTTPTransportErrors(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "mantenimiento", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	tr := &HTTPTransport{URL: down.URL, Client: down.Client()}
+	if _, err := tr.Send([]byte("<Envelope/>")); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Send to an unavailable SII = %v, want a 503 error", err)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	tr = &HTTPTransport{URL: closed.URL}
+	if _, err := tr.Send([]byte("<Envelope/>")); err == nil {
+		t.Error("Send to a closed server succeeded")
+	}
+}
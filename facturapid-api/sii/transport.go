@@ -0,0 +1,216 @@
+package sii
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Endpoints of the AEAT's "Facturas Emitidas" web service. Both require a client
+// certificate of the Titular or of a representative.
+const (
+	ProductionURL = "https://www1.agenciatributaria.gob.es/wlpl/SSII-FACT/ws/fe/SiiFactFEV1SOAP"
+	TestURL       = "https://prewww1.aeat.es/wlpl/SSII-FACT/ws/fe/SiiFactFEV1SOAP" // Preproducción
+)
+
+const (
+	// requestTimeout bounds each request; a batch of MaxBatchRecords takes a while.
+	requestTimeout = 2 * time.Minute
+	// maxAnswerSize bounds the answer read, about 1 KB per document.
+	maxAnswerSize = 32 << 20
+)
+
+// Transport delivers the SOAP envelope of a batch to the SII and returns its answer.
+type Transport interface {
+	Send(envelope []byte) ([]byte, error)
+}
+
+// HTTPTransport posts batches to the web service at URL. Client must present the
+// certificate the AEAT authenticates the sender with (see NewHTTPTransport).
+type HTTPTransport struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPTransport returns a transport to url authenticating with cert, e.g. built
+// from the PDF signing certificate.
+func NewHTTPTransport(url string, cert tls.Certificate) *HTTPTransport {
+	return &HTTPTransport{
+		URL: url,
+		Client: &http.Client{
+			Timeout: requestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}
+}
+
+// Send implements Transport. SOAP faults come with a 500 status and are returned as
+// answers, for ParseAnswer to report.
+func (t *HTTPTransport) Send(envelope []byte) ([]byte, error) {
+	client := t.Client
+	if client == nil {
+		client = &http.Client{Timeout: requestTimeout}
+	}
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(envelope))
+	if err != nil {
+		return nil, fmt.Errorf("error building SII request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=UTF-8")
+	req.Header.Set("SOAPAction", `""`)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error sending SII batch to %s: %w", t.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAnswerSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading SII answer: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusInternalServerError {
+		return nil, fmt.Errorf("SII responded %s", resp.Status)
+	}
+	return body, nil
+}
+
+// Error codes the Stub answers with.
+const (
+	stubErrorRejected  = 1100 // Valor o tipo incorrecto del campo
+	stubErrorWithError = 2011 // El NIF de la contraparte no está identificado
+)
+
+// Stub stands in for the AEAT web service in tests: as a Transport it
+// answers in-process, and as an http.Handler it serves an HTTPTransport, e.g. from an
+// httptest.Server. It only checks the structure of the batches: every document is
+// accepted, except those whose number is in Rejected or AcceptedWithErrors, and a
+// document it registered before is rejected as a duplicate, like the SII does.
+type Stub struct {
+	Rejected           map[string]bool
+	AcceptedWithErrors map[string]bool
+
+	mu         sync.Mutex
+	registered map[string]bool // By issuer NIF and number
+	seq        int
+}
+
+// stubRequest reads a batch by local names, like answerEnvelope.
+type stubRequest struct {
+	Body struct {
+		Suministro struct {
+			TitularNIF string `xml:"Cabecera>Titular>NIF"`
+			Registros  []struct {
+				IDFactura struct {
+					NumSerieFacturaEmisor        string `xml:"NumSerieFacturaEmisor"`
+					FechaExpedicionFacturaEmisor string `xml:"FechaExpedicionFacturaEmisor"`
+				} `xml:"IDFactura"`
+			} `xml:"RegistroLRFacturasEmitidas"`
+		} `xml:"SuministroLRFacturasEmitidas"`
+	} `xml:"Body"`
+}
+
+// Send implements Transport.
+func (s *Stub) Send(envelope []byte) ([]byte, error) {
+	return marshalAnswer(s.answer(envelope))
+}
+
+// answer returns the answer to a batch: a SOAP fault when the batch cannot be read.
+func (s *Stub) answer(envelope []byte) answerEnvelope {
+	var env answerEnvelope
+	env.XMLName = xml.Name{Space: soapNS, Local: "Envelope"}
+	var req stubRequest
+	err := xml.Unmarshal(envelope, &req)
+	sum := req.Body.Suministro
+	if err != nil || sum.TitularNIF == "" || len(sum.Registros) == 0 || len(sum.Registros) > MaxBatchRecords {
+		env.Body.Fault = &fault{Code: "soapenv:Client", String: "Codigo[4102].El XML no cumple el esquema."}
+		return env
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registered == nil {
+		s.registered = map[string]bool{}
+	}
+	r := respuesta{XMLName: xml.Name{Space: siiRNS, Local: "RespuestaLRFacturasEmitidas"}}
+	accepted := 0
+	for _, reg := range sum.Registros {
+		number := reg.IDFactura.NumSerieFacturaEmisor
+		l := respuestaLinea{EstadoRegistro: estadoCorrecto}
+		l.IDFactura.NumSerieFacturaEmisor = number
+		l.IDFactura.FechaExpedicionFacturaEmisor = reg.IDFactura.FechaExpedicionFacturaEmisor
+		key := sum.TitularNIF + "/" + number
+		switch {
+		case s.registered[key]:
+			l.EstadoRegistro = estadoIncorrecto
+			l.CodigoErrorRegistro = strconv.Itoa(errorDuplicate)
+			l.DescripcionErrorRegistro = "Factura ya existe en el sistema"
+		case s.Rejected[number]:
+			l.EstadoRegistro = estadoIncorrecto
+			l.CodigoErrorRegistro = strconv.Itoa(stubErrorRejected)
+			l.DescripcionErrorRegistro = "Valor o tipo incorrecto del campo"
+		case s.AcceptedWithErrors[number]:
+			l.EstadoRegistro = estadoAceptadoConErrores
+			l.CodigoErrorRegistro = strconv.Itoa(stubErrorWithError)
+			l.DescripcionErrorRegistro = "El NIF de la contraparte no está identificado"
+		}
+		if l.EstadoRegistro != estadoIncorrecto {
+			s.registered[key] = true
+			accepted++
+		}
+		r.Lineas = append(r.Lineas, l)
+	}
+	switch accepted {
+	case len(r.Lineas):
+		r.EstadoEnvio = estadoCorrecto
+	case 0:
+		r.EstadoEnvio = estadoIncorrecto
+	default:
+		r.EstadoEnvio = estadoParcialmenteCorrecto
+	}
+	if accepted > 0 {
+		s.seq++
+		r.CSV = fmt.Sprintf("STUB%012d", s.seq)
+	}
+	env.Body.Respuesta = &r
+	return env
+}
+
+func marshalAnswer(env answerEnvelope) ([]byte, error) {
+	out, err := xml.Marshal(env)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding SII answer: %w", err)
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxAnswerSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	env := s.answer(body)
+	answer, err := marshalAnswer(env)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if env.Body.Fault != nil {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(answer)
+}
@@ -0,0 +1,374 @@
+// Package ubl builds the machine-readable version of an invoice as an OASIS UBL 2.1
+// Invoice document. It is embedded in the PDF so a single file serves both people and
+// accounting software.
+//
+// Only the UBL schema is targeted, not a CIUS such as EN 16931: simplified (ticket)
+// invoices have no buyer, and addresses are stored as free text, which the stricter
+// profiles do not allow.
+package ubl
+
+import (
+	"encoding/xml"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"strconv"
+)
+
+const (
+	invoiceNS   = "urn:oasis:names:specification:ubl:schema:xsd:Invoice-2"
+	cacNS       = "urn:oasis:names:specification:ubl:schema:xsd:CommonAggregateComponents-2"
+	cbcNS       = "urn:oasis:names:specification:ubl:schema:xsd:CommonBasicComponents-2"
+	currency    = "EUR"
+	countryCode = "ES"
+
+	invoiceTypeCommercial = "380" // UNCL1001 commercial invoice
+	invoiceTypeCorrected  = "384" // UNCL1001 corrected invoice (factura rectificativa)
+
+	// UNCL5305 tax category codes.
+	categoryStandard = "S"
+	categoryExempt   = "E"
+
+	schemeVAT       = "VAT"
+	schemeSurcharge = "RE" // Recargo de equivalencia, reported as its own tax scheme
+)
+
+// Elements are declared in UBL schema order; the schema is a strict xs:sequence.
+
+type amount struct {
+	CurrencyID string `xml:"currencyID,attr"`
+	Value      string `xml:",chardata"`
+}
+
+func eur(d money.Decimal) amount {
+	return amount{CurrencyID: currency, Value: d.StringFixed(2)}
+}
+
+type quantity struct {
+	UnitCode string `xml:"unitCode,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type taxScheme struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type partyTaxScheme struct {
+	CompanyID string    `xml:"cbc:CompanyID"`
+	TaxScheme taxScheme `xml:"cac:TaxScheme"`
+}
+
+type partyLegalEntity struct {
+	RegistrationName string `xml:"cbc:RegistrationName"`
+	CompanyID        string `xml:"cbc:CompanyID,omitempty"`
+}
+
+type addressLine struct {
+	Line string `xml:"cbc:Line"`
+}
+
+type country struct {
+	IdentificationCode string `xml:"cbc:IdentificationCode"`
+}
+
+type address struct {
+	AddressLine addressLine `xml:"cac:AddressLine"`
+	Country     country     `xml:"cac:Country"`
+}
+
+func spanishAddress(line string) *address {
+	return &address{AddressLine: addressLine{Line: line}, Country: country{IdentificationCode: countryCode}}
+}
+
+type partyName struct {
+	Name string `xml:"cbc:Name"`
+}
+
+type identification struct {
+	ID string `xml:"cbc:ID"`
+}
+
+type contact struct {
+	ElectronicMail string `xml:"cbc:ElectronicMail"`
+}
+
+type party struct {
+	PartyName        *partyName        `xml:"cac:PartyName,omitempty"`
+	PostalAddress    *address          `xml:"cac:PostalAddress,omitempty"`
+	PartyTaxScheme   *partyTaxScheme   `xml:"cac:PartyTaxScheme,omitempty"`
+	PartyLegalEntity *partyLegalEntity `xml:"cac:PartyLegalEntity,omitempty"`
+	Contact          *contact          `xml:"cac:Contact,omitempty"`
+}
+
+type partyWrapper struct {
+	Party *party `xml:"cac:Party,omitempty"`
+}
+
+type taxCategory struct {
+	ID                     string    `xml:"cbc:ID"`
+	Percent                string    `xml:"cbc:Percent"`
+	TaxExemptionReasonCode string    `xml:"cbc:TaxExemptionReasonCode,omitempty"`
+	TaxScheme              taxScheme `xml:"cac:TaxScheme"`
+}
+
+type taxSubtotal struct {
+	TaxableAmount amount      `xml:"cbc:TaxableAmount"`
+	TaxAmount     amount      `xml:"cbc:TaxAmount"`
+	TaxCategory   taxCategory `xml:"cac:TaxCategory"`
+}
+
+type taxTotal struct {
+	TaxAmount    amount        `xml:"cbc:TaxAmount"`
+	TaxSubtotals []taxSubtotal `xml:"cac:TaxSubtotal"`
+}
+
+type monetaryTotal struct {
+	LineExtensionAmount amount `xml:"cbc:LineExtensionAmount"`
+	TaxExclusiveAmount  amount `xml:"cbc:TaxExclusiveAmount"`
+	TaxInclusiveAmount  amount `xml:"cbc:TaxInclusiveAmount"`
+	PayableAmount       amount `xml:"cbc:PayableAmount"`
+}
+
+type item struct {
+	Name                      string          `xml:"cbc:Name"`
+	SellersItemIdentification *identification `xml:"cac:SellersItemIdentification,omitempty"`
+	ClassifiedTaxCategory     taxCategory     `xml:"cac:ClassifiedTaxCategory"`
+}
+
+type invoiceLine struct {
+	ID                  string   `xml:"cbc:ID"`
+	InvoicedQuantity    quantity `xml:"cbc:InvoicedQuantity"`
+	LineExtensionAmount amount   `xml:"cbc:LineExtensionAmount"`
+	Item                item     `xml:"cac:Item"`
+	Price               struct {
+		PriceAmount amount `xml:"cbc:PriceAmount"`
+	} `xml:"cac:Price"`
+}
+
+type documentReference struct {
+	ID        string `xml:"cbc:ID"`
+	IssueDate string `xml:"cbc:IssueDate,omitempty"`
+}
+
+type billingReference struct {
+	InvoiceDocumentReference documentReference `xml:"cac:InvoiceDocumentReference"`
+}
+
+type invoice struct {
+	XMLName                 xml.Name          `xml:"Invoice"`
+	Xmlns                   string            `xml:"xmlns,attr"`
+	XmlnsCac                string            `xml:"xmlns:cac,attr"`
+	XmlnsCbc                string            `xml:"xmlns:cbc,attr"`
+	UBLVersionID            string            `xml:"cbc:UBLVersionID"`
+	ID                      string            `xml:"cbc:ID"`
+	IssueDate               string            `xml:"cbc:IssueDate"`
+	IssueTime               string            `xml:"cbc:IssueTime,omitempty"`
+	InvoiceTypeCode         string            `xml:"cbc:InvoiceTypeCode"`
+	Note                    []string          `xml:"cbc:Note,omitempty"`
+	DocumentCurrencyCode    string            `xml:"cbc:DocumentCurrencyCode"`
+	BillingReference        *billingReference `xml:"cac:BillingReference,omitempty"`
+	AccountingSupplierParty partyWrapper      `xml:"cac:AccountingSupplierParty"`
+	AccountingCustomerParty partyWrapper      `xml:"cac:AccountingCustomerParty"`
+	TaxTotal                []taxTotal        `xml:"cac:TaxTotal"`
+	LegalMonetaryTotal      monetaryTotal     `xml:"cac:LegalMonetaryTotal"`
+	InvoiceLines            []invoiceLine     `xml:"cac:InvoiceLine"`
+}
+
+func getString(s *string) string {
+	if s != nil {
+		return *s
+	}
+	return ""
+}
+
+func category(rate money.Decimal, causaExencion *string) taxCategory {
+	c := taxCategory{ID: categoryStandard, Percent: rate.StringFixed(2), TaxScheme: taxScheme{ID: schemeVAT}}
+	if rate.IsZero() {
+		c.ID = categoryExempt
+		c.TaxExemptionReasonCode = getString(causaExencion)
+		if c.TaxExemptionReasonCode == "" {
+			c.TaxExemptionReasonCode = "E1" // Same default as the printed exemption note
+		}
+	}
+	return c
+}
+
+// InvoiceID is the invoice number as shown to the customer ("A-123").
+func InvoiceID(header dto.InvoiceHeaderDTO) string {
+	return header.Serie + "-" + strconv.Itoa(header.Codigo)
+}
+
+// DocumentID is the number an invoice document is issued under. Rectifying invoices
+// are numbered apart from invoices (FacturasR), so their series is prefixed with "R"
+// to keep the two numberings from clashing ("RA-12").
+func DocumentID(inv dto.FullInvoiceDTO) string {
+	if inv.Rectification != nil {
+		return "R" + InvoiceID(inv.Header)
+	}
+	return InvoiceID(inv.Header)
+}
+
+// BuildInvoice returns the UBL document for invoice, issued by issuer.
+//
+// Tax totals come from the header's VAT groups, which are the fiscal figures. Line
+// amounts are net in UBL; when the lines at a rate add up to the group's base plus
+// quota rather than to its base, they are treated as VAT-inclusive and converted.
+func BuildInvoice(inv dto.FullInvoiceDTO, issuer dto.IssuerProfileDTO) ([]byte, error) {
+	h := inv.Header
+	if h.Fecha == nil || *h.Fecha == "" {
+		return nil, fmt.Errorf("invoice %s has no issue date", InvoiceID(h))
+	}
+
+	doc := invoice{
+		Xmlns:                invoiceNS,
+		XmlnsCac:             cacNS,
+		XmlnsCbc:             cbcNS,
+		UBLVersionID:         "2.1",
+		ID:                   DocumentID(inv),
+		IssueDate:            *h.Fecha,
+		IssueTime:            getString(h.Hora),
+		InvoiceTypeCode:      invoiceTypeCommercial,
+		DocumentCurrencyCode: currency,
+	}
+	if rect := inv.Rectification; rect != nil {
+		doc.InvoiceTypeCode = invoiceTypeCorrected
+		doc.BillingReference = &billingReference{InvoiceDocumentReference: documentReference{ID: rect.Original, IssueDate: getString(rect.OriginalFecha)}}
+		if reason := getString(rect.Motivo); reason != "" {
+			doc.Note = append(doc.Note, reason)
+		}
+	}
+
+	supplier := &party{
+		PostalAddress:    spanishAddress(issuer.Address),
+		PartyTaxScheme:   &partyTaxScheme{CompanyID: issuer.NIF, TaxScheme: taxScheme{ID: schemeVAT}},
+		PartyLegalEntity: &partyLegalEntity{RegistrationName: issuer.LegalName, CompanyID: issuer.NIF},
+	}
+	if name := getString(issuer.TradeName); name != "" {
+		supplier.PartyName = &partyName{Name: name}
+	}
+	doc.AccountingSupplierParty.Party = supplier
+
+	// Simplified invoices carry no buyer; the element is still mandatory but may be empty.
+	if name, nif := getString(h.Cliente1), getString(h.Cliente3); name != "" || nif != "" {
+		customer := &party{}
+		if name != "" {
+			customer.PartyLegalEntity = &partyLegalEntity{RegistrationName: name, CompanyID: nif}
+		}
+		if nif != "" {
+			customer.PartyTaxScheme = &partyTaxScheme{CompanyID: nif, TaxScheme: taxScheme{ID: schemeVAT}}
+		}
+		if addr := getString(h.Cliente2); addr != "" {
+			customer.PostalAddress = spanishAddress(addr)
+		}
+		if email := getString(h.Cliente4); email != "" {
+			customer.Contact = &contact{ElectronicMail: email}
+		}
+		doc.AccountingCustomerParty.Party = customer
+	}
+
+	// Taxes: one subtotal per VAT group, plus one per recargo de equivalencia.
+	groups := h.VATGroups()
+	vat := taxTotal{}
+	var surcharge *taxTotal
+	totalBase := money.Zero
+	totalTax := money.Zero
+	for _, g := range groups {
+		totalBase = totalBase.Add(g.Base)
+		vat.TaxSubtotals = append(vat.TaxSubtotals, taxSubtotal{
+			TaxableAmount: eur(g.Base),
+			TaxAmount:     eur(g.Quota),
+			TaxCategory:   category(g.Rate, h.CausaExencion),
+		})
+		totalTax = totalTax.Add(g.Quota)
+		if !g.SurchargeQuota.IsZero() {
+			if surcharge == nil {
+				surcharge = &taxTotal{}
+			}
+			surcharge.TaxSubtotals = append(surcharge.TaxSubtotals, taxSubtotal{
+				TaxableAmount: eur(g.Base),
+				TaxAmount:     eur(g.SurchargeQuota),
+				TaxCategory: taxCategory{
+					ID: categoryStandard, Percent: g.SurchargeRate.StringFixed(2), TaxScheme: taxScheme{ID: schemeSurcharge},
+				},
+			})
+		}
+	}
+	vat.TaxAmount = eur(totalTax)
+	doc.TaxTotal = append(doc.TaxTotal, vat)
+	if surcharge != nil {
+		sum := money.Zero
+		for _, g := range groups {
+			sum = sum.Add(g.SurchargeQuota)
+		}
+		surcharge.TaxAmount = eur(sum)
+		doc.TaxTotal = append(doc.TaxTotal, *surcharge)
+	}
+
+	// Lines.
+	gross := grossRates(inv.Lines, groups)
+	lineTotal := money.Zero
+	for _, l := range inv.Lines {
+		rate := money.Zero
+		if l.IvaAplicado != nil {
+			rate = *l.IvaAplicado
+		}
+		net := l.Subtotal
+		if gross[rate] {
+			net = net.Div(money.FromInt(100).Add(rate).Div(money.FromInt(100))).Round(2)
+		}
+		lineTotal = lineTotal.Add(net)
+		price := money.Zero
+		if !l.Unidades.IsZero() {
+			price = net.Div(l.Unidades)
+		}
+		line := invoiceLine{
+			ID:                  strconv.Itoa(l.Linea),
+			InvoicedQuantity:    quantity{UnitCode: "C62", Value: l.Unidades.String()}, // C62: "one", i.e. units
+			LineExtensionAmount: eur(net),
+			Item:                item{Name: l.Producto, ClassifiedTaxCategory: category(rate, h.CausaExencion)},
+		}
+		line.Price.PriceAmount = amount{CurrencyID: currency, Value: price.String()}
+		if code := getString(l.CodigoProducto); code != "" {
+			line.Item.SellersItemIdentification = &identification{ID: code}
+		}
+		doc.InvoiceLines = append(doc.InvoiceLines, line)
+	}
+
+	doc.LegalMonetaryTotal = monetaryTotal{
+		LineExtensionAmount: eur(lineTotal),
+		TaxExclusiveAmount:  eur(totalBase),
+		TaxInclusiveAmount:  eur(h.Total),
+		PayableAmount:       eur(h.Total),
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error encoding UBL invoice %s: %w", doc.ID, err)
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// grossRates reports, per VAT rate, whether the invoice lines at that rate include VAT:
+// their sum is closer to the group's base plus quota than to its base.
+func grossRates(lines []dto.InvoiceLineDTO, groups []dto.VATGroup) map[money.Decimal]bool {
+	sums := money.SumByRate{}
+	for _, l := range lines {
+		rate := money.Zero
+		if l.IvaAplicado != nil {
+			rate = *l.IvaAplicado
+		}
+		sums.Add(rate, l.Subtotal)
+	}
+	gross := map[money.Decimal]bool{}
+	for _, s := range sums.Sorted() {
+		for _, g := range groups {
+			if g.Rate.Cmp(s.Rate) != 0 || g.Quota.IsZero() {
+				continue
+			}
+			toNet := s.Amount.Sub(g.Base).Abs()
+			toGross := s.Amount.Sub(g.Base.Add(g.Quota)).Abs()
+			gross[s.Rate] = toGross.Cmp(toNet) < 0
+		}
+	}
+	return gross
+}
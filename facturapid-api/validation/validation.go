@@ -0,0 +1,233 @@
+package validation
+
+import (
+	"encoding/json"
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"fmt"
+	"strings"
+)
+
+// Severity indicates how serious a failed rule is.
+// Warnings are informative (the invoice is still stored as-is), errors mean the
+// figures sent by the TPV do not add up, or the customer's NIF is wrong, and the
+// invoice needs to be reviewed.
+type Severity string
+
+const (
+	SeverityWarning Severity = "warning"
+	SeverityError   Severity = "error"
+)
+
+// Values stored in invoices.validation_status.
+const (
+	StatusValid    = "valid"
+	StatusWarnings = "warnings"
+	StatusInvalid  = "invalid"
+)
+
+// Rule identifiers, returned in each Result so clients can match on them.
+const (
+	RuleVATQuota    = "vat_quota"     // baseN * ivaN / 100 ≈ cuotaIvaN
+	RuleSurcharge   = "surcharge"     // baseN * recargoN / 100 ≈ cuotaRecargoN
+	RuleTotal       = "total"         // sum(baseN + cuotaIvaN + cuotaRecargoN) ≈ total
+	RuleLinesByRate = "lines_by_rate" // sum of line subtotals per iva_aplicado ≈ matching base
+	RuleNIF         = "nif"           // cliente3, when present, is a valid Spanish NIF
+)
+
+// DefaultTolerance is the maximum absolute difference (in euros) accepted between
+// a computed figure and the one sent by the TPV. One cent absorbs the rounding the
+// TPV applies per line.
+const DefaultTolerance = money.Cent
+
+// Config holds the settings of the arithmetic checks.
+type Config struct {
+	// Tolerance is the maximum absolute difference accepted by every rule.
+	Tolerance money.Decimal
+}
+
+// Result is the outcome of a single failed rule.
+type Result struct {
+	Rule     string   `json:"rule"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+}
+
+// Report is the outcome of validating an invoice.
+// Results only lists the rules that failed; an empty list means the invoice reconciles.
+type Report struct {
+	Status  string   `json:"status"`
+	Results []Result `json:"results"`
+}
+
+// JSON returns the report as stored in the validation_report columns.
+func (r Report) JSON() json.RawMessage {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil // Strings and a slice of them always encode
+	}
+	return data
+}
+
+func getDecimal(d *money.Decimal) money.Decimal {
+	if d != nil {
+		return *d
+	}
+	return money.Zero
+}
+
+// nifLetters are the control letters of DNIs and NIEs, by the number modulo 23.
+const nifLetters = "TRWAGMYFPDXBNJZSQVHLCKE"
+
+// digits reports whether s is a non-empty string of decimal digits.
+func digits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// ValidNIF reports whether nif is a valid Spanish NIF: a DNI or NIE with its control
+// letter, or a CIF with its control digit or letter. Spaces, dots, hyphens and an ES
+// prefix are ignored. VAT numbers of other countries (two letters and the number) are
+// not checked and are reported valid.
+func ValidNIF(nif string) bool {
+	nif = dto.NormalizeNIF(nif)
+	if len(nif) > 2 && nif[0] >= 'A' && nif[0] <= 'Z' && nif[1] >= 'A' && nif[1] <= 'Z' {
+		if !strings.HasPrefix(nif, "ES") {
+			return true
+		}
+		nif = nif[2:]
+	}
+	if len(nif) != 9 || !digits(nif[1:8]) {
+		return false
+	}
+	first, control := nif[0], nif[8]
+	number := nif[:8]
+	switch {
+	case first >= '0' && first <= '9': // DNI
+	case strings.IndexByte("XYZ", first) >= 0: // NIE: X, Y and Z stand for 0, 1 and 2
+		number = string("012"[strings.IndexByte("XYZ", first)]) + nif[1:8]
+	case strings.IndexByte("KLM", first) >= 0: // NIF of Spaniards without a DNI
+		number = nif[1:8]
+	case strings.IndexByte("ABCDEFGHJNPQRSUVW", first) >= 0: // CIF
+		return validCIF(nif)
+	default:
+		return false
+	}
+	n := 0
+	for _, r := range number {
+		n = n*10 + int(r-'0')
+	}
+	return nifLetters[n%23] == control
+}
+
+// validCIF checks the control character of a CIF (a letter, seven digits and the
+// control): a digit for companies, a letter for public bodies and foreign entities
+// (P, Q, R, S, N, W), either for the rest.
+func validCIF(cif string) bool {
+	sum := 0
+	for i := 1; i <= 7; i++ {
+		d := int(cif[i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			d = d/10 + d%10
+		}
+		sum += d
+	}
+	check := (10 - sum%10) % 10
+	digit, letter := byte('0'+check), "JABCDEFGHI"[check]
+	switch {
+	case strings.IndexByte("PQRSNW", cif[0]) >= 0:
+		return cif[8] == letter
+	case strings.IndexByte("ABEH", cif[0]) >= 0:
+		return cif[8] == digit
+	default:
+		return cif[8] == digit || cif[8] == letter
+	}
+}
+
+// ValidateInvoice cross-checks the totals, VAT bases and line sums of an invoice, and
+// the customer's NIF.
+func ValidateInvoice(invoice dto.FullInvoiceDTO, cfg Config) Report {
+	report := Report{Status: StatusValid, Results: []Result{}}
+	add := func(rule string, severity Severity, format string, args ...interface{}) {
+		report.Results = append(report.Results, Result{Rule: rule, Severity: severity, Message: fmt.Sprintf(format, args...)})
+		if severity == SeverityError {
+			report.Status = StatusInvalid
+		} else if report.Status == StatusValid {
+			report.Status = StatusWarnings
+		}
+	}
+	within := func(a, b money.Decimal) bool {
+		return a.Sub(b).Abs().Cmp(cfg.Tolerance) <= 0
+	}
+
+	if nif := invoice.Header.Cliente3; nif != nil && strings.TrimSpace(*nif) != "" && !ValidNIF(*nif) {
+		add(RuleNIF, SeverityError, "Cliente3 %q is not a valid NIF.", *nif)
+	}
+
+	groups := invoice.Header.VATGroups()
+
+	// 1. Per rate: base * iva / 100 ≈ cuota, rounded once per rate (see money.VATQuota)
+	var sumBasesAndQuotas money.Decimal
+	for _, g := range groups {
+		expected := money.VATQuota(g.Base, g.Rate)
+		if !within(expected, g.Quota) {
+			add(RuleVATQuota, SeverityError,
+				"Base%d %s at %s%% gives a VAT quota of %s, but CuotaIva%d is %s.",
+				g.Index, g.Base, g.Rate, expected, g.Index, g.Quota)
+		}
+		if expected := money.VATQuota(g.Base, g.SurchargeRate); !within(expected, g.SurchargeQuota) {
+			add(RuleSurcharge, SeverityError,
+				"Base%d %s at a recargo of %s%% gives %s, but CuotaRecargo%d is %s.",
+				g.Index, g.Base, g.SurchargeRate, expected, g.Index, g.SurchargeQuota)
+		}
+		sumBasesAndQuotas = sumBasesAndQuotas.Add(g.Total())
+	}
+
+	// 2. Sum of bases plus quotas ≈ total
+	if len(groups) > 0 && !within(sumBasesAndQuotas, invoice.Header.Total) {
+		add(RuleTotal, SeverityError,
+			"Sum of bases, VAT and recargo quotas is %s, but Total is %s.",
+			sumBasesAndQuotas, invoice.Header.Total)
+	}
+
+	// 3. Lines grouped by iva_aplicado ≈ matching base.
+	// The TPV may store line subtotals with or without VAT, so a group reconciles if it
+	// matches either the base or the base plus its quota.
+	if len(invoice.Lines) == 0 {
+		return report
+	}
+	lineSums := money.SumByRate{}
+	for _, line := range invoice.Lines {
+		lineSums.Add(getDecimal(line.IvaAplicado), line.Subtotal)
+	}
+	for _, ra := range lineSums.Sorted() {
+		rate, sum := ra.Rate, ra.Amount
+		var match *dto.VATGroup
+		for i := range groups {
+			if groups[i].Rate == rate {
+				match = &groups[i]
+				break
+			}
+		}
+		if match == nil {
+			if !sum.IsZero() {
+				add(RuleLinesByRate, SeverityWarning,
+					"Lines at %s%% add up to %s, but the header has no base for that rate.", rate, sum)
+			}
+			continue
+		}
+		gross := match.Base.Add(match.Quota)
+		if !within(sum, match.Base) && !within(sum, gross) {
+			add(RuleLinesByRate, SeverityWarning,
+				"Lines at %s%% add up to %s, which matches neither Base%d (%s) nor Base%d plus CuotaIva%d (%s).",
+				rate, sum, match.Index, match.Base, match.Index, match.Index, gross)
+		}
+	}
+
+	return report
+}
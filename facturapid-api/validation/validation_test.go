@@ -0,0 +1,152 @@
+package validation
+
+import (
+	"facturapid-api/dto"
+	"facturapid-api/money"
+	"testing"
+)
+
+func dec(s string) *money.Decimal {
+	d := money.MustParse(s)
+	return &d
+}
+
+// ticket returns an invoice that reconciles: 100.00 at 21% and 50.00 at 10%, with a
+// line per rate.
+func ticket() dto.FullInvoiceDTO {
+	return dto.FullInvoiceDTO{
+		Header: dto.InvoiceHeaderDTO{
+			Codigo: 1, Serie: "A", Tarifa: "1", Total: money.MustParse("176.00"),
+			Base1: dec("100.00"), Iva1: dec("21"), CuotaIva1: dec("21.00"),
+			Base2: dec("50.00"), Iva2: dec("10"), CuotaIva2: dec("5.00"),
+		},
+		Lines: []dto.InvoiceLineDTO{
+			{CodigoFactura: 1, Linea: 1, Producto: "Menú del día", Subtotal: money.MustParse("100.00"), IvaAplicado: dec("21")},
+			{CodigoFactura: 1, Linea: 2, Producto: "Agua", Subtotal: money.MustParse("50.00"), IvaAplicado: dec("10")},
+		},
+	}
+}
+
+func TestValidateInvoice(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*dto.FullInvoiceDTO)
+		status string
+		rules  []string // Failed rules, in order
+	}{
+		{"reconciles", func(*dto.FullInvoiceDTO) {}, StatusValid, nil},
+		{"quota within tolerance", func(inv *dto.FullInvoiceDTO) {
+			inv.Header.CuotaIva1, inv.Header.Total = dec("21.01"), money.MustParse("176.01")
+		}, StatusValid, nil},
+		{"quota mismatch", func(inv *dto.FullInvoiceDTO) {
+			inv.Header.CuotaIva1, inv.Header.Total = dec("20.00"), money.MustParse("175.00")
+		}, StatusInvalid, []string{RuleVATQuota}},
+		{"surcharge", func(inv *dto.FullInvoiceDTO) {
+			inv.Header.Recargo1, inv.Header.CuotaRecargo1 = dec("5.2"), dec("5.20")
+			inv.Header.Total = money.MustParse("181.20")
+		}, StatusValid, nil},
+		{"surcharge mismatch", func(inv *dto.FullInvoiceDTO) {
+			inv.Header.Recargo1, inv.Header.CuotaRecargo1 = dec("5.2"), dec("4.00")
+			inv.Header.Total = money.MustParse("180.00")
+		}, StatusInvalid, []string{RuleSurcharge}},
+		{"total mismatch", func(inv *dto.FullInvoiceDTO) {
+			inv.Header.Total = money.MustParse("177.00")
+		}, StatusInvalid, []string{RuleTotal}},
+		{"lines with VAT", func(inv *dto.FullInvoiceDTO) {
+			inv.Lines[0].Subtotal = money.MustParse("121.00")
+		}, StatusValid, nil},
+		{"lines mismatch", func(inv *dto.FullInvoiceDTO) {
+			inv.Lines[1].Subtotal = money.MustParse("45.00")
+		}, StatusWarnings, []string{RuleLinesByRate}},
+		{"lines at a rate without base", func(inv *dto.FullInvoiceDTO) {
+			inv.Lines = append(inv.Lines, dto.InvoiceLineDTO{CodigoFactura: 1, Linea: 3, Producto: "Pan", Subtotal: money.MustParse("1.00"), IvaAplicado: dec("4")})
+		}, StatusWarnings, []string{RuleLinesByRate}},
+		{"free lines at a rate without base", func(inv *dto.FullInvoiceDTO) {
+			inv.Lines = append(inv.Lines, dto.InvoiceLineDTO{CodigoFactura: 1, Linea: 3, Producto: "Invitación", Subtotal: money.Zero, IvaAplicado: dec("4")})
+		}, StatusValid, nil},
+		{"no lines", func(inv *dto.FullInvoiceDTO) {
+			inv.Lines = nil
+		}, StatusValid, nil},
+		{"valid NIF", func(inv *dto.FullInvoiceDTO) {
+			nif := "b-1234567.4"
+			inv.Header.Cliente3 = &nif
+		}, StatusValid, nil},
+		{"rejected NIF", func(inv *dto.FullInvoiceDTO) {
+			nif := "B12345678"
+			inv.Header.Cliente3 = &nif
+		}, StatusInvalid, []string{RuleNIF}},
+		{"errors and warnings", func(inv *dto.FullInvoiceDTO) {
+			nif := "12345678A"
+			inv.Header.Cliente3 = &nif
+			inv.Header.Total = money.MustParse("170.00")
+			inv.Lines[1].Subtotal = money.MustParse("45.00")
+		}, StatusInvalid, []string{RuleNIF, RuleTotal, RuleLinesByRate}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := ticket()
+			tt.change(&inv)
+			report := ValidateInvoice(inv, Config{Tolerance: DefaultTolerance})
+			if report.Status != tt.status {
+				t.Errorf("status = %s, want %s: %+v", report.Status, tt.status, report.Results)
+			}
+			if len(report.Results) != len(tt.rules) {
+				t.Fatalf("results = %+v, want rules %v", report.Results, tt.rules)
+			}
+			for i, r := range report.Results {
+				if r.Rule != tt.rules[i] {
+					t.Errorf("result %d: rule %s, want %s (%s)", i, r.Rule, tt.rules[i], r.Message)
+				}
+				want := SeverityError
+				if r.Rule == RuleLinesByRate {
+					want = SeverityWarning
+				}
+				if r.Severity != want {
+					t.Errorf("result %d: severity %s, want %s", i, r.Severity, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateInvoiceTolerance(t *testing.T) {
+	inv := ticket()
+	inv.Header.CuotaIva1, inv.Header.Total = dec("21.01"), money.MustParse("176.01")
+	if report := ValidateInvoice(inv, Config{Tolerance: money.Zero}); report.Status != StatusInvalid {
+		t.Errorf("one cent off with no tolerance: status %s, want %s", report.Status, StatusInvalid)
+	}
+}
+
+func TestValidNIF(t *testing.T) {
+	tests := []struct {
+		nif   string
+		valid bool
+	}{
+		{"12345678Z", true},     // DNI
+		{"12.345.678-z", true},  // Formatted
+		{"ES12345678Z", true},   // EU VAT number of a DNI
+		{"X1234567L", true},     // NIE
+		{"Y1234567X", true},     // NIE
+		{"K1234567L", true},     // NIF without a DNI
+		{"B12345674", true},     // CIF of a company: control digit
+		{"Q2826000H", true},     // CIF of a public body: control letter
+		{"G1234567D", true},     // CIF of an association: either
+		{"G12345674", true},     // CIF of an association: either
+		{"FR40303265045", true}, // VAT number of another country, not checked
+		{"12345678A", false},    // Wrong letter
+		{"X1234567A", false},    // Wrong letter
+		{"B12345678", false},    // Wrong control digit
+		{"B1234567D", false},    // Companies have a control digit
+		{"Q28260008", false},    // Public bodies have a control letter
+		{"I12345674", false},    // No such entity type
+		{"1234567Z", false},     // Too short
+		{"ES1234567", false},    // Too short
+		{"1234567AZ", false},    // Not a number
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := ValidNIF(tt.nif); got != tt.valid {
+			t.Errorf("ValidNIF(%q) = %v, want %v", tt.nif, got, tt.valid)
+		}
+	}
+}
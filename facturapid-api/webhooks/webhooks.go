@@ -0,0 +1,76 @@
+// Package webhooks notifies subscribed endpoints (e.g. the accounting integration) of
+// invoice lifecycle events. Events are queued as one delivery per subscription and
+// sent by a Worker, which retries failures with backoff and logs every attempt.
+package webhooks
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"facturapid-api/database"
+	"fmt"
+	"time"
+)
+
+// Event types.
+const (
+	EventInvoiceReceived           = "invoice.received"              // Created from the TPV
+	EventInvoiceFiscalDataComplete = "invoice.fiscal_data_completed" // The customer filled in their fiscal data
+	EventInvoicePDFIssued          = "invoice.pdf_issued"            // A PDF was generated for a new invoice version
+	EventInvoiceVoided             = "invoice.voided"
+	// EventPing is only sent by the test endpoint, never to every subscription.
+	EventPing = "ping"
+)
+
+// Event is the JSON body of every webhook request.
+type Event struct {
+	ID        string      `json:"id"` // Unique per event; receivers use it to discard duplicates
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// NewEvent returns an event of the given type with a new random ID.
+func NewEvent(eventType string, data interface{}) (Event, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return Event{}, fmt.Errorf("error generating event id: %w", err)
+	}
+	return Event{ID: "evt_" + hex.EncodeToString(b), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}, nil
+}
+
+// NewSecret returns a random subscription secret.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Emit queues an event of a tenant for every active subscription of the tenant to its
+// type and returns how many deliveries were queued. invoiceID, when not nil, is
+// recorded to find the deliveries of an invoice.
+func Emit(db *sql.DB, tenantID int, eventType string, invoiceID *int, data interface{}) (int, error) {
+	event, err := NewEvent(eventType, data)
+	if err != nil {
+		return 0, err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return 0, fmt.Errorf("error encoding %s event: %w", eventType, err)
+	}
+	return database.CreateWebhookDeliveries(db, tenantID, event.ID, eventType, invoiceID, payload)
+}
+
+// EmitInvoice queues an event whose data is the current state of an invoice of a
+// tenant.
+func EmitInvoice(db *sql.DB, tenantID int, eventType string, invoiceID int) error {
+	invoice, err := database.GetFullInvoiceByID(db, tenantID, invoiceID)
+	if err != nil {
+		return fmt.Errorf("error retrieving invoice for %s event: %w", eventType, err)
+	}
+	_, err = Emit(db, tenantID, eventType, &invoiceID, map[string]interface{}{"invoice": invoice})
+	return err
+}
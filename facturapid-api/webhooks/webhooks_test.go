@@ -0,0 +1,294 @@
+package webhooks
+
+import (
+	"database/sql"
+	"encoding/json"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "whsec_0123456789abcdef0123456789abcdef"
+
+// received is a request as the receiver got it.
+type received struct {
+	header http.Header
+	body   []byte
+	valid  error // Verify's verdict on the signature
+}
+
+// receiver is a webhook endpoint that checks signatures like a Go receiver would and
+// answers each request with the next status of statuses, then with the last one.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, received{
+		header: req.Header.Clone(),
+		body:   body,
+		valid:  Verify(testSecret, req.Header.Get(SignatureHeader), body, 5*time.Minute, time.Now()),
+	})
+	status := r.statuses[len(r.statuses)-1]
+	if len(r.requests) <= len(r.statuses) {
+		status = r.statuses[len(r.requests)-1]
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "status %d", status)
+}
+
+func (r *receiver) got() []received {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]received(nil), r.requests...)
+}
+
+func testDelivery(t *testing.T) dto.WebhookDeliveryDTO {
+	event, err := NewEvent(EventInvoiceVoided, map[string]int{"invoice_id": 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dto.WebhookDeliveryDTO{ID: 7, EventID: event.ID, EventType: event.Type, Payload: payload}
+}
+
+func TestSendSignsPayload(t *testing.T) {
+	r := &receiver{statuses: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	d := testDelivery(t)
+	a := Send(srv.Client(), srv.URL, testSecret, d)
+	if a.Error != nil {
+		t.Fatalf("Send failed: %s", *a.Error)
+	}
+	if a.StatusCode == nil || *a.StatusCode != http.StatusNoContent {
+		t.Errorf("StatusCode = %v, want 204", a.StatusCode)
+	}
+	reqs := r.got()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want 1", len(reqs))
+	}
+	got := reqs[0]
+	if got.valid != nil {
+		t.Errorf("receiver rejected the signature %q: %v", got.header.Get(SignatureHeader), got.valid)
+	}
+	if string(got.body) != string(d.Payload) {
+		t.Errorf("body = %s, want the payload as stored", got.body)
+	}
+	for h, want := range map[string]string{
+		"Content-Type":          "application/json",
+		"X-Facturapid-Event":    EventInvoiceVoided,
+		"X-Facturapid-Delivery": "7",
+	} {
+		if v := got.header.Get(h); v != want {
+			t.Errorf("%s = %q, want %q", h, v, want)
+		}
+	}
+	if err := Verify("whsec_another_secret_of_the_tenant", got.header.Get(SignatureHeader), got.body, 0, time.Now()); err != ErrInvalidSignature {
+		t.Errorf("Verify with another secret = %v, want ErrInvalidSignature", err)
+	}
+	if err := Verify(testSecret, got.header.Get(SignatureHeader), append(got.body, ' '), 0, time.Now()); err != ErrInvalidSignature {
+		t.Errorf("Verify of a tampered body = %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestVerifyRejectsReplays(t *testing.T) {
+	body := []byte(`{"id":"evt_1"}`)
+	sent := time.Now().Add(-10 * time.Minute)
+	header := Sign(testSecret, sent, body)
+	if err := Verify(testSecret, header, body, 5*time.Minute, time.Now()); err != ErrInvalidSignature {
+		t.Errorf("Verify of a 10 minute old signature = %v, want ErrInvalidSignature", err)
+	}
+	if err := Verify(testSecret, header, body, 0, time.Now()); err != nil {
+		t.Errorf("Verify without tolerance = %v, want nil", err)
+	}
+	// Receivers accept any of several v1 signatures, for secret rotation
+	_, sig, _ := strings.Cut(header, ",")
+	rotated := Sign("whsec_old_secret_0123456789", sent, body) + "," + sig
+	if err := Verify(testSecret, rotated, body, 0, time.Now()); err != nil {
+		t.Errorf("Verify with two signatures = %v, want nil", err)
+	}
+}
+
+func TestSendFailures(t *testing.T) {
+	failing := httptest.NewServer(&receiver{statuses: []int{http.StatusInternalServerError}})
+	defer failing.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	d := testDelivery(t)
+	a := Send(failing.Client(), failing.URL, testSecret, d)
+	if a.Error == nil || a.StatusCode == nil || *a.StatusCode != http.StatusInternalServerError {
+		t.Errorf("5xx response: attempt %+v, want an error with status 500", a)
+	}
+	if a.Response == nil || *a.Response != "status 500" {
+		t.Errorf("5xx response: Response = %v, want the receiver's body", a.Response)
+	}
+
+	a = Send(&http.Client{Timeout: 50 * time.Millisecond}, slow.URL, testSecret, d)
+	if a.Error == nil || a.StatusCode != nil {
+		t.Errorf("timeout: attempt %+v, want an error without status", a)
+	}
+
+	a = Send(nil, closed.URL, testSecret, d)
+	if a.Error == nil || a.StatusCode != nil {
+		t.Errorf("connection refused: attempt %+v, want an error without status", a)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	failedAt := time.Date(2026, 3, 14, 12, 0, 0, 0, time.UTC)
+	prev := time.Duration(0)
+	for attempts := 1; attempts <= len(retryDelays); attempts++ {
+		next := nextAttempt(attempts, failedAt)
+		if next == nil {
+			t.Fatalf("attempt %d: no retry, want one", attempts)
+		}
+		wait := next.Sub(failedAt)
+		if attempts == 1 && wait != 30*time.Second {
+			t.Errorf("first retry after %v, want 30s", wait)
+		}
+		if attempts > 1 && wait != 2*prev {
+			t.Errorf("retry after attempt %d waits %v, want double the previous %v", attempts, wait, prev)
+		}
+		prev = wait
+	}
+	if next := nextAttempt(len(retryDelays)+1, failedAt); next != nil {
+		t.Errorf("attempt %d retried at %v, want the delivery given up", len(retryDelays)+1, next)
+	}
+}
+
+// testDB connects to the database in FACTURAPID_TEST_DATABASE_URL, or skips the test.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	url := os.Getenv("FACTURAPID_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("FACTURAPID_TEST_DATABASE_URL not set")
+	}
+	db, err := database.InitDB(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := database.CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// TestWorkerRetries delivers an event to a receiver that fails once, then to one that
+// always fails, through the queue.
+func TestWorkerRetries(t *testing.T) {
+	db := testDB(t)
+	tenant, err := database.CreateTenant(db, dto.TenantDTO{Code: "webhooks-" + strconv.FormatInt(time.Now().UnixNano(), 36), Name: "Pruebas webhooks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flaky := &receiver{statuses: []int{http.StatusServiceUnavailable, http.StatusOK}}
+	down := &receiver{statuses: []int{http.StatusBadGateway}}
+	flakySrv, downSrv := httptest.NewServer(flaky), httptest.NewServer(down)
+	defer flakySrv.Close()
+	defer downSrv.Close()
+	for _, url := range []string{flakySrv.URL, downSrv.URL} {
+		if _, err := database.CreateWebhookSubscription(db, tenant.ID, dto.WebhookSubscriptionDTO{URL: url, Secret: testSecret}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := Emit(db, tenant.ID, EventInvoiceReceived, nil, map[string]int{"invoice_id": 1}); err != nil || n != 2 {
+		t.Fatalf("Emit = %d, %v; want 2 deliveries", n, err)
+	}
+	deliveries := func() map[string]dto.WebhookDeliveryDTO {
+		out := map[string]dto.WebhookDeliveryDTO{}
+		rows, err := db.Query(`SELECT d.id, s.url FROM webhook_deliveries d JOIN webhook_subscriptions s ON s.id = d.subscription_id WHERE d.tenant_id = $1`, tenant.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			var url string
+			if err := rows.Scan(&id, &url); err != nil {
+				t.Fatal(err)
+			}
+			d, err := database.GetWebhookDelivery(db, tenant.ID, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[url] = d
+		}
+		return out
+	}
+	makeDue := func() {
+		if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = NOW() WHERE tenant_id = $1 AND status = 'pending'`, tenant.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := &Worker{DB: db}
+
+	before := time.Now()
+	if _, err := w.ProcessDue(); err != nil {
+		t.Fatal(err)
+	}
+	for url, d := range deliveries() {
+		if d.Status != "pending" || d.Attempts != 1 || len(d.AttemptLog) != 1 || d.LastStatusCode == nil {
+			t.Fatalf("%s after the first attempt: %+v, want pending with one attempt logged", url, d)
+		}
+		if wait := d.NextAttemptAt.Sub(before); wait < retryDelays[0] || wait > retryDelays[0]+time.Minute {
+			t.Errorf("%s retried %v after the failure, want %v", url, wait, retryDelays[0])
+		}
+	}
+
+	makeDue()
+	if _, err := w.ProcessDue(); err != nil {
+		t.Fatal(err)
+	}
+	got := deliveries()
+	if d := got[flakySrv.URL]; d.Status != "delivered" || d.Attempts != 2 || d.DeliveredAt == nil {
+		t.Errorf("flaky receiver: %+v, want delivered on the second attempt", d)
+	}
+	reqs := flaky.got()
+	if len(reqs) != 2 || string(reqs[0].body) != string(reqs[1].body) {
+		t.Fatalf("flaky receiver got %d requests, want the same payload twice", len(reqs))
+	}
+	for i, r := range reqs {
+		if r.valid != nil {
+			t.Errorf("request %d: signature rejected: %v", i+1, r.valid)
+		}
+	}
+
+	// Run out the retries of the receiver that is down
+	for i := 2; i <= len(retryDelays)+1; i++ {
+		makeDue()
+		if _, err := w.ProcessDue(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := got[downSrv.URL]; d.Attempts != 2 {
+		t.Errorf("down receiver after two runs: %d attempts, want 2", d.Attempts)
+	}
+	if d := deliveries()[downSrv.URL]; d.Status != "failed" || d.Attempts != len(retryDelays)+1 || len(down.got()) != len(retryDelays)+1 {
+		t.Errorf("down receiver: status %s after %d attempts (%d requests), want failed after %d", d.Status, d.Attempts, len(down.got()), len(retryDelays)+1)
+	}
+}
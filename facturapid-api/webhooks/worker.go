@@ -0,0 +1,159 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"facturapid-api/database"
+	"facturapid-api/dto"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// retryDelays are the waits after each failed attempt, doubling from 30 seconds to
+// about an hour; once they are exhausted the delivery is marked as failed.
+var retryDelays = []time.Duration{
+	30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute,
+	8 * time.Minute, 16 * time.Minute, 32 * time.Minute, 64 * time.Minute,
+}
+
+const (
+	claimBatch = 20
+	// claimLease must be longer than an attempt can take (see requestTimeout).
+	claimLease = 2 * time.Minute
+	// requestTimeout bounds each request, so a slow receiver cannot hold the queue.
+	requestTimeout = 10 * time.Second
+	// maxResponseLog is how much of a response body is kept in the attempt log.
+	maxResponseLog = 1024
+)
+
+// DefaultClient is the HTTP client used when none is given.
+var DefaultClient = &http.Client{Timeout: requestTimeout}
+
+// Send posts a delivery payload to url, signed with secret, and returns the attempt.
+// A 2xx response is a success; anything else, or no response, sets attempt.Error.
+func Send(client *http.Client, url, secret string, d dto.WebhookDeliveryDTO) dto.WebhookAttemptDTO {
+	if client == nil {
+		client = DefaultClient
+	}
+	attempt := dto.WebhookAttemptDTO{AttemptedAt: time.Now()}
+	fail := func(err error) dto.WebhookAttemptDTO {
+		msg := err.Error()
+		attempt.Error = &msg
+		attempt.DurationMS = int(time.Since(attempt.AttemptedAt) / time.Millisecond)
+		return attempt
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return fail(fmt.Errorf("error building request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Facturapid-Webhooks/1.0")
+	req.Header.Set("X-Facturapid-Event", d.EventType)
+	req.Header.Set("X-Facturapid-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set(SignatureHeader, Sign(secret, attempt.AttemptedAt, d.Payload))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseLog))
+	attempt.DurationMS = int(time.Since(attempt.AttemptedAt) / time.Millisecond)
+	attempt.StatusCode = &resp.StatusCode
+	if len(body) > 0 && utf8.Valid(body) {
+		response := string(body)
+		attempt.Response = &response
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := "receiver responded " + resp.Status
+		attempt.Error = &msg
+	}
+	return attempt
+}
+
+// Worker sends the queued webhook deliveries.
+type Worker struct {
+	DB       *sql.DB
+	Client   *http.Client  // nil: DefaultClient
+	Interval time.Duration // Time between queue polls
+}
+
+// Run polls the queue until ctx is cancelled.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		if _, err := w.ProcessDue(); err != nil {
+			log.Printf("Error processing webhook queue: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue sends every due delivery and returns how many were attempted.
+func (w *Worker) ProcessDue() (int, error) {
+	total := 0
+	for {
+		deliveries, err := database.ClaimDueWebhookDeliveries(w.DB, claimBatch, claimLease)
+		if err != nil {
+			return total, err
+		}
+		for _, d := range deliveries {
+			w.attempt(d)
+		}
+		total += len(deliveries)
+		if len(deliveries) < claimBatch {
+			return total, nil
+		}
+	}
+}
+
+// nextAttempt returns when a delivery whose attempts-th attempt failed at failedAt is
+// retried, or nil when it has no retries left.
+func nextAttempt(attempts int, failedAt time.Time) *time.Time {
+	if attempts < 1 || attempts > len(retryDelays) {
+		return nil
+	}
+	t := failedAt.Add(retryDelays[attempts-1])
+	return &t
+}
+
+// attempt sends one delivery and records the outcome.
+func (w *Worker) attempt(d dto.WebhookDeliveryDTO) {
+	sub, err := database.GetWebhookSubscription(w.DB, d.TenantID, d.SubscriptionID)
+	if err != nil {
+		// Deleted subscriptions take their deliveries with them, so this is transient
+		log.Printf("Error retrieving webhook subscription %d (delivery %d): %v", d.SubscriptionID, d.ID, err)
+		return
+	}
+	a := Send(w.Client, sub.URL, sub.Secret, d)
+	if a.Error == nil {
+		if err := database.RecordWebhookAttempt(w.DB, d.ID, a, true, nil); err != nil {
+			log.Printf("Error recording webhook delivery %d: %v", d.ID, err)
+		}
+		return
+	}
+
+	retryAt := nextAttempt(d.Attempts, time.Now())
+	if retryAt != nil {
+		log.Printf("Error delivering %s webhook to %s (delivery %d, attempt %d), retrying at %s: %s",
+			d.EventType, sub.URL, d.ID, d.Attempts, retryAt.Format(time.RFC3339), *a.Error)
+	} else {
+		log.Printf("Error delivering %s webhook to %s (delivery %d), giving up after %d attempts: %s",
+			d.EventType, sub.URL, d.ID, d.Attempts, *a.Error)
+	}
+	if err := database.RecordWebhookAttempt(w.DB, d.ID, a, false, retryAt); err != nil {
+		log.Printf("Error recording webhook delivery %d: %v", d.ID, err)
+	}
+}
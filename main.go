@@ -23,59 +23,111 @@ import (
 const (
 	serviceName        = "FacturapidSynchronizer"
 	serviceDisplayName = "Facturapid Synchronizer Service"
-	serviceDescription = "Monitors MS Access DB for new invoices, processes them, and generates QR codes."
+	serviceDescription = "Monitors MS Access DB for new invoices and rectifying invoices, processes them, and generates QR codes."
 	qrCodeDir          = "qrcodes" // Directory to store QR codes
 	// Note: In a real service, qrCodeDir should be an absolute path or configurable.
 	// For example, it could be relative to the executable or a system app data folder.
 	// For simplicity here, it's relative to the working dir of the service.
+
+	// establecimiento is the code of this restaurant's tenant in the API, and terminalID
+	// identifies this TPV. Both are sent with every invoice and rectifying invoice; the
+	// API rejects those whose establecimiento is not the tenant of the API key.
+	establecimiento = "default"
+	terminalID      = "TPV1"
 )
 
 // --- Structs (FacturaData, FacturaLinData, FullInvoice) remain the same ---
+// Amounts are json.Number so the decimal text read from Access is sent to the API
+// unchanged; converting them to float64 would introduce cent drift.
 type FacturaData struct {
-	Codigo      int     `json:"codigo"`
-	Fecha       string  `json:"fecha"`
-	Hora        string  `json:"hora"`
-	Total       float64 `json:"total"`
-	Cliente1    string  `json:"cliente1"`
-	Impresa     string  `json:"impresa"`
-	Base1       float64 `json:"base1"`
-	Iva1        float64 `json:"iva1"`
-	CuotaIva1   float64 `json:"cuotaIva1"`
-	TotalConIva float64 `json:"totalConIva"`
-	FormaPago   string  `json:"formaPago"`
+	Codigo      int         `json:"codigo"`
+	Fecha       string      `json:"fecha"`
+	Hora        string      `json:"hora"`
+	Total       json.Number `json:"total"`
+	Cliente1    string      `json:"cliente1"`
+	Impresa     string      `json:"impresa"`
+	Base1       json.Number `json:"base1"`
+	Iva1        json.Number `json:"iva1"`
+	CuotaIva1   json.Number `json:"cuotaIva1"`
+	TotalConIva json.Number `json:"totalConIva"`
+	FormaPago   string      `json:"formaPago"`
+
+	Establecimiento string `json:"establecimiento,omitempty"`
+	Terminal        string `json:"terminal,omitempty"`
 }
 type FacturaLinData struct {
-	ID            int     `json:"id"`
-	CodigoFactura int     `json:"codigoFactura"`
-	Producto      string  `json:"producto"`
-	Descripcion   string  `json:"descripcion"`
-	Unidades      float64 `json:"unidades"`
-	PrecioUnidad  float64 `json:"precioUnidad"`
-	Subtotal      float64 `json:"subtotal"`
-	IvaAplicado   float64 `json:"ivaAplicado"`
-	TotalLinea    float64 `json:"totalLinea"`
+	ID            int         `json:"id"`
+	CodigoFactura int         `json:"codigoFactura"`
+	Producto      string      `json:"producto"`
+	Descripcion   string      `json:"descripcion"`
+	Unidades      json.Number `json:"unidades"`
+	PrecioUnidad  json.Number `json:"precioUnidad"`
+	Subtotal      json.Number `json:"subtotal"`
+	IvaAplicado   json.Number `json:"ivaAplicado"`
+	TotalLinea    json.Number `json:"totalLinea"`
 }
 type FullInvoice struct {
 	Header FacturaData      `json:"header"`
 	Lines  []FacturaLinData `json:"lines"`
 }
 
+// FacturaRData is a row of FacturasR, the TPV's rectifying invoices (returns and
+// corrections). Their Codigo numbering is separate from Facturas; CodigoDeFactura is
+// the Codigo of the invoice being rectified. Amounts are negative for returns.
+type FacturaRData struct {
+	Codigo             int         `json:"codigo"`
+	Fecha              string      `json:"fecha"`
+	Hora               string      `json:"hora"`
+	Total              json.Number `json:"total"`
+	Tarifa             string      `json:"tarifa"`
+	Serie              string      `json:"serie"`
+	Cliente1           string      `json:"cliente1"`
+	Impresa            string      `json:"impresa"`
+	Base1              json.Number `json:"base1"`
+	Iva1               json.Number `json:"iva1"`
+	CuotaIva1          json.Number `json:"cuota_iva1"`
+	CuotaIVA           json.Number `json:"cuota_iva"`
+	FacturaRectificada int         `json:"factura_rectificada"` // CodigoDeFactura in FacturasR
+
+	Establecimiento string `json:"establecimiento,omitempty"`
+	Terminal        string `json:"terminal,omitempty"`
+}
+type FacturaRLinData struct {
+	CodigoFactura int         `json:"codigo_factura"`
+	Linea         int         `json:"linea"`
+	Producto      string      `json:"producto"`
+	Unidades      json.Number `json:"unidades"`
+	Subtotal      json.Number `json:"subtotal"`
+	IvaAplicado   json.Number `json:"iva_aplicado"`
+}
+type FullRectifyingInvoice struct {
+	Header FacturaRData      `json:"header"`
+	Lines  []FacturaRLinData `json:"lines"`
+}
+
 // --- Simulated Database Data (dummyFacturaHeaders, dummyFacturaTable, dummyFacturasLinTable) remain the same ---
 var dummyFacturaHeaders = []FacturaData{
-	{Codigo: 1, Fecha: "2023-01-15", Hora: "10:00", Total: 121.00, Cliente1: "QR", Impresa: "S"},
-	{Codigo: 4, Fecha: "2023-01-15", Hora: "10:15", Total: 242.00, Cliente1: "QR", Impresa: "S"},
-	{Codigo: 5, Fecha: "2023-01-15", Hora: "10:20", Total: 60.50, Cliente1: "QR", Impresa: "S"},
+	{Codigo: 1, Fecha: "2023-01-15", Hora: "10:00", Total: "121.00", Cliente1: "QR", Impresa: "S"},
+	{Codigo: 4, Fecha: "2023-01-15", Hora: "10:15", Total: "242.00", Cliente1: "QR", Impresa: "S"},
+	{Codigo: 5, Fecha: "2023-01-15", Hora: "10:20", Total: "60.50", Cliente1: "QR", Impresa: "S"},
 }
 var dummyFacturaTable = map[int]FacturaData{
-	1: {Codigo: 1, Fecha: "2023-01-15", Hora: "10:00", Cliente1: "QR", Impresa: "S", Base1: 100.00, Iva1: 21.0, CuotaIva1: 21.00, Total: 121.00, FormaPago: "Efectivo"},
-	4: {Codigo: 4, Fecha: "2023-01-15", Hora: "10:15", Cliente1: "QR", Impresa: "S", Base1: 200.00, Iva1: 21.0, CuotaIva1: 42.00, Total: 242.00, FormaPago: "Tarjeta"},
-	5: {Codigo: 5, Fecha: "2023-01-15", Hora: "10:20", Cliente1: "QR", Impresa: "S", Base1: 50.00, Iva1: 21.0, CuotaIva1: 10.50, Total: 60.50, FormaPago: "Efectivo"},
+	1: {Codigo: 1, Fecha: "2023-01-15", Hora: "10:00", Cliente1: "QR", Impresa: "S", Base1: "100.00", Iva1: "21.0", CuotaIva1: "21.00", Total: "121.00", FormaPago: "Efectivo"},
+	4: {Codigo: 4, Fecha: "2023-01-15", Hora: "10:15", Cliente1: "QR", Impresa: "S", Base1: "200.00", Iva1: "21.0", CuotaIva1: "42.00", Total: "242.00", FormaPago: "Tarjeta"},
+	5: {Codigo: 5, Fecha: "2023-01-15", Hora: "10:20", Cliente1: "QR", Impresa: "S", Base1: "50.00", Iva1: "21.0", CuotaIva1: "10.50", Total: "60.50", FormaPago: "Efectivo"},
 }
 var dummyFacturasLinTable = []FacturaLinData{
-	{ID: 1, CodigoFactura: 1, Producto: "PROD001", Descripcion: "Product A", Unidades: 2, PrecioUnidad: 25.00, Subtotal: 50.00, IvaAplicado: 21.0, TotalLinea: 60.50},
-	{ID: 2, CodigoFactura: 1, Producto: "PROD002", Descripcion: "Product B", Unidades: 1, PrecioUnidad: 50.00, Subtotal: 50.00, IvaAplicado: 21.0, TotalLinea: 60.50},
-	{ID: 4, CodigoFactura: 4, Producto: "PROD004", Descripcion: "Product D", Unidades: 4, PrecioUnidad: 50.00, Subtotal: 200.00, IvaAplicado: 21.0, TotalLinea: 242.00},
-	{ID: 5, CodigoFactura: 5, Producto: "PROD005", Descripcion: "Product E", Unidades: 1, PrecioUnidad: 50.00, Subtotal: 50.00, IvaAplicado: 21.0, TotalLinea: 60.50},
+	{ID: 1, CodigoFactura: 1, Producto: "PROD001", Descripcion: "Product A", Unidades: "2", PrecioUnidad: "25.00", Subtotal: "50.00", IvaAplicado: "21.0", TotalLinea: "60.50"},
+	{ID: 2, CodigoFactura: 1, Producto: "PROD002", Descripcion: "Product B", Unidades: "1", PrecioUnidad: "50.00", Subtotal: "50.00", IvaAplicado: "21.0", TotalLinea: "60.50"},
+	{ID: 4, CodigoFactura: 4, Producto: "PROD004", Descripcion: "Product D", Unidades: "4", PrecioUnidad: "50.00", Subtotal: "200.00", IvaAplicado: "21.0", TotalLinea: "242.00"},
+	{ID: 5, CodigoFactura: 5, Producto: "PROD005", Descripcion: "Product E", Unidades: "1", PrecioUnidad: "50.00", Subtotal: "50.00", IvaAplicado: "21.0", TotalLinea: "60.50"},
+}
+var dummyFacturasRTable = []FacturaRData{
+	// Return of one Product B from invoice 1
+	{Codigo: 1, Fecha: "2023-01-16", Hora: "11:30", Total: "-60.50", Tarifa: "1", Serie: "A", Cliente1: "QR", Impresa: "S", Base1: "-50.00", Iva1: "21.0", CuotaIva1: "-10.50", CuotaIVA: "-10.50", FacturaRectificada: 1},
+}
+var dummyFacturasRLinTable = []FacturaRLinData{
+	{CodigoFactura: 1, Linea: 1, Producto: "Product B", Unidades: "-1", Subtotal: "-60.50", IvaAplicado: "21.0"},
 }
 var globalSimCounter = 0 // Renamed to avoid conflict if program struct has its own simCounter
 
@@ -114,6 +166,7 @@ func (p *program) runLoop() {
 	defer p.logger.Info("Application logic loop stopped.")
 
 	lastProcessedCodigo := 0
+	lastProcessedRectCodigo := 0 // FacturasR has its own numbering
 	// maxPolls is removed for continuous running; service stop will terminate.
 	// For demonstration, we might re-introduce a counter or time limit if run interactively.
 	ticker := time.NewTicker(10 * time.Second) // Polling interval
@@ -154,6 +207,8 @@ func (p *program) runLoop() {
 						p.logger.Warningf("Error getting lines for invoice %d: %v.", header.Codigo, err)
 					}
 
+					facturaDetails.Establecimiento = establecimiento
+					facturaDetails.Terminal = terminalID
 					fullInvoice := FullInvoice{
 						Header: facturaDetails,
 						Lines:  facturaLines,
@@ -188,6 +243,24 @@ func (p *program) runLoop() {
 			} else {
 				p.logger.Info("No new invoice headers found.")
 			}
+
+			// Rectifying invoices are sent after the invoices, so the invoice they
+			// rectify has normally reached the API already.
+			newRectHeaders, err := p.fetchNewRectificationHeaders(lastProcessedRectCodigo)
+			if err != nil {
+				p.logger.Errorf("Error fetching new rectifying invoice headers: %v", err)
+			}
+			for _, header := range newRectHeaders {
+				p.logger.Infof("Processing new rectifying invoice - Codigo: %d (rectifies invoice %d)", header.Codigo, header.FacturaRectificada)
+				header.Establecimiento = establecimiento
+				header.Terminal = terminalID
+				rectifying := FullRectifyingInvoice{Header: header, Lines: p.getFacturaRLines(header.Codigo)}
+				if err := p.sendRectificationToAPI(rectifying); err != nil {
+					p.logger.Errorf("Error sending rectifying invoice %d to API: %v", header.Codigo, err)
+					break // Retry from this one on the next tick
+				}
+				lastProcessedRectCodigo = header.Codigo
+			}
 			localSimCounter++ // Increment local simulation counter
 		}
 	}
@@ -265,6 +338,39 @@ func (p *program) sendInvoiceToAPI(invoice FullInvoice) error {
 	return nil
 }
 
+func (p *program) fetchNewRectificationHeaders(lastCodigo int) ([]FacturaRData, error) {
+	p.logger.Infof("Simulating fetch for rectifying invoice headers (FacturasR) with Codigo > %d", lastCodigo)
+	var newHeaders []FacturaRData
+	for _, header := range dummyFacturasRTable {
+		if header.Impresa == "S" && header.Codigo > lastCodigo {
+			newHeaders = append(newHeaders, header)
+		}
+	}
+	return newHeaders, nil
+}
+
+func (p *program) getFacturaRLines(codigo int) []FacturaRLinData {
+	var lines []FacturaRLinData
+	for _, line := range dummyFacturasRLinTable {
+		if line.CodigoFactura == codigo {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func (p *program) sendRectificationToAPI(rectifying FullRectifyingInvoice) error {
+	apiEndpoint := "http://localhost:8080/api/v1/rectifying-invoices" // Mock API endpoint (ideally from config)
+	jsonData, err := json.MarshalIndent(rectifying, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling rectifying invoice to JSON: %w", err)
+	}
+	p.logger.Infof("\n--- Attempting to send Rectifying Invoice %d to API ---\nEndpoint: %s\nJSON Payload:\n%s",
+		rectifying.Header.Codigo, apiEndpoint, string(jsonData))
+	p.logger.Infof("Simulated: Successfully sent JSON for rectifying invoice %d to %s", rectifying.Header.Codigo, apiEndpoint)
+	return nil
+}
+
 func (p *program) generateQRCode(url string, filename string) error {
     dir := filepath.Dir(filename)
     if _, err := os.Stat(dir); os.IsNotExist(err) {